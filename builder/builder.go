@@ -76,6 +76,7 @@ type Builder struct {
 	NumFullfileWorkers int
 	NumDeltaWorkers    int
 	NumBundleWorkers   int
+	NumManifestWorkers int
 
 	// Parsed versions.
 	MixVerUint32      uint32
@@ -96,6 +97,8 @@ type UpdateParameters struct {
 	SkipFullfiles bool
 	// Skip zero packs generation
 	SkipPacks bool
+	// Number of previous versions to create bundle manifest deltas from
+	ManifestDeltas int
 }
 
 var localPackages = make(map[string]bool)
@@ -368,25 +371,25 @@ func (b *Builder) ReadVersions() error {
 }
 
 // SignManifestMoM will sign the Manifest.MoM file in in place based on the Mix
-// version read from builder.conf.
+// version read from builder.conf. The keys used are set in the [Signing]
+// section of the configuration.
 func (b *Builder) SignManifestMoM() error {
 	mom := filepath.Join(b.Config.Builder.ServerStateDir, "www", b.MixVer, "Manifest.MoM")
 	sig := mom + ".sig"
 
-	// Call openssl because signing and pkcs7 stuff is not well supported in Go yet.
-	cmd := exec.Command("openssl", "smime", "-sign", "-binary", "-in", mom,
-		"-signer", b.Config.Builder.Cert, "-inkey", filepath.Dir(b.Config.Builder.Cert)+"/private.pem",
-		"-outform", "DER", "-out", sig)
-
-	// Capture the output as it is useful in case of errors.
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	err := cmd.Run()
+	signers, err := b.signers()
 	if err != nil {
-		return fmt.Errorf("failed to sign Manifest.MoM:\n%s", out.String())
+		return err
 	}
-	return nil
+	content, err := ioutil.ReadFile(mom)
+	if err != nil {
+		return err
+	}
+	signature, err := swupd.SignDetached(content, signers)
+	if err != nil {
+		return errors.Wrapf(err, "failed to sign Manifest.MoM")
+	}
+	return ioutil.WriteFile(sig, signature, 0644)
 }
 
 const (
@@ -644,7 +647,8 @@ func (b *Builder) getFullBundleSet(bundles bundleSet) (bundleSet, error) {
 	set := make(bundleSet)
 
 	// recurseBundleSet adds a list of bundles to a bundle set,
-	// recursively adding any bundles included by those in the list.
+	// recursively adding any bundles included or also-added by those in
+	// the list.
 	var recurseBundleSet func(bundles []string) error
 	recurseBundleSet = func(bundles []string) error {
 		for _, bName := range bundles {
@@ -661,6 +665,12 @@ func (b *Builder) getFullBundleSet(bundles bundleSet) (bundleSet, error) {
 						return err
 					}
 				}
+				if len(bundle.OptionalIncludes) > 0 {
+					err := recurseBundleSet(bundle.OptionalIncludes)
+					if err != nil {
+						return err
+					}
+				}
 			}
 		}
 		return nil
@@ -1168,6 +1178,7 @@ const bundleTemplateFormat = `# [TITLE]: %s
 # [MAINTAINER]: 
 # 
 # List bundles one per line. Includes have format: include(bundle)
+# Optional bundles have format: also-add(bundle)
 `
 
 func createBundleFile(bundle string, path string) error {
@@ -1560,12 +1571,18 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 
 	minVersion := uint32(params.MinVersion)
 
+	// Validate the compressors before doing any work.
+	content, manifestCompressors, err := b.contentOptions(format)
+	if err != nil {
+		return err
+	}
+
 	err = writeMetaFiles(filepath.Join(b.Config.Builder.ServerStateDir, "www", b.MixVer), b.State.Mix.Format, Version)
 	if err != nil {
 		return errors.Wrapf(err, "failed to write update metadata files")
 	}
 	timer.Start("CREATE MANIFESTS")
-	mom, err := swupd.CreateManifests(b.MixVerUint32, minVersion, uint(format), b.Config.Builder.ServerStateDir)
+	mom, err := swupd.CreateManifests(b.MixVerUint32, minVersion, uint(format), b.Config.Builder.ServerStateDir, b.NumManifestWorkers, content)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create update metadata")
 	}
@@ -1587,9 +1604,9 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 	fmt.Println("Compressing Manifest.MoM")
 	momF := filepath.Join(thisVersionDir, "Manifest.MoM")
 	if params.SkipSigning {
-		err = createCompressedArchive(momF+".tar", momF)
+		err = createCompressedArchive(momF+".tar", manifestCompressors, momF)
 	} else {
-		err = createCompressedArchive(momF+".tar", momF, momF+".sig")
+		err = createCompressedArchive(momF+".tar", manifestCompressors, momF, momF+".sig")
 	}
 	if err != nil {
 		return err
@@ -1608,7 +1625,7 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 		for bundle := range bundleChan {
 			fmt.Printf("  %s\n", bundle.Name)
 			f := filepath.Join(thisVersionDir, "Manifest."+bundle.Name)
-			err = createCompressedArchive(f+".tar", f)
+			err = createCompressedArchive(f+".tar", manifestCompressors, f)
 			if err != nil {
 				errorChan <- err
 				break
@@ -1646,12 +1663,18 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 	// Now tar the full manifest, since it doesn't show up in the MoM
 	fmt.Println("  full")
 	f := filepath.Join(thisVersionDir, "Manifest.full")
-	err = createCompressedArchive(f+".tar", f)
+	err = createCompressedArchive(f+".tar", manifestCompressors, f)
 	if err != nil {
 		return err
 	}
 
 	// TODO: Create manifest tars for Manifest.MoM and the mom.UpdatedBundles.
+
+	if params.ManifestDeltas > 0 {
+		if err = createManifestDeltas(outputDir, &mom.Manifest, uint32(params.ManifestDeltas), content); err != nil {
+			return err
+		}
+	}
 	timer.Stop()
 
 	if !params.SkipFullfiles {
@@ -1660,7 +1683,7 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 		fullfilesDir := filepath.Join(outputDir, b.MixVer, "files")
 		fullChrootDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer, "full")
 		var info *swupd.FullfilesInfo
-		info, err = swupd.CreateFullfiles(mom.FullManifest, fullChrootDir, fullfilesDir, b.NumFullfileWorkers)
+		info, err = swupd.CreateFullfiles(mom.FullManifest, fullChrootDir, fullfilesDir, b.NumFullfileWorkers, content)
 		if err != nil {
 			return err
 		}
@@ -1701,7 +1724,7 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 			fmt.Printf("Creating zero pack for %s to version %d\n", name, version)
 
 			var info *swupd.PackInfo
-			info, err = swupd.CreatePack(name, 0, version, outputDir, bundleDir, 0)
+			info, err = swupd.CreatePack(name, 0, version, outputDir, bundleDir, 0, content)
 			if err != nil {
 				return errors.Wrapf(err, "couldn't make pack for bundle %q", name)
 			}
@@ -1723,6 +1746,42 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 	return nil
 }
 
+// createManifestDeltas creates the deltas for the bundle manifests updated in
+// mom from up to prev previous versions, found by walking the "previous" field
+// of the MoMs. Deltas that can't be created are reported but are not an error,
+// clients fall back to the compressed manifest. The extended attributes of the
+// manifests are checked if enabled in content.
+func createManifestDeltas(outputDir string, mom *swupd.Manifest, prev uint32, content *swupd.ContentOptions) error {
+	var fromVersions []uint32
+	cur := mom.Header.Previous
+	for i := uint32(0); i < prev && cur != 0; i++ {
+		m, err := swupd.ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(cur), "Manifest.MoM"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not find manifest for previous version %d, skipping...\n", cur)
+			break
+		}
+		fromVersions = append(fromVersions, cur)
+		cur = m.Header.Previous
+	}
+
+	fmt.Printf("Creating manifest deltas from %d previous versions\n", len(fromVersions))
+	deltas, err := swupd.CreateManifestDeltas(outputDir, mom.Header.Version, fromVersions, content)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create manifest deltas")
+	}
+	var created int
+	for _, d := range deltas {
+		if d.Error != nil {
+			fmt.Printf("  skipping %s: %s\n", filepath.Base(d.Path), d.Error)
+			continue
+		}
+		fmt.Printf("  %s\n", filepath.Base(d.Path))
+		created++
+	}
+	fmt.Printf("Total manifest deltas: %d\n", created)
+	return nil
+}
+
 // BuildImage will now proceed to build the full image with the previously
 // validated configuration.
 func (b *Builder) BuildImage(format string, template string) error {
@@ -1955,33 +2014,127 @@ func parseUint32(s string) (uint32, error) {
 	return uint32(parsed), nil
 }
 
-// createCompressedArchive will use tar and xz to create a compressed
-// file. It does not stream the sources contents, doing all the work
-// in memory before writing the destination file.
-func createCompressedArchive(dst string, srcs ...string) error {
-	err := createCompressedArchiveInternal(dst, srcs...)
-	return errors.Wrapf(err, "couldn't create compressed archive %s", dst)
+// zstdCompressor is the name of the zstd compressor, only used for formats that
+// support it.
+const zstdCompressor = "zstd"
+
+// formatReached tells if format is at least the one in value, set by the
+// configuration key. An empty value is never reached.
+func formatReached(format uint32, value, key string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	threshold, err := parseUint32(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid %s in configuration", key)
+	}
+	return format >= threshold, nil
 }
 
-func createCompressedArchiveInternal(dst string, srcs ...string) error {
-	archive := &bytes.Buffer{}
-	xw, err := swupd.NewExternalWriter(archive, "xz")
+// xattrsEnabled tells if the hashes of format include the extended attributes,
+// i.e. if format is at least XATTRS_FORMAT in the configuration.
+func (b *Builder) xattrsEnabled(format uint32) (bool, error) {
+	return formatReached(format, b.Config.Server.XattrsFormat, "XATTRS_FORMAT")
+}
+
+// contentOptions returns the options used to create the hashes, fullfiles and
+// packs of the format being built, based on the configuration. Extended
+// attributes are enabled as told by xattrsEnabled and the contentsize is not
+// clamped from UNCLAMPED_CONTENTSIZE_FORMAT on. COMPRESSORS only selects the
+// fullfile candidates, packs and manifest tars use xz, and zstd starting at
+// ZSTD_FORMAT. Also returns the candidates to be used for the manifest tars.
+func (b *Builder) contentOptions(format uint32) (*swupd.ContentOptions, []string, error) {
+	fullfile, err := swupd.ParseCompressorList(b.Config.Server.Compressors)
 	if err != nil {
-		return err
+		return nil, nil, errors.Wrapf(err, "invalid COMPRESSORS in configuration")
 	}
 
-	err = archiveFiles(xw, srcs)
+	useZstd, err := formatReached(format, b.Config.Server.ZstdFormat, "ZSTD_FORMAT")
 	if err != nil {
-		_ = xw.Close()
-		return err
+		return nil, nil, err
 	}
 
-	err = xw.Close()
+	xattrs, err := b.xattrsEnabled(format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unclamped, err := formatReached(format, b.Config.Server.UnclampedContentSizeFormat, "UNCLAMPED_CONTENTSIZE_FORMAT")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := []string{"xz"}
+	pack := "xz"
+	if useZstd {
+		fullfile = appendUniqueString(fullfile, zstdCompressor)
+		manifest = append(manifest, zstdCompressor)
+		pack = zstdCompressor
+	} else {
+		for _, name := range fullfile {
+			if name == zstdCompressor {
+				return nil, nil, errors.Errorf("zstd compression is not enabled for format %d, check ZSTD_FORMAT in configuration", format)
+			}
+		}
+	}
+
+	content := &swupd.ContentOptions{
+		FullfileCompressors:  fullfile,
+		PackCompressor:       pack,
+		Xattrs:               xattrs,
+		UnclampedContentSize: unclamped,
+	}
+	return content, manifest, nil
+}
+
+// appendUniqueString appends s to a copy of ss if not present.
+func appendUniqueString(ss []string, s string) []string {
+	for _, e := range ss {
+		if e == s {
+			return ss
+		}
+	}
+	result := make([]string, 0, len(ss)+1)
+	result = append(result, ss...)
+	return append(result, s)
+}
+
+// createCompressedArchive will use tar and the smallest result of the
+// compressors to create a compressed file. It does not stream the sources
+// contents, doing all the work in memory before writing the destination file.
+func createCompressedArchive(dst string, compressors []string, srcs ...string) error {
+	err := createCompressedArchiveInternal(dst, compressors, srcs...)
+	return errors.Wrapf(err, "couldn't create compressed archive %s", dst)
+}
+
+func createCompressedArchiveInternal(dst string, compressors []string, srcs ...string) error {
+	archive := &bytes.Buffer{}
+	err := archiveFiles(archive, srcs)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(dst, archive.Bytes(), 0644)
+	var best *bytes.Buffer
+	for _, name := range compressors {
+		var c *swupd.Compressor
+		c, err = swupd.GetCompressor(name)
+		if err != nil {
+			return err
+		}
+		candidate := &bytes.Buffer{}
+		err = c.Compress(candidate, bytes.NewReader(archive.Bytes()))
+		if err != nil {
+			return err
+		}
+		if best == nil || candidate.Len() < best.Len() {
+			best = candidate
+		}
+	}
+	if best == nil {
+		return errors.Errorf("no compressors for archive")
+	}
+
+	return ioutil.WriteFile(dst, best.Bytes(), 0644)
 }
 
 func archiveFiles(w io.Writer, srcs []string) error {
@@ -2017,8 +2170,9 @@ func archiveFiles(w io.Writer, srcs []string) error {
 	return tw.Close()
 }
 
-// BuildDeltaPacks between two versions of the mix.
-func (b *Builder) BuildDeltaPacks(from, to uint32, printReport bool) error {
+// BuildDeltaPacks between two versions of the mix. If verify is set, each pack
+// created is read back and checked with swupd.VerifyPack.
+func (b *Builder) BuildDeltaPacks(from, to uint32, printReport, verify bool) error {
 	var err error
 
 	if to == 0 {
@@ -2046,20 +2200,25 @@ func (b *Builder) BuildDeltaPacks(from, to uint32, printReport bool) error {
 		return errors.Wrapf(err, "couldn't find manifest of from version")
 	}
 
+	content, _, err := b.contentOptions(uint32(toManifest.Header.Format))
+	if err != nil {
+		return err
+	}
+
 	bundleDir := filepath.Join(b.Config.Builder.ServerStateDir, "image")
 	fmt.Printf("Using %d workers\n", b.NumDeltaWorkers)
 	// Create all deltas first
-	err = swupd.CreateAllDeltas(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), b.NumDeltaWorkers)
+	err = swupd.CreateAllDeltas(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), b.NumDeltaWorkers, content)
 	if err != nil {
 		return err
 	}
 	// Create packs filling in any missing deltas
-	return createDeltaPacks(fromManifest, toManifest, printReport, outputDir, bundleDir, b.NumDeltaWorkers)
+	return createDeltaPacks(fromManifest, toManifest, printReport, verify, outputDir, bundleDir, b.NumDeltaWorkers, content)
 }
 
 // BuildDeltaPacksPreviousVersions builds packs to version from up to
 // prev versions. It walks the Manifest "previous" field to find those from versions.
-func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport bool) error {
+func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport, verify bool) error {
 	var err error
 
 	if to == 0 {
@@ -2094,6 +2253,11 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 
 	fmt.Printf("Found %d previous versions\n", len(previousManifests))
 
+	content, _, err := b.contentOptions(uint32(toManifest.Header.Format))
+	if err != nil {
+		return err
+	}
+
 	bundleDir := filepath.Join(b.Config.Builder.ServerStateDir, "image")
 	// Create all deltas for all previous versions first based on full manifests
 	var versionQueue = make(chan *swupd.Manifest)
@@ -2117,7 +2281,7 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 		go func() {
 			defer wg.Done()
 			for fromManifest := range versionQueue {
-				deltaErr := swupd.CreateAllDeltas(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), b.NumDeltaWorkers)
+				deltaErr := swupd.CreateAllDeltas(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), b.NumDeltaWorkers, content)
 				if deltaErr != nil {
 					deltaErrors = append(deltaErrors, deltaErr)
 				}
@@ -2141,7 +2305,7 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 	// Simply pack all deltas up since they are now created
 	for _, fromManifest := range previousManifests {
 		fmt.Println()
-		err = createDeltaPacks(fromManifest, toManifest, printReport, outputDir, bundleDir, b.NumDeltaWorkers)
+		err = createDeltaPacks(fromManifest, toManifest, printReport, verify, outputDir, bundleDir, b.NumDeltaWorkers, content)
 		if err != nil {
 			return err
 		}
@@ -2149,7 +2313,106 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 	return nil
 }
 
-func createDeltaPacks(fromMoM *swupd.Manifest, toMoM *swupd.Manifest, printReport bool, outputDir, bundleDir string, numWorkers int) error {
+// VerifyUpdate checks the content published for version in the www directory.
+// If a version is not given, the current mix version is used. Extended
+// attributes are included in the hashes if the configuration enables them for
+// the format of the version.
+func (b *Builder) VerifyUpdate(version uint32, opts swupd.VerifyOptions) (*swupd.VerifyReport, error) {
+	if version == 0 {
+		version = b.MixVerUint32
+	}
+	outputDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	mom, err := swupd.ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(version), "Manifest.MoM"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't verify version %d", version)
+	}
+	opts.Xattrs, err = b.xattrsEnabled(uint32(mom.Header.Format))
+	if err != nil {
+		return nil, err
+	}
+	report, err := swupd.VerifyRepository(outputDir, version, &opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't verify version %d", version)
+	}
+	return report, nil
+}
+
+// BundleSizes returns the sizes of bundles in the update content of a version,
+// by default the current mix version, or of all its bundles if none is given.
+func (b *Builder) BundleSizes(version uint32, bundles []string, largest int) ([]*swupd.BundleSize, error) {
+	if version == 0 {
+		version = b.MixVerUint32
+	}
+	outputDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	sizes, err := swupd.ComputeBundleSizes(outputDir, version, bundles, largest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't compute bundle sizes for version %d", version)
+	}
+	return sizes, nil
+}
+
+// PlanMinVersion compares the candidate minversions for the next update, based
+// on the content published up to version, by default the latest version in the
+// www directory. See swupd.PlanMinVersion.
+func (b *Builder) PlanMinVersion(version uint32, maxReissue float64) (*swupd.MinVersionPlan, error) {
+	outputDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	if version == 0 {
+		versions, err := swupd.ListVersions(outputDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't list versions in %s", outputDir)
+		}
+		if len(versions) == 0 {
+			return nil, errors.Errorf("no versions found in %s", outputDir)
+		}
+		version = versions[len(versions)-1]
+	}
+	plan, err := swupd.PlanMinVersion(outputDir, version, maxReissue)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't plan minversion from version %d", version)
+	}
+	return plan, nil
+}
+
+// GarbageCollect removes the content in the www directory that is not reachable
+// from the versions retained by the keep policy, see swupd.ParseKeepPolicy. The
+// current mix version and the latest version of each format are always
+// retained. With dryRun, only the report of reclaimable space is printed.
+func (b *Builder) GarbageCollect(policy string, dryRun, verbose bool) error {
+	keep, err := swupd.ParseKeepPolicy(policy)
+	if err != nil {
+		return err
+	}
+	outputDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	versions, err := swupd.ListVersions(outputDir)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list versions in %s", outputDir)
+	}
+	retain := keep.Select(versions)
+	for _, v := range versions {
+		if v == b.MixVerUint32 {
+			retain = append(retain, v)
+		}
+	}
+
+	plan, err := swupd.PlanGC(outputDir, retain)
+	if err != nil {
+		return err
+	}
+	if err = plan.WriteText(os.Stdout, verbose); err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Println("Dry run, nothing was removed")
+		return nil
+	}
+	if err = plan.Execute(); err != nil {
+		return errors.Wrapf(err, "couldn't remove unreachable content")
+	}
+	fmt.Printf("Removed %d files\n", len(plan.Remove))
+	return nil
+}
+
+func createDeltaPacks(fromMoM *swupd.Manifest, toMoM *swupd.Manifest, printReport, verify bool, outputDir, bundleDir string, numWorkers int, content *swupd.ContentOptions) error {
 	timer := &stopWatch{w: os.Stdout}
 	defer timer.WriteSummary(os.Stdout)
 	timer.Start("CREATE DELTA PACKS")
@@ -2189,6 +2452,8 @@ func createDeltaPacks(fromMoM *swupd.Manifest, toMoM *swupd.Manifest, printRepor
 
 	var bundleQueue = make(chan *swupd.BundleToPack)
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var verifyFailed []string
 	wg.Add(bundleWorkers)
 
 	// Delta creation takes a lot of memory, so create a limited amount of goroutines.
@@ -2197,7 +2462,7 @@ func createDeltaPacks(fromMoM *swupd.Manifest, toMoM *swupd.Manifest, printRepor
 			defer wg.Done()
 			for b := range bundleQueue {
 				fmt.Printf("  Creating delta pack for bundle %q from %d to %d\n", b.Name, b.FromVersion, b.ToVersion)
-				info, err := swupd.CreatePack(b.Name, b.FromVersion, b.ToVersion, outputDir, bundleDir, numWorkers)
+				info, err := swupd.CreatePack(b.Name, b.FromVersion, b.ToVersion, outputDir, bundleDir, numWorkers, content)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "ERROR: Pack %q from %d to %d FAILED to be created: %s\n", b.Name, b.FromVersion, b.ToVersion, err)
 					// Do not exit on errors, we have logging for all other failures and deltas are optional
@@ -2225,6 +2490,26 @@ func createDeltaPacks(fromMoM *swupd.Manifest, toMoM *swupd.Manifest, printRepor
 				}
 				fmt.Printf("    Fullfiles in pack: %d\n", info.FullfileCount)
 				fmt.Printf("    Deltas in pack: %d\n", info.DeltaCount)
+
+				if !verify {
+					continue
+				}
+				report, err := verifyDeltaPack(b, outputDir, bundleDir, content.Xattrs)
+				if err == nil && !report.OK() {
+					problems := report.Problems()
+					for _, p := range problems {
+						fmt.Fprintf(os.Stderr, "    %s\n", p)
+					}
+					err = errors.Errorf("%d problems found", len(problems))
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: Pack %q from %d to %d FAILED verification: %s\n", b.Name, b.FromVersion, b.ToVersion, err)
+					mu.Lock()
+					verifyFailed = append(verifyFailed, b.Name)
+					mu.Unlock()
+					continue
+				}
+				fmt.Printf("    Pack verified: %d entries\n", len(report.Items))
 			}
 		}()
 	}
@@ -2237,9 +2522,42 @@ func createDeltaPacks(fromMoM *swupd.Manifest, toMoM *swupd.Manifest, printRepor
 	wg.Wait()
 
 	timer.Stop()
+	if len(verifyFailed) > 0 {
+		sort.Strings(verifyFailed)
+		return errors.Errorf("packs from %d to %d failed verification: %s", fromMoM.Header.Version, toMoM.Header.Version, strings.Join(verifyFailed, ", "))
+	}
 	return nil
 }
 
+// verifyDeltaPack reads back a pack created by createDeltaPacks and checks it
+// against the bundle manifests, using the chroots in bundleDir when possible.
+func verifyDeltaPack(b *swupd.BundleToPack, outputDir, bundleDir string, xattrs bool) (*swupd.PackReport, error) {
+	toM, err := swupd.ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(b.ToVersion), "Manifest."+b.Name))
+	if err != nil {
+		return nil, err
+	}
+	var fromM *swupd.Manifest
+	if b.FromVersion > 0 {
+		fromM, err = swupd.ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(b.FromVersion), "Manifest."+b.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(filepath.Join(outputDir, fmt.Sprint(b.ToVersion), swupd.GetPackFilename(b.Name, b.FromVersion)))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return swupd.VerifyPack(f, fromM, toM, &swupd.VerifyPackOptions{
+		OutputDir: outputDir,
+		ChrootDir: bundleDir,
+		Xattrs:    xattrs,
+	})
+}
+
 // writeMetaFiles writes mixer and format metadata to files
 func writeMetaFiles(path, format, version string) error {
 	err := os.MkdirAll(path, 0777)
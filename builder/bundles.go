@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -15,7 +16,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/clearlinux/mixer-tools/config"
 	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/swupd"
 	"github.com/go-ini/ini"
 	"github.com/pkg/errors"
 )
@@ -82,6 +85,107 @@ func readBuildBundlesConfig(path string) (*buildBundlesConfig, error) {
 	return cfg, nil
 }
 
+// writeHeuristicsINI writes the [Heuristics] section of server.ini with the
+// rules set in the configuration. Nothing is written if no rules are set, so
+// swupd uses its defaults.
+func writeHeuristicsINI(w io.Writer, c *config.MixConfig) {
+	h := c.Heuristics
+	keys := []struct {
+		name  string
+		value string
+	}{
+		{"config_prefixes", h.ConfigPrefixes},
+		{"config_paths", h.ConfigPaths},
+		{"config_globs", h.ConfigGlobs},
+		{"config_exclude", h.ConfigExclude},
+		{"state_prefixes", h.StatePrefixes},
+		{"state_paths", h.StatePaths},
+		{"state_globs", h.StateGlobs},
+		{"state_exclude", h.StateExclude},
+		{"boot_prefixes", h.BootPrefixes},
+		{"boot_paths", h.BootPaths},
+		{"boot_globs", h.BootGlobs},
+		{"boot_exclude", h.BootExclude},
+	}
+
+	header := false
+	for _, k := range keys {
+		if k.value == "" {
+			continue
+		}
+		if !header {
+			fmt.Fprint(w, "\n[Heuristics]\n")
+			header = true
+		}
+		fmt.Fprintf(w, "%s=%s\n", k.name, k.value)
+	}
+}
+
+// writeRenamesINI writes the [Renames] section of server.ini with the rename
+// detection rules set in the configuration, if any.
+func writeRenamesINI(w io.Writer, c *config.MixConfig) {
+	r := c.Renames
+	keys := []struct {
+		name  string
+		value string
+	}{
+		{"strategies", r.Strategies},
+		{"min_size", r.MinSize},
+		{"similarity", r.Similarity},
+		{"path_components", r.PathComponents},
+		{"bundles", r.Bundles},
+		{"exclude_bundles", r.ExcludeBundles},
+	}
+
+	header := false
+	for _, k := range keys {
+		if k.value == "" {
+			continue
+		}
+		if !header {
+			fmt.Fprint(w, "\n[Renames]\n")
+			header = true
+		}
+		fmt.Fprintf(w, "%s=%s\n", k.name, k.value)
+	}
+}
+
+// writeIndexINI writes the [Index] section of server.ini with the index bundle
+// options set in the configuration.
+func writeIndexINI(w io.Writer, c *config.MixConfig) {
+	s := c.Server
+	keys := []struct {
+		name  string
+		value string
+	}{
+		{"enabled", s.IndexEnabled},
+		{"bundle", s.IndexBundle},
+		{"file", s.IndexFile},
+		{"format", s.IndexFormat},
+	}
+
+	header := false
+	for _, k := range keys {
+		if k.value == "" {
+			continue
+		}
+		if !header {
+			fmt.Fprint(w, "\n[Index]\n")
+			header = true
+		}
+		fmt.Fprintf(w, "%s=%s\n", k.name, k.value)
+	}
+}
+
+// writeLifecycleINI writes the [Lifecycle] section of server.ini, that controls
+// the removal of deprecated bundles.
+func writeLifecycleINI(w io.Writer, c *config.MixConfig) {
+	if c.Server.RemoveDeprecatedAfter == "" {
+		return
+	}
+	fmt.Fprintf(w, "\n[Lifecycle]\nremove_deprecated_after=%s\n", c.Server.RemoveDeprecatedAfter)
+}
+
 var bannedPaths = [...]string{
 	"/var/lib/",
 	"/var/cache/",
@@ -661,6 +765,12 @@ emptydir=%s/empty
 imagebase=%s/image/
 outputdir=%s/www/
 `, b.Config.Builder.ServerStateDir, b.Config.Builder.ServerStateDir, b.Config.Builder.ServerStateDir)
+	if b.Config.Server.HashCache != "" {
+		fmt.Fprintf(&serverINI, "hash_cache=%s\n", b.Config.Server.HashCache)
+	}
+	if b.Config.Server.HashCacheVerify != "" {
+		fmt.Fprintf(&serverINI, "hash_cache_verify=%s\n", b.Config.Server.HashCacheVerify)
+	}
 	if cfg.HasServerSection {
 		fmt.Fprintf(&serverINI, `
 [Debuginfo]
@@ -669,6 +779,16 @@ lib=%s
 src=%s
 `, cfg.DebugInfoBanned, cfg.DebugInfoLib, cfg.DebugInfoSrc)
 	}
+	if b.Config.Server.DebugInfoSplit != "" {
+		if !cfg.HasServerSection {
+			fmt.Fprint(&serverINI, "\n[Debuginfo]\n")
+		}
+		fmt.Fprintf(&serverINI, "split=%s\n", b.Config.Server.DebugInfoSplit)
+	}
+	writeHeuristicsINI(&serverINI, &b.Config)
+	writeRenamesINI(&serverINI, &b.Config)
+	writeIndexINI(&serverINI, &b.Config)
+	writeLifecycleINI(&serverINI, &b.Config)
 	err = ioutil.WriteFile(filepath.Join(b.Config.Builder.ServerStateDir, "server.ini"), serverINI.Bytes(), 0644)
 	if err != nil {
 		return err
@@ -677,7 +797,11 @@ src=%s
 	// in bundleset to check for that. See also readGroupsINI in swupd package.
 	var groupsINI bytes.Buffer
 	for _, bundle := range set {
-		fmt.Fprintf(&groupsINI, "[%s]\ngroup=%s\n\n", bundle.Name, bundle.Name)
+		fmt.Fprintf(&groupsINI, "[%s]\ngroup=%s\n", bundle.Name, bundle.Name)
+		if bundle.Header.Status != "" {
+			fmt.Fprintf(&groupsINI, "status=%s\n", bundle.Header.Status)
+		}
+		fmt.Fprint(&groupsINI, "\n")
 	}
 	err = ioutil.WriteFile(filepath.Join(b.Config.Builder.ServerStateDir, "groups.ini"), groupsINI.Bytes(), 0644)
 	if err != nil {
@@ -712,6 +836,9 @@ src=%s
 		for _, inc := range bundle.DirectIncludes {
 			fmt.Fprintf(&includes, "%s\n", inc)
 		}
+		for _, opt := range bundle.OptionalIncludes {
+			fmt.Fprintf(&includes, "also-add(%s)\n", opt)
+		}
 		err = ioutil.WriteFile(filepath.Join(buildVersionDir, name+"-includes"), includes.Bytes(), 0644)
 		if err != nil {
 			return err
@@ -774,6 +901,12 @@ src=%s
 		return err
 	}
 
+	if b.Config.Server.IndexFormat == swupd.IndexFormatBinary {
+		if err = createFilePackagesFile(buildVersionDir); err != nil {
+			return err
+		}
+	}
+
 	// now that all dnf/yum/rpm operations have completed
 	// remove all packager state files from chroot
 	// This is not a critical step, just to prevent these files from
@@ -795,6 +928,31 @@ func createOsPackagesFile(buildVersionDir string) error {
 	return ioutil.WriteFile(filepath.Join(buildVersionDir, "os-packages"), packages.Bytes(), 0644)
 }
 
+// createFilePackagesFile creates a file that maps every file in the full chroot
+// to the package that provides it, used by swupd to add the packages to the
+// index when the binary index format is used.
+func createFilePackagesFile(buildVersionDir string) error {
+	fullChroot := filepath.Join(buildVersionDir, "full")
+	files, err := helpers.RunCommandOutput("rpm", "--root="+fullChroot, "-qa", "--queryformat", "[%{FILENAMES}\t%{NAME}\n]")
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(files)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			continue
+		}
+		fmt.Fprintf(&out, "%s\t%s\n", resolveFileName(fields[0]), fields[1])
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(buildVersionDir, "file-packages"), out.Bytes(), 0644)
+}
+
 // createVersionsFile creates a file that contains all the packages available for a specific
 // version. It uses one chroot to query information from the repositories using dnf.
 func createVersionsFile(baseDir string, packagerCmd []string) error {
@@ -31,8 +31,12 @@ type bundle struct {
 	Header   bundleHeader
 
 	DirectIncludes []string
-	DirectPackages map[string]bool
-	AllPackages    map[string]bool
+	// OptionalIncludes are the bundles listed with also-add(), they are
+	// suggested to be installed with the bundle but their content is not
+	// part of it.
+	OptionalIncludes []string
+	DirectPackages   map[string]bool
+	AllPackages      map[string]bool
 
 	Files map[string]bool
 }
@@ -45,6 +49,8 @@ type bundleSet map[string]*bundle
 // 1) Completeness. For each bundle in the set, every bundle included by that
 //    bundle is also in the set.
 // 2) Cycle-Free. The set contains no bundle include cycles.
+// Optional includes must also be in the set, but they don't contribute
+// packages and can form cycles.
 func validateAndFillBundleSet(bundles bundleSet) error {
 	// Sort the bundles so that all includes appear before a bundle, then
 	// calculate AllPackages for each bundle. Cycles and missing bundles are
@@ -53,6 +59,13 @@ func validateAndFillBundleSet(bundles bundleSet) error {
 	if err != nil {
 		return err
 	}
+	for _, b := range sortedBundles {
+		for _, opt := range b.OptionalIncludes {
+			if _, exists := bundles[opt]; !exists {
+				return fmt.Errorf("bundle %q also-adds bundle %q which is not available", b.Name, opt)
+			}
+		}
+	}
 	for _, b := range sortedBundles {
 		b.AllPackages = make(map[string]bool)
 		for k, v := range b.DirectPackages {
@@ -285,12 +298,13 @@ func parseBundleFile(filename string) (*bundle, error) {
 }
 
 // parseBundle parses the bytes of a bundle file, ignoring comments and
-// processing "include()" directives the same way that m4 works.
+// processing "include()" directives the same way that m4 works. The
+// "also-add()" directive lists optional bundles.
 func parseBundle(contents []byte) (*bundle, error) {
 	scanner := bufio.NewScanner(bytes.NewReader(contents))
 
 	var b bundle
-	var includes, packages []string
+	var includes, optional, packages []string
 
 	line := 0
 	for scanner.Scan() {
@@ -330,6 +344,15 @@ func parseBundle(contents []byte) (*bundle, error) {
 				return nil, fmt.Errorf("Invalid bundle name %q in line %d", text, line)
 			}
 			includes = append(includes, text)
+		} else if strings.HasPrefix(text, "also-add(") {
+			if !strings.HasSuffix(text, ")") {
+				return nil, fmt.Errorf("Missing end parenthesis in line %d: %q", line, text)
+			}
+			text = text[9 : len(text)-1]
+			if !validBundleNameRegex.MatchString(text) {
+				return nil, fmt.Errorf("Invalid bundle name %q in line %d", text, line)
+			}
+			optional = append(optional, text)
 		} else {
 			if !validPackageNameRegex.MatchString(text) {
 				return nil, fmt.Errorf("Invalid package name %q in line %d", text, line)
@@ -343,6 +366,7 @@ func parseBundle(contents []byte) (*bundle, error) {
 	}
 
 	b.DirectIncludes = includes
+	b.OptionalIncludes = optional
 	b.DirectPackages = make(map[string]bool)
 	for _, p := range packages {
 		b.DirectPackages[p] = true
@@ -15,6 +15,7 @@ func TestParseBundle(t *testing.T) {
 		Contents         []byte
 		ExpectedHeader   bundleHeader
 		ExpectedIncludes []string
+		ExpectedOptional []string
 		ExpectedPackages map[string]bool
 		ShouldFail       bool
 	}{
@@ -74,9 +75,22 @@ pkg1 # [TITLE]: wrongtitle
 			ExpectedIncludes: []string{"a"},
 			ExpectedPackages: map[string]bool{"pkg1": true},
 		},
+		{
+			Contents: []byte(`# Bundle with optional bundles
+include(a)
+also-add(b)
+also-add(c) # Comment
+pkg1
+`),
+			ExpectedIncludes: []string{"a"},
+			ExpectedOptional: []string{"b", "c"},
+			ExpectedPackages: map[string]bool{"pkg1": true},
+		},
 
 		// Error cases.
 		{Contents: []byte(`include(`), ShouldFail: true},
+		{Contents: []byte(`also-add(`), ShouldFail: true},
+		{Contents: []byte(`also-add(abc))`), ShouldFail: true},
 		{Contents: []byte(`()`), ShouldFail: true},
 		{Contents: []byte(`Include(`), ShouldFail: true},
 		{Contents: []byte(`include())`), ShouldFail: true},
@@ -106,6 +120,10 @@ pkg1 # [TITLE]: wrongtitle
 			t.Errorf("got wrong includes when parsing bundle\nCONTENTS:\n%s\nPARSED INCLUDES (%d): %s\nEXPECTED INCLUDES (%d): %s", tt.Contents, len(b.DirectIncludes), b.DirectIncludes, len(tt.ExpectedIncludes), tt.ExpectedIncludes)
 		}
 
+		if !reflect.DeepEqual(b.OptionalIncludes, tt.ExpectedOptional) {
+			t.Errorf("got wrong optional includes when parsing bundle\nCONTENTS:\n%s\nPARSED OPTIONAL: %s\nEXPECTED OPTIONAL: %s", tt.Contents, b.OptionalIncludes, tt.ExpectedOptional)
+		}
+
 		if !reflect.DeepEqual(b.DirectPackages, tt.ExpectedPackages) {
 			t.Errorf("got wrong packages when parsing bundle\nCONTENTS:\n%s\nPARSED PACKAGES (%d):\n%v\nEXPECTED PACKAGES (%d):\n%v", tt.Contents, len(b.DirectPackages), b.DirectPackages, len(tt.ExpectedPackages), tt.ExpectedPackages)
 		}
@@ -388,6 +406,33 @@ func TestParseBundleSet(t *testing.T) {
 
 		{"bundle not available 2",
 			FilesMap{"a": "include(b)", "b": "include(c)"}, Error},
+
+		{
+			"optional bundles don't add packages",
+			FilesMap{
+				"a": Lines("A1 A2"),
+				"b": Lines("also-add(a) B1"),
+			},
+			CountsMap{
+				"a": 2,
+				"b": 1,
+			},
+		},
+
+		{
+			"optional bundles can form cycles",
+			FilesMap{
+				"a": Lines("also-add(b) A"),
+				"b": Lines("also-add(a) B"),
+			},
+			CountsMap{
+				"a": 1,
+				"b": 1,
+			},
+		},
+
+		{"optional bundle not available",
+			FilesMap{"a": "also-add(c)"}, Error},
 	}
 
 	testDir, err := ioutil.TempDir("", "bundleset-test-")
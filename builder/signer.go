@@ -0,0 +1,239 @@
+// Copyright © 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// Backends for the signing keys, set by BACKEND in the [Signing] section of
+// the configuration.
+const (
+	signingBackendLocal   = "local"
+	signingBackendPKCS11  = "pkcs11"
+	signingBackendCommand = "command"
+)
+
+// signers returns the certificates and keys used to sign Manifest.MoM.
+func (b *Builder) signers() ([]swupd.Signer, error) {
+	conf := b.Config.Signing
+
+	certPaths := splitSigningList(conf.Certs)
+	if len(certPaths) == 0 {
+		certPaths = []string{b.Config.Builder.Cert}
+	}
+	keys := splitSigningList(conf.Keys)
+
+	var pin string
+	backend := conf.Backend
+	if backend == "" {
+		backend = signingBackendLocal
+	}
+	switch backend {
+	case signingBackendLocal:
+		if len(keys) == 0 && len(certPaths) == 1 {
+			keys = []string{filepath.Join(filepath.Dir(certPaths[0]), "private.pem")}
+		}
+	case signingBackendPKCS11:
+		if conf.PKCS11Module == "" {
+			return nil, errors.Errorf("PKCS11_MODULE is required by the %s signing backend", backend)
+		}
+		var err error
+		pin, err = readPKCS11PIN(conf.PKCS11PINFile)
+		if err != nil {
+			return nil, err
+		}
+	case signingBackendCommand:
+		if strings.TrimSpace(conf.Command) == "" {
+			return nil, errors.Errorf("COMMAND is required by the %s signing backend", backend)
+		}
+	default:
+		return nil, errors.Errorf("unknown signing BACKEND %q in configuration, must be %s, %s or %s",
+			backend, signingBackendLocal, signingBackendPKCS11, signingBackendCommand)
+	}
+	if backend != signingBackendCommand && len(keys) != len(certPaths) {
+		return nil, errors.Errorf("signing configuration has %d certificates but %d keys", len(certPaths), len(keys))
+	}
+
+	signers := make([]swupd.Signer, 0, len(certPaths))
+	for i, certPath := range certPaths {
+		certs, err := swupd.ReadCertificates(certPath)
+		if err != nil {
+			return nil, err
+		}
+		cert := certs[0]
+
+		var key crypto.Signer
+		switch backend {
+		case signingBackendLocal:
+			key, err = swupd.ReadPrivateKey(keys[i])
+			if err != nil {
+				return nil, err
+			}
+		case signingBackendPKCS11:
+			key = &pkcs11Key{
+				module: conf.PKCS11Module,
+				token:  conf.PKCS11Token,
+				pin:    pin,
+				label:  keys[i],
+				pub:    cert.PublicKey,
+			}
+		case signingBackendCommand:
+			key = &commandKey{
+				args: strings.Fields(conf.Command),
+				cert: certPath,
+				pub:  cert.PublicKey,
+			}
+		}
+		signers = append(signers, swupd.Signer{Cert: cert, Key: key})
+	}
+	return signers, nil
+}
+
+func splitSigningList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// pkcs11PINEnv is the environment variable with the PIN of the PKCS #11 token.
+// It is also used to hand the PIN to pkcs11-tool, so it never shows up in the
+// command line of the process.
+const pkcs11PINEnv = "MIXER_PKCS11_PIN"
+
+// readPKCS11PIN returns the PIN of the PKCS #11 token, from the environment
+// or, when not set there, from the first line of file. An empty PIN means no
+// login is done.
+func readPKCS11PIN(file string) (string, error) {
+	if pin, ok := os.LookupEnv(pkcs11PINEnv); ok {
+		return pin, nil
+	}
+	if file == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't read PKCS #11 PIN file")
+	}
+	return strings.SplitN(string(content), "\n", 2)[0], nil
+}
+
+// sha256DigestInfo is the DER prefix of a DigestInfo for a SHA-256 digest.
+// Tokens doing raw PKCS #1 v1.5 signatures expect it before the digest.
+var sha256DigestInfo = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+// pkcs11Key signs with a key kept in a PKCS #11 token, like a hardware
+// security module or SoftHSM. The signing is done by pkcs11-tool from OpenSC,
+// so no PKCS #11 library is linked into mixer. The PIN is passed to it in the
+// environment, using the env: form of its --pin option.
+type pkcs11Key struct {
+	module string
+	token  string
+	pin    string
+	label  string
+	pub    crypto.PublicKey
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *pkcs11Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.Errorf("unsupported hash %v for PKCS #11 signing", opts.HashFunc())
+	}
+
+	args := []string{"--module", k.module, "--sign", "--label", k.label}
+	if k.token != "" {
+		args = append(args, "--token-label", k.token)
+	}
+	if k.pin != "" {
+		args = append(args, "--login", "--pin", "env:"+pkcs11PINEnv)
+	}
+	var input []byte
+	switch k.pub.(type) {
+	case *rsa.PublicKey:
+		args = append(args, "--mechanism", "RSA-PKCS")
+		input = append(append([]byte(nil), sha256DigestInfo...), digest...)
+	case *ecdsa.PublicKey:
+		args = append(args, "--mechanism", "ECDSA", "--signature-format", "openssl")
+		input = digest
+	default:
+		return nil, errors.Errorf("unsupported key type %T for PKCS #11 signing", k.pub)
+	}
+
+	cmd := exec.Command("pkcs11-tool", args...)
+	cmd.Env = append(os.Environ(), pkcs11PINEnv+"="+k.pin)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Errorf("pkcs11-tool failed to sign with key %q: %s\n%s", k.label, err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// commandKey signs by running an external command, which gets the SHA-256
+// digest to sign in its standard input and must write the signature to its
+// standard output: PKCS #1 v1.5 for RSA keys or ASN.1 DER for ECDSA keys. The
+// command
+//
+//	openssl pkeyutl -sign -inkey private.pem -pkeyopt digest:sha256
+//
+// is an example. The certificate being used is available to the command in
+// the MIXER_SIGNING_CERT environment variable.
+type commandKey struct {
+	args []string
+	cert string
+	pub  crypto.PublicKey
+}
+
+func (k *commandKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *commandKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.Errorf("unsupported hash %v for signing command", opts.HashFunc())
+	}
+	cmd := exec.Command(k.args[0], k.args[1:]...)
+	cmd.Env = append(os.Environ(), "MIXER_SIGNING_CERT="+k.cert, "MIXER_SIGNING_DIGEST=sha256")
+	cmd.Stdin = bytes.NewReader(digest)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Errorf("signing command %q failed for certificate %s: %s\n%s", strings.Join(k.args, " "), k.cert, err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
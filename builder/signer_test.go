@@ -0,0 +1,268 @@
+package builder
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+// writeTestKeyPair writes a self-signed certificate and its private key in
+// PKCS #8 format to dir.
+func writeTestKeyPair(t *testing.T, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{Organization: []string{name}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+"-key.pem")
+	if err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func mustSignAndVerify(t *testing.T, b *Builder, roots ...string) {
+	t.Helper()
+	signers, err := b.signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("MANIFEST\t25\n")
+	sig, err := swupd.SignDetached(content, signers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range roots {
+		certs, err := swupd.ReadCertificates(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(certs[0])
+		if _, err = swupd.VerifyDetached(content, sig, &swupd.VerifySignatureOptions{Roots: pool}); err != nil {
+			t.Fatalf("couldn't verify signature trusting %s: %s", root, err)
+		}
+	}
+}
+
+func TestSignersLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signers-local-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// Default is the private.pem next to CERT.
+	cert, key := writeTestKeyPair(t, dir, "Swupd_Root")
+	if err = os.Rename(key, filepath.Join(dir, "private.pem")); err != nil {
+		t.Fatal(err)
+	}
+	b := New()
+	b.Config.Builder.Cert = cert
+	mustSignAndVerify(t, b, cert)
+
+	// Rotation signs with both certificates.
+	newCert, newKey := writeTestKeyPair(t, dir, "New")
+	b.Config.Signing.Certs = cert + "," + newCert
+	b.Config.Signing.Keys = filepath.Join(dir, "private.pem") + "," + newKey
+	mustSignAndVerify(t, b, cert, newCert)
+
+	b.Config.Signing.Keys = newKey
+	if _, err = b.signers(); err == nil {
+		t.Errorf("expected error when number of keys doesn't match certificates")
+	}
+	b.Config.Signing.Backend = "unknown"
+	if _, err = b.signers(); err == nil {
+		t.Errorf("expected error for unknown backend")
+	}
+}
+
+// TestSignerHelperProcess is used as the external signing command, it signs
+// the digest in stdin with the key in MIXER_TEST_SIGNING_KEY.
+func TestSignerHelperProcess(t *testing.T) {
+	keyPath := os.Getenv("MIXER_TEST_SIGNING_KEY")
+	if keyPath == "" {
+		return
+	}
+	key, err := swupd.ReadPrivateKey(keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	digest, err := ioutil.ReadAll(os.Stdin)
+	if err != nil || os.Getenv("MIXER_SIGNING_CERT") == "" {
+		fmt.Fprintln(os.Stderr, "missing digest or certificate")
+		os.Exit(1)
+	}
+	sig, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	_, _ = os.Stdout.Write(sig)
+	os.Exit(0)
+}
+
+func TestSignersCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signers-command-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	cert, key := writeTestKeyPair(t, dir, "Swupd_Root")
+	if err = os.Setenv("MIXER_TEST_SIGNING_KEY", key); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Unsetenv("MIXER_TEST_SIGNING_KEY")
+	}()
+
+	b := New()
+	b.Config.Builder.Cert = cert
+	b.Config.Signing.Backend = signingBackendCommand
+	b.Config.Signing.Command = os.Args[0] + " -test.run=TestSignerHelperProcess"
+	mustSignAndVerify(t, b, cert)
+
+	// A command signing with a key that doesn't match the certificate.
+	otherCert, _ := writeTestKeyPair(t, dir, "Other")
+	b.Config.Builder.Cert = otherCert
+	signers, err := b.signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = swupd.SignDetached([]byte("content"), signers); err == nil {
+		t.Errorf("expected error when signing command uses a different key")
+	}
+}
+
+func TestSignersPKCS11(t *testing.T) {
+	module := "/usr/lib/softhsm/libsofthsm2.so"
+	if _, err := os.Stat(module); err != nil {
+		t.Skip("SoftHSM module not available")
+	}
+	for _, tool := range []string{"softhsm2-util", "pkcs11-tool"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "signers-pkcs11-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	tokens := filepath.Join(dir, "tokens")
+	if err = os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err = ioutil.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Setenv("SOFTHSM2_CONF", conf); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Unsetenv("SOFTHSM2_CONF")
+	}()
+
+	cert, key := writeTestKeyPair(t, dir, "Swupd_Root")
+	for _, args := range [][]string{
+		{"--init-token", "--free", "--label", "mixer", "--pin", "1234", "--so-pin", "5678"},
+		{"--import", key, "--token", "mixer", "--label", "mom", "--id", "01", "--pin", "1234"},
+	} {
+		if out, err := exec.Command("softhsm2-util", args...).CombinedOutput(); err != nil {
+			t.Fatalf("softhsm2-util %v failed: %s\n%s", args, err, out)
+		}
+	}
+
+	b := New()
+	b.Config.Builder.Cert = cert
+	b.Config.Signing.Backend = signingBackendPKCS11
+	b.Config.Signing.Keys = "mom"
+	b.Config.Signing.PKCS11Module = module
+	b.Config.Signing.PKCS11Token = "mixer"
+	b.Config.Signing.PKCS11PINFile = filepath.Join(dir, "pin")
+	if err = ioutil.WriteFile(b.Config.Signing.PKCS11PINFile, []byte("1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mustSignAndVerify(t, b, cert)
+}
+
+func TestReadPKCS11PIN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkcs11-pin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "pin")
+	if err = ioutil.WriteFile(file, []byte("1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Unsetenv(pkcs11PINEnv); err != nil {
+		t.Fatal(err)
+	}
+	if pin, err := readPKCS11PIN(file); err != nil || pin != "1234" {
+		t.Errorf("got PIN %q (error %v) from file but expected %q", pin, err, "1234")
+	}
+	if pin, err := readPKCS11PIN(""); err != nil || pin != "" {
+		t.Errorf("got PIN %q (error %v) without file but expected no PIN", pin, err)
+	}
+	if _, err = readPKCS11PIN(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected error when PIN file is missing")
+	}
+
+	if err = os.Setenv(pkcs11PINEnv, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Unsetenv(pkcs11PINEnv)
+	}()
+	if pin, err := readPKCS11PIN(file); err != nil || pin != "5678" {
+		t.Errorf("got PIN %q (error %v) with %s set but expected %q", pin, err, pkcs11PINEnv, "5678")
+	}
+}
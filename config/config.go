@@ -39,10 +39,13 @@ const CurrentConfigVersion = "1.0"
 
 // MixConfig represents the config parameters found in the builder config file.
 type MixConfig struct {
-	Builder builderConf
-	Swupd   swupdConf
-	Server  serverConf
-	Mixer   mixerConf
+	Builder    builderConf
+	Swupd      swupdConf
+	Server     serverConf
+	Heuristics heuristicsConf
+	Renames    renamesConf
+	Signing    signingConf
+	Mixer      mixerConf
 
 	/* hidden properties */
 	filename string
@@ -71,6 +74,70 @@ type serverConf struct {
 	DebugInfoBanned string `required:"false" toml:"DEBUG_INFO_BANNED"`
 	DebugInfoLib    string `required:"false" toml:"DEBUG_INFO_LIB"`
 	DebugInfoSrc    string `required:"false" toml:"DEBUG_INFO_SRC"`
+	DebugInfoSplit  string `required:"false" toml:"DEBUG_INFO_SPLIT,omitempty"`
+	// Compressors are the candidates tried for each fullfile, the smallest
+	// result is kept. It only covers fullfiles: packs and manifest tars use
+	// xz, and zstd starting at ZstdFormat.
+	Compressors     string `required:"false" toml:"COMPRESSORS,omitempty"`
+	ZstdFormat      string `required:"false" toml:"ZSTD_FORMAT,omitempty"`
+	XattrsFormat    string `required:"false" toml:"XATTRS_FORMAT,omitempty"`
+	HashCache       string `required:"false" toml:"HASH_CACHE,omitempty"`
+	HashCacheVerify string `required:"false" toml:"HASH_CACHE_VERIFY,omitempty"`
+	IndexEnabled    string `required:"false" toml:"INDEX_ENABLED,omitempty"`
+	IndexBundle     string `required:"false" toml:"INDEX_BUNDLE,omitempty"`
+	IndexFile       string `required:"false" toml:"INDEX_FILE,omitempty"`
+	IndexFormat     string `required:"false" toml:"INDEX_FORMAT,omitempty"`
+	// RemoveDeprecatedAfter is the number of versions a deprecated bundle
+	// is published before it is removed from the mix.
+	RemoveDeprecatedAfter string `required:"false" toml:"REMOVE_DEPRECATED_AFTER,omitempty"`
+	// UnclampedContentSizeFormat is the first format whose bundles have
+	// their real contentsize, earlier formats keep it clamped for the
+	// clients that need it.
+	UnclampedContentSizeFormat string `required:"false" toml:"UNCLAMPED_CONTENTSIZE_FORMAT,omitempty"`
+}
+
+// heuristicsConf holds the rules used to set the file modifiers. Values are
+// comma separated lists that replace the swupd defaults when set.
+type heuristicsConf struct {
+	ConfigPrefixes string `required:"false" toml:"CONFIG_PREFIXES,omitempty"`
+	ConfigPaths    string `required:"false" toml:"CONFIG_PATHS,omitempty"`
+	ConfigGlobs    string `required:"false" toml:"CONFIG_GLOBS,omitempty"`
+	ConfigExclude  string `required:"false" toml:"CONFIG_EXCLUDE,omitempty"`
+	StatePrefixes  string `required:"false" toml:"STATE_PREFIXES,omitempty"`
+	StatePaths     string `required:"false" toml:"STATE_PATHS,omitempty"`
+	StateGlobs     string `required:"false" toml:"STATE_GLOBS,omitempty"`
+	StateExclude   string `required:"false" toml:"STATE_EXCLUDE,omitempty"`
+	BootPrefixes   string `required:"false" toml:"BOOT_PREFIXES,omitempty"`
+	BootPaths      string `required:"false" toml:"BOOT_PATHS,omitempty"`
+	BootGlobs      string `required:"false" toml:"BOOT_GLOBS,omitempty"`
+	BootExclude    string `required:"false" toml:"BOOT_EXCLUDE,omitempty"`
+}
+
+// renamesConf holds the rules used by rename detection when creating deltas.
+// Empty values keep the swupd defaults.
+type renamesConf struct {
+	Strategies     string `required:"false" toml:"STRATEGIES,omitempty"`
+	MinSize        string `required:"false" toml:"MIN_SIZE,omitempty"`
+	Similarity     string `required:"false" toml:"SIMILARITY,omitempty"`
+	PathComponents string `required:"false" toml:"PATH_COMPONENTS,omitempty"`
+	Bundles        string `required:"false" toml:"BUNDLES,omitempty"`
+	ExcludeBundles string `required:"false" toml:"EXCLUDE_BUNDLES,omitempty"`
+}
+
+// signingConf selects how Manifest.MoM is signed. BACKEND is "local" (the
+// default), "pkcs11" or "command". CERTS and KEYS are comma separated lists,
+// signing with more than one certificate allows rotating keys. Empty values
+// sign with CERT and the private.pem next to it. The PIN of a PKCS #11 token
+// is never kept in the configuration, it is read from the MIXER_PKCS11_PIN
+// environment variable or from the PKCS11_PIN_FILE.
+type signingConf struct {
+	Backend       string `required:"false" toml:"BACKEND,omitempty"`
+	Certs         string `required:"false" toml:"CERTS,omitempty"`
+	Keys          string `required:"false" toml:"KEYS,omitempty"`
+	PKCS11Module  string `required:"false" toml:"PKCS11_MODULE,omitempty"`
+	PKCS11Token   string `required:"false" toml:"PKCS11_TOKEN,omitempty"`
+	PKCS11PINFile string `required:"false" toml:"PKCS11_PIN_FILE,omitempty"`
+	Command       string `required:"false" toml:"COMMAND,omitempty"`
 }
 
 type mixerConf struct {
@@ -109,6 +176,7 @@ func (config *MixConfig) LoadDefaultsForPath(localrpms bool, path string) {
 	config.Server.DebugInfoBanned = "true"
 	config.Server.DebugInfoLib = "/usr/lib/debug"
 	config.Server.DebugInfoSrc = "/usr/src/debug"
+	config.Server.Compressors = "bzip2,gzip,xz"
 
 	// [Mixer]
 	config.Mixer.LocalBundleDir = filepath.Join(path, "local-bundles")
@@ -240,7 +308,8 @@ func (config *MixConfig) SetProperty(propertyStr string, value string) error {
 	for i := 0; i < sectionV.NumField(); i++ {
 		tag, ok := sectionT.Field(i).Tag.Lookup("toml")
 
-		if ok && tag == property {
+		// ignore options such as omitempty
+		if ok && strings.Split(tag, ",")[0] == property {
 			sectionV.Field(i).SetString(value)
 			return config.SaveConfig()
 		}
@@ -348,6 +417,31 @@ func (config *MixConfig) legacyParse() error {
 		{`^debuginfo_banned\s*=\s*`, &config.Server.DebugInfoBanned, false},
 		{`^debuginfo_lib\s*=\s*`, &config.Server.DebugInfoLib, false},
 		{`^debuginfo_src\s*=\s*`, &config.Server.DebugInfoSrc, false},
+		{`^debuginfo_split\s*=\s*`, &config.Server.DebugInfoSplit, false},
+		{`^compressors\s*=\s*`, &config.Server.Compressors, false},
+		{`^zstd_format\s*=\s*`, &config.Server.ZstdFormat, false},
+		{`^xattrs_format\s*=\s*`, &config.Server.XattrsFormat, false},
+		{`^hash_cache\s*=\s*`, &config.Server.HashCache, false},
+		{`^hash_cache_verify\s*=\s*`, &config.Server.HashCacheVerify, false},
+		{`^unclamped_contentsize_format\s*=\s*`, &config.Server.UnclampedContentSizeFormat, false},
+		{`^index_enabled\s*=\s*`, &config.Server.IndexEnabled, false},
+		{`^index_bundle\s*=\s*`, &config.Server.IndexBundle, false},
+		{`^index_file\s*=\s*`, &config.Server.IndexFile, false},
+		{`^index_format\s*=\s*`, &config.Server.IndexFormat, false},
+		{`^remove_deprecated_after\s*=\s*`, &config.Server.RemoveDeprecatedAfter, false},
+		// [Heuristics]
+		{`^config_prefixes\s*=\s*`, &config.Heuristics.ConfigPrefixes, false},
+		{`^config_paths\s*=\s*`, &config.Heuristics.ConfigPaths, false},
+		{`^config_globs\s*=\s*`, &config.Heuristics.ConfigGlobs, false},
+		{`^config_exclude\s*=\s*`, &config.Heuristics.ConfigExclude, false},
+		{`^state_prefixes\s*=\s*`, &config.Heuristics.StatePrefixes, false},
+		{`^state_paths\s*=\s*`, &config.Heuristics.StatePaths, false},
+		{`^state_globs\s*=\s*`, &config.Heuristics.StateGlobs, false},
+		{`^state_exclude\s*=\s*`, &config.Heuristics.StateExclude, false},
+		{`^boot_prefixes\s*=\s*`, &config.Heuristics.BootPrefixes, false},
+		{`^boot_paths\s*=\s*`, &config.Heuristics.BootPaths, false},
+		{`^boot_globs\s*=\s*`, &config.Heuristics.BootGlobs, false},
+		{`^boot_exclude\s*=\s*`, &config.Heuristics.BootExclude, false},
 		// [Mixer]
 		{`^LOCAL_BUNDLE_DIR\s*=\s*`, &config.Mixer.LocalBundleDir, false},
 		{`^LOCAL_REPO_DIR\s*=\s*`, &config.Mixer.LocalRepoDir, false},
@@ -364,6 +458,48 @@ func (config *MixConfig) legacyParse() error {
 		}
 	}
 
+	// The keys of [Signing] and [Renames] have names generic enough to be
+	// used by other sections, so they are only matched inside their own.
+	sectionFields := []struct {
+		section string
+		re      string
+		dest    *string
+	}{
+		{"Signing", `^backend\s*=\s*`, &config.Signing.Backend},
+		{"Signing", `^certs\s*=\s*`, &config.Signing.Certs},
+		{"Signing", `^keys\s*=\s*`, &config.Signing.Keys},
+		{"Signing", `^pkcs11_module\s*=\s*`, &config.Signing.PKCS11Module},
+		{"Signing", `^pkcs11_token\s*=\s*`, &config.Signing.PKCS11Token},
+		{"Signing", `^pkcs11_pin_file\s*=\s*`, &config.Signing.PKCS11PINFile},
+		{"Signing", `^command\s*=\s*`, &config.Signing.Command},
+		{"Renames", `^strategies\s*=\s*`, &config.Renames.Strategies},
+		{"Renames", `^min_size\s*=\s*`, &config.Renames.MinSize},
+		{"Renames", `^similarity\s*=\s*`, &config.Renames.Similarity},
+		{"Renames", `^path_components\s*=\s*`, &config.Renames.PathComponents},
+		{"Renames", `^bundles\s*=\s*`, &config.Renames.Bundles},
+		{"Renames", `^exclude_bundles\s*=\s*`, &config.Renames.ExcludeBundles},
+	}
+	sectionRe := regexp.MustCompile(`^\s*\[(.*)\]\s*$`)
+	sections := make([]string, len(lines))
+	var section string
+	for n, i := range lines {
+		if m := sectionRe.FindStringSubmatch(i); m != nil {
+			section = strings.TrimSpace(m[1])
+		}
+		sections[n] = section
+	}
+	for _, h := range sectionFields {
+		r := regexp.MustCompile(h.re)
+		for n, i := range lines {
+			if !strings.EqualFold(sections[n], h.section) {
+				continue
+			}
+			if m := r.FindIndex([]byte(i)); m != nil {
+				*h.dest = i[m[1]:]
+			}
+		}
+	}
+
 	config.hasFormatField = format != ""
 
 	if config.Mixer.LocalBundleDir == "" {
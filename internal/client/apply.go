@@ -0,0 +1,690 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+// ApplyOptions describes an update performed by State.Apply.
+type ApplyOptions struct {
+	// Root is the directory where the bundles are installed.
+	Root string
+
+	// Bundles installed in Root. Bundles included by them are also updated.
+	Bundles []string
+
+	// From is the version installed in Root, or zero to install the bundles
+	// in an empty Root.
+	From uint32
+
+	// To is the version to update to.
+	To uint32
+
+	// NoPacks disables the use of packs, so every file is downloaded as a
+	// fullfile.
+	NoPacks bool
+}
+
+// ApplyReport summarizes the work done by State.Apply.
+type ApplyReport struct {
+	// Bundles contains the bundles updated, including the ones included by
+	// the requested bundles.
+	Bundles []string
+
+	Packs     int // Packs used.
+	Deltas    int // Files staged by applying a delta.
+	Fullfiles int // Files staged from a fullfile.
+	Installed int // Files written to the root.
+	Removed   int // Files removed from the root.
+
+	// KeptConfig contains config files changed locally, which are not
+	// overwritten by the update.
+	KeptConfig []string
+
+	// Boot contains the boot files updated. A swupd client would update the
+	// bootloader after installing them.
+	Boot []string
+
+	// Problems contains the files in the root that don't match
+	// Manifest.full after the update.
+	Problems []string
+}
+
+// packedDelta is a delta extracted from a pack, to be applied to the
+// original content with hash from.
+type packedDelta struct {
+	from swupd.Hashval
+	path string
+}
+
+type applier struct {
+	cs     *State
+	opts   *ApplyOptions
+	report *ApplyReport
+
+	// Files from all the bundles, indexed by name. Present files are
+	// preferred over deleted or ghosted ones.
+	fromFiles map[string]*swupd.File
+	toFiles   map[string]*swupd.File
+
+	// original has the names of the regular files present in the installed
+	// version, indexed by hash, to find the content deltas apply to.
+	original map[swupd.Hashval][]string
+
+	deltas map[swupd.Hashval][]packedDelta
+}
+
+// Apply updates the bundles installed in a root directory, like a swupd client
+// would do: the manifests of the target version are read, the content is
+// taken from the packs when available, applying the deltas to the files in the
+// root, and from the fullfiles otherwise. Deleted files are removed, ghosted
+// and state files are left alone and config files changed locally are kept.
+// Files of the installed version not listed at all in the target manifests,
+// e.g. when deleted records were dropped by a format bump, are removed too.
+// The resulting tree is verified against Manifest.full. An error is returned
+// when the update can't be performed, files that don't match after the update
+// are listed in the report.
+func (cs *State) Apply(opts *ApplyOptions) (*ApplyReport, error) {
+	if opts.From >= opts.To {
+		return nil, fmt.Errorf("from version (%d) must be smaller than to version (%d)", opts.From, opts.To)
+	}
+	if len(opts.Bundles) == 0 {
+		return nil, fmt.Errorf("no bundles to update")
+	}
+
+	a := &applier{
+		cs:        cs,
+		opts:      opts,
+		report:    &ApplyReport{},
+		fromFiles: make(map[string]*swupd.File),
+		toFiles:   make(map[string]*swupd.File),
+		original:  make(map[swupd.Hashval][]string),
+		deltas:    make(map[swupd.Hashval][]packedDelta),
+	}
+
+	toMoM, err := cs.GetMoM(fmt.Sprint(opts.To))
+	if err != nil {
+		return nil, err
+	}
+	toBundles, err := cs.resolveBundles(toMoM, opts.Bundles)
+	if err != nil {
+		return nil, err
+	}
+
+	var fromMoM *swupd.Manifest
+	if opts.From > 0 {
+		fromMoM, err = cs.GetMoM(fmt.Sprint(opts.From))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range sortedBundleNames(toBundles) {
+		a.report.Bundles = append(a.report.Bundles, name)
+		toM := toBundles[name]
+		addFiles(a.toFiles, toM)
+
+		var fromM *swupd.Manifest
+		if fromMoM != nil {
+			if bundleF := findBundleFile(fromMoM, name); bundleF != nil {
+				fromM, err = cs.GetBundleManifest(fmt.Sprint(bundleF.Version), name, bundleF.Hash.String())
+				if err != nil {
+					return nil, err
+				}
+				addFiles(a.fromFiles, fromM)
+			}
+		}
+
+		if opts.NoPacks {
+			continue
+		}
+		var fromVersion uint32
+		if fromM != nil {
+			fromVersion = fromM.Header.Version
+		}
+		if fromVersion == toM.Header.Version {
+			continue
+		}
+		if err = a.extractPack(toM.Header.Version, name, fromVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, f := range a.fromFiles {
+		if f.Type == swupd.TypeFile && f.Present() {
+			a.original[f.Hash] = append(a.original[f.Hash], name)
+		}
+	}
+
+	if err = os.MkdirAll(opts.Root, 0755); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range a.toFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Parent directories sort before their contents, so installing in
+	// order always has a place to write the files.
+	for _, name := range names {
+		if err = a.install(a.toFiles[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Remove in reverse order, so directories are empty when removed.
+	removed := a.removedNames()
+	for i := len(removed) - 1; i >= 0; i-- {
+		if err = a.remove(removed[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = a.verify(); err != nil {
+		return nil, err
+	}
+	return a.report, nil
+}
+
+func addFiles(files map[string]*swupd.File, m *swupd.Manifest) {
+	for _, f := range m.Files {
+		if prev, ok := files[f.Name]; ok && (prev.Present() || !f.Present()) {
+			continue
+		}
+		files[f.Name] = f
+	}
+}
+
+func findBundleFile(mom *swupd.Manifest, name string) *swupd.File {
+	for _, f := range mom.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func sortedBundleNames(bundles map[string]*swupd.Manifest) []string {
+	var names []string
+	for name := range bundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveBundles reads the manifests of the requested bundles and the bundles
+// they include.
+func (cs *State) resolveBundles(mom *swupd.Manifest, requested []string) (map[string]*swupd.Manifest, error) {
+	bundles := make(map[string]*swupd.Manifest)
+	queue := append([]string(nil), requested...)
+	for len(queue) > 0 {
+		var name string
+		name, queue = queue[0], queue[1:]
+		if _, ok := bundles[name]; ok {
+			continue
+		}
+		bundleF := findBundleFile(mom, name)
+		if bundleF == nil {
+			return nil, fmt.Errorf("bundle %s not found in Manifest.MoM", name)
+		}
+		m, err := cs.GetBundleManifest(fmt.Sprint(bundleF.Version), name, bundleF.Hash.String())
+		if err != nil {
+			return nil, err
+		}
+		for _, inc := range m.Header.Includes {
+			queue = append(queue, inc.Name)
+		}
+		bundles[name] = m
+	}
+	return bundles, nil
+}
+
+// extractPack stages the content of a pack and keeps its deltas to be applied
+// later. A pack that can't be downloaded is not an error, the content will be
+// taken from the fullfiles.
+func (a *applier) extractPack(version uint32, name string, fromVersion uint32) error {
+	packName := swupd.GetPackFilename(name, fromVersion)
+	f, err := a.cs.OpenFile(fmt.Sprint(version), packName)
+	if err != nil {
+		if a.cs.Verbose {
+			fmt.Printf("- no pack %s in version %d: %s\n", packName, version, err)
+		}
+		return nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	pr, err := swupd.OpenPack(f)
+	if err != nil {
+		return fmt.Errorf("invalid pack %s: %s", packName, err)
+	}
+	defer func() {
+		_ = pr.Close()
+	}()
+
+	deltaDir := a.cs.Path("delta")
+	if err = os.MkdirAll(deltaDir, 0755); err != nil {
+		return err
+	}
+	for {
+		item, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid pack %s: %s", packName, err)
+		}
+		switch item.Type {
+		case swupd.PackItemStaged:
+			err = a.cs.extractFullfile(item.Header, pr)
+		case swupd.PackItemDelta:
+			path := filepath.Join(deltaDir, filepath.Base(item.Name()))
+			err = writeDelta(path, pr)
+			a.deltas[item.Hash] = append(a.deltas[item.Hash], packedDelta{item.FromHash, path})
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't extract %s from pack %s: %s", item.Name(), packName, err)
+		}
+	}
+	a.report.Packs++
+	return nil
+}
+
+func writeDelta(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stage makes sure the content of f is in the staged directory, applying a
+// delta or downloading the fullfile when needed.
+func (a *applier) stage(f *swupd.File) (string, error) {
+	staged := a.cs.Path("staged", f.Hash.String())
+	if _, err := os.Lstat(staged); err == nil {
+		return staged, nil
+	}
+
+	for _, d := range a.deltas[f.Hash] {
+		err := a.stageFromDelta(f, d)
+		if err == nil {
+			a.report.Deltas++
+			return staged, nil
+		}
+		if a.cs.Verbose {
+			fmt.Printf("- couldn't apply delta for %s, trying next option: %s\n", f.Name, err)
+		}
+	}
+
+	if err := a.cs.GetFullfile(fmt.Sprint(f.Version), f.Hash.String()); err != nil {
+		return "", fmt.Errorf("couldn't get fullfile for %s with hash %s: %s", f.Name, f.Hash, err)
+	}
+	a.report.Fullfiles++
+	return staged, nil
+}
+
+// stageFromDelta applies the delta to the original content, found either in
+// the root or in the staged directory.
+func (a *applier) stageFromDelta(f *swupd.File, d packedDelta) error {
+	oldPath, err := a.originalContent(d.from)
+	if err != nil {
+		return err
+	}
+	old, err := ioutil.ReadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	delta, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	content, info, err := swupd.ApplyDelta(old, delta)
+	if err != nil {
+		return err
+	}
+	// Deltas are only created when the extended attributes didn't change.
+	info.Xattrs, err = swupd.ReadXattrs(oldPath)
+	if err != nil {
+		return err
+	}
+	return a.cs.stageBytes(f.Hash.String(), content, info)
+}
+
+// originalContent returns the path of a file with the given hash.
+func (a *applier) originalContent(hash swupd.Hashval) (string, error) {
+	if staged := a.cs.Path("staged", hash.String()); isRegular(staged) {
+		return staged, nil
+	}
+	for _, name := range a.original[hash] {
+		path := filepath.Join(a.opts.Root, name)
+		if got, err := swupd.GetHashForFileWithXattrs(path, a.cs.Xattrs); err == nil && got == hash.String() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("original content with hash %s not available", hash)
+}
+
+func isRegular(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// stageBytes writes the content produced by a delta to the staged directory,
+// checking it has the expected hash.
+func (cs *State) stageBytes(hash string, content []byte, info *swupd.HashFileInfo) error {
+	tempFilename := cs.Path("staged/temp", hash)
+	mode := unixToFileMode(info.Mode)
+	err := ioutil.WriteFile(tempFilename, content, mode)
+	if err != nil {
+		return err
+	}
+	if err = os.Chown(tempFilename, int(info.UID), int(info.GID)); err != nil {
+		_ = os.Remove(tempFilename)
+		return err
+	}
+	if err = os.Chmod(tempFilename, mode); err != nil {
+		_ = os.Remove(tempFilename)
+		return err
+	}
+	if err = swupd.WriteXattrs(tempFilename, info.Xattrs); err != nil {
+		_ = os.Remove(tempFilename)
+		return err
+	}
+	got, err := swupd.GetHashForFileWithXattrs(tempFilename, cs.Xattrs)
+	if err != nil {
+		_ = os.Remove(tempFilename)
+		return err
+	}
+	if got != hash {
+		_ = os.Remove(tempFilename)
+		return fmt.Errorf("result of delta has hash %s instead of %s", got, hash)
+	}
+	return os.Rename(tempFilename, cs.Path("staged", hash))
+}
+
+func unixToFileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// install writes f to the root, unless the root already has the expected
+// content or the file shouldn't be touched by an update.
+func (a *applier) install(f *swupd.File) error {
+	if !f.Present() {
+		return nil
+	}
+	dst := filepath.Join(a.opts.Root, f.Name)
+	dstFI, err := os.Lstat(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't access existing file %s: %s", dst, err)
+	}
+	exists := err == nil
+
+	if exists {
+		// State files are owned by the system once created.
+		if f.Modifier == swupd.ModifierState {
+			return nil
+		}
+		hash, err := swupd.GetHashForFileWithXattrs(dst, a.cs.Xattrs)
+		if err != nil {
+			return err
+		}
+		if hash == f.Hash.String() {
+			return nil
+		}
+		if f.Modifier == swupd.ModifierConfig {
+			if old, ok := a.fromFiles[f.Name]; ok && old.Present() && old.Hash.String() != hash {
+				a.report.KeptConfig = append(a.report.KeptConfig, f.Name)
+				return nil
+			}
+		}
+	}
+
+	src, err := a.stage(f)
+	if err != nil {
+		return err
+	}
+	srcFI, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("couldn't access staged file for %s: %s", dst, err)
+	}
+
+	// Manifests usually list all the parent directories, but don't fail
+	// when they are missing.
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if exists && dstFI.IsDir() {
+		if srcFI.IsDir() {
+			// Fix the metadata in place to preserve the contents.
+			err = copyMetadata(dst, src, srcFI)
+			if err != nil {
+				return fmt.Errorf("couldn't fix metadata of %s: %s", dst, err)
+			}
+			a.report.Installed++
+			return nil
+		}
+		if err = os.RemoveAll(dst); err != nil {
+			return fmt.Errorf("couldn't remove %s: %s", dst, err)
+		}
+	}
+
+	if srcFI.IsDir() {
+		if exists && !dstFI.IsDir() {
+			if err = os.Remove(dst); err != nil {
+				return fmt.Errorf("couldn't remove %s: %s", dst, err)
+			}
+		}
+		if err = os.Mkdir(dst, srcFI.Mode().Perm()); err != nil {
+			return err
+		}
+		if err = copyMetadata(dst, src, srcFI); err != nil {
+			return err
+		}
+	} else {
+		// Write next to the destination and rename, so the file is
+		// replaced atomically.
+		temp := filepath.Join(filepath.Dir(dst), ".update."+filepath.Base(dst))
+		if err = os.RemoveAll(temp); err != nil {
+			return err
+		}
+		if srcFI.Mode()&os.ModeSymlink != 0 {
+			var link string
+			link, err = os.Readlink(src)
+			if err == nil {
+				err = os.Symlink(link, temp)
+			}
+		} else {
+			err = copyFile(temp, src, srcFI)
+		}
+		if err == nil {
+			err = copyXattrs(temp, src)
+		}
+		if err != nil {
+			_ = os.Remove(temp)
+			return fmt.Errorf("couldn't write %s: %s", dst, err)
+		}
+		if err = os.Rename(temp, dst); err != nil {
+			_ = os.Remove(temp)
+			return err
+		}
+	}
+
+	a.report.Installed++
+	if f.Modifier == swupd.ModifierBoot {
+		a.report.Boot = append(a.report.Boot, f.Name)
+	}
+	return nil
+}
+
+// removedNames returns the sorted names of the files to remove from the root:
+// the ones deleted after the installed version and the ones present in the
+// installed version but missing from the target manifests. State files are
+// never removed.
+func (a *applier) removedNames() []string {
+	if a.opts.From == 0 {
+		return nil
+	}
+	var names []string
+	for name, f := range a.toFiles {
+		if f.Status == swupd.StatusDeleted && f.Version > a.opts.From {
+			names = append(names, name)
+		}
+	}
+	for name, f := range a.fromFiles {
+		if _, ok := a.toFiles[name]; !ok && f.Present() && f.Modifier != swupd.ModifierState {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// remove deletes a file from the root.
+func (a *applier) remove(name string) error {
+	dst := filepath.Join(a.opts.Root, name)
+	fi, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't access existing file %s: %s", dst, err)
+	}
+	err = os.Remove(dst)
+	if err != nil {
+		// Directories may still have content not managed by the bundles.
+		if fi.IsDir() {
+			return nil
+		}
+		return fmt.Errorf("couldn't remove %s: %s", dst, err)
+	}
+	a.report.Removed++
+	return nil
+}
+
+// verify checks the files in the root against Manifest.full of the target
+// version.
+func (a *applier) verify() error {
+	path, err := a.cs.GetFile(fmt.Sprint(a.opts.To), "Manifest.full")
+	if err != nil {
+		return err
+	}
+	full, err := swupd.ParseManifestFile(path)
+	if err != nil {
+		return err
+	}
+	fullFiles := make(map[string]*swupd.File, len(full.Files))
+	for _, f := range full.Files {
+		fullFiles[f.Name] = f
+	}
+	kept := make(map[string]bool)
+	for _, name := range a.report.KeptConfig {
+		kept[name] = true
+	}
+
+	var names []string
+	for name, f := range a.toFiles {
+		if f.Present() && f.Modifier != swupd.ModifierState && !kept[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := fullFiles[name]
+		if f == nil {
+			a.report.Problems = append(a.report.Problems, fmt.Sprintf("%s: not in Manifest.full", name))
+			continue
+		}
+		if f.Hash != a.toFiles[name].Hash {
+			a.report.Problems = append(a.report.Problems, fmt.Sprintf("%s: bundle manifest has hash %s but Manifest.full has %s", name, a.toFiles[name].Hash, f.Hash))
+			continue
+		}
+		hash, err := swupd.GetHashForFileWithXattrs(filepath.Join(a.opts.Root, name), a.cs.Xattrs)
+		if err != nil {
+			a.report.Problems = append(a.report.Problems, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		if hash != f.Hash.String() {
+			a.report.Problems = append(a.report.Problems, fmt.Sprintf("%s: has hash %s but Manifest.full has %s", name, hash, f.Hash))
+		}
+	}
+	return nil
+}
+
+func copyMetadata(dst string, src string, srcFI os.FileInfo) error {
+	st := srcFI.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, srcFI.Mode()); err != nil {
+		return err
+	}
+	return copyXattrs(dst, src)
+}
+
+// copyXattrs copies to dst the extended attributes of src carried by swupd
+// content.
+func copyXattrs(dst string, src string) error {
+	xattrs, err := swupd.ReadXattrs(src)
+	if err != nil {
+		return err
+	}
+	return swupd.WriteXattrs(dst, xattrs)
+}
+
+func copyFile(dst string, src string, srcFI os.FileInfo) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+
+	dstFile, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, srcFI.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstFile, srcFile)
+	if err == nil {
+		st := srcFI.Sys().(*syscall.Stat_t)
+		err = dstFile.Chown(int(st.Uid), int(st.Gid))
+	}
+	if err == nil {
+		// Chown clears setuid and setgid bits, so set the mode after it.
+		err = dstFile.Chmod(srcFI.Mode())
+	}
+	if err != nil {
+		_ = dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
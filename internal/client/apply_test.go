@@ -0,0 +1,308 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+// testRepo builds update content with the swupd package, the same way mixer
+// does, so it can be applied by the client.
+type testRepo struct {
+	t      *testing.T
+	dir    string
+	format uint
+	last   uint32
+
+	// files has the files of each bundle in the version being built.
+	files map[string][]string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "client-apply-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRepo{t: t, dir: dir, format: 1}
+	r.write("image/LAST_VER", "0\n")
+	r.write("server.ini", fmt.Sprintf("[Server]\nemptydir=%s/empty/\nimagebase=%s/image/\noutputdir=%s/www/\n", dir, dir, dir))
+	return r
+}
+
+func (r *testRepo) cleanup() {
+	if r.t.Failed() {
+		fmt.Printf("Keeping directory %s because test failed\n", r.dir)
+		return
+	}
+	_ = os.RemoveAll(r.dir)
+}
+
+func (r *testRepo) path(subpath string) string {
+	return filepath.Join(r.dir, subpath)
+}
+
+func (r *testRepo) write(subpath, content string) {
+	r.t.Helper()
+	path := r.path(subpath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) read(subpath string) string {
+	r.t.Helper()
+	content, err := ioutil.ReadFile(r.path(subpath))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return string(content)
+}
+
+func (r *testRepo) exists(subpath string) bool {
+	_, err := os.Lstat(r.path(subpath))
+	return err == nil
+}
+
+// addFile adds a file to a bundle of the next version to be built.
+func (r *testRepo) addFile(version uint32, bundle, name, content string) {
+	r.t.Helper()
+	if r.files == nil {
+		r.files = make(map[string][]string)
+	}
+	r.files[bundle] = append(r.files[bundle], name)
+	r.write(filepath.Join("image", fmt.Sprint(version), "full", name), content)
+}
+
+// build creates the manifests, fullfiles and packs of version, with deltas
+// from the previously built version.
+func (r *testRepo) build(version uint32) {
+	r.t.Helper()
+	var bundles []string
+	for name := range r.files {
+		bundles = append(bundles, name)
+	}
+	sort.Strings(bundles)
+
+	groups := "[os-core]\ngroup=os-core\nstatus=ACTIVE\n"
+	for _, name := range bundles {
+		groups += fmt.Sprintf("[%s]\ngroup=%s\nstatus=ACTIVE\n", name, name)
+		r.addFile(version, name, "/usr/share/clear/bundles/"+name, "")
+	}
+	r.write("groups.ini", groups)
+	r.addFile(version, "os-core", "/usr/lib/os-release", fmt.Sprintf("VERSION_ID=%d\n", version))
+
+	for name, files := range r.files {
+		info := struct {
+			Name           string
+			DirectIncludes []string
+			DirectPackages map[string]bool
+			Files          map[string]bool
+		}{Name: name, DirectPackages: map[string]bool{}, Files: map[string]bool{}}
+		for _, f := range files {
+			info.Files[f] = true
+		}
+		b, err := json.Marshal(&info)
+		if err != nil {
+			r.t.Fatal(err)
+		}
+		r.write(filepath.Join("image", fmt.Sprint(version), name+"-info"), string(b))
+	}
+
+	mom, err := swupd.CreateManifests(version, 0, r.format, r.dir, 0, nil)
+	if err != nil {
+		r.t.Fatalf("couldn't create manifests for version %d: %s", version, err)
+	}
+	fullChroot := r.path(filepath.Join("image", fmt.Sprint(version), "full"))
+	www := r.path("www")
+	if _, err = swupd.CreateFullfiles(mom.FullManifest, fullChroot, filepath.Join(www, fmt.Sprint(version), "files"), 0, nil); err != nil {
+		r.t.Fatalf("couldn't create fullfiles for version %d: %s", version, err)
+	}
+	if r.last != 0 {
+		if err = swupd.CreateAllDeltas(www, int(r.last), int(version), 0, nil); err != nil {
+			r.t.Fatalf("couldn't create deltas from %d to %d: %s", r.last, version, err)
+		}
+	}
+	for _, m := range mom.UpdatedBundles {
+		if _, err = swupd.CreatePack(m.Name, 0, version, www, r.path("image"), 0, nil); err != nil {
+			r.t.Fatalf("couldn't create zero pack for %s: %s", m.Name, err)
+		}
+		if r.last == 0 {
+			continue
+		}
+		if _, err = swupd.CreatePack(m.Name, r.last, version, www, r.path("image"), 0, nil); err != nil {
+			r.t.Fatalf("couldn't create pack for %s from %d: %s", m.Name, r.last, err)
+		}
+	}
+
+	r.write("image/LAST_VER", fmt.Sprintf("%d\n", version))
+	r.last = version
+	r.files = nil
+}
+
+// apply updates the root in the repository directory with a new client state,
+// so no content staged by previous updates is reused.
+func (r *testRepo) apply(from, to uint32, bundles ...string) *ApplyReport {
+	r.t.Helper()
+	stateDir, err := ioutil.TempDir(r.dir, "state-")
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	cs, err := NewState(stateDir, r.path("www"))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	report, err := cs.Apply(&ApplyOptions{
+		Root:    r.path("root"),
+		Bundles: bundles,
+		From:    from,
+		To:      to,
+	})
+	if err != nil {
+		r.t.Fatalf("couldn't update from %d to %d: %s", from, to, err)
+	}
+	if len(report.Problems) > 0 {
+		r.t.Errorf("problems after update from %d to %d:\n%s", from, to, strings.Join(report.Problems, "\n"))
+	}
+	return report
+}
+
+func (r *testRepo) checkContent(name, expected string) {
+	r.t.Helper()
+	if got := r.read(filepath.Join("root", name)); got != expected {
+		r.t.Errorf("%s has content %q but expected %q", name, got, expected)
+	}
+}
+
+// randomContent returns content big enough to get a delta, that doesn't
+// compress well.
+func randomContent(seed int64) []byte {
+	content := make([]byte, 16*1024)
+	_, _ = rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApply(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.cleanup()
+
+	large := randomContent(1)
+	r.addFile(10, "test-bundle", "/usr/bin/deleted", "deleted")
+	r.addFile(10, "test-bundle", "/usr/share/large", string(large))
+	r.addFile(10, "test-bundle", "/etc/kept", "config 10")
+	r.addFile(10, "test-bundle", "/etc/updated", "config 10")
+	r.addFile(10, "test-bundle", "/var/lib/state", "state 10")
+	r.addFile(10, "test-bundle", "/usr/lib/kernel/boot", "boot 10")
+	r.addFile(10, "test-bundle", "/usr/lib/kernel/ghosted", "ghosted")
+	r.build(10)
+
+	report := r.apply(0, 10, "test-bundle")
+	if report.Deltas != 0 || report.Removed != 0 {
+		t.Errorf("unexpected deltas or removed files when installing: %+v", report)
+	}
+	r.checkContent("/usr/share/large", string(large))
+	r.checkContent("/usr/lib/kernel/ghosted", "ghosted")
+
+	// Local changes.
+	r.write("root/etc/kept", "local config")
+	r.write("root/var/lib/state", "local state")
+
+	large[100]++
+	r.addFile(20, "test-bundle", "/usr/share/large", string(large))
+	r.addFile(20, "test-bundle", "/etc/kept", "config 20")
+	r.addFile(20, "test-bundle", "/etc/updated", "config 20")
+	r.addFile(20, "test-bundle", "/var/lib/state", "state 20")
+	r.addFile(20, "test-bundle", "/usr/lib/kernel/boot", "boot 20")
+	r.build(20)
+
+	report = r.apply(10, 20, "test-bundle")
+
+	// Delta applied to the content in the root.
+	if report.Deltas != 1 {
+		t.Errorf("got %d deltas applied but expected 1", report.Deltas)
+	}
+	r.checkContent("/usr/share/large", string(large))
+
+	// Deleted files are removed, ghosted files are left alone.
+	if r.exists("root/usr/bin/deleted") {
+		t.Errorf("deleted file was not removed")
+	}
+	if report.Removed != 1 {
+		t.Errorf("got %d files removed but expected 1", report.Removed)
+	}
+	r.checkContent("/usr/lib/kernel/ghosted", "ghosted")
+
+	// Config files changed locally are kept, the others are updated.
+	r.checkContent("/etc/kept", "local config")
+	r.checkContent("/etc/updated", "config 20")
+	if !contains(report.KeptConfig, "/etc/kept") || contains(report.KeptConfig, "/etc/updated") {
+		t.Errorf("got kept config files %v but expected only /etc/kept", report.KeptConfig)
+	}
+
+	// State files are not touched once created.
+	r.checkContent("/var/lib/state", "local state")
+
+	// Boot files updated are reported.
+	r.checkContent("/usr/lib/kernel/boot", "boot 20")
+	if len(report.Boot) != 1 || report.Boot[0] != "/usr/lib/kernel/boot" {
+		t.Errorf("got boot files %v but expected /usr/lib/kernel/boot", report.Boot)
+	}
+}
+
+func TestApplyMissingFiles(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.cleanup()
+
+	r.addFile(10, "test-bundle", "/usr/bin/foo", "foo")
+	r.addFile(10, "test-bundle", "/usr/bin/bar", "bar")
+	r.addFile(10, "test-bundle", "/var/lib/state", "state")
+	r.build(10)
+	r.apply(0, 10, "test-bundle")
+
+	// Deleted records are dropped when the format changes, so the files
+	// removed in version 20 are not listed at all in version 30.
+	r.addFile(20, "test-bundle", "/usr/bin/foo", "foo")
+	r.build(20)
+	r.format++
+	r.addFile(30, "test-bundle", "/usr/bin/foo", "foo 30")
+	r.build(30)
+	m, err := swupd.ParseManifestFile(r.path("www/30/Manifest.test-bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range m.Files {
+		if f.Name == "/usr/bin/bar" {
+			t.Fatalf("/usr/bin/bar is still in the manifest, test needs updating")
+		}
+	}
+
+	report := r.apply(10, 30, "test-bundle")
+	if r.exists("root/usr/bin/bar") {
+		t.Errorf("file missing from the manifests was not removed")
+	}
+	if report.Removed != 1 {
+		t.Errorf("got %d files removed but expected 1", report.Removed)
+	}
+	r.checkContent("/usr/bin/foo", "foo 30")
+	r.checkContent("/var/lib/state", "state")
+}
@@ -2,12 +2,14 @@ package client
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/clearlinux/mixer-tools/swupd"
@@ -17,8 +19,10 @@ import (
 
 // State provides a way to query information and content from a swupd repository.
 type State struct {
-	NoCache bool // Disables cache of the metadata and files.
-	Verbose bool // Prints extra messages during the operations.
+	NoCache bool   // Disables cache of the metadata and files.
+	Verbose bool   // Prints extra messages during the operations.
+	Cert    string // If set, certificate used to verify the signature of Manifest.MoM.
+	Xattrs  bool   // Includes the extended attributes in the hashes.
 
 	dir         string
 	baseContent string
@@ -125,12 +129,24 @@ func (cs *State) Path(elem ...string) string {
 	return filepath.Join(cs.dir, filepath.Join(elem...))
 }
 
-// GetMoM returns the Manifest struct for the MoM of a given version.
+// GetMoM returns the Manifest struct for the MoM of a given version. If Cert is
+// set, the signature of the MoM is verified.
 func (cs *State) GetMoM(version string) (*swupd.Manifest, error) {
 	momFile, err := cs.GetFile(version, "Manifest.MoM")
 	if err != nil {
 		return nil, err
 	}
+	if cs.Cert != "" {
+		var sigFile string
+		sigFile, err = cs.GetFile(version, "Manifest.MoM.sig")
+		if err != nil {
+			return nil, err
+		}
+		err = swupd.VerifySignatureFile(momFile, sigFile, cs.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't verify Manifest.MoM of version %s: %s", version, err)
+		}
+	}
 	mom, err := swupd.ParseManifestFile(momFile)
 	if err != nil {
 		return nil, err
@@ -152,7 +168,7 @@ func (cs *State) GetBundleManifest(version, name, expectedHash string) (*swupd.M
 	// TODO: Calculate the hash without being root, maybe we just need a function that takes the
 	// HashInfo and use the file only for contents?
 	if expectedHash != "" {
-		hash, gerr := swupd.GetHashForFile(filename)
+		hash, gerr := swupd.GetHashForFileWithXattrs(filename, cs.Xattrs)
 		if gerr != nil {
 			return nil, fmt.Errorf("couldn't calculate hash for %s: %s", filename, gerr)
 		}
@@ -168,6 +184,65 @@ func (cs *State) GetBundleManifest(version, name, expectedHash string) (*swupd.M
 	return m, nil
 }
 
+// GetBundleManifestDelta returns the Manifest struct for a given version of a bundle, built by
+// applying the manifest delta from the manifest of the bundle at fromVersion instead of downloading
+// the whole manifest. If expectedHash is not empty, it is used to verify the resulting manifest. For
+// remote repositories the result is cached, so later calls to GetBundleManifest use it.
+func (cs *State) GetBundleManifestDelta(fromVersion, version, name, expectedHash string) (*swupd.Manifest, error) {
+	if name == "MoM" {
+		return nil, fmt.Errorf("invalid arguments to GetBundleManifestDelta: MoM is not a bundle")
+	}
+	from, err := strconv.ParseUint(fromVersion, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from version %q: %s", fromVersion, err)
+	}
+	oldFilename, err := cs.GetFile(fromVersion, "Manifest."+name)
+	if err != nil {
+		return nil, err
+	}
+	deltaFilename, err := cs.GetFile(version, swupd.ManifestDeltaName(name, uint32(from)))
+	if err != nil {
+		return nil, err
+	}
+	oldContent, err := ioutil.ReadFile(oldFilename)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := ioutil.ReadFile(deltaFilename)
+	if err != nil {
+		return nil, err
+	}
+	var xattrs map[string]string
+	if cs.Xattrs {
+		if xattrs, err = swupd.ReadXattrs(oldFilename); err != nil {
+			return nil, err
+		}
+	}
+	content, err := swupd.ApplyManifestDelta(oldContent, delta, xattrs, expectedHash)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't apply %s: %s", deltaFilename, err)
+	}
+
+	if cs.isRemote {
+		filename := cs.Path(version, "Manifest."+name)
+		if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(filename, content, 0644); err != nil {
+			return nil, err
+		}
+		if err = swupd.WriteXattrs(filename, xattrs); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := swupd.ParseManifest(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse bundle manifest produced by %s: %s", deltaFilename, err)
+	}
+	return m, nil
+}
+
 // GetFullfile downloads a the fullfile with hash from the given version.
 func (cs *State) GetFullfile(version, hash string) error {
 	tarredFilename, err := cs.GetFile(version, "files", hash+".tar")
@@ -207,17 +282,6 @@ func (cs *State) GetFullfile(version, hash string) error {
 	return nil
 }
 
-func newTarXzReader(r io.Reader) (*swupd.CompressedTarReader, error) {
-	result := &swupd.CompressedTarReader{}
-	xr, err := swupd.NewExternalReader(r, "unxz")
-	if err != nil {
-		return nil, fmt.Errorf("couldn't decompress using xz: %s", err)
-	}
-	result.CompressionCloser = xr
-	result.Reader = tar.NewReader(xr)
-	return result, nil
-}
-
 // GetZeroPack downloads the zero pack for a bundle in a specific version.
 func (cs *State) GetZeroPack(version, name string) error {
 	cachedName := cs.Path(fmt.Sprintf("pack-%s-from-0-to-%s.tar", name, version))
@@ -235,8 +299,7 @@ func (cs *State) GetZeroPack(version, name string) error {
 		_ = pack.Close()
 	}()
 
-	// Compression time is known ahead of time, so avoid the need of Seeker interface.
-	tr, err := newTarXzReader(pack)
+	tr, err := swupd.NewCompressedTarReader(pack)
 	if err != nil {
 		return err
 	}
@@ -323,7 +386,7 @@ func (cs *State) extractFullfile(hdr *tar.Header, r io.Reader) error {
 
 	// File exists, check the hash.
 	if err == nil {
-		hash, herr := swupd.GetHashForFile(filename)
+		hash, herr := swupd.GetHashForFileWithXattrs(filename, cs.Xattrs)
 		if herr == nil && hash == basename {
 			if !cs.NoCache {
 				// No work needed!
@@ -405,8 +468,15 @@ func (cs *State) extractFullfile(hdr *tar.Header, r io.Reader) error {
 		return fmt.Errorf("unsupported type %c in fullfile %s", hdr.Typeflag, basename)
 	}
 
+	// Restore the extended attributes before hashing, since they may be part
+	// of the hash.
+	err = swupd.WriteXattrs(tempFilename, swupd.TarHeaderXattrs(hdr))
+	if err != nil {
+		return err
+	}
+
 	// Now validate the file.
-	hash, err := swupd.GetHashForFile(tempFilename)
+	hash, err := swupd.GetHashForFileWithXattrs(tempFilename, cs.Xattrs)
 	if err != nil {
 		return err
 	}
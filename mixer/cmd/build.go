@@ -41,9 +41,12 @@ type buildCmdFlags struct {
 	skipFullfiles bool
 	skipPacks     bool
 
+	manifestDeltas int
+
 	numFullfileWorkers int
 	numDeltaWorkers    int
 	numBundleWorkers   int
+	numManifestWorkers int
 }
 
 var buildFlags buildCmdFlags
@@ -65,6 +68,11 @@ func setWorkers(b *builder.Builder) {
 		workers = runtime.NumCPU()
 	}
 	b.NumBundleWorkers = workers
+	workers = buildFlags.numManifestWorkers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	b.NumManifestWorkers = workers
 }
 
 // buildCmd represents the base build command when called without any subcommands
@@ -358,12 +366,13 @@ var buildUpdateCmd = &cobra.Command{
 		}
 		setWorkers(b)
 		params := builder.UpdateParameters{
-			MinVersion:    buildFlags.minVersion,
-			Format:        buildFlags.format,
-			Publish:       !buildFlags.noPublish,
-			SkipSigning:   buildFlags.noSigning,
-			SkipFullfiles: buildFlags.skipFullfiles,
-			SkipPacks:     buildFlags.skipPacks,
+			MinVersion:     buildFlags.minVersion,
+			Format:         buildFlags.format,
+			Publish:        !buildFlags.noPublish,
+			SkipSigning:    buildFlags.noSigning,
+			SkipFullfiles:  buildFlags.skipFullfiles,
+			SkipPacks:      buildFlags.skipPacks,
+			ManifestDeltas: buildFlags.manifestDeltas,
 		}
 		err = b.BuildUpdate(params)
 		if err != nil {
@@ -404,12 +413,13 @@ var buildAllCmd = &cobra.Command{
 			failf("Couldn't build bundles: %s", err)
 		}
 		params := builder.UpdateParameters{
-			MinVersion:    buildFlags.minVersion,
-			Format:        buildFlags.format,
-			Publish:       !buildFlags.noPublish,
-			SkipSigning:   buildFlags.noSigning,
-			SkipFullfiles: buildFlags.skipFullfiles,
-			SkipPacks:     buildFlags.skipPacks,
+			MinVersion:     buildFlags.minVersion,
+			Format:         buildFlags.format,
+			Publish:        !buildFlags.noPublish,
+			SkipSigning:    buildFlags.noSigning,
+			SkipFullfiles:  buildFlags.skipFullfiles,
+			SkipPacks:      buildFlags.skipPacks,
+			ManifestDeltas: buildFlags.manifestDeltas,
 		}
 		err = b.BuildUpdate(params)
 		if err != nil {
@@ -467,6 +477,10 @@ each one to the current mix version, instead of --from use
 To change the target version (by default the current version), use the
 flag --to. The target version must be larger than the --from version.
 
+Use --verify to read back each pack created, check the staged files
+against the manifest hashes, apply the deltas to the original content
+and make sure no content needed by the update is missing from the pack.
+
 `,
 	RunE: runBuildDeltaPacks,
 }
@@ -476,6 +490,7 @@ var buildDeltaPacksFlags struct {
 	from             uint32
 	to               uint32
 	report           bool
+	verify           bool
 }
 
 func runBuildDeltaPacks(cmd *cobra.Command, args []string) error {
@@ -491,9 +506,9 @@ func runBuildDeltaPacks(cmd *cobra.Command, args []string) error {
 	}
 	setWorkers(b)
 	if fromChanged {
-		err = b.BuildDeltaPacks(buildDeltaPacksFlags.from, buildDeltaPacksFlags.to, buildDeltaPacksFlags.report)
+		err = b.BuildDeltaPacks(buildDeltaPacksFlags.from, buildDeltaPacksFlags.to, buildDeltaPacksFlags.report, buildDeltaPacksFlags.verify)
 	} else {
-		err = b.BuildDeltaPacksPreviousVersions(buildDeltaPacksFlags.previousVersions, buildDeltaPacksFlags.to, buildDeltaPacksFlags.report)
+		err = b.BuildDeltaPacksPreviousVersions(buildDeltaPacksFlags.previousVersions, buildDeltaPacksFlags.to, buildDeltaPacksFlags.report, buildDeltaPacksFlags.verify)
 	}
 	if err != nil {
 		fail(err)
@@ -509,6 +524,7 @@ func setUpdateFlags(cmd *cobra.Command) {
 	cmd.Flags().BoolVar(&buildFlags.noPublish, "no-publish", false, "Do not update the latest version after update")
 	cmd.Flags().BoolVar(&buildFlags.skipFullfiles, "skip-fullfiles", false, "Do not generate fullfiles")
 	cmd.Flags().BoolVar(&buildFlags.skipPacks, "skip-packs", false, "Do not generate zero packs")
+	cmd.Flags().IntVar(&buildFlags.manifestDeltas, "manifest-deltas", 0, "Generate deltas for the updated bundle manifests from this many previous versions")
 
 	var unusedStringFlag string
 	cmd.Flags().StringVar(&unusedStringFlag, "prefix", "", "Supply prefix for where the swupd binaries live")
@@ -542,6 +558,7 @@ func init() {
 	buildCmd.PersistentFlags().IntVar(&buildFlags.numFullfileWorkers, "fullfile-workers", 0, "Number of parallel workers when creating fullfiles, 0 means number of CPUs")
 	buildCmd.PersistentFlags().IntVar(&buildFlags.numDeltaWorkers, "delta-workers", 0, "Number of parallel workers when creating deltas, 0 means number of CPUs")
 	buildCmd.PersistentFlags().IntVar(&buildFlags.numBundleWorkers, "bundle-workers", 0, "Number of parallel workers when building bundles, 0 means number of CPUs")
+	buildCmd.PersistentFlags().IntVar(&buildFlags.numManifestWorkers, "manifest-workers", 0, "Number of parallel workers when creating manifests, 0 means number of CPUs")
 
 	RootCmd.AddCommand(buildCmd)
 
@@ -558,6 +575,7 @@ func init() {
 	buildDeltaPacksCmd.Flags().Uint32Var(&buildDeltaPacksFlags.previousVersions, "previous-versions", 0, "Generate packs for multiple previous versions")
 	buildDeltaPacksCmd.Flags().Uint32Var(&buildDeltaPacksFlags.to, "to", 0, "Generate packs targeting a specific version")
 	buildDeltaPacksCmd.Flags().BoolVar(&buildDeltaPacksFlags.report, "report", false, "Report reason each file in to manifest was packed or not")
+	buildDeltaPacksCmd.Flags().BoolVar(&buildDeltaPacksFlags.verify, "verify", false, "Read back each pack created and verify its contents")
 
 	setUpdateFlags(buildUpdateCmd)
 	setUpdateFlags(buildAllCmd)
@@ -570,8 +588,6 @@ func init() {
 	}
 	externalDeps[buildUpdateCmd] = []string{
 		"hardlink",
-		"openssl",
-		"xz",
 	}
 	externalDeps[buildImageCmd] = []string{
 		"ister.py",
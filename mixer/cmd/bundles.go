@@ -15,7 +15,10 @@
 package cmd
 
 import (
+	"os"
+
 	"github.com/clearlinux/mixer-tools/builder"
+	"github.com/clearlinux/mixer-tools/swupd"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -252,6 +255,50 @@ Passing '--all-local' will run validation on all bundles in local-bundles.`,
 	},
 }
 
+// Bundle size command ('mixer bundle size')
+type bundleSizeCmdFlags struct {
+	version uint32
+	largest int
+	json    bool
+}
+
+var bundleSizeFlags bundleSizeCmdFlags
+
+var bundleSizeCmd = &cobra.Command{
+	Use:   "size [<bundle>...]",
+	Short: "Report the size of bundles",
+	Long: `Reports the size of bundles in the update content of a version, by default
+the current mix version. Without arguments, all bundles of the version are
+reported. For each bundle the report has:
+
+  Installed  files and size of the bundle with all the bundles it includes
+  Unique     files and size of the bundle after subtracting its includes
+  Fullfiles  compressed size of the fullfiles of the unique files
+  Zero pack  size of the pack used to install the bundle from scratch
+
+followed by its largest files. Sizes are read from the fullfiles, so 'mixer
+build update' must have created them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+
+		sizes, err := b.BundleSizes(bundleSizeFlags.version, args, bundleSizeFlags.largest)
+		if err != nil {
+			fail(err)
+		}
+		if bundleSizeFlags.json {
+			err = swupd.WriteBundleSizesJSON(os.Stdout, sizes)
+		} else {
+			err = swupd.WriteBundleSizesText(os.Stdout, sizes)
+		}
+		if err != nil {
+			fail(err)
+		}
+	},
+}
+
 // List of all bundle commands
 var bundlesCmds = []*cobra.Command{
 	bundleAddCmd,
@@ -259,6 +306,7 @@ var bundlesCmds = []*cobra.Command{
 	bundleListCmd,
 	bundleEditCmd,
 	bundleValidateCmd,
+	bundleSizeCmd,
 }
 
 func init() {
@@ -284,4 +332,8 @@ func init() {
 
 	bundleValidateCmd.Flags().BoolVar(&bundleValidateFlags.allLocal, "all-local", false, "Validate all local bundles")
 	bundleValidateCmd.Flags().BoolVar(&bundleValidateFlags.strict, "strict", false, "Strict validation (see usage)")
+
+	bundleSizeCmd.Flags().Uint32Var(&bundleSizeFlags.version, "version", 0, "Version to report, instead of the current mix version")
+	bundleSizeCmd.Flags().IntVar(&bundleSizeFlags.largest, "largest", 10, "Number of largest files listed for each bundle")
+	bundleSizeCmd.Flags().BoolVar(&bundleSizeFlags.json, "json", false, "Print the report as JSON")
 }
@@ -0,0 +1,73 @@
+// Copyright © 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/clearlinux/mixer-tools/builder"
+	"github.com/spf13/cobra"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove update content not reachable from retained versions",
+	Long: `Remove update content not reachable from retained versions.
+
+The versions to retain are selected with --keep, a comma separated list
+of rules:
+
+  last:N     retain the N most recent versions
+  since:V    retain version V and all versions after it
+  V          retain version V
+
+The current mix version and the latest published version of each format
+are always retained. Everything reachable from a retained version is
+kept: its own directory, the bundle manifests and fullfiles referenced
+by its manifests, deltas between reachable files and packs from other
+retained versions. The rest of the content in the update directory is
+removed. Clients running versions that are not retained won't be able to
+use packs and deltas to update.
+
+Use --dry-run to only report the space that would be reclaimed.
+`,
+	Args: cobra.NoArgs,
+	Run:  runGC,
+}
+
+var gcFlags struct {
+	keep    string
+	dryRun  bool
+	verbose bool
+}
+
+func init() {
+	RootCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().StringVarP(&configFile, "config", "c", "", "Builder config to use")
+	gcCmd.Flags().StringVar(&gcFlags.keep, "keep", "", "Policy selecting the versions to retain (required)")
+	gcCmd.Flags().BoolVar(&gcFlags.dryRun, "dry-run", false, "Report reclaimable space without removing anything")
+	gcCmd.Flags().BoolVar(&gcFlags.verbose, "verbose", false, "List every file that is removed")
+	_ = gcCmd.MarkFlagRequired("keep")
+}
+
+func runGC(cmd *cobra.Command, args []string) {
+	b, err := builder.NewFromConfig(configFile)
+	if err != nil {
+		fail(err)
+	}
+	err = b.GarbageCollect(gcFlags.keep, gcFlags.dryRun, gcFlags.verbose)
+	if err != nil {
+		fail(err)
+	}
+}
@@ -76,7 +76,7 @@ var RootCmd = &cobra.Command{
 		}
 
 		networkCheck := true
-		noNetworkCmds := []string{"list", "edit", "validate", "convert", "set", "repo", "add-rpms"}
+		noNetworkCmds := []string{"list", "edit", "validate", "convert", "set", "repo", "add-rpms", "verify", "gc"}
 		// Don't reach out over network for these commands, it's not needed
 		for _, ignoreCmd := range noNetworkCmds {
 			if cmdContains(cmd, ignoreCmd) {
@@ -0,0 +1,117 @@
+// Copyright © 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/clearlinux/mixer-tools/builder"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify content generated by mixer",
+}
+
+var verifyUpdateCmd = &cobra.Command{
+	Use:   "update [version]",
+	Short: "Verify the update content published for a version",
+	Long: `Verify the update content in the www directory for a version, by
+default the current mix version. The following checks are performed:
+
+  signature   Manifest.MoM.sig is valid for the certificate in builder.conf
+  manifests   bundle manifests match the hashes in the Manifest.MoM
+  fullfiles   every file in Manifest.full has a fullfile with the right content
+  packs       packs of the version provide the files in the bundle manifests,
+              and their deltas apply to the expected content
+  pointers    the latest version of each format points to a valid Manifest.MoM
+
+Use --json to get a machine readable report. The command fails if any
+issue is found.
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runVerifyUpdate,
+}
+
+var verifyUpdateFlags struct {
+	json          bool
+	cert          string
+	skipSignature bool
+	skipFullfiles bool
+	skipPacks     bool
+	workers       int
+}
+
+func init() {
+	verifyCmd.AddCommand(verifyUpdateCmd)
+	RootCmd.AddCommand(verifyCmd)
+
+	verifyUpdateCmd.Flags().StringVarP(&configFile, "config", "c", "", "Builder config to use")
+	verifyUpdateCmd.Flags().BoolVar(&verifyUpdateFlags.json, "json", false, "Print the report as JSON")
+	verifyUpdateCmd.Flags().StringVar(&verifyUpdateFlags.cert, "cert", "", "Certificate used to verify the Manifest.MoM signature, instead of the one in builder.conf")
+	verifyUpdateCmd.Flags().BoolVar(&verifyUpdateFlags.skipSignature, "skip-signature", false, "Do not verify the Manifest.MoM signature")
+	verifyUpdateCmd.Flags().BoolVar(&verifyUpdateFlags.skipFullfiles, "skip-fullfiles", false, "Do not verify fullfiles")
+	verifyUpdateCmd.Flags().BoolVar(&verifyUpdateFlags.skipPacks, "skip-packs", false, "Do not verify packs")
+	verifyUpdateCmd.Flags().IntVar(&verifyUpdateFlags.workers, "workers", 0, "Number of parallel workers when verifying fullfiles, 0 means number of CPUs")
+}
+
+func runVerifyUpdate(cmd *cobra.Command, args []string) {
+	b, err := builder.NewFromConfig(configFile)
+	if err != nil {
+		fail(err)
+	}
+
+	var version uint32
+	if len(args) > 0 {
+		version, err = parseUint32(args[0])
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	opts := swupd.VerifyOptions{
+		SkipFullfiles: verifyUpdateFlags.skipFullfiles,
+		SkipPacks:     verifyUpdateFlags.skipPacks,
+		NumWorkers:    verifyUpdateFlags.workers,
+	}
+	if opts.NumWorkers < 1 {
+		opts.NumWorkers = runtime.NumCPU()
+	}
+	if !verifyUpdateFlags.skipSignature {
+		opts.Cert = verifyUpdateFlags.cert
+		if opts.Cert == "" {
+			opts.Cert = b.Config.Builder.Cert
+		}
+	}
+
+	report, err := b.VerifyUpdate(version, opts)
+	if err != nil {
+		fail(err)
+	}
+	if verifyUpdateFlags.json {
+		err = report.WriteJSON(os.Stdout)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fail(err)
+	}
+	if !report.OK() {
+		failf("verification of version %d found %d issues", report.Version, len(report.Issues))
+	}
+}
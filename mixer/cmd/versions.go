@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"os"
 	"strconv"
 
 	"github.com/clearlinux/mixer-tools/builder"
@@ -53,6 +54,34 @@ necessary. The increment can be configured with the --increment flag.
 	Run: runVersionsUpdate,
 }
 
+var versionsPlanMinVersionCmd = &cobra.Command{
+	Use:   "plan-minversion [version]",
+	Short: "Compare minversions for the next update",
+	Long: `Analyze the published update content up to a version, by default the
+latest one in the www directory, and report for each candidate minversion:
+
+  files      files older than the minversion, that get the new version
+  fullfiles  fullfiles re-issued for those files
+  re-issued  compressed size of those fullfiles
+  obsolete   deltas and packs from versions older than the minversion, that
+             clients can't use to reach the new version
+  size       size of those deltas and packs
+
+Every published version of the current format is a candidate. The recommended
+minversion is the highest one that re-issues at most --max-reissue percent of
+the size of all fullfiles. Pass it to 'mixer build update --min-version' to
+build the update content with it.
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runVersionsPlanMinVersion,
+}
+
+var versionsPlanMinVersionFlags struct {
+	maxReissue float64
+	json       bool
+	verbose    bool
+}
+
 var versionsUpdateFlags struct {
 	mixVersion      uint32
 	upstreamVersion string // Accepts "latest".
@@ -61,6 +90,7 @@ var versionsUpdateFlags struct {
 
 func init() {
 	versionsCmd.AddCommand(versionsUpdateCmd)
+	versionsCmd.AddCommand(versionsPlanMinVersionCmd)
 	RootCmd.AddCommand(versionsCmd)
 
 	versionsUpdateCmd.Flags().StringVarP(&configFile, "config", "c", "", "Builder config to use")
@@ -68,6 +98,11 @@ func init() {
 	versionsUpdateCmd.Flags().StringVar(&versionsUpdateFlags.upstreamVersion, "upstream-version", "", "Next upstream version (either version number or 'latest')")
 	versionsUpdateCmd.Flags().StringVar(&versionsUpdateFlags.upstreamVersion, "clear-version", "", "Alias to --upstream-version")
 	versionsUpdateCmd.Flags().Uint32Var(&versionsUpdateFlags.increment, "increment", 10, "Amount to increment current mix version")
+
+	versionsPlanMinVersionCmd.Flags().StringVarP(&configFile, "config", "c", "", "Builder config to use")
+	versionsPlanMinVersionCmd.Flags().Float64Var(&versionsPlanMinVersionFlags.maxReissue, "max-reissue", 10, "Maximum percent of the fullfile size re-issued by the recommended minversion")
+	versionsPlanMinVersionCmd.Flags().BoolVar(&versionsPlanMinVersionFlags.json, "json", false, "Print the plan as JSON")
+	versionsPlanMinVersionCmd.Flags().BoolVar(&versionsPlanMinVersionFlags.verbose, "verbose", false, "List the missing fullfiles and the deltas and packs made obsolete by each minversion")
 }
 
 func runVersions(cmd *cobra.Command, args []string) {
@@ -113,6 +148,39 @@ func runVersionsUpdate(cmd *cobra.Command, args []string) {
 	}
 }
 
+func runVersionsPlanMinVersion(cmd *cobra.Command, args []string) {
+	maxReissue := versionsPlanMinVersionFlags.maxReissue
+	if maxReissue < 0 || maxReissue > 100 {
+		failf("invalid --max-reissue %v, must be a percent between 0 and 100", maxReissue)
+	}
+
+	b, err := builder.NewFromConfig(configFile)
+	if err != nil {
+		fail(err)
+	}
+
+	var version uint32
+	if len(args) > 0 {
+		version, err = parseUint32(args[0])
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	plan, err := b.PlanMinVersion(version, maxReissue/100)
+	if err != nil {
+		fail(err)
+	}
+	if versionsPlanMinVersionFlags.json {
+		err = plan.WriteJSON(os.Stdout)
+	} else {
+		err = plan.WriteText(os.Stdout, versionsPlanMinVersionFlags.verbose)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
 func parseUint32(s string) (uint32, error) {
 	parsed, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
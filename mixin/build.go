@@ -204,8 +204,7 @@ func buildMix(prepNeeded bool) error {
 
 	cert := "/usr/share/ca-certs/Swupd_Root.pem"
 
-	err = helpers.RunCommandSilent("openssl", "smime", "-verify", "-in", "Manifest.MoM.sig",
-		"-inform", "der", "-content", "Manifest.MoM", "-CAfile", cert)
+	err = swupd.VerifySignatureFile("Manifest.MoM", "Manifest.MoM.sig", cert)
 	if err != nil {
 		_ = os.Remove(mixFlagFile)
 		return err
@@ -220,12 +219,10 @@ func buildMix(prepNeeded bool) error {
 	}
 
 	mixDir := filepath.Join(mixWS, fmt.Sprintf("update/www/%d", mixVer))
-	err = helpers.RunCommandSilent("openssl", "smime", "-sign", "-binary", "-in",
-		filepath.Join(mixDir, "Manifest.MoM"),
-		"-signer", filepath.Join(mixWS, "Swupd_Root.pem"),
-		"-inkey", filepath.Join(mixWS, "private.pem"),
-		"-outform", "DER",
-		"-out", filepath.Join(mixDir, "Manifest.MoM.sig"))
+	err = swupd.SignFile(filepath.Join(mixDir, "Manifest.MoM"),
+		filepath.Join(mixDir, "Manifest.MoM.sig"),
+		filepath.Join(mixWS, "Swupd_Root.pem"),
+		filepath.Join(mixWS, "private.pem"))
 	if err != nil {
 		_ = os.Remove(mixFlagFile)
 		return err
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/internal/client"
+)
+
+func usage() {
+	fmt.Printf(`swupd-apply updates a directory from one version of a swupd repository to another
+
+Usage:
+
+    swupd-apply [flags] https://.../update        BUNDLE...
+    swupd-apply [flags] /local/path/to/update/www BUNDLE...
+
+The program does what a swupd client does when updating the BUNDLEs
+installed in the -root directory from the -from version to the -to
+version: it reads the manifests, uses the packs when available,
+applies their deltas to the installed files and falls back to the
+fullfiles otherwise. Deleted files are removed, ghosted and state
+files are left alone, and config files changed locally are kept. At
+the end the files are verified against Manifest.full of the -to
+version.
+
+Use -from 0 (the default) to install the bundles in an empty root.
+This allows testing the update paths of a mix without booting a system
+with the swupd client, e.g.
+
+    swupd-apply -root root -to 10 update/www os-core editors
+    swupd-apply -root root -from 10 -to 20 update/www os-core editors
+
+Intermediate data is saved in a directory sibling to the root
+directory called "swupd-state" or a directory set with the -state
+flag.
+
+Flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+	log.SetFlags(0)
+
+	var (
+		rootDir  string
+		stateDir string
+		from     uint
+		to       uint
+		noPacks  bool
+		noCache  bool
+		verbose  bool
+		xattrs   bool
+	)
+
+	flag.StringVar(&rootDir, "root", "root", "directory where the bundles are installed")
+	flag.StringVar(&stateDir, "state", "", "directory to store intermediate files")
+	flag.UintVar(&from, "from", 0, "version installed in the root, 0 to install from scratch")
+	flag.UintVar(&to, "to", 0, "version to update to")
+	flag.BoolVar(&noPacks, "no-packs", false, "don't use packs, get all the content from fullfiles")
+	flag.BoolVar(&noCache, "no-cache", false, "don't use cached files, force downloads")
+	flag.BoolVar(&verbose, "v", false, "print extra messages")
+	flag.BoolVar(&xattrs, "xattrs", false, "include extended attributes in the hashes, for formats that have them")
+	flag.Usage = usage
+	flag.Parse()
+
+	if len(flag.Args()) < 2 || to == 0 {
+		usage()
+		return
+	}
+
+	if os.Getuid() != 0 {
+		log.Fatal("This program needs to run as root to write files with proper permissions.")
+	}
+
+	content := strings.TrimRight(flag.Arg(0), "/")
+	if _, err := strconv.ParseUint(filepath.Base(content), 10, 32); err == nil {
+		log.Fatalf("ERROR: %s looks like a version directory, pass the update content directory and use -to to select the version", content)
+	}
+	if stateDir == "" {
+		stateDir = filepath.Join(filepath.Dir(rootDir), "swupd-state")
+	}
+
+	state, err := client.NewState(stateDir, content)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	state.NoCache = noCache
+	state.Verbose = verbose
+	state.Xattrs = xattrs
+
+	fmt.Printf("» Updating %s from %d to %d\n", rootDir, from, to)
+	report, err := state.Apply(&client.ApplyOptions{
+		Root:    rootDir,
+		Bundles: flag.Args()[1:],
+		From:    uint32(from),
+		To:      uint32(to),
+		NoPacks: noPacks,
+	})
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	fmt.Printf(`
+  Bundles:          %s
+  Packs used:       %d
+  Deltas applied:   %d
+  Fullfiles used:   %d
+  Files installed:  %d
+  Files removed:    %d
+`, strings.Join(report.Bundles, " "), report.Packs, report.Deltas, report.Fullfiles, report.Installed, report.Removed)
+
+	for _, name := range report.KeptConfig {
+		fmt.Printf("! kept locally changed config file %s\n", name)
+	}
+	if len(report.Boot) > 0 {
+		fmt.Printf("! %d boot files updated, the bootloader was not updated\n", len(report.Boot))
+	}
+
+	if len(report.Problems) > 0 {
+		fmt.Printf("\n» Verification against Manifest.full FAILED, %d problems found:\n", len(report.Problems))
+		for _, p := range report.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("\n» Verified against Manifest.full\n")
+}
@@ -15,7 +15,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -38,7 +37,8 @@ The program downloads the content of a specific version in a swupd
 repository and extract the content of the specified bundles (groups of
 content). If no bundle is specified the program will list the bundles
 available. Bundles specified will automatically trigger the extraction
-of bundles that they include.
+of bundles that they include. With the -also-add flag, the optional
+bundles listed by them with also-add are extracted too.
 
 The program extracts the content to a directory called "output" or a
 directory set with the -output flag. Intermediate data is saved in a
@@ -57,6 +57,10 @@ case the version can be omitted so that the latest version is used:
 If not available locally, the certificate for Clear Linux is
 automatically downloaded and verified.
 
+Content created with extended attributes in the hashes (see
+XATTRS_FORMAT in builder.conf) must be extracted with the -xattrs flag,
+so the hashes of the files match the manifests.
+
 Flags:
 `)
 	flag.PrintDefaults()
@@ -79,6 +83,8 @@ func main() {
 		cert        string
 		noCache     bool
 		noOverwrite bool
+		xattrs      bool
+		alsoAdd     bool
 	)
 
 	flag.StringVar(&outputDir, "output", "output", "where to extract the files")
@@ -86,6 +92,8 @@ func main() {
 	flag.StringVar(&cert, "cert", "", "certificate used to verify content")
 	flag.BoolVar(&noCache, "no-cache", false, "don't use cached files, force downloads")
 	flag.BoolVar(&noOverwrite, "no-overwrite", false, "don't overwrite output files")
+	flag.BoolVar(&xattrs, "xattrs", false, "include extended attributes in the hashes, for formats that have them")
+	flag.BoolVar(&alsoAdd, "also-add", false, "also extract the optional bundles of the extracted bundles")
 	flag.Parse()
 
 	if os.Getuid() != 0 {
@@ -171,6 +179,7 @@ func main() {
 	}
 	state.NoCache = noCache
 	state.Verbose = true
+	state.Xattrs = xattrs
 
 	if mayDownloadClearLinuxCert {
 		if _, err = os.Stat(cert); err != nil {
@@ -213,7 +222,7 @@ func main() {
 		log.Fatalf("ERROR: %s", err)
 	}
 
-	err = verifySignature(momFile, momSig, cert)
+	err = swupd.VerifySignatureFile(momFile, momSig, cert)
 	if err != nil {
 		log.Fatalf("ERROR: couldn't verify Manifest.MoM: %s", err)
 	}
@@ -236,7 +245,7 @@ func main() {
 	}
 
 	requestedBundles := flag.Args()[1:]
-	bundleMap, err := resolveBundles(state, mom, requestedBundles)
+	bundleMap, err := resolveBundles(state, mom, requestedBundles, alsoAdd)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -276,7 +285,7 @@ func main() {
 	}
 }
 
-func resolveBundles(state *client.State, mom *swupd.Manifest, requested []string) (map[string]*swupd.Manifest, error) {
+func resolveBundles(state *client.State, mom *swupd.Manifest, requested []string, alsoAdd bool) (map[string]*swupd.Manifest, error) {
 	var includes []string
 
 	// Ignore requested duplicates.
@@ -290,6 +299,7 @@ func resolveBundles(state *client.State, mom *swupd.Manifest, requested []string
 
 	// Visit bundles and their included files. For the purposes of extracting, we
 	// don't care if there are cycles in the bundles, so don't validate that.
+	// Optional bundles are visited the same way when alsoAdd is set.
 	max := 0
 	bundles := make(map[string]*swupd.Manifest)
 	for len(includes) > 0 {
@@ -324,6 +334,11 @@ func resolveBundles(state *client.State, mom *swupd.Manifest, requested []string
 		for _, inc := range m.Header.Includes {
 			includes = append(includes, inc.Name)
 		}
+		if alsoAdd {
+			for _, opt := range m.Header.Optional {
+				includes = append(includes, opt.Name)
+			}
+		}
 		bundles[name] = m
 	}
 
@@ -369,7 +384,7 @@ func copyAllFiles(state *client.State, outputDir string, allFiles []*swupd.File,
 		}
 		if err == nil {
 			var hash string
-			hash, err = swupd.GetHashForFile(dst)
+			hash, err = swupd.GetHashForFileWithXattrs(dst, state.Xattrs)
 			if err != nil {
 				return err
 			}
@@ -396,6 +411,10 @@ func copyAllFiles(state *client.State, outputDir string, allFiles []*swupd.File,
 						return fmt.Errorf("couldn't fix ownership of existing file %s: %s", dst, err)
 					}
 				}
+				err = copyXattrs(dst, src)
+				if err != nil {
+					return fmt.Errorf("couldn't fix extended attributes of existing file %s: %s", dst, err)
+				}
 				continue
 			}
 
@@ -433,11 +452,25 @@ func copyAllFiles(state *client.State, outputDir string, allFiles []*swupd.File,
 		if err != nil {
 			return err
 		}
+		err = copyXattrs(dst, src)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// copyXattrs copies the extended attributes restored from the fullfile to the
+// extracted file.
+func copyXattrs(dst string, src string) error {
+	xattrs, err := swupd.ReadXattrs(src)
+	if err != nil {
+		return err
+	}
+	return swupd.WriteXattrs(dst, xattrs)
+}
+
 func copyFile(dst string, src string, srcFI os.FileInfo) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -478,25 +511,6 @@ func copyFile(dst string, src string, srcFI os.FileInfo) error {
 	return dstFile.Close()
 }
 
-func verifySignature(content, sig, cert string) error {
-	cmd := exec.Command(
-		"openssl", "smime", "-verify",
-		"-in", sig,
-		"-inform", "der",
-		"-content", content,
-		"-CAfile", cert,
-		"-purpose", "crlsign",
-	)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("%s\nsignature verification failed: %s\nCOMMAND LINE: %s", buf.Bytes(), err, strings.Join(cmd.Args, " "))
-	}
-	return nil
-}
-
 func findDefaultCert() string {
 	certInCurrentDir, err := filepath.Abs("Swupd_Root.pem")
 	if err != nil {
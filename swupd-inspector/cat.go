@@ -8,16 +8,19 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/clearlinux/mixer-tools/internal/client"
 	"github.com/clearlinux/mixer-tools/swupd"
 )
 
 // TODO: Support reading text files.
 
-func runCat(cacheDir, url, arg string) {
+type catFlags struct {
+	json bool
+}
+
+func runCat(cacheDir string, flags *catFlags, url, arg string) {
 	base, version := parseURL(url)
 	stateDir := filepath.Join(cacheDir, convertContentBaseToDirname(base))
-	state, err := client.NewState(stateDir, base)
+	state, err := newState(stateDir, base)
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -33,7 +36,7 @@ func runCat(cacheDir, url, arg string) {
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
-		err = copyFileToStdout(path)
+		err = printManifest(flags, path)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
@@ -55,7 +58,7 @@ func runCat(cacheDir, url, arg string) {
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
-		err = copyFileToStdout(path)
+		err = printManifest(flags, path)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
@@ -65,6 +68,19 @@ func runCat(cacheDir, url, arg string) {
 	}
 }
 
+// printManifest writes the manifest in path to stdout, converting it to JSON if
+// requested.
+func printManifest(flags *catFlags, path string) error {
+	if !flags.json {
+		return copyFileToStdout(path)
+	}
+	m, err := swupd.ParseManifestFile(path)
+	if err != nil {
+		return err
+	}
+	return m.WriteManifestJSON(os.Stdout)
+}
+
 func copyFileToStdout(src string) error {
 	srcF, err := os.Open(src)
 	if err != nil {
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"path/filepath"
-	"sort"
+	"strings"
 
 	"github.com/clearlinux/mixer-tools/internal/client"
 	"github.com/clearlinux/mixer-tools/swupd"
@@ -22,10 +26,16 @@ var (
 type diffFlags struct {
 	noColor bool
 	strict  bool
+	format  string
 }
 
 func runDiff(cacheDir string, flags *diffFlags, urlA, urlB string) {
-	if flags.noColor {
+	switch flags.format {
+	case "text", "json", "summary":
+	default:
+		log.Fatalf("ERROR: invalid output format %q, must be text, json or summary", flags.format)
+	}
+	if flags.noColor || flags.format != "text" {
 		RED = ""
 		GREEN = ""
 		RESET = ""
@@ -36,7 +46,7 @@ func runDiff(cacheDir string, flags *diffFlags, urlA, urlB string) {
 
 	var stateA, stateB *client.State
 	stateDirA := filepath.Join(cacheDir, convertContentBaseToDirname(baseA))
-	stateA, err := client.NewState(stateDirA, baseA)
+	stateA, err := newState(stateDirA, baseA)
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -49,13 +59,13 @@ func runDiff(cacheDir string, flags *diffFlags, urlA, urlB string) {
 			// This should be a rare case, if we hit this we should improve
 			// our normalization function.
 			stateDirB = stateDirB + "_other"
-			stateB, err = client.NewState(stateDirB, baseB)
+			stateB, err = newState(stateDirB, baseB)
 			if err != nil {
 				log.Fatalf("ERROR: %s", err)
 			}
 		}
 	} else {
-		stateB, err = client.NewState(stateDirB, baseB)
+		stateB, err = newState(stateDirB, baseB)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
@@ -70,184 +80,103 @@ func runDiff(cacheDir string, flags *diffFlags, urlA, urlB string) {
 		log.Fatalf("ERROR: %s", err)
 	}
 
-	fmt.Printf(`=== Differences from A to B
-
-  A Base:            %s
-  A Version:         %s
-  A State directory: %s
-
-  B Base:            %s
-  B Version:         %s
-  B State directory: %s
-
-`, baseA, versionA, stateDirA, baseB, versionB, stateDirB)
-
-	sortFiles(momA)
-	sortFiles(momB)
-
-	fmt.Println("=== Manifest.MoM")
-
-	type bundlePair struct {
-		Name string
-		A, B *swupd.File
+	opts := &swupd.DiffOptions{Versions: flags.strict}
+	momDiff, err := swupd.DiffManifests(momA, momB, opts)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
 	}
-	var bundles []*bundlePair
+	d := &swupd.Diff{MoM: momDiff}
 
 	// TODO: Check all them are manifests...
 
-	walkFiles(momA.Files, momB.Files, func(a, b *swupd.File) {
-		switch {
-		case a == nil:
-			fmt.Printf("%s+%s%s %s%s\n", GREEN, b.Type, b.Status, b.Name, RESET)
-		case b == nil:
-			fmt.Printf("%s-%s%s %s%s\n", RED, a.Type, a.Status, a.Name, RESET)
+	for _, c := range momDiff.Changes {
+		switch c.Kind {
+		case swupd.ChangeAdded, swupd.ChangeRemoved, swupd.ChangeContent:
 		default:
-			if a.Type != b.Type || a.Status != b.Status {
-				fmt.Printf("%s-%s%s %s%s\n", RED, a.Type, a.Status, a.Name, RESET)
-				fmt.Printf("%s+%s%s %s%s\n", RED, a.Type, a.Status, a.Name, RESET)
-			} else {
-				fmt.Printf(" %s%s %s", a.Type, a.Status, a.Name)
-				if flags.strict && a.Version != b.Version {
-					fmt.Printf(" (VERSION: %s-%d%s / %s+%d%s)", RED, a.Version, RESET, GREEN, b.Version, RESET)
-				}
-				if a.Hash != b.Hash {
-					pair := &bundlePair{
-						Name: a.Name,
-						A:    a,
-						B:    b,
-					}
-					bundles = append(bundles, pair)
-					fmt.Printf(" (HASH: %s-%s%s / %s+%s%s)", RED, a.Hash.String()[:7], RESET, GREEN, b.Hash.String()[:7], RESET)
-				}
-				fmt.Println()
+			continue
+		}
+		// Bundle manifests can be large, so read their entries without
+		// loading them all in memory.
+		var mA, mB *swupd.SortedManifestReader
+		if c.A != nil && c.A.Present() {
+			mA, err = openSortedBundleManifest(stateA, c.A)
+			if err != nil {
+				log.Fatalf("ERROR: %s", err)
 			}
 		}
-	})
-	fmt.Println()
-
-	flagString := func(f *swupd.File) string {
-		result, err := f.GetFlagString()
-		if err != nil {
-			result = "...."
+		if c.B != nil && c.B.Present() {
+			mB, err = openSortedBundleManifest(stateB, c.B)
+			if err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
 		}
-		return result[:3]
-	}
-
-	for _, pair := range bundles {
-		mA, err := stateA.GetBundleManifest(fmt.Sprint(pair.A.Version), pair.Name, "")
-		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+		bundleDiff, err := swupd.DiffSortedManifests(c.Name, mA, mB, opts)
+		if mA != nil {
+			_ = mA.Close()
+		}
+		if mB != nil {
+			_ = mB.Close()
 		}
-
-		mB, err := stateB.GetBundleManifest(fmt.Sprint(pair.B.Version), pair.Name, "")
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
+		d.Bundles = append(d.Bundles, bundleDiff)
+	}
 
-		fmt.Printf("=== Manifest.%s A=%d B=%d\n", pair.Name, mA.Header.Version, mB.Header.Version)
+	switch flags.format {
+	case "json":
+		err = d.WriteJSON(os.Stdout)
+	case "summary":
+		err = d.WritePatchSummary(os.Stdout)
+	default:
+		fmt.Printf(`=== Differences from A to B
 
-		var extraIncludesA, extraIncludesB []string
-		{
-			includesA := map[string]bool{}
-			for _, inc := range mA.Header.Includes {
-				includesA[inc.Name] = true
-			}
-			includesB := map[string]bool{}
-			for _, inc := range mB.Header.Includes {
-				includesB[inc.Name] = true
-			}
-			for name := range includesA {
-				if !includesB[name] {
-					extraIncludesA = append(extraIncludesA, name)
-				}
-			}
-			for name := range includesB {
-				if !includesA[name] {
-					extraIncludesB = append(extraIncludesB, name)
-				}
-			}
-		}
+  A Base:            %s
+  A Version:         %s
+  A State directory: %s
 
-		if mA.Header.FileCount != mB.Header.FileCount {
-			fmt.Printf("%s-filecount: %d%s\n", RED, mA.Header.FileCount, RESET)
-			fmt.Printf("%s+filecount: %d%s\n", GREEN, mB.Header.FileCount, RESET)
-		}
-		// TODO: Compare ContentSize?
+  B Base:            %s
+  B Version:         %s
+  B State directory: %s
 
-		for _, name := range extraIncludesA {
-			fmt.Printf("%s-includes: %s%s\n", RED, name, RESET)
-		}
-		for _, name := range extraIncludesB {
-			fmt.Printf("%s+includes: %s%s\n", GREEN, name, RESET)
+`, baseA, versionA, stateDirA, baseB, versionB, stateDirB)
+		var text bytes.Buffer
+		err = d.WriteText(&text)
+		if err == nil {
+			err = writeColored(os.Stdout, &text)
 		}
-
-		// TODO: Move sort files to walker?
-		sortFiles(mA)
-		sortFiles(mB)
-		walkFiles(mA.Files, mB.Files, func(a, b *swupd.File) {
-			switch {
-			case a == nil:
-				fmt.Printf("%s+%s %s%s\n", GREEN, flagString(b), b.Name, RESET)
-			case b == nil:
-				fmt.Printf("%s-%s %s%s\n", RED, flagString(a), a.Name, RESET)
-			default:
-				if flagString(a) != flagString(b) {
-					fmt.Printf("%s-%s %s%s\n", RED, flagString(a), a.Name, RESET)
-					fmt.Printf("%s+%s %s%s\n", GREEN, flagString(b), b.Name, RESET)
-				} else if a.Rename != b.Rename || a.Hash != b.Hash || (flags.strict && a.Version != b.Version) {
-					fmt.Printf(" %s %s", flagString(a), a.Name)
-					if flags.strict && a.Version != b.Version {
-						fmt.Printf(" (VERSION: %s-%d%s / %s+%d%s)", RED, a.Version, RESET, GREEN, b.Version, RESET)
-					}
-					if a.Rename != b.Rename {
-						fmt.Printf(" (RENAME: %s-%d%s / %s+%d%s)", RED, a.Rename, RESET, GREEN, b.Rename, RESET)
-					}
-					if a.Hash != b.Hash {
-						fmt.Printf(" (HASH: %s-%s%s / %s+%s%s)", RED, a.Hash.String()[:7], RESET, GREEN, b.Hash.String()[:7], RESET)
-					}
-					fmt.Println()
-				}
-			}
-		})
-		fmt.Println()
 	}
-
-	// TODO: Print number of mismatches, new files in B and missing files in A.
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
 }
 
-func walkFiles(filesA, filesB []*swupd.File, fn func(a, b *swupd.File)) {
-	indexA := 0
-	indexB := 0
-	for indexA < len(filesA) && indexB < len(filesB) {
-		fileA := filesA[indexA]
-		fileB := filesB[indexB]
+// writeColored copies the text output of a diff, coloring the lines for added
+// and removed content.
+func writeColored(w io.Writer, text io.Reader) error {
+	scanner := bufio.NewScanner(text)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var err error
 		switch {
-		case fileA.Name < fileB.Name:
-			indexA++
-			fn(fileA, nil)
-		case fileA.Name > fileB.Name:
-			indexB++
-			fn(nil, fileB)
-		case fileA.Name == fileB.Name:
-			indexA++
-			indexB++
-			fn(fileA, fileB)
+		case strings.HasPrefix(line, "+"):
+			_, err = fmt.Fprintf(w, "%s%s%s\n", GREEN, line, RESET)
+		case strings.HasPrefix(line, "-"):
+			_, err = fmt.Fprintf(w, "%s%s%s\n", RED, line, RESET)
+		default:
+			_, err = fmt.Fprintln(w, line)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	for indexA < len(filesA) {
-		fileA := filesA[indexA]
-		indexA++
-		fn(fileA, nil)
-	}
-	for indexB < len(filesB) {
-		fileB := filesB[indexB]
-		indexB++
-		fn(nil, fileB)
-	}
+	return scanner.Err()
 }
 
-func sortFiles(m *swupd.Manifest) {
-	sort.Slice(m.Files, func(i, j int) bool {
-		return m.Files[i].Name < m.Files[j].Name
-	})
+func openSortedBundleManifest(state *client.State, bundle *swupd.File) (*swupd.SortedManifestReader, error) {
+	path, err := state.GetFile(fmt.Sprint(bundle.Version), "Manifest."+bundle.Name)
+	if err != nil {
+		return nil, err
+	}
+	return swupd.OpenSortedManifest(path)
 }
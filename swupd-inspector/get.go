@@ -15,7 +15,7 @@ import (
 func runGet(cacheDir, url, arg string) {
 	base, version := parseURL(url)
 	stateDir := filepath.Join(cacheDir, convertContentBaseToDirname(base))
-	state, err := client.NewState(stateDir, base)
+	state, err := newState(stateDir, base)
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -107,18 +107,11 @@ func runGet(cacheDir, url, arg string) {
 }
 
 func visitAllFiles(state *client.State, mom *swupd.Manifest, visitFunc func(bundle, file *swupd.File) bool) error {
-	var stop bool
 	for _, bundleF := range mom.Files {
-		bundle, err := state.GetBundleManifest(fmt.Sprint(bundleF.Version), bundleF.Name, "")
+		stop, err := visitBundleFiles(state, bundleF, visitFunc)
 		if err != nil {
 			return err
 		}
-		for _, f := range bundle.Files {
-			if visitFunc(bundleF, f) {
-				stop = true
-				break
-			}
-		}
 		if stop {
 			break
 		}
@@ -126,6 +119,40 @@ func visitAllFiles(state *client.State, mom *swupd.Manifest, visitFunc func(bund
 	return nil
 }
 
+// visitBundleFiles calls visitFunc for each file in the bundle manifest, reading
+// them one at a time instead of loading the whole manifest. Returns true if
+// visitFunc stopped the iteration.
+func visitBundleFiles(state *client.State, bundleF *swupd.File, visitFunc func(bundle, file *swupd.File) bool) (bool, error) {
+	path, err := state.GetFile(fmt.Sprint(bundleF.Version), "Manifest."+bundleF.Name)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	mr, err := swupd.NewManifestReader(f)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse bundle manifest file %s: %s", path, err)
+	}
+	for {
+		file, err := mr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("couldn't parse bundle manifest file %s: %s", path, err)
+		}
+		if visitFunc(bundleF, file) {
+			return true, nil
+		}
+	}
+}
+
 func downloadFullfile(state *client.State, file *swupd.File) error {
 	fullfile := file.Hash.String() + ".tar"
 	f, err := state.GetFile(fmt.Sprint(file.Version), "files", fullfile)
@@ -14,7 +14,7 @@ import (
 func runLog(cacheDir, url, filename string) {
 	base, version := parseURL(url)
 	stateDir := filepath.Join(cacheDir, convertContentBaseToDirname(base))
-	state, err := client.NewState(stateDir, base)
+	state, err := newState(stateDir, base)
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -94,14 +94,6 @@ func runLog(cacheDir, url, filename string) {
 }
 
 func visitFilesInBundle(state *client.State, bundleFile *swupd.File, visitFunc func(bundle, file *swupd.File) bool) error {
-	bundle, err := state.GetBundleManifest(fmt.Sprint(bundleFile.Version), bundleFile.Name, "")
-	if err != nil {
-		return err
-	}
-	for _, f := range bundle.Files {
-		if visitFunc(bundleFile, f) {
-			break
-		}
-	}
-	return nil
+	_, err := visitBundleFiles(state, bundleFile, visitFunc)
+	return err
 }
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/clearlinux/mixer-tools/internal/client"
 	"github.com/spf13/cobra"
 )
 
@@ -51,8 +52,12 @@ It is possible to refer to content by aliases. The alias 'clear' works
 by default, so clear/20520 refer to the same as the URL above. Other
 aliases can be defined in $HOME/.config/swupd-inspector/aliases in the
 format ALIAS=URL per line.
+
+Use --cert to verify the signature of every Manifest.MoM read against
+the given certificate.
 `,
 	}
+	rootCmd.PersistentFlags().StringVar(&certFile, "cert", "", "certificate used to verify Manifest.MoM signatures")
 
 	diffFlags := &diffFlags{}
 	diffCmd := &cobra.Command{
@@ -63,6 +68,13 @@ format ALIAS=URL per line.
 The filenames and flags will be compared, recursing to the
 bundles. Use --strict to also compare the version numbers of the
 files. Use --no-color to not emit escape codes in the output.
+
+Use --format to select the output: "text" (default), "json" or
+"summary", which prints one line per change with the manifest name,
+a letter for the kind of change and the file name, separated by tabs.
+The letters are A (added), D (removed), M (content changed), F (flags
+changed), R (renamed, followed by old and new names), T (type changed)
+and V (version changed, only with --strict).
 `,
 		Args: cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
@@ -71,6 +83,7 @@ files. Use --no-color to not emit escape codes in the output.
 	}
 	diffCmd.Flags().BoolVar(&diffFlags.noColor, "no-color", false, "disable colored output")
 	diffCmd.Flags().BoolVar(&diffFlags.strict, "strict", false, "compare version numbers of files")
+	diffCmd.Flags().StringVar(&diffFlags.format, "format", "text", "output format: text, json or summary")
 	rootCmd.AddCommand(diffCmd)
 
 	getCmd := &cobra.Command{
@@ -107,16 +120,60 @@ Different types of content can be downloaded:
 	}
 	rootCmd.AddCommand(cleanCmd)
 
+	catFlags := &catFlags{}
 	catCmd := &cobra.Command{
 		Use:   "cat [flags] URL Manifest.NAME",
 		Short: "Print the contents of a Manifest",
-		Args:  cobra.ExactArgs(2),
+		Long: `Print the contents of a Manifest.
+
+Use --json to print the Manifest in the JSON representation described
+by swupd.ManifestJSONSchema instead of the text format.
+`,
+		Args: cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
-			runCat(cacheDir, args[0], args[1])
+			runCat(cacheDir, catFlags, args[0], args[1])
 		},
 	}
+	catCmd.Flags().BoolVar(&catFlags.json, "json", false, "print the manifest as JSON")
 	rootCmd.AddCommand(catCmd)
 
+	packCmd := &cobra.Command{
+		Use:   "pack URL BUNDLE FROM",
+		Short: "List and verify the pack of a bundle",
+		Long: `List and verify the pack of a bundle.
+
+The pack used by a client to update BUNDLE from version FROM to the
+version in URL is downloaded and its staged files and deltas are
+listed. Staged files are checked against the hashes in the bundle
+manifest, deltas are applied to the fullfiles of the FROM version and
+the result checked. Content missing from the pack or not in the
+manifest is also reported. Use 0 as FROM to check the zero pack.
+`,
+		Args: cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			runPack(cacheDir, args[0], args[1], args[2])
+		},
+	}
+	rootCmd.AddCommand(packCmd)
+
+	manifestDeltaCmd := &cobra.Command{
+		Use:   "manifest-delta URL BUNDLE FROM",
+		Short: "Verify the manifest delta of a bundle",
+		Long: `Verify the manifest delta of a bundle.
+
+The manifest delta used by a client to update the manifest of BUNDLE
+from version FROM to the version in URL is downloaded and applied to
+the manifest of the FROM version. The result is checked against the
+hash in Manifest.MoM and cached, so other commands use it instead of
+downloading the full manifest.
+`,
+		Args: cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			runManifestDelta(cacheDir, args[0], args[1], args[2])
+		},
+	}
+	rootCmd.AddCommand(manifestDeltaCmd)
+
 	logCmd := &cobra.Command{
 		Use:   "log [flags] URL FILENAME",
 		Short: "Print FILENAME version and all previous versions",
@@ -130,6 +187,18 @@ Different types of content can be downloaded:
 	_ = rootCmd.Execute()
 }
 
+// certFile is the certificate used to verify the Manifest.MoM, if set.
+var certFile string
+
+func newState(stateDir, baseContent string) (*client.State, error) {
+	state, err := client.NewState(stateDir, baseContent)
+	if err != nil {
+		return nil, err
+	}
+	state.Cert = certFile
+	return state, nil
+}
+
 var aliases = map[string]string{
 	"clear": "https://cdn.download.clearlinux.org/update",
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+func runManifestDelta(cacheDir, url, bundle, fromArg string) {
+	base, version := parseURL(url)
+	stateDir := filepath.Join(cacheDir, convertContentBaseToDirname(base))
+	state, err := newState(stateDir, base)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	from, err := strconv.ParseUint(fromArg, 10, 32)
+	if err != nil || from == 0 {
+		log.Fatalf("ERROR: invalid from version %q", fromArg)
+	}
+
+	mom, err := state.GetMoM(version)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	toBundle := findBundle(mom, bundle)
+	if toBundle == nil {
+		log.Fatalf("ERROR: Manifest.MoM for version %s doesn't have a bundle named %s", version, bundle)
+	}
+
+	// Like packs, manifest deltas are named after the version of the
+	// manifest the client has.
+	fromMoM, err := state.GetMoM(fmt.Sprint(from))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	fromBundle := findBundle(fromMoM, bundle)
+	if fromBundle == nil {
+		log.Fatalf("ERROR: Manifest.MoM for version %d doesn't have a bundle named %s", from, bundle)
+	}
+	if fromBundle.Version == toBundle.Version {
+		log.Fatalf("ERROR: bundle %s didn't change between versions %d and %s, no manifest delta needed", bundle, from, version)
+	}
+
+	m, err := state.GetBundleManifestDelta(fmt.Sprint(fromBundle.Version), fmt.Sprint(toBundle.Version), bundle, toBundle.Hash.String())
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	deltaName := swupd.ManifestDeltaName(bundle, fromBundle.Version)
+	fmt.Printf("%s/%d/%s\n", base, toBundle.Version, deltaName)
+	if path, err := state.GetFile(fmt.Sprint(toBundle.Version), deltaName); err == nil {
+		if fi, err := os.Stat(path); err == nil {
+			fmt.Printf("  size     %d bytes\n", fi.Size())
+		}
+	}
+	fmt.Printf("  from     Manifest.%s version %d\n", bundle, fromBundle.Version)
+	fmt.Printf("  to       Manifest.%s version %d (%d files)\n", bundle, m.Header.Version, len(m.Files))
+	fmt.Printf("\nManifest delta OK: result matches hash %s in Manifest.MoM\n", toBundle.Hash)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+func runPack(cacheDir, url, bundle, fromArg string) {
+	base, version := parseURL(url)
+	stateDir := filepath.Join(cacheDir, convertContentBaseToDirname(base))
+	state, err := newState(stateDir, base)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	from, err := strconv.ParseUint(fromArg, 10, 32)
+	if err != nil {
+		log.Fatalf("ERROR: invalid from version %q: %s", fromArg, err)
+	}
+
+	mom, err := state.GetMoM(version)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	toBundle := findBundle(mom, bundle)
+	if toBundle == nil {
+		log.Fatalf("ERROR: Manifest.MoM for version %s doesn't have a bundle named %s", version, bundle)
+	}
+	toM, err := state.GetBundleManifest(fmt.Sprint(toBundle.Version), bundle, "")
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	// Packs are named after the version of the bundle the client has, a
+	// bundle not in the from version is updated with the zero pack.
+	var fromM *swupd.Manifest
+	if from > 0 {
+		fromMoM, err := state.GetMoM(fmt.Sprint(from))
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		if fromBundle := findBundle(fromMoM, bundle); fromBundle != nil {
+			fromM, err = state.GetBundleManifest(fmt.Sprint(fromBundle.Version), bundle, "")
+			if err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+		}
+	}
+	var fromVersion uint32
+	if fromM != nil {
+		fromVersion = fromM.Header.Version
+	}
+	if fromVersion == toBundle.Version {
+		log.Fatalf("ERROR: bundle %s didn't change between versions %d and %s, no pack needed", bundle, from, version)
+	}
+
+	packName := swupd.GetPackFilename(bundle, fromVersion)
+	path, err := state.GetFile(fmt.Sprint(toBundle.Version), packName)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	report, err := swupd.VerifyPack(f, fromM, toM, &swupd.VerifyPackOptions{
+		GetFullfile: func(version uint32, hash swupd.Hashval) (string, error) {
+			return state.GetFile(fmt.Sprint(version), "files", hash.String()+".tar")
+		},
+	})
+	if err != nil {
+		log.Fatalf("ERROR: couldn't read %s: %s", packName, err)
+	}
+
+	names := make(map[swupd.Hashval]string)
+	for _, f := range toM.Files {
+		if _, ok := names[f.Hash]; !ok {
+			names[f.Hash] = f.Name
+		}
+	}
+
+	fmt.Printf("%s/%d/%s\n", base, toBundle.Version, packName)
+	for _, item := range report.Items {
+		switch item.Type {
+		case swupd.PackItemDelta:
+			fmt.Printf("  delta  %s %s (from %s in version %d)\n", item.Hash, names[item.Hash], item.FromHash, item.FromVersion)
+		default:
+			fmt.Printf("  staged %s %s\n", item.Hash, names[item.Hash])
+		}
+	}
+
+	problems := report.Problems()
+	if len(problems) > 0 {
+		fmt.Printf("\n%d problems found:\n", len(problems))
+		for _, p := range problems {
+			fmt.Printf("  %s\n", p)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("\nPack OK: %d entries\n", len(report.Items))
+}
+
+func findBundle(mom *swupd.Manifest, name string) *swupd.File {
+	for _, f := range mom.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
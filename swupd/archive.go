@@ -2,11 +2,15 @@ package swupd
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
 	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
 // CompressedTarReader is a tar.Reader that also wraps the uncompression Reader.
@@ -29,43 +33,46 @@ var (
 	gzipMagic  = []byte{0x1F, 0x8B}
 	xzMagic    = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
 	bzip2Magic = []byte{'B', 'Z', 'h'}
+	zstdMagic  = []byte{0x28, 0xB5, 0x2F, 0xFD}
 )
 
 // NewCompressedTarReader creates a struct compatible with tar.Reader reading from uncompressed or
-// compressed input. Compressed input type is guessed based on the magic on the input.
-func NewCompressedTarReader(rs io.ReadSeeker) (*CompressedTarReader, error) {
-	var h [6]byte
-	_, err := rs.Read(h[:])
-	if err != nil {
-		return nil, err
-	}
-	_, err = rs.Seek(0, io.SeekStart)
-	if err != nil {
+// compressed input. Compressed input type is guessed based on the magic on the input, so the
+// input doesn't need to be seekable.
+func NewCompressedTarReader(r io.Reader) (*CompressedTarReader, error) {
+	br := bufio.NewReader(r)
+	h, err := br.Peek(6)
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 	result := &CompressedTarReader{}
 
 	switch {
-	case bytes.HasPrefix(h[:], gzipMagic):
-		gr, err := gzip.NewReader(rs)
+	case bytes.HasPrefix(h, gzipMagic):
+		gr, err := gzip.NewReader(br)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't decompress using gzip: %s", err)
 		}
 		result.CompressionCloser = gr
 		result.Reader = tar.NewReader(gr)
-	case bytes.HasPrefix(h[:], xzMagic):
-		xr, err := NewExternalReader(rs, "unxz")
+	case bytes.HasPrefix(h, xzMagic):
+		xr, err := xz.NewReader(br)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't decompress using xz: %s", err)
 		}
-		result.CompressionCloser = xr
 		result.Reader = tar.NewReader(xr)
-	case bytes.HasPrefix(h[:], bzip2Magic):
-		br := bzip2.NewReader(rs)
-		result.Reader = tar.NewReader(br)
+	case bytes.HasPrefix(h, bzip2Magic):
+		result.Reader = tar.NewReader(bzip2.NewReader(br))
+	case bytes.HasPrefix(h, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress using zstd: %s", err)
+		}
+		result.CompressionCloser = zr.IOReadCloser()
+		result.Reader = tar.NewReader(zr)
 	default:
 		// Assume uncompressed tar and let it complain if not valid.
-		result.Reader = tar.NewReader(rs)
+		result.Reader = tar.NewReader(br)
 	}
 	return result, nil
 }
@@ -0,0 +1,653 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ulikunitz/xz"
+)
+
+// This file implements the bsdiff algorithm by Colin Percival, producing the
+// delta format written by the bsdiff tool used by swupd (the Clear Linux
+// fork). A delta file is
+//
+//     offset  size  contents
+//     0       8     magic "BSDIFF4" followed by format byte '2'
+//     8       8     length of encoded control block
+//     16      8     length of encoded diff block
+//     24      8     length of encoded extra block
+//     32      8     size of the new file
+//     40      8     st_mode of the new file
+//     48      4     st_uid of the new file
+//     52      4     st_gid of the new file
+//     56      1     encoding of control block
+//     57      1     encoding of diff block
+//     58      1     encoding of extra block
+//     59      ...   control block, diff block, extra block
+//
+// All header integers are little endian. The control block is a sequence of
+// triples (diff length, extra length, seek in old file), each value stored in
+// 8 bytes as sign and magnitude, the same way the original bsdiff does.
+//
+// The patching side also accepts the original "BSDIFF40" format, which has a
+// 32 byte header and bzip2 encoded blocks.
+
+var (
+	bsdiffMagic       = []byte("BSDIFF42")
+	bsdiffLegacyMagic = []byte("BSDIFF40")
+)
+
+const (
+	bsdiffHeaderSize       = 59
+	bsdiffLegacyHeaderSize = 32
+)
+
+// Encodings for the blocks of a delta file.
+const (
+	bsdiffEncNone  byte = 0
+	bsdiffEncBzip2 byte = 1
+	bsdiffEncGzip  byte = 2
+	bsdiffEncXz    byte = 3
+	bsdiffEncZeros byte = 4
+)
+
+var (
+	// errDeltaNotWorth is returned when the delta would not be smaller than
+	// downloading the new file, equivalent to the FULLDL result of bsdiff.
+	errDeltaNotWorth = errors.New("delta is not worth, use fullfile")
+
+	// errDeltaBudget is returned when the delta computation would need more
+	// memory or time than allowed.
+	errDeltaBudget = errors.New("delta exceeds resource budget")
+)
+
+// bspatchMaxSize is the largest file bspatch creates. The whole new file is
+// kept in memory while the delta is applied, so a larger size in the header is
+// treated as a corrupt delta instead of being allocated. It is independent of
+// the limits used to create deltas, since deltas may come from other tools.
+const bspatchMaxSize = 4 << 30
+
+// bsdiffLimits bounds the resources used to compute a single delta. Zero values
+// mean no limit.
+type bsdiffLimits struct {
+	// MaxMemory is the approximate maximum amount of memory, in bytes, used
+	// by the suffix sorting and the output blocks.
+	MaxMemory int64
+
+	// Timeout is the maximum amount of time used computing the delta.
+	Timeout time.Duration
+}
+
+// bsdiffFileInfo is the metadata of the new file stored in the delta header.
+type bsdiffFileInfo struct {
+	Mode uint32
+	UID  uint32
+	GID  uint32
+	Size int64
+}
+
+// bsdiffMemoryEstimate returns approximately how much memory is needed to
+// compute the delta between files of oldSize and newSize.
+func bsdiffMemoryEstimate(oldSize, newSize int64) int64 {
+	// Suffix array and inverse (int32 each), old and new contents, diff and
+	// extra blocks, plus the encoded candidates for them.
+	return 8*(oldSize+1) + oldSize + 5*newSize
+}
+
+// bsdiff computes a delta that transforms old into new, and writes it to w. If
+// the delta is not smaller than new, errDeltaNotWorth is returned and nothing is
+// written.
+func bsdiff(w io.Writer, old, new []byte, info *bsdiffFileInfo, limits bsdiffLimits) error {
+	if limits.MaxMemory > 0 && bsdiffMemoryEstimate(int64(len(old)), int64(len(new))) > limits.MaxMemory {
+		return errDeltaBudget
+	}
+	if int64(len(old)) >= 1<<31-1 {
+		return errDeltaBudget
+	}
+
+	var deadline time.Time
+	if limits.Timeout > 0 {
+		deadline = time.Now().Add(limits.Timeout)
+	}
+
+	I := make([]int32, len(old)+1)
+	V := make([]int32, len(old)+1)
+	qsufsort(I, V, old)
+	V = nil
+
+	var ctrl bytes.Buffer
+	db := make([]byte, 0, len(new))
+	eb := make([]byte, 0)
+
+	var scan, pos, length int
+	var lastscan, lastpos, lastoffset int
+	var iterations int
+
+	for scan < len(new) {
+		oldscore := 0
+
+		scsc := scan + length
+		for scan += length; scan < len(new); scan++ {
+			iterations++
+			if !deadline.IsZero() && iterations%1024 == 0 && time.Now().After(deadline) {
+				return errDeltaBudget
+			}
+
+			pos, length = search(I, old, new[scan:])
+
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastoffset < len(old) && old[scsc+lastoffset] == new[scsc] {
+					oldscore++
+				}
+			}
+
+			if (length == oldscore && length != 0) || length > oldscore+8 {
+				break
+			}
+
+			if scan+lastoffset < len(old) && old[scan+lastoffset] == new[scan] {
+				oldscore--
+			}
+		}
+
+		if length == oldscore && scan != len(new) {
+			continue
+		}
+
+		var s, sf, lenf int
+		for i := 0; lastscan+i < scan && lastpos+i < len(old); {
+			if old[lastpos+i] == new[lastscan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf = s
+				lenf = i
+			}
+		}
+
+		lenb := 0
+		if scan < len(new) {
+			var s, sb int
+			for i := 1; scan >= lastscan+i && pos >= i; i++ {
+				if old[pos-i] == new[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb = s
+					lenb = i
+				}
+			}
+		}
+
+		if lastscan+lenf > scan-lenb {
+			overlap := (lastscan + lenf) - (scan - lenb)
+			var s, ss, lens int
+			for i := 0; i < overlap; i++ {
+				if new[lastscan+lenf-overlap+i] == old[lastpos+lenf-overlap+i] {
+					s++
+				}
+				if new[scan-lenb+i] == old[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss = s
+					lens = i + 1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		for i := 0; i < lenf; i++ {
+			db = append(db, new[lastscan+i]-old[lastpos+i])
+		}
+		eb = append(eb, new[lastscan+lenf:scan-lenb]...)
+
+		writeOfft(&ctrl, int64(lenf))
+		writeOfft(&ctrl, int64((scan-lenb)-(lastscan+lenf)))
+		writeOfft(&ctrl, int64((pos-lenb)-(lastpos+lenf)))
+
+		lastscan = scan - lenb
+		lastpos = pos - lenb
+		lastoffset = pos - scan
+	}
+
+	ctrlEnc, ctrlBlock, err := encodeBsdiffBlock(ctrl.Bytes())
+	if err != nil {
+		return err
+	}
+	diffEnc, diffBlock, err := encodeBsdiffBlock(db)
+	if err != nil {
+		return err
+	}
+	extraEnc, extraBlock, err := encodeBsdiffBlock(eb)
+	if err != nil {
+		return err
+	}
+
+	total := bsdiffHeaderSize + len(ctrlBlock) + len(diffBlock) + len(extraBlock)
+	if total >= len(new) {
+		return errDeltaNotWorth
+	}
+
+	header := make([]byte, bsdiffHeaderSize)
+	copy(header, bsdiffMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(ctrlBlock)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(diffBlock)))
+	binary.LittleEndian.PutUint64(header[24:], uint64(len(extraBlock)))
+	binary.LittleEndian.PutUint64(header[32:], uint64(len(new)))
+	binary.LittleEndian.PutUint64(header[40:], uint64(info.Mode))
+	binary.LittleEndian.PutUint32(header[48:], info.UID)
+	binary.LittleEndian.PutUint32(header[52:], info.GID)
+	header[56] = ctrlEnc
+	header[57] = diffEnc
+	header[58] = extraEnc
+
+	for _, b := range [][]byte{header, ctrlBlock, diffBlock, extraBlock} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeBsdiffBlock picks the smallest encoding for a block.
+func encodeBsdiffBlock(block []byte) (byte, []byte, error) {
+	allZeros := true
+	for _, b := range block {
+		if b != 0 {
+			allZeros = false
+			break
+		}
+	}
+	if allZeros {
+		// Only the size of the block is needed, and it can be derived from
+		// the control block.
+		return bsdiffEncZeros, nil, nil
+	}
+
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err = gw.Write(block); err != nil {
+		return 0, nil, err
+	}
+	if err = gw.Close(); err != nil {
+		return 0, nil, err
+	}
+	if buf.Len() < len(block) {
+		return bsdiffEncGzip, buf.Bytes(), nil
+	}
+	return bsdiffEncNone, block, nil
+}
+
+// bspatch applies delta to old, returning the new file contents and the file
+// metadata stored in the delta.
+func bspatch(old, delta []byte) ([]byte, *bsdiffFileInfo, error) {
+	var ctrlLen, diffLen, extraLen, newSize int64
+	var encs [3]byte
+	var hdrSize int
+	info := &bsdiffFileInfo{}
+
+	switch {
+	case len(delta) >= bsdiffHeaderSize && bytes.Equal(delta[:8], bsdiffMagic):
+		hdrSize = bsdiffHeaderSize
+		ctrlLen = int64(binary.LittleEndian.Uint64(delta[8:]))
+		diffLen = int64(binary.LittleEndian.Uint64(delta[16:]))
+		extraLen = int64(binary.LittleEndian.Uint64(delta[24:]))
+		newSize = int64(binary.LittleEndian.Uint64(delta[32:]))
+		info.Mode = uint32(binary.LittleEndian.Uint64(delta[40:]))
+		info.UID = binary.LittleEndian.Uint32(delta[48:])
+		info.GID = binary.LittleEndian.Uint32(delta[52:])
+		copy(encs[:], delta[56:59])
+	case len(delta) >= bsdiffLegacyHeaderSize && bytes.Equal(delta[:8], bsdiffLegacyMagic):
+		hdrSize = bsdiffLegacyHeaderSize
+		ctrlLen = readOfft(delta[8:])
+		diffLen = readOfft(delta[16:])
+		newSize = readOfft(delta[24:])
+		extraLen = int64(len(delta)) - int64(hdrSize) - ctrlLen - diffLen
+		encs = [3]byte{bsdiffEncBzip2, bsdiffEncBzip2, bsdiffEncBzip2}
+	default:
+		return nil, nil, errors.New("invalid delta header")
+	}
+	info.Size = newSize
+
+	// Check each length against what is left, so the sums can't overflow.
+	left := int64(len(delta)) - int64(hdrSize)
+	if ctrlLen < 0 || diffLen < 0 || extraLen < 0 ||
+		ctrlLen > left || diffLen > left-ctrlLen || extraLen > left-ctrlLen-diffLen {
+		return nil, nil, errors.New("corrupt delta: invalid block lengths")
+	}
+	if newSize < 0 || newSize > bspatchMaxSize {
+		return nil, nil, fmt.Errorf("corrupt delta: invalid new file size %d", newSize)
+	}
+
+	blocks := make([]io.Reader, 3)
+	offset := int64(hdrSize)
+	for i, l := range []int64{ctrlLen, diffLen, extraLen} {
+		r, err := decodeBsdiffBlock(encs[i], delta[offset:offset+l])
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks[i] = r
+		offset += l
+	}
+	ctrlBlock, diffBlock, extraBlock := blocks[0], blocks[1], blocks[2]
+
+	new := make([]byte, newSize)
+	var oldpos, newpos int64
+	maxSeek := int64(len(old)) + newSize
+	var ctrl [3]int64
+	buf := make([]byte, 8)
+	for newpos < newSize {
+		for i := range ctrl {
+			if _, err := io.ReadFull(ctrlBlock, buf); err != nil {
+				return nil, nil, fmt.Errorf("corrupt delta: reading control block: %s", err)
+			}
+			ctrl[i] = readOfft(buf)
+		}
+
+		// newpos is always between 0 and newSize, and oldpos can't move
+		// further than the size of both files, so none of the additions
+		// below overflow.
+		if ctrl[0] < 0 || ctrl[0] > newSize-newpos ||
+			ctrl[1] < 0 || ctrl[1] > newSize-newpos-ctrl[0] ||
+			ctrl[2] < -maxSeek || ctrl[2] > maxSeek {
+			return nil, nil, errors.New("corrupt delta: invalid control data")
+		}
+		if _, err := io.ReadFull(diffBlock, new[newpos:newpos+ctrl[0]]); err != nil {
+			return nil, nil, fmt.Errorf("corrupt delta: reading diff block: %s", err)
+		}
+		for i := int64(0); i < ctrl[0]; i++ {
+			if oldpos+i >= 0 && oldpos+i < int64(len(old)) {
+				new[newpos+i] += old[oldpos+i]
+			}
+		}
+		newpos += ctrl[0]
+		oldpos += ctrl[0]
+
+		if _, err := io.ReadFull(extraBlock, new[newpos:newpos+ctrl[1]]); err != nil {
+			return nil, nil, fmt.Errorf("corrupt delta: reading extra block: %s", err)
+		}
+		newpos += ctrl[1]
+		oldpos += ctrl[2]
+		if oldpos < -maxSeek || oldpos > maxSeek {
+			return nil, nil, errors.New("corrupt delta: invalid control data")
+		}
+	}
+
+	return new, info, nil
+}
+
+func decodeBsdiffBlock(enc byte, block []byte) (io.Reader, error) {
+	switch enc {
+	case bsdiffEncNone:
+		return bytes.NewReader(block), nil
+	case bsdiffEncZeros:
+		return zeroReader{}, nil
+	case bsdiffEncGzip:
+		return gzip.NewReader(bytes.NewReader(block))
+	case bsdiffEncBzip2:
+		return bzip2.NewReader(bytes.NewReader(block)), nil
+	case bsdiffEncXz:
+		return xz.NewReader(bytes.NewReader(block))
+	default:
+		return nil, fmt.Errorf("unsupported delta block encoding %d", enc)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// writeOfft writes x as 8 bytes in sign and magnitude format.
+func writeOfft(w io.Writer, x int64) {
+	var buf [8]byte
+	y := x
+	if x < 0 {
+		y = -x
+	}
+	binary.LittleEndian.PutUint64(buf[:], uint64(y))
+	if x < 0 {
+		buf[7] |= 0x80
+	}
+	_, _ = w.Write(buf[:])
+}
+
+// readOfft reads a value stored by writeOfft.
+func readOfft(buf []byte) int64 {
+	y := int64(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+	if buf[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+// qsufsort builds the suffix array I of buf using the Larsson-Sadakane
+// algorithm. V is used as scratch space. Both must have len(buf)+1 elements.
+func qsufsort(I, V []int32, buf []byte) {
+	var buckets [256]int32
+	n := int32(len(buf))
+
+	for _, c := range buf {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, c := range buf {
+		buckets[c]++
+		I[buckets[c]] = int32(i)
+	}
+	I[0] = n
+	for i, c := range buf {
+		V[i] = buckets[c]
+	}
+	V[n] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := int32(1); I[0] != -(n + 1); h += h {
+		var length int32
+		var i int32
+		for i < n+1 {
+			if I[i] < 0 {
+				length -= I[i]
+				i -= I[i]
+			} else {
+				if length != 0 {
+					I[i-length] = -length
+				}
+				length = V[I[i]] + 1 - i
+				split(I, V, i, length, h)
+				i += length
+				length = 0
+			}
+		}
+		if length != 0 {
+			I[i-length] = -length
+		}
+	}
+
+	for i := int32(0); i < n+1; i++ {
+		I[V[i]] = i
+	}
+}
+
+func split(I, V []int32, start, length, h int32) {
+	if length < 16 {
+		var j int32
+		for k := start; k < start+length; k += j {
+			j = 1
+			x := V[I[k]+h]
+			for i := int32(1); k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := int32(0); i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	var jj, kk int32
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, int32(0), int32(0)
+	for i < jj {
+		if V[I[i]+h] < x {
+			i++
+		} else if V[I[i]+h] == x {
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		} else {
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		split(I, V, start, jj-start, h)
+	}
+
+	for i := int32(0); i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+
+	if start+length > kk {
+		split(I, V, kk, start+length-kk, h)
+	}
+}
+
+func matchlen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// search finds the longest match of new in old using the suffix array I,
+// returning its position in old and its length.
+func search(I []int32, old, new []byte) (int, int) {
+	st, en := 0, len(old)
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		suffix := old[I[x]:]
+		n := len(suffix)
+		if len(new) < n {
+			n = len(new)
+		}
+		if bytes.Compare(suffix[:n], new[:n]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+
+	x := matchlen(old[I[st]:], new)
+	y := matchlen(old[I[en]:], new)
+	if x > y {
+		return int(I[st]), x
+	}
+	return int(I[en]), y
+}
+
+// ApplyDelta applies a delta created by swupd to the contents of the old
+// file. The returned info has the size of the result and, if the delta format
+// records them, its mode and ownership. Deltas don't carry extended
+// attributes, the result keeps the ones of the old file.
+func ApplyDelta(old, delta []byte) ([]byte, *HashFileInfo, error) {
+	content, info, err := bspatch(old, delta)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, &HashFileInfo{
+		Mode: info.Mode,
+		UID:  info.UID,
+		GID:  info.GID,
+		Size: info.Size,
+	}, nil
+}
+
+// applyDeltaFile reads a delta file and applies it to the contents of oldPath.
+func applyDeltaFile(oldPath, deltaPath string) ([]byte, *bsdiffFileInfo, error) {
+	old, err := ioutil.ReadFile(oldPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	delta, err := ioutil.ReadFile(deltaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bspatch(old, delta)
+}
@@ -0,0 +1,224 @@
+package swupd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ulikunitz/xz"
+)
+
+func mustBsdiffRoundTrip(t *testing.T, old, new []byte) []byte {
+	t.Helper()
+	info := &bsdiffFileInfo{Mode: 0100644, UID: 1, GID: 2, Size: int64(len(new))}
+	var delta bytes.Buffer
+	if err := bsdiff(&delta, old, new, info, bsdiffLimits{}); err != nil {
+		t.Fatalf("couldn't create delta: %s", err)
+	}
+	got, gotInfo, err := bspatch(old, delta.Bytes())
+	if err != nil {
+		t.Fatalf("couldn't apply delta: %s", err)
+	}
+	if !bytes.Equal(got, new) {
+		t.Fatalf("patched content doesn't match new content")
+	}
+	if *gotInfo != *info {
+		t.Fatalf("got file info %+v but want %+v", *gotInfo, *info)
+	}
+	return delta.Bytes()
+}
+
+func TestBsdiffRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	old := make([]byte, 64*1024)
+	for i := range old {
+		// Limit the alphabet so the data looks more like real files.
+		old[i] = byte('a' + r.Intn(8))
+	}
+
+	tests := []struct {
+		name string
+		new  func() []byte
+	}{
+		{"single byte change", func() []byte {
+			b := append([]byte{}, old...)
+			b[1000] ^= 0xff
+			return b
+		}},
+		{"insertion", func() []byte {
+			b := append([]byte{}, old[:500]...)
+			b = append(b, []byte("inserted content")...)
+			return append(b, old[500:]...)
+		}},
+		{"deletion", func() []byte {
+			return append(append([]byte{}, old[:2000]...), old[3000:]...)
+		}},
+		{"moved blocks", func() []byte {
+			return append(append([]byte{}, old[32*1024:]...), old[:32*1024]...)
+		}},
+		{"scattered changes", func() []byte {
+			b := append([]byte{}, old...)
+			for i := 0; i < 50; i++ {
+				b[r.Intn(len(b))]++
+			}
+			return b
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			new := tt.new()
+			delta := mustBsdiffRoundTrip(t, old, new)
+			if len(delta) >= len(new)/10 {
+				t.Errorf("delta has %d bytes, expected it to be much smaller than %d", len(delta), len(new))
+			}
+		})
+	}
+}
+
+func TestBsdiffEmptyOld(t *testing.T) {
+	mustBsdiffRoundTrip(t, nil, []byte(strings.Repeat("content", 100)))
+}
+
+func TestBsdiffNotWorth(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	old := make([]byte, 1000)
+	new := make([]byte, 1000)
+	r.Read(old)
+	r.Read(new)
+
+	var delta bytes.Buffer
+	err := bsdiff(&delta, old, new, &bsdiffFileInfo{}, bsdiffLimits{})
+	if err != errDeltaNotWorth {
+		t.Fatalf("got error %v but want %v", err, errDeltaNotWorth)
+	}
+	if delta.Len() != 0 {
+		t.Fatalf("delta was written even if not worth")
+	}
+}
+
+func TestBsdiffLimits(t *testing.T) {
+	old := []byte(strings.Repeat("old", 1000))
+	new := []byte(strings.Repeat("new", 1000))
+
+	var delta bytes.Buffer
+	err := bsdiff(&delta, old, new, &bsdiffFileInfo{}, bsdiffLimits{MaxMemory: 1024})
+	if err != errDeltaBudget {
+		t.Fatalf("got error %v but want %v for memory limit", err, errDeltaBudget)
+	}
+
+	big := make([]byte, 1024*1024)
+	err = bsdiff(&delta, big, big[1:], &bsdiffFileInfo{}, bsdiffLimits{Timeout: time.Nanosecond})
+	if err != errDeltaBudget {
+		t.Fatalf("got error %v but want %v for time limit", err, errDeltaBudget)
+	}
+}
+
+func TestBspatchCorruptDelta(t *testing.T) {
+	old := []byte(strings.Repeat("content", 100))
+	new := append([]byte("new "), old...)
+	delta := mustBsdiffRoundTrip(t, old, new)
+
+	hugeSize := append([]byte(nil), delta...)
+	binary.LittleEndian.PutUint64(hugeSize[32:], 1<<62)
+	hugeBlock := append([]byte(nil), delta...)
+	binary.LittleEndian.PutUint64(hugeBlock[16:], 1<<63-1)
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("NOTBSDIF"), delta[8:]...)},
+		{"truncated", delta[:len(delta)-1]},
+		{"huge new size", hugeSize},
+		{"huge block length", hugeBlock},
+		// The second diff length overflows newpos.
+		{"overflowing diff", mustRawDelta(10, []int64{0, 1, 0, 1<<63 - 1, 0, 0}, "x")},
+		{"overflowing extra", mustRawDelta(10, []int64{1, 1<<63 - 1, 0}, "x")},
+		{"overflowing seek", mustRawDelta(10, []int64{0, 1, 1<<63 - 1, 0, 1, 1<<63 - 1}, "xx")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := bspatch(old, tt.delta); err == nil {
+				t.Fatalf("expected error when applying corrupt delta")
+			}
+		})
+	}
+}
+
+func TestBspatchXzBlocks(t *testing.T) {
+	old := []byte("old content")
+	extra := "new content"
+
+	// Control and extra blocks encoded with xz, as written by the bsdiff
+	// tool, and a diff block of zeros.
+	var ctrl bytes.Buffer
+	writeOfft(&ctrl, 0)
+	writeOfft(&ctrl, int64(len(extra)))
+	writeOfft(&ctrl, 0)
+	encode := func(b []byte) []byte {
+		var buf bytes.Buffer
+		w, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	ctrlBlock := encode(ctrl.Bytes())
+	extraBlock := encode([]byte(extra))
+
+	delta := make([]byte, bsdiffHeaderSize)
+	copy(delta, bsdiffMagic)
+	binary.LittleEndian.PutUint64(delta[8:], uint64(len(ctrlBlock)))
+	binary.LittleEndian.PutUint64(delta[24:], uint64(len(extraBlock)))
+	binary.LittleEndian.PutUint64(delta[32:], uint64(len(extra)))
+	delta[56] = bsdiffEncXz
+	delta[57] = bsdiffEncZeros
+	delta[58] = bsdiffEncXz
+	delta = append(append(delta, ctrlBlock...), extraBlock...)
+
+	got, _, err := bspatch(old, delta)
+	if err != nil {
+		t.Fatalf("couldn't apply delta with xz blocks: %s", err)
+	}
+	if string(got) != extra {
+		t.Fatalf("got %q but want %q", got, extra)
+	}
+}
+
+// mustRawDelta builds a delta with unencoded blocks, the given control triples
+// and extra block, and an empty diff block.
+func mustRawDelta(newSize int64, ctrl []int64, extra string) []byte {
+	var buf bytes.Buffer
+	for _, v := range ctrl {
+		writeOfft(&buf, v)
+	}
+	hdr := make([]byte, bsdiffHeaderSize)
+	copy(hdr, bsdiffMagic)
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(buf.Len()))
+	binary.LittleEndian.PutUint64(hdr[24:], uint64(len(extra)))
+	binary.LittleEndian.PutUint64(hdr[32:], uint64(newSize))
+	buf.WriteString(extra)
+	return append(hdr, buf.Bytes()...)
+}
+
+func TestOfft(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 255, -256, 1 << 40, -(1 << 40)} {
+		var buf bytes.Buffer
+		writeOfft(&buf, v)
+		if got := readOfft(buf.Bytes()); got != v {
+			t.Errorf("got %d after reading back %d", got, v)
+		}
+	}
+}
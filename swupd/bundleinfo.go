@@ -20,23 +20,28 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
 type bundleInfo struct {
-	Name           string
-	Filename       string
-	DirectIncludes []string
-	DirectPackages map[string]bool
-	AllPackages    map[string]bool
-	Files          map[string]bool
+	Name     string
+	Filename string
+	Header   struct {
+		Status string
+	}
+	DirectIncludes   []string
+	OptionalIncludes []string
+	DirectPackages   map[string]bool
+	AllPackages      map[string]bool
+	Files            map[string]bool
 }
 
 func (m *Manifest) getBundleInfo(c config, path string) error {
 	var err error
 	if _, err = os.Stat(path); os.IsNotExist(err) {
 		basePath := filepath.Dir(path)
-		err = m.addFilesFromChroot(filepath.Join(filepath.Dir(path), m.Name), "")
+		err = m.addFilesFromChroot(filepath.Join(filepath.Dir(path), m.Name), "", c.hashCache, c.recordPool, c.content.xattrs())
 		if err != nil {
 			return err
 		}
@@ -52,7 +57,12 @@ func (m *Manifest) getBundleInfo(c config, path string) error {
 			return err
 		}
 		m.bundleInfo.DirectIncludes = includes
-		return nil
+		m.bundleInfo.OptionalIncludes, err = readOptionalIncludesFile(filepath.Join(basePath, "noship", m.Name+"-includes"))
+		if err != nil {
+			return err
+		}
+		m.bundleInfo.Header.Status, err = readGroupStatus(filepath.Join(c.stateDir, "groups.ini"), m.Name)
+		return err
 	}
 
 	biBytes, err := ioutil.ReadFile(path)
@@ -88,23 +98,13 @@ func (m *Manifest) getBundleInfo(c config, path string) error {
 
 func (m *Manifest) addFilesFromBundleInfo(c config, version uint32) error {
 	chrootDir := filepath.Join(c.imageBase, fmt.Sprint(version), "full")
+	paths := make([]string, 0, len(m.bundleInfo.Files))
 	for fpath := range m.bundleInfo.Files {
-		fullPath := filepath.Join(chrootDir, fpath)
-		fi, err := os.Lstat(fullPath)
-		if err != nil {
-			return err
-		}
-
-		err = m.createFileRecord(chrootDir, fpath, "", fi)
-		if err != nil {
-			if strings.Contains(err.Error(), "hash calculation error") {
-				return err
-			}
-			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
-		}
+		paths = append(paths, fpath)
 	}
+	sort.Strings(paths)
 
-	return nil
+	return m.addRecords(chrootDir, "", paths, nil, c.hashCache, c.recordPool, c.content.xattrs())
 }
 
 func appendUniqueManifest(ms []*Manifest, man *Manifest) []*Manifest {
@@ -116,7 +116,7 @@ func appendUniqueManifest(ms []*Manifest, man *Manifest) []*Manifest {
 	return append(ms, man)
 }
 
-func (m *Manifest) readIncludesFromBundleInfo(bundles []*Manifest) error {
+func (m *Manifest) readIncludesFromBundleInfo(bundles []*Manifest, idx *indexConfig) error {
 	includes := []*Manifest{}
 	// os-core is added as an include for every bundle
 	// handle it manually so we don't have to rely on the includes list having it
@@ -128,8 +128,10 @@ func (m *Manifest) readIncludesFromBundleInfo(bundles []*Manifest) error {
 
 	for _, bn := range m.bundleInfo.DirectIncludes {
 		// just add this one blindly since it is processed later
-		if bn == indexBundle {
-			includes = append(includes, &Manifest{Name: indexBundle})
+		if bn == idx.bundle {
+			if !idx.disabled {
+				includes = append(includes, &Manifest{Name: idx.bundle})
+			}
 			continue
 		}
 
@@ -146,5 +148,29 @@ func (m *Manifest) readIncludesFromBundleInfo(bundles []*Manifest) error {
 	}
 
 	m.Header.Includes = includes
+
+	// Optional bundles are only listed, their content is not subtracted
+	// from m. A bundle that is also included is not optional.
+	var optional []*Manifest
+	for _, bn := range m.bundleInfo.OptionalIncludes {
+		if bn == m.Name || containsManifest(includes, bn) {
+			continue
+		}
+		for _, b := range bundles {
+			if bn == b.Name {
+				optional = appendUniqueManifest(optional, b)
+			}
+		}
+	}
+	m.Header.Optional = optional
 	return nil
 }
+
+func containsManifest(ms []*Manifest, name string) bool {
+	for _, m := range ms {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
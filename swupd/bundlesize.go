@@ -0,0 +1,283 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FileSize is a file of a bundle and its installed size.
+type FileSize struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// BundleSize describes the cost of installing and downloading a bundle in a
+// version. Installed sizes are the sizes of the regular files, as stored in
+// their fullfiles.
+type BundleSize struct {
+	Name    string `json:"name"`
+	Version uint32 `json:"version"`
+
+	// InstalledFiles and InstalledSize count the files of the bundle and of
+	// all the bundles it includes, what installing it brings to a system.
+	InstalledFiles int   `json:"installedFiles"`
+	InstalledSize  int64 `json:"installedSize"`
+	// UniqueFiles and UniqueSize count only the files in the manifest of
+	// the bundle, that remain after subtracting its includes.
+	UniqueFiles int   `json:"uniqueFiles"`
+	UniqueSize  int64 `json:"uniqueSize"`
+
+	// FullfileSize is the size of the compressed fullfiles of the unique
+	// files, and ZeroPackSize the size of the pack from version zero, zero
+	// when the pack was not created.
+	FullfileSize int64 `json:"fullfileSize"`
+	ZeroPackSize int64 `json:"zeroPackSize"`
+
+	// Largest are the largest unique files, biggest first.
+	Largest []FileSize `json:"largest"`
+	// Missing counts the files without a fullfile, their size is not
+	// known and not included in the totals.
+	Missing int `json:"missing,omitempty"`
+}
+
+type fullfileSize struct {
+	size       int64
+	compressed int64
+	missing    bool
+}
+
+type bundleSizer struct {
+	outputDir string
+	version   uint32
+	entries   map[string]*File
+	manifests map[string]*Manifest
+	fullfiles map[Hashval]*fullfileSize
+}
+
+// ComputeBundleSizes returns the sizes of bundles in the given version of the
+// content in outputDir, or of all bundles in the MoM if bundles is empty. Up to
+// largest files are listed for each bundle, all of them if it is negative.
+func ComputeBundleSizes(outputDir string, version uint32, bundles []string, largest int) ([]*BundleSize, error) {
+	mom, err := ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(version), "Manifest.MoM"))
+	if err != nil {
+		return nil, err
+	}
+	s := &bundleSizer{
+		outputDir: outputDir,
+		version:   version,
+		entries:   make(map[string]*File, len(mom.Files)),
+		manifests: make(map[string]*Manifest),
+		fullfiles: make(map[Hashval]*fullfileSize),
+	}
+	for _, f := range mom.Files {
+		s.entries[f.Name] = f
+	}
+	if len(bundles) == 0 {
+		for _, f := range mom.Files {
+			bundles = append(bundles, f.Name)
+		}
+		sort.Strings(bundles)
+	}
+
+	var sizes []*BundleSize
+	for _, name := range bundles {
+		bs, err := s.bundleSize(name, largest)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, bs)
+	}
+	return sizes, nil
+}
+
+func (s *bundleSizer) manifest(name string) (*Manifest, error) {
+	if m, ok := s.manifests[name]; ok {
+		return m, nil
+	}
+	entry, ok := s.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("bundle %s is not in version %d", name, s.version)
+	}
+	m, err := ParseManifestFile(filepath.Join(s.outputDir, fmt.Sprint(entry.Version), "Manifest."+name))
+	if err != nil {
+		return nil, err
+	}
+	s.manifests[name] = m
+	return m, nil
+}
+
+// fullfile returns the sizes of the fullfile of f, reading only the header of
+// the tar inside it.
+func (s *bundleSizer) fullfile(f *File) *fullfileSize {
+	if ff, ok := s.fullfiles[f.Hash]; ok {
+		return ff
+	}
+	ff := &fullfileSize{}
+	s.fullfiles[f.Hash] = ff
+
+	path := filepath.Join(s.outputDir, fmt.Sprint(f.Version), "files", f.Hash.String()+".tar")
+	fi, err := os.Stat(path)
+	if err != nil {
+		ff.missing = true
+		return ff
+	}
+	ff.compressed = fi.Size()
+	size, err := readFullfileSize(path)
+	if err != nil {
+		ff.missing = true
+		return ff
+	}
+	ff.size = size
+	return ff
+}
+
+func readFullfileSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	tr, err := NewCompressedTarReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tr.Close()
+	}()
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, err
+	}
+	return hdr.Size, nil
+}
+
+func (s *bundleSizer) bundleSize(name string, largest int) (*BundleSize, error) {
+	m, err := s.manifest(name)
+	if err != nil {
+		return nil, err
+	}
+	bs := &BundleSize{
+		Name:    name,
+		Version: m.Header.Version,
+	}
+
+	var files []FileSize
+	compressed := make(map[Hashval]bool)
+	for _, f := range m.Files {
+		if !f.Present() {
+			continue
+		}
+		ff := s.fullfile(f)
+		if ff.missing {
+			bs.Missing++
+		}
+		bs.UniqueFiles++
+		bs.UniqueSize += ff.size
+		if !compressed[f.Hash] {
+			compressed[f.Hash] = true
+			bs.FullfileSize += ff.compressed
+		}
+		files = append(files, FileSize{f.Name, ff.size})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Size != files[j].Size {
+			return files[i].Size > files[j].Size
+		}
+		return files[i].Name < files[j].Name
+	})
+	if largest >= 0 && len(files) > largest {
+		files = files[:largest]
+	}
+	bs.Largest = files
+
+	// Walk the includes, a file shared by many bundles is installed once.
+	installed := make(map[string]bool)
+	visited := map[string]bool{name: true}
+	queue := []*Manifest{m}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, f := range cur.Files {
+			if !f.Present() || installed[f.Name] {
+				continue
+			}
+			installed[f.Name] = true
+			bs.InstalledFiles++
+			bs.InstalledSize += s.fullfile(f).size
+		}
+		for _, inc := range cur.Header.Includes {
+			if visited[inc.Name] {
+				continue
+			}
+			visited[inc.Name] = true
+			incM, err := s.manifest(inc.Name)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, incM)
+		}
+	}
+
+	if fi, err := os.Stat(filepath.Join(s.outputDir, fmt.Sprint(m.Header.Version), GetPackFilename(name, 0))); err == nil {
+		bs.ZeroPackSize = fi.Size()
+	}
+	return bs, nil
+}
+
+// WriteBundleSizesText writes a report of sizes.
+func WriteBundleSizesText(w io.Writer, sizes []*BundleSize) error {
+	var buf bytes.Buffer
+	for i, bs := range sizes {
+		if i > 0 {
+			fmt.Fprintln(&buf)
+		}
+		fmt.Fprintf(&buf, "%s (version %d)\n", bs.Name, bs.Version)
+		fmt.Fprintf(&buf, "  Installed:  %6d files  %s\n", bs.InstalledFiles, formatSize(bs.InstalledSize))
+		fmt.Fprintf(&buf, "  Unique:     %6d files  %s\n", bs.UniqueFiles, formatSize(bs.UniqueSize))
+		fmt.Fprintf(&buf, "  Fullfiles:  %s\n", formatSize(bs.FullfileSize))
+		if bs.ZeroPackSize > 0 {
+			fmt.Fprintf(&buf, "  Zero pack:  %s\n", formatSize(bs.ZeroPackSize))
+		} else {
+			fmt.Fprintf(&buf, "  Zero pack:  not found\n")
+		}
+		if bs.Missing > 0 {
+			fmt.Fprintf(&buf, "  Missing:    %6d fullfiles, their size is not counted\n", bs.Missing)
+		}
+		if len(bs.Largest) > 0 {
+			fmt.Fprintf(&buf, "  Largest files:\n")
+			for _, f := range bs.Largest {
+				fmt.Fprintf(&buf, "    %10s  %s\n", formatSize(f.Size), f.Name)
+			}
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteBundleSizesJSON writes sizes as a JSON array.
+func WriteBundleSizesJSON(w io.Writer, sizes []*BundleSize) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sizes)
+}
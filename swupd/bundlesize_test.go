@@ -0,0 +1,88 @@
+package swupd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeBundleSizes(t *testing.T) {
+	ts := newTestSwupd(t, "bundle-sizes-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"base", "editor"}
+	ts.addFile(10, "base", "/base", strings.Repeat("b", 100))
+	ts.addFile(10, "editor", "/base", strings.Repeat("b", 100))
+	ts.addFile(10, "editor", "/editor", strings.Repeat("e", 1000))
+	ts.addFile(10, "editor", "/editor.conf", "conf")
+	ts.addIncludes(10, "editor", []string{"base"})
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+	ts.createPack("editor", 0, 10, "")
+
+	sizes, err := ComputeBundleSizes(ts.path("www"), 10, []string{"editor"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 1 {
+		t.Fatalf("got %d bundle sizes, but want 1", len(sizes))
+	}
+	bs := sizes[0]
+	if bs.UniqueSize != 1004 || bs.InstalledSize <= 1104 || bs.InstalledFiles <= bs.UniqueFiles {
+		t.Errorf("unexpected sizes: %+v", bs)
+	}
+	if bs.FullfileSize == 0 || bs.ZeroPackSize == 0 || bs.Missing != 0 {
+		t.Errorf("unexpected download sizes: %+v", bs)
+	}
+	if len(bs.Largest) != 1 || bs.Largest[0].Name != "/editor" || bs.Largest[0].Size != 1000 {
+		t.Errorf("got largest files %v, but want /editor", bs.Largest)
+	}
+
+	var buf bytes.Buffer
+	if err = WriteBundleSizesText(&buf, sizes); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "/editor") {
+		t.Errorf("report doesn't list the largest file:\n%s", buf.String())
+	}
+
+	if sizes, err = ComputeBundleSizes(ts.path("www"), 10, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 4 {
+		t.Errorf("got %d bundle sizes, but want all 4 bundles", len(sizes))
+	}
+	if _, err = ComputeBundleSizes(ts.path("www"), 10, []string{"missing"}, 0); err == nil {
+		t.Errorf("expected error for a bundle not in the version")
+	}
+}
+
+func TestWriteBundleManifestsContentSize(t *testing.T) {
+	fs := newTestFileSystem(t, "contentsize-")
+	defer fs.cleanup()
+
+	for _, noClamp := range []bool{false, true} {
+		bundle := &Manifest{
+			Name: "test-bundle",
+			Header: ManifestHeader{
+				Format:      1,
+				Version:     10,
+				FileCount:   1,
+				TimeStamp:   time.Unix(1000, 0),
+				ContentSize: 3 * badMax,
+			},
+			Files: []*File{{Name: "/foo", Version: 10, Type: TypeFile}},
+		}
+		mom := &Manifest{Name: "MoM"}
+		if _, err := mom.writeBundleManifests([]*Manifest{bundle}, fs.Dir, noClamp, false); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseManifestFile(fs.path("Manifest.test-bundle"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clamped := m.Header.ContentSize < badMax; clamped == noClamp {
+			t.Errorf("got contentsize %d with noClamp %v", m.Header.ContentSize, noClamp)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// Status of a bundle, taken from the Status field of the bundle header. Active
+// bundles are the default and have no status line in their manifest, the
+// others are written in the status: header so clients can show it.
+const (
+	BundleStatusActive        = "Active"
+	BundleStatusExperimental  = "Experimental"
+	BundleStatusDeprecated    = "Deprecated"
+	BundleStatusPendingDelete = "Pending-Delete"
+)
+
+// parseBundleStatus returns the status to write in the manifest header for the
+// status of a bundle definition, ignoring case. Active and empty statuses
+// result in an empty string. An unknown status is reported and handled as
+// Active.
+func parseBundleStatus(bundle, status string) string {
+	for _, s := range []string{BundleStatusExperimental, BundleStatusDeprecated, BundleStatusPendingDelete} {
+		if strings.EqualFold(status, s) {
+			return s
+		}
+	}
+	if status != "" && !strings.EqualFold(status, BundleStatusActive) {
+		fmt.Printf("Warning: bundle %s has unknown status %q, handling it as %s\n", bundle, status, BundleStatusActive)
+	}
+	return ""
+}
+
+func validManifestStatus(status string) bool {
+	switch status {
+	case "", BundleStatusExperimental, BundleStatusDeprecated, BundleStatusPendingDelete:
+		return true
+	}
+	return false
+}
+
+func isDeprecatedStatus(status string) bool {
+	return status == BundleStatusDeprecated || status == BundleStatusPendingDelete
+}
+
+// readGroupStatus returns the status key of the bundle section in the
+// groups.ini file at path, used for bundles without a bundle-info file.
+func readGroupStatus(path, bundle string) (string, error) {
+	if !exists(path) {
+		return "", nil
+	}
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return "", err
+	}
+	return cfg.Section(bundle).Key("status").Value(), nil
+}
+
+// lifecycleConfig controls what happens to deprecated bundles.
+type lifecycleConfig struct {
+	// removeDeprecatedAfter is the number of versions a deprecated bundle
+	// is published before it is removed, zero keeps deprecated bundles.
+	removeDeprecatedAfter uint32
+}
+
+// readLifecycleSection overrides the lifecycle configuration in l with the one
+// set in section: remove_deprecated_after.
+func readLifecycleSection(section *ini.Section, l *lifecycleConfig) error {
+	if key, err := section.GetKey("remove_deprecated_after"); err == nil {
+		n, err := key.Uint()
+		if err != nil {
+			return fmt.Errorf("invalid lifecycle remove_deprecated_after %q", key.Value())
+		}
+		l.removeDeprecatedAfter = uint32(n)
+	}
+	return nil
+}
+
+// deprecationHistory describes how a bundle was published in the last
+// versions.
+type deprecationHistory struct {
+	// published is set when the bundle is in the MoM of the last version,
+	// and lastStatus is its status there.
+	published  bool
+	lastStatus string
+	// versions is the number of consecutive versions, up to the last one,
+	// in which the bundle was published as deprecated.
+	versions uint32
+}
+
+// readDeprecationHistory walks the MoMs from oldMoM back through their previous
+// versions, up to limit versions, to find how long the bundle has been
+// deprecated.
+func readDeprecationHistory(outputDir string, oldMoM *Manifest, bundle string, limit uint32) (*deprecationHistory, error) {
+	h := &deprecationHistory{}
+	manifests := make(map[uint32]*Manifest)
+	mom := oldMoM
+	for mom.Header.Version != 0 && h.versions < limit {
+		var entry *File
+		for _, f := range mom.Files {
+			if f.Name == bundle {
+				entry = f
+				break
+			}
+		}
+		if entry == nil {
+			break
+		}
+		m := manifests[entry.Version]
+		if m == nil {
+			var err error
+			m, err = ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(entry.Version), "Manifest."+bundle))
+			if err != nil {
+				return nil, err
+			}
+			manifests[entry.Version] = m
+		}
+		if mom == oldMoM {
+			h.published = true
+			h.lastStatus = m.Header.Status
+		}
+		if !isDeprecatedStatus(m.Header.Status) {
+			break
+		}
+		h.versions++
+
+		if mom.Header.Previous == 0 {
+			break
+		}
+		var err error
+		mom, err = getOldManifest(filepath.Join(outputDir, fmt.Sprint(mom.Header.Previous), "Manifest.MoM"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// applyBundleLifecycle reports the deprecated bundles and, when configured to
+// remove them, marks as Pending-Delete the ones deprecated for long enough and
+// returns the names of the bundles that were Pending-Delete in the last version
+// and should be removed in this one. Their files are deleted by a last manifest
+// written for them. A bundle still included by another one is
+// kept. Deprecated bundles that are not in the last version are not added
+// back.
+func applyBundleLifecycle(ui UpdateInfo, c config, bundles []*Manifest) (map[string]bool, error) {
+	oldMoM, err := getOldManifest(filepath.Join(c.outputDir, fmt.Sprint(ui.lastVersion), "Manifest.MoM"))
+	if err != nil {
+		return nil, err
+	}
+
+	limit := c.lifecycle.removeDeprecatedAfter
+	removed := make(map[string]bool)
+	for _, b := range bundles {
+		if b.Name == "full" || !isDeprecatedStatus(b.Header.Status) {
+			continue
+		}
+		if limit == 0 {
+			fmt.Printf("Warning: bundle %s is %s\n", b.Name, b.Header.Status)
+			continue
+		}
+
+		h, err := readDeprecationHistory(c.outputDir, oldMoM, b.Name, limit)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case oldMoM.Header.Version != 0 && !h.published:
+			fmt.Printf("Warning: bundle %s is %s and not in version %d, not adding it\n", b.Name, b.Header.Status, ui.lastVersion)
+			removed[b.Name] = true
+		case h.lastStatus == BundleStatusPendingDelete:
+			fmt.Printf("Warning: removing bundle %s, it was %s in version %d\n", b.Name, BundleStatusPendingDelete, ui.lastVersion)
+			removed[b.Name] = true
+		case b.Header.Status == BundleStatusPendingDelete || h.versions+1 >= limit:
+			b.Header.Status = BundleStatusPendingDelete
+			fmt.Printf("Warning: bundle %s is %s, it will be removed in the next version\n", b.Name, BundleStatusPendingDelete)
+		default:
+			fmt.Printf("Warning: bundle %s is %s, it will be removed after %d more versions\n", b.Name, b.Header.Status, limit-h.versions-1)
+		}
+	}
+
+	// Keep the bundles still included by others, until no other bundle is
+	// kept because of them. They stay Pending-Delete.
+	for changed := true; changed; {
+		changed = false
+		for _, b := range bundles {
+			if removed[b.Name] {
+				continue
+			}
+			for _, inc := range b.Header.Includes {
+				if removed[inc.Name] {
+					fmt.Printf("Warning: bundle %s is included by %s, not removing it\n", inc.Name, b.Name)
+					delete(removed, inc.Name)
+					inc.Header.Status = BundleStatusPendingDelete
+					changed = true
+				}
+			}
+		}
+	}
+
+	// Optional bundles are only suggested, drop the removed ones.
+	for _, b := range bundles {
+		if removed[b.Name] {
+			continue
+		}
+		var optional []*Manifest
+		for _, opt := range b.Header.Optional {
+			if !removed[opt.Name] {
+				optional = append(optional, opt)
+			}
+		}
+		b.Header.Optional = optional
+	}
+	return removed, nil
+}
@@ -0,0 +1,109 @@
+package swupd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func mustSetBundleStatus(t *testing.T, ts *testSwupd, version uint32, bundle string, status string) {
+	t.Helper()
+	path := ts.path(filepath.Join("image", fmt.Sprint(version), bundle+"-info"))
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bi bundleInfo
+	if err = json.Unmarshal(content, &bi); err != nil {
+		t.Fatal(err)
+	}
+	bi.Header.Status = status
+	if content, err = json.Marshal(&bi); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateManifestsBundleStatus(t *testing.T) {
+	ts := newTestSwupd(t, "bundle-status-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"test-bundle", "new-bundle"}
+	for _, v := range []uint32{10, 20} {
+		ts.addFile(v, "test-bundle", "/foo", "foo")
+		ts.addFile(v, "new-bundle", "/bar", "bar")
+	}
+	mustSetBundleStatus(t, ts, 10, "test-bundle", "active")
+	mustSetBundleStatus(t, ts, 10, "new-bundle", "experimental")
+	ts.createManifests(10)
+
+	ts.checkNotContains("www/10/Manifest.test-bundle", "status:")
+	ts.checkContains("www/10/Manifest.new-bundle", "status:\tExperimental\n")
+	if m := ts.parseManifest(10, "new-bundle"); m.Header.Status != BundleStatusExperimental {
+		t.Errorf("got status %q, but want %q", m.Header.Status, BundleStatusExperimental)
+	}
+
+	// A status change alone updates the manifest.
+	mustSetBundleStatus(t, ts, 20, "test-bundle", "Deprecated")
+	mustSetBundleStatus(t, ts, 20, "new-bundle", "Experimental")
+	ts.createManifests(20)
+
+	mom := ts.parseManifest(20, "MoM")
+	fileInManifest(t, mom, 20, "test-bundle")
+	fileInManifest(t, mom, 10, "new-bundle")
+	ts.checkContains("www/20/Manifest.test-bundle", "status:\tDeprecated\n")
+}
+
+func TestCreateManifestsRemoveDeprecated(t *testing.T) {
+	ts := newTestSwupd(t, "remove-deprecated-")
+	defer ts.cleanup()
+	ts.appendServerINI("\n[Lifecycle]\nremove_deprecated_after=2\n")
+
+	ts.Bundles = []string{"test-bundle", "old-bundle", "used-bundle"}
+	for v := uint32(10); v <= 50; v += 10 {
+		ts.addFile(v, "test-bundle", "/foo", "foo")
+		ts.addFile(v, "old-bundle", "/bar", "bar")
+		ts.addFile(v, "used-bundle", "/baz", "baz")
+		ts.addIncludes(v, "test-bundle", []string{"used-bundle"})
+		if v > 10 {
+			mustSetBundleStatus(t, ts, v, "old-bundle", BundleStatusDeprecated)
+			mustSetBundleStatus(t, ts, v, "used-bundle", BundleStatusDeprecated)
+		}
+		ts.createManifests(v)
+	}
+
+	ts.checkContains("www/20/Manifest.old-bundle", "status:\tDeprecated\n")
+	ts.checkContains("www/30/Manifest.old-bundle", "status:\tPending-Delete\n")
+
+	// The last manifest deletes the files, that are not in full anymore.
+	fileInManifest(t, ts.parseManifest(40, "MoM"), 40, "old-bundle")
+	old := ts.parseManifest(40, "old-bundle")
+	fileDeletedInManifest(t, old, 40, "/bar")
+	fileDeletedInManifest(t, old, 40, "/usr/share/clear/bundles/old-bundle")
+	full := ts.parseManifest(40, "full")
+	fileDeletedInManifest(t, full, 40, "/bar")
+	fileDeletedInManifest(t, full, 40, "/usr/share/clear/bundles/old-bundle")
+	ts.checkNotExists("www/50/Manifest.old-bundle")
+
+	for _, v := range []uint32{40, 50} {
+		mom := ts.parseManifest(v, "MoM")
+		if v > 40 {
+			fileNotInManifest(t, mom, "old-bundle")
+		}
+		// still included by test-bundle
+		fileInManifest(t, mom, 30, "used-bundle")
+	}
+	ts.checkContains("www/30/Manifest.used-bundle", "status:\tPending-Delete\n")
+}
+
+func TestReadServerINIBadLifecycle(t *testing.T) {
+	ts := newTestSwupd(t, "server-ini-lifecycle-")
+	defer ts.cleanup()
+	ts.write("server.ini", "[Lifecycle]\nremove_deprecated_after=-1\n")
+	if _, err := readServerINI(ts.Dir, ts.path("server.ini")); err == nil {
+		t.Errorf("readServerINI did not raise an error for a negative remove_deprecated_after")
+	}
+}
@@ -28,6 +28,7 @@ func main() {
 
 	cpuProfile := flag.String("cpuprofile", "", "write CPU profile to a file")
 	outputDir := flag.String("o", "", "output directory, creates temporary if not specified")
+	compressors := flag.String("compressors", "", "comma separated list of compressors to try, uses default set if not specified")
 	flag.Usage = usage
 
 	flag.Parse()
@@ -44,6 +45,12 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	names, err := swupd.ParseCompressorList(*compressors)
+	if err != nil {
+		log.Fatalf("invalid compressors: %s", err)
+	}
+	opts := &swupd.ContentOptions{FullfileCompressors: names}
+
 	stateDir := flag.Arg(0)
 	version := flag.Arg(1)
 
@@ -79,7 +86,7 @@ func main() {
 	}
 
 	log.Printf("Output directory: %s", *outputDir)
-	_, err = swupd.CreateFullfiles(m, chrootDir, *outputDir, 0)
+	_, err = swupd.CreateFullfiles(m, chrootDir, *outputDir, 0, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,174 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compressor describes a compression algorithm available for the content
+// generated by swupd.
+type Compressor struct {
+	// Name identifies the compressor, it is used when selecting compressors
+	// and when reporting which one was used.
+	Name string
+
+	// NewWriter returns a WriteCloser that compresses the data written to it
+	// into w. Close must be called to flush the data, it doesn't close w.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// Compress compresses all the data from src into dst.
+func (c *Compressor) Compress(dst io.Writer, src io.Reader) error {
+	w, err := c.NewWriter(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = make(map[string]*Compressor)
+)
+
+// DefaultFullfileCompressors are the candidates used for fullfiles when no other set is
+// configured.
+var DefaultFullfileCompressors = []string{"bzip2", "gzip", "xz"}
+
+// DefaultPackCompressor is used for packs when no other compressor is
+// configured.
+const DefaultPackCompressor = "xz"
+
+// fullfileCompressors returns the selected compressors for fullfiles. Fails if
+// any of the names is not registered.
+func (o *ContentOptions) fullfileCompressors() ([]*Compressor, error) {
+	names := DefaultFullfileCompressors
+	if o != nil && len(o.FullfileCompressors) > 0 {
+		names = o.FullfileCompressors
+	}
+	selected := make([]*Compressor, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		c, err := GetCompressor(name)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, c)
+	}
+	return selected, nil
+}
+
+// packCompressor returns the selected compressor for packs.
+func (o *ContentOptions) packCompressor() (*Compressor, error) {
+	if o == nil || o.PackCompressor == "" {
+		return GetCompressor(DefaultPackCompressor)
+	}
+	return GetCompressor(o.PackCompressor)
+}
+
+func init() {
+	RegisterCompressor(&Compressor{
+		Name: "gzip",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		},
+	})
+	RegisterCompressor(&Compressor{
+		Name: "bzip2",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: bzip2.BestCompression})
+		},
+	})
+	RegisterCompressor(&Compressor{
+		Name: "xz",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	})
+	RegisterCompressor(&Compressor{
+		Name: "zstd",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		},
+	})
+}
+
+// RegisterCompressor makes a compressor available by its name. Registering a
+// compressor with the same name of an existing one replaces it.
+func RegisterCompressor(c *Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name] = c
+}
+
+// GetCompressor returns the registered compressor with the given name.
+func GetCompressor(name string) (*Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor %q", name)
+	}
+	return c, nil
+}
+
+// CompressorNames returns the names of all registered compressors, sorted.
+func CompressorNames() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCompressorList parses a comma or space separated list of compressor
+// names, as used in configuration files. An empty list results in the default
+// fullfile compressors.
+func ParseCompressorList(s string) ([]string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return DefaultFullfileCompressors, nil
+	}
+	for _, name := range fields {
+		if _, err := GetCompressor(name); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
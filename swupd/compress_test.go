@@ -0,0 +1,134 @@
+package swupd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressorsRoundTrip(t *testing.T) {
+	input := strings.Repeat("Hello, compressed world! ", 1000)
+
+	for _, name := range CompressorNames() {
+		t.Run(name, func(t *testing.T) {
+			c, err := GetCompressor(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Wrap the compressed data in a tar so NewCompressedTarReader can be
+			// used to detect the format and decompress.
+			var archive bytes.Buffer
+			w, err := c.NewWriter(&archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tw := tar.NewWriter(w)
+			if err = tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(input))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tw.Write([]byte(input)); err != nil {
+				t.Fatal(err)
+			}
+			if err = tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tr, err := NewCompressedTarReader(bytes.NewReader(archive.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = tr.Close()
+			}()
+			if _, err = tr.Next(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != input {
+				t.Fatalf("decompressed content doesn't match the input")
+			}
+		})
+	}
+}
+
+func TestParseCompressorList(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		fail     bool
+	}{
+		{"", DefaultFullfileCompressors, false},
+		{"xz", []string{"xz"}, false},
+		{"gzip,xz", []string{"gzip", "xz"}, false},
+		{" gzip, bzip2 ", []string{"gzip", "bzip2"}, false},
+		{"gzip,rar", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseCompressorList(tt.input)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("expected error when parsing %q", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error when parsing %q: %s", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("got %v when parsing %q but want %v", got, tt.input, tt.expected)
+		}
+	}
+}
+
+func TestCreateFullfilesSelectedCompressors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fullfiles-compressors-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	path := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(path, []byte(strings.Repeat("compress me", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := GetHashForFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Files: []*File{{Name: "file", Hash: internHash(hash), Type: TypeFile, Version: 10}}}
+	m.Header.Version = 10
+
+	outputDir := filepath.Join(dir, "output")
+	if _, err = CreateFullfiles(m, dir, outputDir, 1, &ContentOptions{FullfileCompressors: []string{"unknown"}}); err == nil {
+		t.Fatal("expected error when selecting an unknown compressor")
+	}
+	info, err := CreateFullfiles(m, dir, outputDir, 1, &ContentOptions{FullfileCompressors: []string{"gzip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CompressedCounts["gzip"] != 1 || len(info.CompressedCounts) != 1 {
+		t.Fatalf("got compressed counts %v but expected only gzip", info.CompressedCounts)
+	}
+
+	fis, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("found %d files in output directory, but expected only the fullfile", len(fis))
+	}
+	mustHaveMatchingHash(t, filepath.Join(outputDir, hash+".tar"))
+}
@@ -29,14 +29,72 @@ type dbgConfig struct {
 	banned bool
 	lib    string
 	src    string
+	// split moves the debuginfo files to generated bundles instead of
+	// removing them, see generateDebuginfoBundles.
+	split string
+}
+
+// ContentOptions select how the content of a version is created. A nil
+// *ContentOptions uses the default compressors and leaves extended attributes
+// out.
+type ContentOptions struct {
+	// FullfileCompressors are the candidates tried for each regular
+	// fullfile, the smallest result is kept. If empty,
+	// DefaultFullfileCompressors are used.
+	FullfileCompressors []string
+
+	// PackCompressor is used to compress the packs. Unlike fullfiles, packs
+	// are too large to try multiple candidates. If empty,
+	// DefaultPackCompressor is used.
+	PackCompressor string
+
+	// Xattrs includes the extended attributes of the files in the disk in
+	// their hashes, fullfiles and packs. Since it changes the hash of every
+	// file with extended attributes, it should only be enabled for formats
+	// that support it. Hashes of tar entries always include the extended
+	// attributes they carry.
+	Xattrs bool
+
+	// UnclampedContentSize writes the real contentsize of the bundles,
+	// instead of clamping it for the clients that need it, see
+	// setMaxContentSizeHack. It should only be enabled for formats not
+	// supported by those clients.
+	UnclampedContentSize bool
+}
+
+// xattrs tells whether extended attributes are enabled.
+func (o *ContentOptions) xattrs() bool {
+	return o != nil && o.Xattrs
+}
+
+// unclampedContentSize tells whether the real contentsize is written.
+func (o *ContentOptions) unclampedContentSize() bool {
+	return o != nil && o.UnclampedContentSize
 }
 
 type config struct {
-	stateDir  string
-	emptyDir  string
-	imageBase string
-	outputDir string
-	debuginfo dbgConfig
+	stateDir   string
+	emptyDir   string
+	imageBase  string
+	outputDir  string
+	debuginfo  dbgConfig
+	heuristics heuristicsConfig
+	renames    renameConfig
+	index      indexConfig
+	lifecycle  lifecycleConfig
+
+	// useHashCache enables the hash cache in the state dir, and
+	// hashCacheVerify is the ratio of cache hits that are verified.
+	useHashCache    bool
+	hashCacheVerify float64
+	// content selects the compressors and extended attributes of the
+	// content being created, it can be nil.
+	content *ContentOptions
+	// hashCache is the cache loaded for the current build, nil when the
+	// cache is not used.
+	hashCache *hashCache
+	// recordPool creates the file records for the current build.
+	recordPool *recordPool
 }
 
 var defaultConfig = config{
@@ -49,6 +107,9 @@ var defaultConfig = config{
 		lib:    "/usr/lib/debug",
 		src:    "/usr/src/debug",
 	},
+	heuristics: defaultHeuristics,
+	renames:    defaultRenames,
+	index:      defaultIndex,
 }
 
 func getConfig(stateDir string) (config, error) {
@@ -91,6 +152,16 @@ func readServerINI(stateDir, path string) (config, error) {
 		userConfig.outputDir = key.Value()
 	}
 
+	if key, err := cfg.Section("Server").GetKey("hash_cache"); err == nil {
+		userConfig.useHashCache = (key.Value() == "true")
+	}
+
+	if key, err := cfg.Section("Server").GetKey("hash_cache_verify"); err == nil {
+		if userConfig.hashCacheVerify, err = key.Float64(); err != nil || userConfig.hashCacheVerify < 0 || userConfig.hashCacheVerify > 1 {
+			return defaultConfig, fmt.Errorf("invalid hash_cache_verify %q, must be between 0 and 1", key.Value())
+		}
+	}
+
 	if key, err := cfg.Section("Debuginfo").GetKey("banned"); err == nil {
 		userConfig.debuginfo.banned = (key.Value() == "true")
 	}
@@ -103,9 +174,109 @@ func readServerINI(stateDir, path string) (config, error) {
 		userConfig.debuginfo.src = key.Value()
 	}
 
+	if key, err := cfg.Section("Debuginfo").GetKey("split"); err == nil {
+		switch split := key.Value(); split {
+		case "", debuginfoSplitBundle, debuginfoSplitGlobal:
+			userConfig.debuginfo.split = split
+		default:
+			return defaultConfig, fmt.Errorf("invalid debuginfo split %q, must be %s or %s", split, debuginfoSplitBundle, debuginfoSplitGlobal)
+		}
+	}
+
+	if err = readHeuristicsSection(cfg.Section("Heuristics"), &userConfig.heuristics); err != nil {
+		return defaultConfig, err
+	}
+
+	if err = readRenamesSection(cfg.Section("Renames"), &userConfig.renames); err != nil {
+		return defaultConfig, err
+	}
+
+	if err = readIndexSection(cfg.Section("Index"), &userConfig.index); err != nil {
+		return defaultConfig, err
+	}
+
+	if err = readLifecycleSection(cfg.Section("Lifecycle"), &userConfig.lifecycle); err != nil {
+		return defaultConfig, err
+	}
+
 	return userConfig, nil
 }
 
+// readHeuristicsSection overrides the rules in h with the ones set in section.
+// Keys are named after the modifier and the kind of rule, e.g. boot_prefixes,
+// and hold comma or space separated lists. A key that is present replaces the
+// default list for that kind of rule.
+func readHeuristicsSection(section *ini.Section, h *heuristicsConfig) error {
+	modifiers := []struct {
+		name  string
+		rules *heuristicRules
+	}{
+		{"config", &h.config},
+		{"state", &h.state},
+		{"boot", &h.boot},
+	}
+	for _, m := range modifiers {
+		lists := []struct {
+			kind string
+			dest *[]string
+		}{
+			{"prefixes", &m.rules.prefixes},
+			{"paths", &m.rules.paths},
+			{"globs", &m.rules.globs},
+			{"exclude", &m.rules.exclude},
+		}
+		for _, l := range lists {
+			key, err := section.GetKey(m.name + "_" + l.kind)
+			if err != nil {
+				continue
+			}
+			*l.dest = splitList(key.Value())
+		}
+		if err := m.rules.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRenamesSection overrides the rename detection rules in r with the ones
+// set in section: strategies, min_size, similarity, path_components, bundles
+// and exclude_bundles.
+func readRenamesSection(section *ini.Section, r *renameConfig) error {
+	if key, err := section.GetKey("strategies"); err == nil {
+		r.strategies = splitList(key.Value())
+	}
+	if key, err := section.GetKey("bundles"); err == nil {
+		r.bundles = splitList(key.Value())
+	}
+	if key, err := section.GetKey("exclude_bundles"); err == nil {
+		r.excludeBundles = splitList(key.Value())
+	}
+	if key, err := section.GetKey("min_size"); err == nil {
+		if r.minSize, err = key.Int64(); err != nil {
+			return fmt.Errorf("invalid rename min_size: %s", err)
+		}
+	}
+	if key, err := section.GetKey("similarity"); err == nil {
+		if r.similarity, err = key.Float64(); err != nil {
+			return fmt.Errorf("invalid rename similarity: %s", err)
+		}
+	}
+	if key, err := section.GetKey("path_components"); err == nil {
+		if r.pathComponents, err = key.Int(); err != nil {
+			return fmt.Errorf("invalid rename path_components: %s", err)
+		}
+	}
+	return r.validate()
+}
+
+// splitList splits a comma or space separated list.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
 // readGroupsINI reads the groups.ini file from path. Raises an error when the
 // groups.ini file does not exist because it is required for the build
 func readGroupsINI(path string) ([]string, error) {
@@ -128,7 +299,7 @@ func readGroupsINI(path string) ([]string, error) {
 			continue
 		}
 
-		// we don't appear to need the status key at the moment
+		// the status key is read with each bundle, see readGroupStatus
 		groups = append(groups, section)
 		if !osCoreFound && section == "os-core" {
 			osCoreFound = true
@@ -184,10 +355,31 @@ func readIncludesFile(path string) ([]string, error) {
 
 	includes := []string{}
 	for _, s := range strings.Split(string(allIncludes), "\n") {
-		if s != "" {
+		if s != "" && !strings.HasPrefix(s, "also-add(") {
 			includes = appendUnique(includes, s)
 		}
 	}
 
 	return includes, nil
 }
+
+// readOptionalIncludesFile reads the bundles listed as "also-add(NAME)" in an
+// includes file.
+func readOptionalIncludesFile(path string) ([]string, error) {
+	if !exists(path) {
+		return nil, nil
+	}
+
+	allIncludes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var optional []string
+	for _, s := range strings.Split(string(allIncludes), "\n") {
+		if strings.HasPrefix(s, "also-add(") && strings.HasSuffix(s, ")") {
+			optional = appendUnique(optional, s[len("also-add("):len(s)-1])
+		}
+	}
+	return optional, nil
+}
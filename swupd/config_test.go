@@ -1,6 +1,8 @@
 package swupd
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -26,6 +28,56 @@ func TestReadServerINI(t *testing.T) {
 		t.Errorf("%v\n%v\n%v\n%v\n%v\n",
 			c.imageBase, c.outputDir, c.debuginfo.banned, c.debuginfo.lib, c.debuginfo.src)
 	}
+
+	expectedBoot := []string{"/boot/", "/usr/lib/modules/", "/usr/lib/kernel/", "/usr/lib/vendor-kernel/"}
+	if !reflect.DeepEqual(c.heuristics.boot.prefixes, expectedBoot) {
+		t.Errorf("boot prefixes %v did not match expected %v", c.heuristics.boot.prefixes, expectedBoot)
+	}
+	if !reflect.DeepEqual(c.heuristics.state.prefixes, defaultHeuristics.state.prefixes) {
+		t.Errorf("state prefixes %v were changed but not configured", c.heuristics.state.prefixes)
+	}
+
+	expectedRenames := defaultRenames
+	expectedRenames.strategies = []string{RenameHash, RenamePath}
+	expectedRenames.similarity = 0.5
+	expectedRenames.excludeBundles = []string{"kernel-native"}
+	if !reflect.DeepEqual(c.renames, expectedRenames) {
+		t.Errorf("renames %+v did not match expected %+v", c.renames, expectedRenames)
+	}
+}
+
+func TestReadServerINIBadRenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-ini-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	path := filepath.Join(dir, "server.ini")
+	for _, section := range []string{"strategies=hash,content", "similarity=2", "path_components=x"} {
+		if err = ioutil.WriteFile(path, []byte("[Renames]\n"+section+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readServerINI(dir, path); err == nil {
+			t.Errorf("readServerINI did not raise an error for %q", section)
+		}
+	}
+}
+
+func TestReadServerINIBadHeuristics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-ini-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	path := filepath.Join(dir, "server.ini")
+	if err = ioutil.WriteFile(path, []byte("[Heuristics]\nconfig_globs=/etc/[\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readServerINI(dir, path); err == nil {
+		t.Error("readServerINI did not raise an error for an invalid glob")
+	}
 }
 
 func TestReadGroupsINI(t *testing.T) {
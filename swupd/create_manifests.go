@@ -15,8 +15,8 @@
 package swupd
 
 import (
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -65,6 +65,8 @@ func initBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 	bundleWorker := func() {
 		defer wg.Done()
 		for bundleName := range bundleChan {
+			// workers run concurrently, don't share the error with them
+			var err error
 			bundle := &Manifest{
 				Header: ManifestHeader{
 					Format:    ui.format,
@@ -113,15 +115,11 @@ func initBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 				break
 			}
 
-			// detect type changes
-			// fail out here if a type change is detected since this is not yet supported in client
-			if bundle.hasUnsupportedTypeChanges() {
-				errorChan <- errors.New("type changes not yet supported")
-				break
-			}
+			bundle.Header.Status = parseBundleStatus(bundle.Name, bundle.bundleInfo.Header.Status)
 
-			// remove banned debuginfo if configured to do so
-			if c.debuginfo.banned {
+			// remove banned debuginfo if configured to do so, when
+			// splitting it is moved to the debuginfo bundles later
+			if c.debuginfo.banned && c.debuginfo.split == "" {
 				bundle.removeDebuginfo(c.debuginfo)
 			}
 
@@ -156,18 +154,30 @@ func initBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 		<-errorChan
 	}
 
+	// Generate the debuginfo bundles before the full manifest, so it gets
+	// their tracking files.
+	if err == nil && c.debuginfo.split != "" {
+		fmt.Println("Generating debuginfo bundles...")
+		var dbgManifests []*Manifest
+		if dbgManifests, err = generateDebuginfoBundles(ui, c, tmpManifests); err != nil {
+			return nil, err
+		}
+		tmpManifests = append(tmpManifests, dbgManifests...)
+	}
+
 	// Now handle the full manifest last, we know the full chroot is populated
 	// with any rsync fallbacks that needed to happen.
 	for _, bundle := range tmpManifests {
 		if bundle.Name == "full" {
 			chroot := filepath.Join(c.imageBase, fmt.Sprint(ui.version), "full")
-			err = bundle.addFilesFromChroot(chroot, "")
+			err = bundle.addFilesFromChroot(chroot, "", c.hashCache, c.recordPool, c.content.xattrs())
 			if err != nil {
 				return nil, err
 			}
 
-			// remove banned debuginfo if configured to do so
-			if c.debuginfo.banned {
+			// remove banned debuginfo if configured to do so, the full
+			// manifest keeps it when splitting
+			if c.debuginfo.banned && c.debuginfo.split == "" {
 				bundle.removeDebuginfo(c.debuginfo)
 			}
 
@@ -177,13 +187,15 @@ func initBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 	return tmpManifests, err
 }
 
-func processBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
+// processBundles returns the manifests of the bundles that changed in this
+// version and the names of the bundles removed from it.
+func processBundles(ui UpdateInfo, c config) ([]*Manifest, map[string]bool, error) {
 	var newFull *Manifest
 	var err error
 	// initialize bundles with with all files and their info
 	tmpManifests, err := initBundles(ui, c)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// read includes for subtraction processing
@@ -195,10 +207,25 @@ func processBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 		}
 		if bundle.Name != "os-core" {
 			// read in bundle includes
-			if err = bundle.readIncludesFromBundleInfo(tmpManifests); err != nil {
-				return nil, err
+			if err = bundle.readIncludesFromBundleInfo(tmpManifests, &c.index); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	removed, err := applyBundleLifecycle(ui, c, tmpManifests)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(removed) > 0 {
+		removeBundleFiles(newFull, tmpManifests, removed)
+		kept := tmpManifests[:0]
+		for _, bundle := range tmpManifests {
+			if !removed[bundle.Name] {
+				kept = append(kept, bundle)
 			}
 		}
+		tmpManifests = kept
 	}
 
 	// Perform manifest subtraction. Important this is done after all includes
@@ -212,12 +239,13 @@ func processBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 	oldMoMPath := filepath.Join(c.outputDir, fmt.Sprint(ui.lastVersion), "Manifest.MoM")
 	oldMoM, err := getOldManifest(oldMoMPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// final loop detects changes, applies heuristics to files, and sorts the file lists
 	fmt.Println("Detecting manifest changes...")
 	newManifests := []*Manifest{}
+	var matches []heuristicMatch
 	for _, bundle := range tmpManifests {
 		// Check for changed includes, changed or added or deleted files
 		// must be done after subtractManifests because the oldM is a subtracted
@@ -230,19 +258,26 @@ func processBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 		oldMPath := filepath.Join(c.outputDir, fmt.Sprint(ver), "Manifest."+bundle.Name)
 		oldM, err := getOldManifest(oldMPath)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		changedIncludes := includesChanged(bundle, oldM)
+		changedStatus := bundle.Header.Status != oldM.Header.Status
 		oldM.sortFilesName()
 		changedFiles, added, deleted := bundle.linkPeersAndChange(oldM, ui.minVersion)
+		// type changes are counted as changed files above
+		for _, tc := range bundle.resolveTypeChanges() {
+			if bundle.Name != "full" {
+				fmt.Printf("Type change in %s: %s (%s -> %s)\n", bundle.Name, tc.Name, tc.From, tc.To)
+			}
+		}
 		// if nothing changed, skip
-		if changedFiles == 0 && added == 0 && deleted == 0 && !changedIncludes {
+		if changedFiles == 0 && added == 0 && deleted == 0 && !changedIncludes && !changedStatus {
 			continue
 		}
 
 		// detect modifier flag for all files in the manifest
 		// must happen after finding newDeleted files to catch ghosted files.
-		bundle.applyHeuristics()
+		matches = append(matches, bundle.applyHeuristics(&c.heuristics)...)
 		// Assign final FileCount based on the files that made it this far
 		bundle.Header.FileCount = uint32(len(bundle.Files))
 		// If we made it this far, this bundle has a change and should be written
@@ -252,14 +287,51 @@ func processBundles(ui UpdateInfo, c config) ([]*Manifest, error) {
 	// maximize full manifest while all the manifests are still sorted by name
 	maximizeFull(newFull, newManifests)
 
-	return newManifests, nil
+	reportPath := filepath.Join(c.imageBase, fmt.Sprint(ui.version), "heuristics-report")
+	if err = writeHeuristicsReport(reportPath, matches); err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("Heuristics report written to %s\n", reportPath)
+
+	return newManifests, removed, nil
 }
 
-func addUnchangedManifests(appendTo *Manifest, appendFrom *Manifest) {
+// removeBundleFiles removes from full the files of the removed bundles that
+// are not in any other bundle.
+func removeBundleFiles(full *Manifest, bundles []*Manifest, removed map[string]bool) {
+	inRemoved := make(map[string]bool)
+	inKept := make(map[string]bool)
+	for _, b := range bundles {
+		if b == full {
+			continue
+		}
+		for _, f := range b.Files {
+			if removed[b.Name] {
+				inRemoved[f.Name] = true
+			} else {
+				inKept[f.Name] = true
+			}
+		}
+	}
+	var kept []*File
+	for _, f := range full.Files {
+		if inRemoved[f.Name] && !inKept[f.Name] {
+			if f.Info != nil {
+				full.Header.ContentSize -= uint64(f.Info.Size())
+			}
+			continue
+		}
+		kept = append(kept, f)
+	}
+	full.Files = kept
+}
+
+// addUnchangedManifests adds to appendTo the bundles of appendFrom it doesn't
+// have, except the ones in skip.
+func addUnchangedManifests(appendTo *Manifest, appendFrom *Manifest, skip map[string]bool) {
 	for _, f := range appendFrom.Files {
 		if f.findFileNameInSlice(appendTo.Files) == nil {
-			if f.Name == indexBundle {
-				// this is generated new each time
+			if skip[f.Name] {
 				continue
 			}
 			appendTo.Files = append(appendTo.Files, f)
@@ -267,9 +339,75 @@ func addUnchangedManifests(appendTo *Manifest, appendFrom *Manifest) {
 	}
 }
 
+// newDeletedManifest returns the last manifest of the bundle name, that is
+// dropped from the MoM: the manifest it had in oldMoM with every file deleted,
+// so the clients remove them. It returns nil if the bundle is not in oldMoM or
+// its deleted manifest was already written.
+func newDeletedManifest(ui UpdateInfo, c config, oldMoM *Manifest, name string) (*Manifest, error) {
+	ver := getManifestVerFromMoM(oldMoM, &Manifest{Name: name})
+	if ver == 0 {
+		return nil, nil
+	}
+	oldM, err := ParseManifestFile(filepath.Join(c.outputDir, fmt.Sprint(ver), "Manifest."+name))
+	if err != nil {
+		return nil, err
+	}
+	if !hasPresentFiles(oldM) {
+		return nil, nil
+	}
+	oldM.sortFilesName()
+
+	m := &Manifest{
+		Name: name,
+		Header: ManifestHeader{
+			Format:    ui.format,
+			Version:   ui.version,
+			TimeStamp: ui.timeStamp,
+			Status:    oldM.Header.Status,
+		},
+	}
+	// with no files in m all the present files of oldM are deleted
+	m.linkPeersAndChange(oldM, ui.minVersion)
+	m.Header.FileCount = uint32(len(m.Files))
+	return m, nil
+}
+
+// hasPresentFiles reports whether m has files that are not deleted or ghosted.
+// Every bundle has at least its tracking file, so only the deleted manifest of
+// a dropped bundle has none.
+func hasPresentFiles(m *Manifest) bool {
+	for _, f := range m.Files {
+		if f.Present() {
+			return true
+		}
+	}
+	return false
+}
+
+// deletedBundles returns the bundles in oldMoM whose deleted manifest was
+// written in its version, so they are not copied to the next MoM.
+func deletedBundles(c config, oldMoM *Manifest) (map[string]bool, error) {
+	deleted := make(map[string]bool)
+	for _, f := range oldMoM.Files {
+		if f.Version != oldMoM.Header.Version {
+			continue
+		}
+		m, err := ParseManifestFile(filepath.Join(c.outputDir, fmt.Sprint(f.Version), "Manifest."+f.Name))
+		if err != nil {
+			return nil, err
+		}
+		if !hasPresentFiles(m) {
+			deleted[f.Name] = true
+		}
+	}
+	return deleted, nil
+}
+
 // writeBundleManifests writes all bundle manifests in newManifests,
-// populates the MoM, and returns the full manifest for this update.
-func (MoM *Manifest) writeBundleManifests(newManifests []*Manifest, out string) (*Manifest, error) {
+// populates the MoM, and returns the full manifest for this update. The
+// contentsize of the bundles is clamped unless noClamp is set, and xattrs
+// includes the extended attributes in the hashes of the manifests.
+func (MoM *Manifest) writeBundleManifests(newManifests []*Manifest, out string, noClamp, xattrs bool) (*Manifest, error) {
 	var newFull *Manifest
 	var err error
 	// write manifests then add them to the MoM
@@ -282,8 +420,11 @@ func (MoM *Manifest) writeBundleManifests(newManifests []*Manifest, out string)
 
 		// TODO: remove this after a format bump in Clear Linux
 		// this is a hack to set maximum contentsize to the incorrect maximum
-		// set in swupd-client v3.15.3
-		bMan.setMaxContentSizeHack()
+		// set in swupd-client v3.15.3, mixes whose format no longer
+		// supports that client can disable it
+		if !noClamp {
+			bMan.setMaxContentSizeHack()
+		}
 		// end hack
 
 		// sort by version then by filename, previously to this sort these bundles
@@ -295,7 +436,7 @@ func (MoM *Manifest) writeBundleManifests(newManifests []*Manifest, out string)
 		}
 
 		// add bundle to Manifest.MoM
-		if err = MoM.createManifestRecord(out, manPath, MoM.Header.Version); err != nil {
+		if err = MoM.createManifestRecord(out, manPath, MoM.Header.Version, xattrs); err != nil {
 			return nil, err
 		}
 	}
@@ -321,8 +462,11 @@ func aggregateManifests(newManifests []*Manifest, newMoM *Manifest, version uint
 	return allManifests, nil
 }
 
-// CreateManifests creates update manifests for changed and added bundles for <version>
-func CreateManifests(version uint32, minVersion uint32, format uint, statedir string) (*MoM, error) {
+// CreateManifests creates update manifests for changed and added bundles for <version>.
+// Multiple workers are used to create the file records of the chroots. If number of
+// workers is zero or less, 1 worker is used. The hashes of the files include their
+// extended attributes if enabled in opts, which can be nil.
+func CreateManifests(version uint32, minVersion uint32, format uint, statedir string, numWorkers int, opts *ContentOptions) (*MoM, error) {
 	var err error
 	var c config
 
@@ -341,11 +485,28 @@ func CreateManifests(version uint32, minVersion uint32, format uint, statedir st
 		return nil, err
 	}
 
+	c.content = opts
+	c.recordPool = newRecordPool(numWorkers)
+	defer c.recordPool.close()
+
+	if c.useHashCache {
+		c.hashCache, err = loadHashCache(hashCachePath(c.stateDir, opts.xattrs()), c.hashCacheVerify)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var groups []string
 	if groups, err = readGroupsINI(filepath.Join(c.stateDir, "groups.ini")); err != nil {
 		return nil, err
 	}
 
+	for _, g := range groups {
+		if g == c.index.bundle && !c.index.disabled {
+			return nil, fmt.Errorf("bundle %s conflicts with the generated index bundle", g)
+		}
+	}
+
 	groups = append(groups, "full")
 
 	var lastVersion uint32
@@ -373,10 +534,56 @@ func CreateManifests(version uint32, minVersion uint32, format uint, statedir st
 		timeStamp:   timeStamp,
 	}
 	var newManifests []*Manifest
-	if newManifests, err = processBundles(ui, c); err != nil {
+	var removed map[string]bool
+	if newManifests, removed, err = processBundles(ui, c); err != nil {
 		return nil, err
 	}
 
+	if c.hashCache != nil {
+		fmt.Printf("Hash cache: %s\n", c.hashCache)
+		if err = c.hashCache.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The removed bundles get a last manifest with their files deleted
+	// before being dropped from the MoM.
+	for _, name := range groups {
+		if !removed[name] {
+			continue
+		}
+		var m *Manifest
+		if m, err = newDeletedManifest(ui, c, oldMoM, name); err != nil {
+			return nil, err
+		}
+		if m != nil {
+			newManifests = append(newManifests, m)
+		}
+	}
+
+	// The index bundle is not in the groups, so when it was renamed or
+	// disabled its last manifest is written here. A bundle now using its
+	// name replaces it instead.
+	oldIndex, err := readIndexBundle(filepath.Join(c.imageBase, fmt.Sprint(lastVersion), indexBundleName))
+	if err != nil {
+		return nil, err
+	}
+	dropIndex := c.index.disabled || oldIndex != c.index.bundle
+	for _, g := range groups {
+		if g == oldIndex {
+			dropIndex = false
+		}
+	}
+	if dropIndex {
+		var idx *Manifest
+		if idx, err = newDeletedManifest(ui, c, oldMoM, oldIndex); err != nil {
+			return nil, err
+		}
+		if idx != nil {
+			newManifests = append(newManifests, idx)
+		}
+	}
+
 	verOutput := filepath.Join(c.outputDir, fmt.Sprint(version))
 	if err = os.MkdirAll(verOutput, 0755); err != nil {
 		return nil, err
@@ -398,13 +605,23 @@ func CreateManifests(version uint32, minVersion uint32, format uint, statedir st
 	}
 
 	fmt.Println("Writing manifest files...")
-	newFull, err := newMoM.writeBundleManifests(newManifests, verOutput)
+	newFull, err := newMoM.writeBundleManifests(newManifests, verOutput, c.content.unclampedContentSize(), c.content.xattrs())
 	if err != nil {
 		return nil, err
 	}
 
-	// copy over unchanged manifests
-	addUnchangedManifests(&newMoM, oldMoM)
+	// copy over unchanged manifests, except the removed bundles, the ones
+	// dropped in the last version and the index bundle, that is generated
+	// new each time or dropped if the index was disabled
+	deleted, err := deletedBundles(c, oldMoM)
+	if err != nil {
+		return nil, err
+	}
+	for name := range deleted {
+		removed[name] = true
+	}
+	removed[c.index.bundle] = true
+	addUnchangedManifests(&newMoM, oldMoM, removed)
 
 	// allManifests must include newManifests plus all old ones in the MoM.
 	allManifests, err := aggregateManifests(newManifests, &newMoM, version, c)
@@ -412,18 +629,25 @@ func CreateManifests(version uint32, minVersion uint32, format uint, statedir st
 		return nil, err
 	}
 
-	var osIdx *Manifest
-	if osIdx, err = writeIndexManifest(&c, &ui, allManifests); err != nil {
-		return nil, err
-	}
+	if !c.index.disabled {
+		var osIdx *Manifest
+		if osIdx, err = writeIndexManifest(&c, &ui, allManifests); err != nil {
+			return nil, err
+		}
 
-	osIdxPath := filepath.Join(verOutput, "Manifest."+osIdx.Name)
-	if err = newMoM.createManifestRecord(verOutput, osIdxPath, version); err != nil {
-		return nil, err
-	}
+		idxName := filepath.Join(c.imageBase, fmt.Sprint(version), indexBundleName)
+		if err = ioutil.WriteFile(idxName, []byte(osIdx.Name+"\n"), 0644); err != nil {
+			return nil, err
+		}
+
+		osIdxPath := filepath.Join(verOutput, "Manifest."+osIdx.Name)
+		if err = newMoM.createManifestRecord(verOutput, osIdxPath, version, c.content.xattrs()); err != nil {
+			return nil, err
+		}
 
-	// track here as well so the manifest tar is made
-	newManifests = append(newManifests, osIdx)
+		// track here as well so the manifest tar is made
+		newManifests = append(newManifests, osIdx)
+	}
 
 	// handle full manifest
 	newFull.sortFilesVersionName()
@@ -1,6 +1,7 @@
 package swupd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
@@ -27,7 +28,7 @@ func TestInitBuildEnv(t *testing.T) {
 }
 
 func TestCreateManifestsBadMinVersion(t *testing.T) {
-	if _, err := CreateManifests(10, 20, 1, "testdir"); err == nil {
+	if _, err := CreateManifests(10, 20, 1, "testdir", 0, nil); err == nil {
 		t.Error("No error raised with invalid minVersion (20) for version 10")
 	}
 }
@@ -119,6 +120,109 @@ func TestCreateManifestDebuginfo(t *testing.T) {
 	fileNotInManifest(t, m, "/usr/src/debug/bar")
 }
 
+func TestCreateManifestDebuginfoSplitBundle(t *testing.T) {
+	ts := newTestSwupd(t, "debuginfo-split-bundle")
+	defer ts.cleanup()
+	ts.appendServerINI("\n[Debuginfo]\nsplit=bundle\n")
+	ts.Bundles = []string{"test-bundle1", "test-bundle2", "test-bundle3", "test-bundle4"}
+	ts.addIncludes(10, "test-bundle2", []string{"test-bundle1"})
+	ts.addIncludes(10, "test-bundle3", []string{"test-bundle2"})
+	ts.addIncludes(10, "test-bundle4", []string{"test-bundle3"})
+	ts.addFile(10, "test-bundle1", "/usr/bin/foo", "foo")
+	ts.addFile(10, "test-bundle1", "/usr/lib/debug/foo", "foo debug")
+	ts.addFile(10, "test-bundle2", "/usr/bin/bar", "bar")
+	ts.addFile(10, "test-bundle2", "/usr/src/debug/bar", "bar debug")
+	ts.addFile(10, "test-bundle3", "/usr/bin/baz", "baz")
+	ts.addFile(10, "test-bundle4", "/usr/bin/qux", "qux")
+	ts.addFile(10, "test-bundle4", "/usr/lib/debug/qux", "qux debug")
+	ts.createManifests(10)
+
+	m1 := ts.parseManifest(10, "test-bundle1")
+	fileInManifest(t, m1, 10, "/usr/bin/foo")
+	fileNotInManifest(t, m1, "/usr/lib/debug/foo")
+	fileNotInManifest(t, ts.parseManifest(10, "test-bundle2"), "/usr/src/debug/bar")
+
+	dbg1 := ts.parseManifest(10, "test-bundle1-debuginfo")
+	fileInManifest(t, dbg1, 10, "/usr/lib/debug/foo")
+	fileInManifest(t, dbg1, 10, "/usr/share/clear/bundles/test-bundle1-debuginfo")
+	fileNotInManifest(t, dbg1, "/usr/bin/foo")
+	checkIncludes(t, dbg1, "os-core", "test-bundle1")
+
+	dbg2 := ts.parseManifest(10, "test-bundle2-debuginfo")
+	fileInManifest(t, dbg2, 10, "/usr/src/debug/bar")
+	fileNotInManifest(t, dbg2, "/usr/lib/debug/foo")
+	checkIncludes(t, dbg2, "os-core", "test-bundle2", "test-bundle1-debuginfo")
+
+	ts.checkNotExists("www/10/Manifest.test-bundle3-debuginfo")
+
+	// Includes without debuginfo are walked through.
+	dbg4 := ts.parseManifest(10, "test-bundle4-debuginfo")
+	checkIncludes(t, dbg4, "os-core", "test-bundle4", "test-bundle2-debuginfo")
+
+	full := ts.parseManifest(10, "full")
+	fileInManifest(t, full, 10, "/usr/lib/debug/foo")
+	fileInManifest(t, full, 10, "/usr/src/debug/bar")
+	fileInManifest(t, full, 10, "/usr/share/clear/bundles/test-bundle2-debuginfo")
+
+	// A debuginfo bundle that becomes empty records the deletions.
+	ts.addFile(20, "test-bundle1", "/usr/bin/foo", "foo")
+	ts.addFile(20, "test-bundle2", "/usr/bin/bar", "bar")
+	ts.addFile(20, "test-bundle2", "/usr/src/debug/bar", "bar debug")
+	ts.addFile(20, "test-bundle3", "/usr/bin/baz", "baz")
+	ts.addFile(20, "test-bundle4", "/usr/bin/qux", "qux")
+	ts.addFile(20, "test-bundle4", "/usr/lib/debug/qux", "qux debug")
+	ts.addIncludes(20, "test-bundle2", []string{"test-bundle1"})
+	ts.addIncludes(20, "test-bundle3", []string{"test-bundle2"})
+	ts.addIncludes(20, "test-bundle4", []string{"test-bundle3"})
+	ts.createManifests(20)
+
+	dbg1 = ts.parseManifest(20, "test-bundle1-debuginfo")
+	fileDeletedInManifest(t, dbg1, 20, "/usr/lib/debug/foo")
+	checkManifestContains(t, ts.Dir, "20", "MoM", "10\ttest-bundle2-debuginfo\n")
+}
+
+func TestCreateManifestDebuginfoSplitGlobal(t *testing.T) {
+	ts := newTestSwupd(t, "debuginfo-split-global")
+	defer ts.cleanup()
+	ts.appendServerINI("\n[Debuginfo]\nsplit=global\n")
+	ts.Bundles = []string{"test-bundle1", "test-bundle2"}
+	ts.addFile(10, "test-bundle1", "/usr/bin/foo", "foo")
+	ts.addFile(10, "test-bundle1", "/usr/lib/debug/foo", "foo debug")
+	ts.addFile(10, "test-bundle1", "/usr/src/debug/common", "common")
+	ts.addFile(10, "test-bundle2", "/usr/src/debug/bar", "bar debug")
+	ts.addFile(10, "test-bundle2", "/usr/src/debug/common", "common")
+	ts.createManifests(10)
+
+	fileNotInManifest(t, ts.parseManifest(10, "test-bundle1"), "/usr/lib/debug/foo")
+	fileNotInManifest(t, ts.parseManifest(10, "test-bundle2"), "/usr/src/debug/common")
+
+	dbg := ts.parseManifest(10, "os-debuginfo")
+	for _, f := range []string{"/usr/lib/debug/foo", "/usr/src/debug/bar", "/usr/src/debug/common"} {
+		fileInManifest(t, dbg, 10, f)
+	}
+	checkIncludes(t, dbg, "os-core")
+	if len(dbg.Files) != 4 {
+		t.Errorf("expected 4 files in %s, got %d", dbg.Name, len(dbg.Files))
+	}
+	ts.checkNotExists("www/10/Manifest.test-bundle1-debuginfo")
+}
+
+func TestCreateManifestDebuginfoSplitConflict(t *testing.T) {
+	ts := newTestSwupd(t, "debuginfo-split-conflict")
+	defer ts.cleanup()
+	ts.appendServerINI("\n[Debuginfo]\nsplit=bundle\n")
+	ts.Bundles = []string{"test-bundle", "test-bundle-debuginfo"}
+	ts.addFile(10, "test-bundle", "/usr/lib/debug/foo", "foo debug")
+	ts.addFile(10, "os-core", "/usr/lib/os-release", "VERSION_ID=10\n")
+	mustInitGroupsINI(t, ts.Dir, ts.Bundles)
+	for _, name := range ts.Bundles {
+		ts.addFile(10, name, filepath.Join("/usr/share/clear/bundles", name), "")
+	}
+	if _, err := CreateManifests(10, 0, 1, ts.Dir, 0, nil); err == nil {
+		t.Fatal("expected error when a bundle has the name of a generated debuginfo bundle")
+	}
+}
+
 func TestCreateManifestFormat(t *testing.T) {
 	ts := newTestSwupd(t, "format-basic")
 	defer ts.cleanup()
@@ -188,6 +292,55 @@ func TestCreateManifestIncludesDeduplicate(t *testing.T) {
 	checkManifestNotContains(t, ts.Dir, "20", "test-bundle2", dualIncludes)
 }
 
+func mustSetOptionalIncludes(t *testing.T, ts *testSwupd, version uint32, bundle string, optional []string) {
+	t.Helper()
+	path := ts.path(filepath.Join("image", fmt.Sprint(version), bundle+"-info"))
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bi bundleInfo
+	if err = json.Unmarshal(content, &bi); err != nil {
+		t.Fatal(err)
+	}
+	bi.OptionalIncludes = optional
+	if content, err = json.Marshal(&bi); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateManifestOptionalIncludes(t *testing.T) {
+	ts := newTestSwupd(t, "optional-includes-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"test-bundle1", "test-bundle2"}
+	ts.addFile(10, "test-bundle1", "/shared", "shared")
+	ts.addFile(10, "test-bundle2", "/shared", "shared")
+	ts.addFile(10, "test-bundle2", "/test2", "test2")
+	mustSetOptionalIncludes(t, ts, 10, "test-bundle2", []string{"test-bundle1", "missing"})
+	ts.createManifests(10)
+
+	// Optional bundles are listed but their files are not subtracted.
+	ts.checkContains("www/10/Manifest.test-bundle2", "also-add:\ttest-bundle1\n")
+	ts.checkNotContains("www/10/Manifest.test-bundle2", "includes:\ttest-bundle1")
+	ts.checkNotContains("www/10/Manifest.test-bundle2", "missing")
+	m := ts.parseManifest(10, "test-bundle2")
+	fileInManifest(t, m, 10, "/shared")
+	if len(m.Header.Optional) != 1 || m.Header.Optional[0].Name != "test-bundle1" {
+		t.Errorf("got optional bundles %v but expected test-bundle1", m.Header.Optional)
+	}
+
+	// Removing the optional bundle changes the manifest.
+	ts.addFile(20, "test-bundle1", "/shared", "shared")
+	ts.addFile(20, "test-bundle2", "/shared", "shared")
+	ts.addFile(20, "test-bundle2", "/test2", "test2")
+	ts.createManifests(20)
+	fileInManifest(t, ts.parseManifest(20, "MoM"), 20, "test-bundle2")
+	ts.checkNotContains("www/20/Manifest.test-bundle2", "also-add:")
+}
+
 func TestCreateManifestDeletes(t *testing.T) {
 	ts := newTestSwupd(t, "deletes")
 	defer ts.cleanup()
@@ -667,3 +820,82 @@ func TestNoUpdateStateFiles(t *testing.T) {
 	m20 := ts.parseManifest(20, "test-bundle")
 	fileInManifest(t, m20, 10, "/usr/lib/kernel/file")
 }
+
+func TestCreateManifestsTypeChanges(t *testing.T) {
+	ts := newTestSwupd(t, "type-changes-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"test-bundle"}
+
+	// Version 10 has /a as a file, /b and /d as directories and /c as a
+	// link.
+	ts.addFile(10, "test-bundle", "/a", "a")
+	ts.addDir(10, "test-bundle", "/b")
+	ts.addFile(10, "test-bundle", "/b/x", "x")
+	ts.addDir(10, "test-bundle", "/d")
+	ts.addFile(10, "test-bundle", "/d/z", "z")
+	ts.symlink("image/10/full/c", "a")
+	ts.addToBundleInfo(10, "test-bundle", "/c")
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+
+	// Version 20 turns /a into a directory, /b into a link and /c and /d
+	// into files.
+	ts.addDir(20, "test-bundle", "/a")
+	ts.addFile(20, "test-bundle", "/a/y", "y")
+	ts.symlink("image/20/full/b", "a")
+	ts.addToBundleInfo(20, "test-bundle", "/b")
+	ts.addFile(20, "test-bundle", "/c", "c")
+	ts.addFile(20, "test-bundle", "/d", "d")
+	ts.createManifests(20)
+	ts.createFullfiles(20)
+
+	for _, name := range []string{"test-bundle", "full"} {
+		m := ts.parseManifest(20, name)
+		expected := map[string]TypeFlag{"/a": TypeDirectory, "/a/y": TypeFile, "/b": TypeLink, "/c": TypeFile, "/d": TypeFile}
+		for fname, typ := range expected {
+			if f := fileInManifest(t, m, 20, fname); f.Type != typ {
+				t.Errorf("%s in Manifest.%s has type %s but expected %s", fname, name, f.Type, typ)
+			}
+		}
+		// The content of a directory replaced by a link is not recorded
+		// as deleted, since removing it would follow the link.
+		fileNotInManifest(t, m, "/b/x")
+		fileDeletedInManifest(t, m, 20, "/d/z")
+	}
+
+	// The new entries are available as fullfiles and in packs, and no delta
+	// is made across types.
+	info := ts.createPack("test-bundle", 10, 20, "")
+	mustHaveDeltaCount(t, info, 0)
+	ts.write("www/version/format1/latest", "20")
+	checkVerifyIssues(t, mustVerifyRepository(t, ts, 20))
+}
+
+func TestCreateManifestsWorkers(t *testing.T) {
+	var results []string
+	for _, workers := range []int{1, 8} {
+		ts := newTestSwupd(t, "manifest-workers-")
+		defer ts.cleanup()
+		ts.Bundles = []string{"test-bundle1", "test-bundle2"}
+		ts.ManifestWorkers = workers
+		for i := 0; i < 50; i++ {
+			ts.addFile(10, "test-bundle1", fmt.Sprintf("/dir%d/foo", i%5), fmt.Sprint(i))
+			ts.addFile(10, "test-bundle2", fmt.Sprintf("/bar%d", i), fmt.Sprint(i))
+		}
+		ts.createManifests(10)
+
+		var result string
+		for _, name := range []string{"test-bundle1", "test-bundle2", "full"} {
+			m := ts.parseManifest(10, name)
+			result += fmt.Sprintf("%s %d %d\n", name, m.Header.FileCount, m.Header.ContentSize)
+			for _, f := range m.Files {
+				result += f.Name + " " + f.Hash.String() + "\n"
+			}
+		}
+		results = append(results, result)
+	}
+
+	if results[0] != results[1] {
+		t.Errorf("manifests created with 1 worker:\n%s\ndiffer from the ones created with 8 workers:\n%s", results[0], results[1])
+	}
+}
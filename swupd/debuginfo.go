@@ -0,0 +1,198 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Values for the split key in the [Debuginfo] section of server.ini.
+const (
+	// debuginfoSplitBundle generates a NAME-debuginfo bundle for each bundle
+	// NAME that has debuginfo files.
+	debuginfoSplitBundle = "bundle"
+	// debuginfoSplitGlobal generates a single bundle with the debuginfo
+	// files of all bundles.
+	debuginfoSplitGlobal = "global"
+)
+
+const (
+	debuginfoSuffix       = "-debuginfo"
+	debuginfoGlobalBundle = "os-debuginfo"
+)
+
+// generateDebuginfoBundles moves the debuginfo files out of bundles into new
+// debuginfo bundles, that are returned. The debuginfo bundle of a bundle
+// includes it and the debuginfo bundles of its includes, direct or not, so
+// adding it brings the symbols for everything installed with the bundle. A debuginfo bundle
+// that was in the last version is still generated when it becomes empty, so
+// the deletion of its files is recorded.
+//
+// The full manifest is not changed, it keeps the debuginfo files so they get
+// fullfiles and can be packed. The tracking file of each generated bundle is
+// written to the full chroot.
+func generateDebuginfoBundles(ui UpdateInfo, c config, bundles []*Manifest) ([]*Manifest, error) {
+	oldMoMPath := filepath.Join(c.outputDir, fmt.Sprint(ui.lastVersion), "Manifest.MoM")
+	oldMoM, err := getOldManifest(oldMoMPath)
+	if err != nil {
+		return nil, err
+	}
+	inOldMoM := func(name string) bool {
+		for _, f := range oldMoM.Files {
+			if f.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	byName := make(map[string]*Manifest, len(bundles))
+	for _, b := range bundles {
+		byName[b.Name] = b
+	}
+
+	newDebuginfoBundle := func(name string) (*Manifest, error) {
+		if _, ok := byName[name]; ok {
+			return nil, fmt.Errorf("bundle %s conflicts with the generated debuginfo bundle of the same name", name)
+		}
+		return &Manifest{
+			Header: ManifestHeader{
+				Format:    ui.format,
+				Version:   ui.version,
+				Previous:  ui.lastVersion,
+				TimeStamp: ui.timeStamp,
+			},
+			Name: name,
+		}, nil
+	}
+
+	var generated []*Manifest
+	switch c.debuginfo.split {
+	case debuginfoSplitBundle:
+		dbgBundles := make(map[string]*Manifest)
+		// Use the groups order so the output doesn't depend on the order
+		// the workers finished.
+		for _, name := range ui.bundles {
+			b := byName[name]
+			if b == nil || name == "full" {
+				continue
+			}
+			files := b.removeDebuginfo(c.debuginfo)
+			dbgName := name + debuginfoSuffix
+			if len(files) == 0 && !inOldMoM(dbgName) {
+				continue
+			}
+			dbg, err := newDebuginfoBundle(dbgName)
+			if err != nil {
+				return nil, err
+			}
+			dbg.addMovedFiles(files)
+			// removed together with the bundle when deprecated
+			dbg.Header.Status = b.Header.Status
+			dbgBundles[name] = dbg
+			generated = append(generated, dbg)
+		}
+		for _, name := range ui.bundles {
+			dbg := dbgBundles[name]
+			if dbg == nil {
+				continue
+			}
+			dbg.bundleInfo.DirectIncludes = append([]string{name}, nearestDebuginfoIncludes(name, byName, dbgBundles)...)
+		}
+
+	case debuginfoSplitGlobal:
+		var files []*File
+		seen := make(map[string]bool)
+		for _, name := range ui.bundles {
+			b := byName[name]
+			if b == nil || name == "full" {
+				continue
+			}
+			// The same file can be in many bundles, the first one is kept.
+			for _, f := range b.removeDebuginfo(c.debuginfo) {
+				if !seen[f.Name] {
+					seen[f.Name] = true
+					files = append(files, f)
+				}
+			}
+		}
+		if len(files) == 0 && !inOldMoM(debuginfoGlobalBundle) {
+			return nil, nil
+		}
+		dbg, err := newDebuginfoBundle(debuginfoGlobalBundle)
+		if err != nil {
+			return nil, err
+		}
+		dbg.addMovedFiles(files)
+		generated = append(generated, dbg)
+
+	default:
+		return nil, fmt.Errorf("invalid debuginfo split %q", c.debuginfo.split)
+	}
+
+	fullChroot := filepath.Join(c.imageBase, fmt.Sprint(ui.version), "full")
+	for _, dbg := range generated {
+		fmt.Printf("  %s\n", dbg.Name)
+		trackingFile := filepath.Join("/usr/share/clear/bundles", dbg.Name)
+		if err = createAndWrite(filepath.Join(fullChroot, trackingFile), []byte{}); err != nil {
+			return nil, err
+		}
+		if err = dbg.addRecords(fullChroot, "", []string{trackingFile}, nil, c.hashCache, c.recordPool, c.content.xattrs()); err != nil {
+			return nil, err
+		}
+		dbg.sortFilesName()
+	}
+	return generated, nil
+}
+
+// nearestDebuginfoIncludes returns the debuginfo bundles of the bundles
+// included by name. Includes without a debuginfo bundle are walked through, so
+// the debuginfo of bundles they include is not lost. Includes with one stop
+// the walk, since their debuginfo bundle already includes the rest.
+func nearestDebuginfoIncludes(name string, byName map[string]*Manifest, dbgBundles map[string]*Manifest) []string {
+	var result []string
+	visited := map[string]bool{name: true}
+	var walk func(string)
+	walk = func(name string) {
+		b := byName[name]
+		if b == nil {
+			return
+		}
+		for _, inc := range b.bundleInfo.DirectIncludes {
+			if visited[inc] {
+				continue
+			}
+			visited[inc] = true
+			if incDbg := dbgBundles[inc]; incDbg != nil {
+				result = append(result, incDbg.Name)
+				continue
+			}
+			walk(inc)
+		}
+	}
+	walk(name)
+	return result
+}
+
+// addMovedFiles adds files taken from another manifest to m.
+func (m *Manifest) addMovedFiles(files []*File) {
+	for _, f := range files {
+		m.Files = append(m.Files, f)
+		if f.Info != nil {
+			m.Header.ContentSize += uint64(f.Info.Size())
+		}
+	}
+}
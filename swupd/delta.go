@@ -1,15 +1,16 @@
 package swupd
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
-	"github.com/clearlinux/mixer-tools/helpers"
 	"github.com/pkg/errors"
 )
 
@@ -24,6 +25,17 @@ const (
 	minimumSizeToMakeDeltaInBytes = 200
 )
 
+// deltaLimits bounds the resources used by each delta worker. The majority of
+// all delta creations take significantly less than 1 minute, deltas taking
+// longer are for very large or very hard to diff files, and in practice end up
+// not being used because they are larger than the compressed fullfile. The
+// memory limit avoids multiple workers exhausting the memory when handling
+// large files, those are better served by fullfiles anyway.
+var deltaLimits = bsdiffLimits{
+	MaxMemory: 2 << 30,
+	Timeout:   60 * time.Second,
+}
+
 // Delta represents a delta file between two other files. If Error is present, it
 // indicates that the delta couldn't be created.
 type Delta struct {
@@ -38,14 +50,16 @@ var bsdiffLog *log.Logger
 // CreateDeltasForManifest creates all delta files between the previous and current version of the
 // supplied manifest. Returns a list of deltas (which contains information about
 // individual delta errors). Returns error (and no deltas) if it can't assemble the delta
-// list. If number of workers is zero or less, 1 worker is used.
-func CreateDeltasForManifest(manifest, statedir string, from, to uint32, numWorkers int) ([]Delta, error) {
+// list. If number of workers is zero or less, 1 worker is used. The extended
+// attributes are checked if enabled in opts, which can be nil.
+func CreateDeltasForManifest(manifest, statedir string, from, to uint32, numWorkers int, opts *ContentOptions) ([]Delta, error) {
 	var c config
 
 	c, err := getConfig(statedir)
 	if err != nil {
 		return nil, err
 	}
+	c.content = opts
 
 	var oldManifest *Manifest
 	var newManifest *Manifest
@@ -117,7 +131,7 @@ func deltaTooLarge(c *config, delta *Delta, newPath string) bool {
 		return false
 	}
 	deltaSize := dInfo.Size()
-	fHash, err := GetHashForFile(newPath)
+	fHash, err := GetHashForFileWithXattrs(newPath, c.content.xattrs())
 	if err != nil {
 		return false
 	}
@@ -142,29 +156,58 @@ func createDelta(c *config, delta *Delta) error {
 	oldPath := filepath.Join(c.imageBase, fmt.Sprint(delta.from.Version), "full", delta.from.Name)
 	newPath := filepath.Join(c.imageBase, fmt.Sprint(delta.to.Version), "full", delta.to.Name)
 
-	// Set timeout to 1 minute (60 seconds) for bsdiff
-	// The majority of all delta creations take significantly less than 1 minute
-	// to run, which signifies that bsdiff is working on a delta that may be very
-	// large, or very difficult to diff. In all the cases where bsdiff took
-	// multiple minutes to finish, the delta ended up not being used because it
-	// was larger than the compressed fullfile. This attempts to skip those cases.
-	if err := helpers.RunCommandTimeout(60, "bsdiff", oldPath, newPath, delta.Path); err != nil {
-		_ = os.Remove(delta.Path)
-		if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
-			// bsdiff returns 1 that stands for "FULLDL", i.e. it decided that
-			// a delta is not worth. Give a better error message for that case.
-			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-				if status.ExitStatus() == 1 {
-					return fmt.Errorf("bsdiff returned FULLDL, not using delta %s (%d-%s) -> %s (%d-%s)", delta.from.Name, delta.from.Version, delta.from.Hash, delta.to.Name, delta.to.Version, delta.to.Hash)
-				}
-			}
+	deltaDesc := fmt.Sprintf("%s (%d-%s) -> %s (%d-%s)", delta.from.Name, delta.from.Version, delta.from.Hash, delta.to.Name, delta.to.Version, delta.to.Hash)
+
+	oldContent, err := ioutil.ReadFile(oldPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create delta for %s", deltaDesc)
+	}
+	newContent, err := ioutil.ReadFile(newPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create delta for %s", deltaDesc)
+	}
+	var xattrs map[string]string
+	if c.content.xattrs() {
+		xattrs, err = unchangedXattrs(oldPath, newPath)
+		if err == errXattrsChanged {
+			return fmt.Errorf("extended attributes changed, not using delta %s", deltaDesc)
 		}
-		errStr := fmt.Sprintf("Failed to create delta for %s (%d-%s) -> %s (%d-%s)", delta.from.Name, delta.from.Version, delta.from.Hash, delta.to.Name, delta.to.Version, delta.to.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to create delta for %s", deltaDesc)
+		}
+	}
+
+	deltaContent, err := diffContent(oldContent, newContent, newPath)
+	if err == errDeltaNotWorth {
+		return fmt.Errorf("bsdiff returned FULLDL, not using delta %s", deltaDesc)
+	}
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to create delta for %s", deltaDesc)
 		bsdiffLog.SetPrefix("BSDIFF: ")
-		bsdiffLog.Println(errStr)
+		bsdiffLog.Println(errStr + ": " + err.Error())
 		return errors.Wrap(err, errStr)
 	}
 
+	// Check that the delta actually applies correctly before writing it.
+	testContent, testHash, err := applyDelta(oldContent, deltaContent, xattrs)
+	if err == nil && !bytes.Equal(testContent, newContent) {
+		err = errors.New("patched content differs from new file")
+	}
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to apply delta %s", delta.Path)
+		bsdiffLog.SetPrefix("BSPATCH: ")
+		bsdiffLog.Println(errStr + ": " + err.Error())
+		return errors.Wrap(err, errStr)
+	}
+	if internHash(testHash) != delta.to.Hash {
+		return fmt.Errorf("Delta mismatch: %s -> %s via delta: %s", oldPath, newPath, delta.Path)
+	}
+
+	if err = ioutil.WriteFile(delta.Path, deltaContent, 0644); err != nil {
+		_ = os.Remove(delta.Path)
+		return errors.Wrapf(err, "Failed to write delta %s", delta.Path)
+	}
+
 	// Check that delta is smaller than compressed full file
 	if deltaTooLarge(c, delta, newPath) {
 		_ = os.Remove(delta.Path)
@@ -175,29 +218,70 @@ func createDelta(c *config, delta *Delta) error {
 		return errors.New(errStr)
 	}
 
-	// Check that the delta actually applies correctly.
-	testPath := delta.Path + ".testnewfile"
-	if err := helpers.RunCommandSilent("bspatch", oldPath, testPath, delta.Path); err != nil {
-		errStr := fmt.Sprintf("Failed to apply delta %s", delta.Path)
-		bsdiffLog.SetPrefix("BSPATCH: ")
-		bsdiffLog.Println(errStr)
-		return errors.Wrapf(err, errStr)
-	}
-	defer func() {
-		_ = os.Remove(testPath)
-	}()
+	return nil
+}
 
-	testHash, err := Hashcalc(testPath)
+// errXattrsChanged is returned by unchangedXattrs when the extended attributes
+// of the files differ.
+var errXattrsChanged = errors.New("extended attributes changed")
+
+// unchangedXattrs returns the extended attributes of the file in newPath, or
+// errXattrsChanged if they differ from the ones of the file in oldPath. Deltas
+// don't carry extended attributes, the client keeps the ones from the old
+// file, so they must not change.
+func unchangedXattrs(oldPath, newPath string) (map[string]string, error) {
+	oldXattrs, err := ReadXattrs(oldPath)
 	if err != nil {
-		_ = os.Remove(delta.Path)
-		return errors.Wrap(err, "Failed to calculate hash for test file created applying delta")
+		return nil, err
 	}
-	if testHash != delta.to.Hash {
-		_ = os.Remove(delta.Path)
-		return errors.Wrapf(err, "Delta mismatch: %s -> %s via delta: %s", oldPath, newPath, delta.Path)
+	xattrs, err := ReadXattrs(newPath)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(xattrsBlob(oldXattrs), xattrsBlob(xattrs)) {
+		return nil, errXattrsChanged
 	}
+	return xattrs, nil
+}
 
-	return nil
+// diffContent returns the delta from oldContent to newContent, the content of
+// the file in newPath, whose mode and owner are recorded in the delta.
+func diffContent(oldContent, newContent []byte, newPath string) ([]byte, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(newPath, &st); err != nil {
+		return nil, err
+	}
+	info := &bsdiffFileInfo{
+		Mode: st.Mode,
+		UID:  st.Uid,
+		GID:  st.Gid,
+		Size: st.Size,
+	}
+	var buf bytes.Buffer
+	if err := bsdiff(&buf, oldContent, newContent, info, deltaLimits); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// applyDelta applies delta to oldContent and returns the new content with its
+// hash, including the extended attributes kept from the old file.
+func applyDelta(oldContent, delta []byte, xattrs map[string]string) ([]byte, string, error) {
+	content, info, err := bspatch(oldContent, delta)
+	if err != nil {
+		return nil, "", err
+	}
+	hash, err := GetHashForBytes(&HashFileInfo{
+		Mode:   info.Mode,
+		UID:    info.UID,
+		GID:    info.GID,
+		Size:   info.Size,
+		Xattrs: xattrs,
+	}, content)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, hash, nil
 }
 
 func findDeltas(c *config, oldManifest, newManifest *Manifest) ([]Delta, error) {
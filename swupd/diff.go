@@ -0,0 +1,528 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ChangeKind describes how a file changed between two manifests.
+type ChangeKind int
+
+// Valid values for ChangeKind.
+const (
+	ChangeAdded ChangeKind = iota + 1
+	ChangeRemoved
+	ChangeContent
+	ChangeFlags
+	ChangeRenamed
+	ChangeType
+	ChangeVersion
+)
+
+var changeKindNames = map[ChangeKind]string{
+	ChangeAdded:   "added",
+	ChangeRemoved: "removed",
+	ChangeContent: "content-changed",
+	ChangeFlags:   "flag-changed",
+	ChangeRenamed: "renamed",
+	ChangeType:    "type-changed",
+	ChangeVersion: "version-changed",
+}
+
+// changeKindLetters are used in the patch summary, similar to the status
+// letters of git diff --name-status.
+var changeKindLetters = map[ChangeKind]string{
+	ChangeAdded:   "A",
+	ChangeRemoved: "D",
+	ChangeContent: "M",
+	ChangeFlags:   "F",
+	ChangeRenamed: "R",
+	ChangeType:    "T",
+	ChangeVersion: "V",
+}
+
+func (k ChangeKind) String() string {
+	if name, ok := changeKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// MarshalJSON encodes the kind using its name.
+func (k ChangeKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
+// FileChange is a change of a single file. A is the file in the old manifest
+// and B in the new one, one of them is nil for added and removed files. For
+// renames, OldName is the name of A and Name the name of B.
+type FileChange struct {
+	Kind    ChangeKind
+	Name    string
+	OldName string
+	A       *File
+	B       *File
+}
+
+// ManifestDiff contains the changes between two versions of a manifest.
+type ManifestDiff struct {
+	Name            string
+	FromVersion     uint32
+	ToVersion       uint32
+	FromFileCount   uint32
+	ToFileCount     uint32
+	IncludesAdded   []string
+	IncludesRemoved []string
+	Changes         []*FileChange
+}
+
+// Diff contains the changes between two MoMs, and the changes of each bundle
+// manifest that changed between them.
+type Diff struct {
+	MoM     *ManifestDiff
+	Bundles []*ManifestDiff
+}
+
+// DiffOptions control what is reported as a change.
+type DiffOptions struct {
+	// Versions reports files that only changed their version.
+	Versions bool
+}
+
+// DiffManifests compares the manifests a and b. Either can be nil to
+// represent a manifest that doesn't exist, e.g. for new bundles. When used
+// with MoMs, the changes refer to the bundle manifests; use DiffMoMs to also
+// compare the contents of the bundles.
+func DiffManifests(a, b *Manifest, opts *DiffOptions) (*ManifestDiff, error) {
+	d := &ManifestDiff{}
+	var itA, itB FileIterator
+	var includesA, includesB []*Manifest
+	itA, d.FromVersion, d.FromFileCount, includesA = sortedManifestFiles(a)
+	itB, d.ToVersion, d.ToFileCount, includesB = sortedManifestFiles(b)
+	if a != nil {
+		d.Name = a.Name
+	}
+	if b != nil {
+		d.Name = b.Name
+	}
+	d.diffIncludes(includesA, includesB)
+	return d, d.diffFiles(itA, itB, opts)
+}
+
+func sortedManifestFiles(m *Manifest) (FileIterator, uint32, uint32, []*Manifest) {
+	if m == nil {
+		return NewFileSliceIterator(nil), 0, 0, nil
+	}
+	files := make([]*File, len(m.Files))
+	copy(files, m.Files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return NewFileSliceIterator(files), m.Header.Version, m.Header.FileCount, m.Header.Includes
+}
+
+// DiffSortedManifests compares two manifests named name while reading them,
+// without keeping all their files in memory. Either reader can be nil to
+// represent a manifest that doesn't exist.
+func DiffSortedManifests(name string, a, b *SortedManifestReader, opts *DiffOptions) (*ManifestDiff, error) {
+	d := &ManifestDiff{Name: name}
+	itA := NewFileSliceIterator(nil)
+	itB := NewFileSliceIterator(nil)
+	var includesA, includesB []*Manifest
+	if a != nil {
+		d.FromVersion = a.Header.Version
+		d.FromFileCount = a.Header.FileCount
+		includesA = a.Header.Includes
+		itA = a
+	}
+	if b != nil {
+		d.ToVersion = b.Header.Version
+		d.ToFileCount = b.Header.FileCount
+		includesB = b.Header.Includes
+		itB = b
+	}
+	d.diffIncludes(includesA, includesB)
+	return d, d.diffFiles(itA, itB, opts)
+}
+
+// BundleLoader returns the bundle manifest referred by an entry of a MoM.
+type BundleLoader func(bundle *File) (*Manifest, error)
+
+// DiffMoMs compares two MoMs and the bundle manifests that were added, removed
+// or changed between them, loaded using loadA and loadB respectively.
+func DiffMoMs(a, b *Manifest, loadA, loadB BundleLoader, opts *DiffOptions) (*Diff, error) {
+	momDiff, err := DiffManifests(a, b, opts)
+	if err != nil {
+		return nil, err
+	}
+	result := &Diff{MoM: momDiff}
+	for _, c := range momDiff.Changes {
+		var bundleA, bundleB *Manifest
+		switch c.Kind {
+		case ChangeAdded, ChangeRemoved, ChangeContent:
+		default:
+			continue
+		}
+		if c.A != nil && c.A.Present() {
+			if bundleA, err = loadA(c.A); err != nil {
+				return nil, err
+			}
+		}
+		if c.B != nil && c.B.Present() {
+			if bundleB, err = loadB(c.B); err != nil {
+				return nil, err
+			}
+		}
+		bundleDiff, err := DiffManifests(bundleA, bundleB, opts)
+		if err != nil {
+			return nil, err
+		}
+		bundleDiff.Name = c.Name
+		result.Bundles = append(result.Bundles, bundleDiff)
+	}
+	return result, nil
+}
+
+func (d *ManifestDiff) diffIncludes(a, b []*Manifest) {
+	inA := make(map[string]bool)
+	for _, inc := range a {
+		inA[inc.Name] = true
+	}
+	inB := make(map[string]bool)
+	for _, inc := range b {
+		inB[inc.Name] = true
+		if !inA[inc.Name] {
+			d.IncludesAdded = append(d.IncludesAdded, inc.Name)
+		}
+	}
+	for _, inc := range a {
+		if !inB[inc.Name] {
+			d.IncludesRemoved = append(d.IncludesRemoved, inc.Name)
+		}
+	}
+	sort.Strings(d.IncludesAdded)
+	sort.Strings(d.IncludesRemoved)
+}
+
+func (d *ManifestDiff) diffFiles(a, b FileIterator, opts *DiffOptions) error {
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+	err := MergeJoinFiles(a, b, func(fa, fb *File) error {
+		presentA := fa != nil && fa.Present()
+		presentB := fb != nil && fb.Present()
+		add := func(kind ChangeKind) {
+			f := fa
+			if f == nil {
+				f = fb
+			}
+			d.Changes = append(d.Changes, &FileChange{Kind: kind, Name: f.Name, A: fa, B: fb})
+		}
+
+		switch {
+		case !presentA && presentB:
+			add(ChangeAdded)
+		case presentA && !presentB:
+			add(ChangeRemoved)
+		case fa == nil || fb == nil:
+			// only a deleted entry, nothing changed.
+		case fa.Type != fb.Type && presentA:
+			add(ChangeType)
+		default:
+			changed := false
+			if presentA && fa.Hash != fb.Hash {
+				add(ChangeContent)
+				changed = true
+			}
+			if fa.Status != fb.Status || fa.Modifier != fb.Modifier || fa.Rename != fb.Rename {
+				add(ChangeFlags)
+				changed = true
+			}
+			if !changed && opts.Versions && fa.Version != fb.Version {
+				add(ChangeVersion)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.detectRenames()
+	return nil
+}
+
+// detectRenames replaces pairs of removed and added regular files with the
+// same contents by a rename. Only unambiguous pairs, where the contents match a
+// single removed and a single added file, are considered.
+func (d *ManifestDiff) detectRenames() {
+	removed := make(map[Hashval][]*FileChange)
+	added := make(map[Hashval][]*FileChange)
+	for _, c := range d.Changes {
+		var f *File
+		var m map[Hashval][]*FileChange
+		switch c.Kind {
+		case ChangeRemoved:
+			f, m = c.A, removed
+		case ChangeAdded:
+			f, m = c.B, added
+		default:
+			continue
+		}
+		if f.Type != TypeFile || f.Hash == 0 {
+			continue
+		}
+		m[f.Hash] = append(m[f.Hash], c)
+	}
+
+	drop := make(map[*FileChange]bool)
+	for hash, adds := range added {
+		removes := removed[hash]
+		if len(adds) != 1 || len(removes) != 1 {
+			continue
+		}
+		add, remove := adds[0], removes[0]
+		add.Kind = ChangeRenamed
+		add.OldName = remove.Name
+		add.A = remove.A
+		drop[remove] = true
+	}
+	if len(drop) == 0 {
+		return
+	}
+
+	changes := d.Changes[:0]
+	for _, c := range d.Changes {
+		if !drop[c] {
+			changes = append(changes, c)
+		}
+	}
+	d.Changes = changes
+}
+
+// Count returns the number of changes of the given kind.
+func (d *ManifestDiff) Count(kind ChangeKind) int {
+	n := 0
+	for _, c := range d.Changes {
+		if c.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Empty returns true if there are no changes in the manifest.
+func (d *ManifestDiff) Empty() bool {
+	return len(d.Changes) == 0 && len(d.IncludesAdded) == 0 && len(d.IncludesRemoved) == 0
+}
+
+func flagsOrDots(f *File) string {
+	if f == nil {
+		return "...."
+	}
+	flags, err := f.GetFlagString()
+	if err != nil {
+		return "...."
+	}
+	return flags
+}
+
+func shortHash(f *File) string {
+	return f.Hash.String()[:7]
+}
+
+// WriteText writes a human readable description of the changes. Lines for
+// added content start with "+", removed content with "-" and other changes
+// with "~".
+func (d *ManifestDiff) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "=== Manifest.%s %d -> %d\n", d.Name, d.FromVersion, d.ToVersion); err != nil {
+		return err
+	}
+	if d.FromFileCount != d.ToFileCount {
+		if _, err := fmt.Fprintf(w, "-filecount: %d\n+filecount: %d\n", d.FromFileCount, d.ToFileCount); err != nil {
+			return err
+		}
+	}
+	for _, name := range d.IncludesRemoved {
+		if _, err := fmt.Fprintf(w, "-includes: %s\n", name); err != nil {
+			return err
+		}
+	}
+	for _, name := range d.IncludesAdded {
+		if _, err := fmt.Fprintf(w, "+includes: %s\n", name); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range d.Changes {
+		var err error
+		switch c.Kind {
+		case ChangeAdded:
+			_, err = fmt.Fprintf(w, "+%s %s\n", flagsOrDots(c.B), c.Name)
+		case ChangeRemoved:
+			_, err = fmt.Fprintf(w, "-%s %s\n", flagsOrDots(c.A), c.Name)
+		case ChangeContent:
+			_, err = fmt.Fprintf(w, "~%s %s (HASH: %s -> %s)\n", flagsOrDots(c.B), c.Name, shortHash(c.A), shortHash(c.B))
+		case ChangeFlags, ChangeType:
+			_, err = fmt.Fprintf(w, "~%s %s (FLAGS: %s -> %s)\n", flagsOrDots(c.B), c.Name, flagsOrDots(c.A), flagsOrDots(c.B))
+		case ChangeRenamed:
+			_, err = fmt.Fprintf(w, "~%s %s (RENAMED FROM: %s)\n", flagsOrDots(c.B), c.Name, c.OldName)
+		case ChangeVersion:
+			_, err = fmt.Fprintf(w, "~%s %s (VERSION: %d -> %d)\n", flagsOrDots(c.B), c.Name, c.A.Version, c.B.Version)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// WriteText writes a human readable description of the changes in the MoM
+// followed by the changes in each bundle.
+func (d *Diff) WriteText(w io.Writer) error {
+	if err := d.MoM.WriteText(w); err != nil {
+		return err
+	}
+	for _, b := range d.Bundles {
+		if err := b.WriteText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePatchSummary writes one line per change with tab separated fields: the
+// manifest name, a letter for the kind of change (A, D, M, F, R, T or V) and
+// the file name. Renames have an extra field with the new name, after the old
+// one.
+func (d *ManifestDiff) WritePatchSummary(w io.Writer) error {
+	for _, c := range d.Changes {
+		var err error
+		if c.Kind == ChangeRenamed {
+			_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Name, changeKindLetters[c.Kind], c.OldName, c.Name)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\t%s\t%s\n", d.Name, changeKindLetters[c.Kind], c.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePatchSummary writes the patch summary of the MoM followed by the patch
+// summary of each bundle.
+func (d *Diff) WritePatchSummary(w io.Writer) error {
+	if err := d.MoM.WritePatchSummary(w); err != nil {
+		return err
+	}
+	for _, b := range d.Bundles {
+		if err := b.WritePatchSummary(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileChangeJSON struct {
+	Kind    ChangeKind `json:"kind"`
+	Name    string     `json:"name"`
+	OldName string     `json:"oldName,omitempty"`
+	A       *fileJSON  `json:"a,omitempty"`
+	B       *fileJSON  `json:"b,omitempty"`
+}
+
+type manifestDiffJSON struct {
+	Name            string            `json:"name"`
+	FromVersion     uint32            `json:"fromVersion"`
+	ToVersion       uint32            `json:"toVersion"`
+	FromFileCount   uint32            `json:"fromFileCount"`
+	ToFileCount     uint32            `json:"toFileCount"`
+	IncludesAdded   []string          `json:"includesAdded,omitempty"`
+	IncludesRemoved []string          `json:"includesRemoved,omitempty"`
+	Changes         []*fileChangeJSON `json:"changes"`
+}
+
+func (d *ManifestDiff) toJSON() (*manifestDiffJSON, error) {
+	dj := &manifestDiffJSON{
+		Name:            d.Name,
+		FromVersion:     d.FromVersion,
+		ToVersion:       d.ToVersion,
+		FromFileCount:   d.FromFileCount,
+		ToFileCount:     d.ToFileCount,
+		IncludesAdded:   d.IncludesAdded,
+		IncludesRemoved: d.IncludesRemoved,
+		Changes:         make([]*fileChangeJSON, 0, len(d.Changes)),
+	}
+	for _, c := range d.Changes {
+		cj := &fileChangeJSON{Kind: c.Kind, Name: c.Name, OldName: c.OldName}
+		var err error
+		if c.A != nil {
+			if cj.A, err = newFileJSON(c.A); err != nil {
+				return nil, err
+			}
+		}
+		if c.B != nil {
+			if cj.B, err = newFileJSON(c.B); err != nil {
+				return nil, err
+			}
+		}
+		dj.Changes = append(dj.Changes, cj)
+	}
+	return dj, nil
+}
+
+func writeIndentedJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// WriteJSON writes the changes as a JSON object. Files are represented as in
+// ManifestJSONSchema.
+func (d *ManifestDiff) WriteJSON(w io.Writer) error {
+	dj, err := d.toJSON()
+	if err != nil {
+		return err
+	}
+	return writeIndentedJSON(w, dj)
+}
+
+// WriteJSON writes the changes as a JSON object with the fields "mom" and
+// "bundles", each containing the changes of a manifest like
+// ManifestDiff.WriteJSON.
+func (d *Diff) WriteJSON(w io.Writer) error {
+	var out struct {
+		MoM     *manifestDiffJSON   `json:"mom"`
+		Bundles []*manifestDiffJSON `json:"bundles"`
+	}
+	var err error
+	if out.MoM, err = d.MoM.toJSON(); err != nil {
+		return err
+	}
+	out.Bundles = make([]*manifestDiffJSON, 0, len(d.Bundles))
+	for _, b := range d.Bundles {
+		bj, err := b.toJSON()
+		if err != nil {
+			return err
+		}
+		out.Bundles = append(out.Bundles, bj)
+	}
+	return writeIndentedJSON(w, &out)
+}
@@ -0,0 +1,226 @@
+package swupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDiffTestManifest(name string, version uint32, files ...*File) *Manifest {
+	return &Manifest{
+		Name: name,
+		Header: ManifestHeader{
+			Format:    26,
+			Version:   version,
+			FileCount: uint32(len(files)),
+			TimeStamp: time.Unix(1000, 0),
+		},
+		Files: files,
+	}
+}
+
+func diffTestHash(c byte) Hashval {
+	return internHash(strings.Repeat(string(c), 64))
+}
+
+func TestDiffManifests(t *testing.T) {
+	a := newDiffTestManifest("test-bundle", 10,
+		&File{Name: "/removed", Hash: diffTestHash('1'), Version: 10, Type: TypeFile},
+		&File{Name: "/content", Hash: diffTestHash('2'), Version: 10, Type: TypeFile},
+		&File{Name: "/flags", Hash: diffTestHash('3'), Version: 10, Type: TypeFile},
+		&File{Name: "/type", Hash: diffTestHash('4'), Version: 10, Type: TypeFile},
+		&File{Name: "/old-name", Hash: diffTestHash('5'), Version: 10, Type: TypeFile},
+		&File{Name: "/same", Hash: diffTestHash('6'), Version: 10, Type: TypeFile},
+		&File{Name: "/version", Hash: diffTestHash('7'), Version: 10, Type: TypeFile},
+		&File{Name: "/was-deleted", Hash: internHash(AllZeroHash), Version: 10, Status: StatusDeleted},
+	)
+	a.Header.Includes = []*Manifest{{Name: "os-core"}, {Name: "editors"}}
+	b := newDiffTestManifest("test-bundle", 20,
+		&File{Name: "/version", Hash: diffTestHash('7'), Version: 20, Type: TypeFile},
+		&File{Name: "/added", Hash: diffTestHash('8'), Version: 20, Type: TypeFile},
+		&File{Name: "/content", Hash: diffTestHash('9'), Version: 20, Type: TypeFile},
+		&File{Name: "/flags", Hash: diffTestHash('3'), Version: 20, Type: TypeFile, Modifier: ModifierConfig},
+		&File{Name: "/type", Hash: diffTestHash('a'), Version: 20, Type: TypeDirectory},
+		&File{Name: "/new-name", Hash: diffTestHash('5'), Version: 20, Type: TypeFile},
+		&File{Name: "/same", Hash: diffTestHash('6'), Version: 10, Type: TypeFile},
+		&File{Name: "/removed", Hash: internHash(AllZeroHash), Version: 20, Status: StatusDeleted},
+		&File{Name: "/was-deleted", Hash: diffTestHash('b'), Version: 20, Type: TypeFile},
+	)
+	b.Header.Includes = []*Manifest{{Name: "os-core"}, {Name: "shells"}}
+
+	d, err := DiffManifests(a, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "test-bundle" || d.FromVersion != 10 || d.ToVersion != 20 {
+		t.Errorf("unexpected diff header %+v", d)
+	}
+	if strings.Join(d.IncludesAdded, ",") != "shells" || strings.Join(d.IncludesRemoved, ",") != "editors" {
+		t.Errorf("got includes added %v and removed %v", d.IncludesAdded, d.IncludesRemoved)
+	}
+
+	var got []string
+	for _, c := range d.Changes {
+		got = append(got, c.Kind.String()+" "+c.OldName+" "+c.Name)
+	}
+	expected := []string{
+		"added  /added",
+		"content-changed  /content",
+		"flag-changed  /flags",
+		"renamed /old-name /new-name",
+		"removed  /removed",
+		"type-changed  /type",
+		"added  /was-deleted",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got changes:\n%s\nbut expected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	d, err = DiffManifests(a, b, &DiffOptions{Versions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Count(ChangeVersion) != 1 {
+		t.Errorf("got %d version changes but expected 1", d.Count(ChangeVersion))
+	}
+}
+
+func TestDiffManifestsAmbiguousRename(t *testing.T) {
+	a := newDiffTestManifest("b", 10,
+		&File{Name: "/a1", Hash: diffTestHash('1'), Type: TypeFile},
+		&File{Name: "/a2", Hash: diffTestHash('1'), Type: TypeFile},
+	)
+	b := newDiffTestManifest("b", 20,
+		&File{Name: "/b1", Hash: diffTestHash('1'), Type: TypeFile},
+	)
+	d, err := DiffManifests(a, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Count(ChangeRenamed) != 0 || d.Count(ChangeAdded) != 1 || d.Count(ChangeRemoved) != 2 {
+		t.Errorf("ambiguous rename was not reported as added and removed files: %v", d.Changes)
+	}
+}
+
+func TestDiffMoMs(t *testing.T) {
+	bundles := map[string]*Manifest{
+		"os-core/10": newDiffTestManifest("os-core", 10, &File{Name: "/a", Hash: diffTestHash('1'), Type: TypeFile}),
+		"os-core/20": newDiffTestManifest("os-core", 20, &File{Name: "/a", Hash: diffTestHash('2'), Type: TypeFile}),
+		"editors/10": newDiffTestManifest("editors", 10, &File{Name: "/vi", Hash: diffTestHash('3'), Type: TypeFile}),
+		"shells/20":  newDiffTestManifest("shells", 20, &File{Name: "/sh", Hash: diffTestHash('4'), Type: TypeFile}),
+	}
+	load := func(f *File) (*Manifest, error) {
+		m, ok := bundles[fmt.Sprintf("%s/%d", f.Name, f.Version)]
+		if !ok {
+			return nil, fmt.Errorf("unexpected load of %s %d", f.Name, f.Version)
+		}
+		return m, nil
+	}
+
+	momA := newDiffTestManifest("MoM", 10,
+		&File{Name: "os-core", Hash: diffTestHash('a'), Version: 10, Type: TypeManifest},
+		&File{Name: "editors", Hash: diffTestHash('b'), Version: 10, Type: TypeManifest},
+		&File{Name: "unchanged", Hash: diffTestHash('c'), Version: 5, Type: TypeManifest},
+	)
+	momB := newDiffTestManifest("MoM", 20,
+		&File{Name: "os-core", Hash: diffTestHash('d'), Version: 20, Type: TypeManifest},
+		&File{Name: "shells", Hash: diffTestHash('e'), Version: 20, Type: TypeManifest},
+		&File{Name: "unchanged", Hash: diffTestHash('c'), Version: 5, Type: TypeManifest},
+	)
+
+	d, err := DiffMoMs(momA, momB, load, load, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.MoM.Changes) != 3 {
+		t.Errorf("got %d MoM changes but expected 3", len(d.MoM.Changes))
+	}
+
+	var summary bytes.Buffer
+	if err = d.WritePatchSummary(&summary); err != nil {
+		t.Fatal(err)
+	}
+	expected := `MoM	D	editors
+MoM	M	os-core
+MoM	A	shells
+editors	D	/vi
+os-core	M	/a
+shells	A	/sh
+`
+	if summary.String() != expected {
+		t.Errorf("got patch summary:\n%s\nbut expected:\n%s", summary.String(), expected)
+	}
+
+	var text bytes.Buffer
+	if err = d.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"=== Manifest.os-core 10 -> 20", "~F... /a (HASH: 1111111 -> 2222222)", "+F... /sh", "-F... /vi"} {
+		if !strings.Contains(text.String(), s) {
+			t.Errorf("text output doesn't contain %q:\n%s", s, text.String())
+		}
+	}
+
+	var js bytes.Buffer
+	if err = d.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		MoM struct {
+			Changes []struct {
+				Kind string
+				Name string
+			}
+		}
+		Bundles []struct {
+			Name string
+		}
+	}
+	if err = json.Unmarshal(js.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Bundles) != 3 || decoded.MoM.Changes[0].Kind != "removed" || decoded.MoM.Changes[0].Name != "editors" {
+		t.Errorf("unexpected JSON output:\n%s", js.String())
+	}
+}
+
+func TestDiffSortedManifests(t *testing.T) {
+	write := func(m *Manifest) *SortedManifestReader {
+		var buf bytes.Buffer
+		if err := m.WriteManifest(&buf); err != nil {
+			t.Fatal(err)
+		}
+		sr, err := NewSortedManifestReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sr
+	}
+	a := newDiffTestManifest("b", 10,
+		&File{Name: "/x", Hash: diffTestHash('1'), Version: 10, Type: TypeFile},
+		&File{Name: "/y", Hash: diffTestHash('2'), Version: 5, Type: TypeFile},
+	)
+	b := newDiffTestManifest("b", 20,
+		&File{Name: "/x", Hash: diffTestHash('3'), Version: 20, Type: TypeFile},
+		&File{Name: "/y", Hash: diffTestHash('2'), Version: 5, Type: TypeFile},
+	)
+
+	d, err := DiffSortedManifests("b", write(a), write(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Changes) != 1 || d.Changes[0].Kind != ChangeContent || d.Changes[0].Name != "/x" {
+		t.Errorf("unexpected changes %v", d.Changes)
+	}
+
+	d, err = DiffSortedManifests("b", nil, write(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Count(ChangeAdded) != 2 || d.FromVersion != 0 || d.ToVersion != 20 {
+		t.Errorf("unexpected diff against missing manifest %+v", d)
+	}
+}
@@ -264,7 +264,10 @@ func (f *File) findFileNameInSlice(fs []*File) *File {
 	return nil
 }
 
-func (f *File) isUnsupportedTypeChange() bool {
+// replacesDirectory tells if f takes the place of a directory with an entry
+// of another type. Only valid while f is linked to its previous version by
+// DeltaPeer.
+func (f *File) replacesDirectory() bool {
 	if f.DeltaPeer == nil {
 		// nothing to check, new or deleted file
 		return false
@@ -274,16 +277,7 @@ func (f *File) isUnsupportedTypeChange() bool {
 		return false
 	}
 
-	if f.Type == f.DeltaPeer.Type {
-		return false
-	}
-
-	// file -> link OK
-	// file -> directory OK
-	// link -> file OK
-	// link -> directory OK
-	// directory -> anything TYPE CHANGE
-	return (f.DeltaPeer.Type == TypeDirectory && f.Type != TypeDirectory)
+	return f.DeltaPeer.Type == TypeDirectory && f.Type != TypeDirectory
 }
 
 // Present tells if a file is present. Returns false if the file is deleted or ghosted.
@@ -361,9 +361,9 @@ func TestTypeHasChanged(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		t.Run("isUnsupportedTypeChange", func(t *testing.T) {
-			if tc.file.isUnsupportedTypeChange() != tc.expected {
-				t.Errorf("isUnsupportedTypeChange returned %v when %v was expected",
+		t.Run("replacesDirectory", func(t *testing.T) {
+			if tc.file.replacesDirectory() != tc.expected {
+				t.Errorf("replacesDirectory returned %v when %v was expected",
 					!tc.expected, tc.expected)
 			}
 		})
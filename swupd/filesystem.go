@@ -19,6 +19,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 const illegalChars = ";&|*`/<>\\\"'"
@@ -27,27 +28,11 @@ func filenameBlacklisted(fname string) bool {
 	return strings.ContainsAny(fname, illegalChars)
 }
 
-// createFileRecord creates a manifest File entry from a file
-func (m *Manifest) createFileRecord(rootPath, path, removePrefix string, fi os.FileInfo) error {
-	file, err := recordFromFile(rootPath, path, removePrefix, fi)
-	if err != nil {
-		return err
-	}
-
-	// this is a file to skip
-	if file == nil {
-		return nil
-	}
-
-	m.Files = append(m.Files, file)
-	m.Header.ContentSize += uint64(fi.Size())
-
-	return nil
-}
-
 // recordFromFile creates a struct File record from an os.FileInfo object
-// this function sets the Name, Info, Type, and Hash fields
-func recordFromFile(rootPath, path, removePrefix string, fi os.FileInfo) (*File, error) {
+// this function sets the Name, Info, Type, and Hash fields. The hash is taken
+// from hc when possible, hc can be nil. The extended attributes are part of the
+// hash if xattrs is true.
+func recordFromFile(rootPath, path, removePrefix string, fi os.FileInfo, hc *hashCache, xattrs bool) (*File, error) {
 	var file *File
 	var fname string
 	if removePrefix != "" {
@@ -80,7 +65,7 @@ func recordFromFile(rootPath, path, removePrefix string, fi os.FileInfo) (*File,
 		return nil, fmt.Errorf("%v is an unsupported file type", file.Name)
 	}
 
-	fh, err := Hashcalc(filepath.Join(rootPath, file.Name))
+	fh, err := hc.hash(filepath.Join(rootPath, file.Name), xattrs)
 	if err != nil {
 		return nil, fmt.Errorf("hash calculation error: %v", err)
 	}
@@ -90,14 +75,16 @@ func recordFromFile(rootPath, path, removePrefix string, fi os.FileInfo) (*File,
 	return file, nil
 }
 
-// createManifestRecord wraps createFileRecord to create a Manifest record for a MoM
-func (m *Manifest) createManifestRecord(rootPath, path string, version uint32) error {
+// createManifestRecord wraps recordFromFile to create a Manifest record for a
+// MoM. The hash includes the extended attributes if xattrs is set, like the
+// hashes of the content.
+func (m *Manifest) createManifestRecord(rootPath, path string, version uint32, xattrs bool) error {
 	fi, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
 
-	file, err := recordFromFile(rootPath, path, "", fi)
+	file, err := recordFromFile(rootPath, path, "", fi, nil, xattrs)
 	if err != nil {
 		if strings.Contains(err.Error(), "hash calculation error") {
 			return err
@@ -118,23 +105,120 @@ func (m *Manifest) createManifestRecord(rootPath, path string, version uint32) e
 	return nil
 }
 
-func (m *Manifest) addFilesFromChroot(rootPath, removePrefix string) error {
+func (m *Manifest) addFilesFromChroot(rootPath, removePrefix string, hc *hashCache, pool *recordPool, xattrs bool) error {
 	if _, err := os.Stat(rootPath); os.IsNotExist(err) {
 		return err
 	}
 
+	var paths []string
+	var infos []os.FileInfo
 	err := filepath.Walk(rootPath, func(path string, fi os.FileInfo, err error) error {
-		err = m.createFileRecord(rootPath, path, removePrefix, fi)
-		if err != nil {
+		paths = append(paths, path)
+		infos = append(infos, fi)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.addRecords(rootPath, removePrefix, paths, infos, hc, pool, xattrs)
+}
+
+// addRecords creates the records of paths in rootPath and adds them to m in
+// the same order as paths, so the result doesn't depend on the number of
+// workers in pool. If infos is nil the paths are stat'ed. Errors other than
+// hash calculation errors are reported as warnings and the path is skipped. The
+// hashes include the extended attributes if xattrs is true.
+func (m *Manifest) addRecords(rootPath, removePrefix string, paths []string, infos []os.FileInfo, hc *hashCache, pool *recordPool, xattrs bool) error {
+	files := make([]*File, len(paths))
+	errs := make([]error, len(paths))
+
+	if infos == nil {
+		infos = make([]os.FileInfo, len(paths))
+		pool.run(len(paths), func(i int) {
+			infos[i], errs[i] = os.Lstat(filepath.Join(rootPath, paths[i]))
+		})
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	pool.run(len(paths), func(i int) {
+		files[i], errs[i] = recordFromFile(rootPath, paths[i], removePrefix, infos[i], hc, xattrs)
+	})
+
+	for i, file := range files {
+		if err := errs[i]; err != nil {
 			if strings.Contains(err.Error(), "hash calculation error") {
 				return err
 			}
 			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+			continue
 		}
-		return nil
-	})
 
-	return err
+		// this is a file to skip
+		if file == nil {
+			continue
+		}
+
+		m.Files = append(m.Files, file)
+		m.Header.ContentSize += uint64(infos[i].Size())
+	}
+	return nil
+}
+
+// recordPool runs the creation of file records with a bounded number of
+// workers, shared by all the manifests being created.
+type recordPool struct {
+	jobs chan func()
+}
+
+// newRecordPool starts a pool with the given number of workers. If number of
+// workers is zero or less, 1 worker is used.
+func newRecordPool(workers int) *recordPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &recordPool{jobs: make(chan func())}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// run calls f for each index from 0 to n-1 using the pool workers, and waits
+// for all of them to finish. A nil pool calls f serially.
+func (p *recordPool) run(n int, f func(i int)) {
+	if p == nil {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		p.jobs <- func() {
+			f(i)
+			wg.Done()
+		}
+	}
+	wg.Wait()
+}
+
+// close stops the workers of the pool.
+func (p *recordPool) close() {
+	if p != nil {
+		close(p.jobs)
+	}
 }
 
 func exists(path string) bool {
@@ -2,6 +2,7 @@ package swupd
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -14,17 +15,6 @@ import (
 // debugFullfiles is a flag to turn on debug statements for fullfile creation.
 const debugFullfiles = false
 
-type compressFunc func(dst io.Writer, src io.Reader) error
-
-var fullfileCompressors = []struct {
-	Name string
-	Func compressFunc
-}{
-	{"external-bzip2", externalCompressFunc("bzip2")},
-	{"external-gzip", externalCompressFunc("gzip")},
-	{"external-xz", externalCompressFunc("xz")},
-}
-
 // FullfilesInfo holds statistics about a fullfile generation.
 type FullfilesInfo struct {
 	NotCompressed    uint
@@ -34,9 +24,15 @@ type FullfilesInfo struct {
 
 // CreateFullfiles creates full file compressed tars for files in chrootDir and places
 // them in outputDir. It doesn't regenerate full files that already exist. If number
-// of workers is zero or less, 1 worker is used.
-func CreateFullfiles(m *Manifest, chrootDir, outputDir string, numWorkers int) (*FullfilesInfo, error) {
-	var err error
+// of workers is zero or less, 1 worker is used. The compressors and extended
+// attributes are selected by opts, which can be nil.
+func CreateFullfiles(m *Manifest, chrootDir, outputDir string, numWorkers int, opts *ContentOptions) (*FullfilesInfo, error) {
+	compressors, err := opts.fullfileCompressors()
+	if err != nil {
+		return nil, err
+	}
+	xattrs := opts.xattrs()
+
 	if _, err = os.Stat(chrootDir); err != nil {
 		return nil, fmt.Errorf("couldn't access the full chroot: %s", err)
 	}
@@ -81,11 +77,11 @@ func CreateFullfiles(m *Manifest, chrootDir, outputDir string, numWorkers int) (
 
 			switch f.Type {
 			case TypeDirectory:
-				tErr = createDirectoryFullfile(input, name, output, info)
+				tErr = createDirectoryFullfile(input, name, output, xattrs, info)
 			case TypeLink:
-				tErr = createLinkFullfile(input, name, output, info)
+				tErr = createLinkFullfile(input, name, output, xattrs, info)
 			case TypeFile:
-				tErr = createRegularFullfile(input, name, output, info)
+				tErr = createRegularFullfile(input, name, output, compressors, xattrs, info)
 			default:
 				tErr = fmt.Errorf("file %s is of unsupported type %q", f.Name, f.Type)
 			}
@@ -144,7 +140,7 @@ func CreateFullfiles(m *Manifest, chrootDir, outputDir string, numWorkers int) (
 	return total, nil
 }
 
-func createDirectoryFullfile(input, name, output string, info *FullfilesInfo) error {
+func createDirectoryFullfile(input, name, output string, xattrs bool, info *FullfilesInfo) error {
 	fi, err := os.Lstat(input)
 	if err != nil {
 		return fmt.Errorf("couldn't create fullfile from %s: %s", input, err)
@@ -153,7 +149,7 @@ func createDirectoryFullfile(input, name, output string, info *FullfilesInfo) er
 		return fmt.Errorf("couldn't create fullfile from %s: manifest expected a directory but it is not", input)
 	}
 
-	hdr, err := getHeaderFromFileInfo(fi)
+	hdr, err := getHeaderFromFileInfo(fi, input, xattrs)
 	if err != nil {
 		return fmt.Errorf("couldn't create fullfile from %s: %s", input, err)
 	}
@@ -169,7 +165,7 @@ func createDirectoryFullfile(input, name, output string, info *FullfilesInfo) er
 	return nil
 }
 
-func createLinkFullfile(input, name, output string, info *FullfilesInfo) error {
+func createLinkFullfile(input, name, output string, xattrs bool, info *FullfilesInfo) error {
 	fi, err := os.Lstat(input)
 	if err != nil {
 		return fmt.Errorf("couldn't create fullfile from %s: %s", input, err)
@@ -182,7 +178,7 @@ func createLinkFullfile(input, name, output string, info *FullfilesInfo) error {
 		return fmt.Errorf("couldn't create fullfile from %s: %s", input, err)
 	}
 
-	hdr, err := getHeaderFromFileInfo(fi)
+	hdr, err := getHeaderFromFileInfo(fi, input, xattrs)
 	if err != nil {
 		return fmt.Errorf("couldn't create fullfile from %s: %s", input, err)
 	}
@@ -199,7 +195,7 @@ func createLinkFullfile(input, name, output string, info *FullfilesInfo) error {
 	return nil
 }
 
-func createRegularFullfile(input, name, output string, info *FullfilesInfo) (err error) {
+func createRegularFullfile(input, name, output string, compressors []*Compressor, xattrs bool, info *FullfilesInfo) (err error) {
 	// Ensure this is a regular file.
 	fi, err := os.Lstat(input)
 	if err != nil {
@@ -221,7 +217,7 @@ func createRegularFullfile(input, name, output string, info *FullfilesInfo) (err
 			err = cerr
 		}
 	}()
-	err = tarRegularFullfile(uncompressed, input, name, fi)
+	err = tarRegularFullfile(uncompressed, input, name, fi, xattrs)
 	if err != nil {
 		return fmt.Errorf("couldn't archive the file %s: %s", input, err)
 	}
@@ -235,56 +231,35 @@ func createRegularFullfile(input, name, output string, info *FullfilesInfo) (err
 		log.Printf("DEBUG: %s (%d bytes, uncompressed)", filepath.Base(output), uncompressedSize)
 	}
 
-	// Pick the best compression option (or no compression) for that specific fullfile.
-	best := ""
+	// Pick the best compression option (or no compression) for that specific fullfile. The
+	// candidates are kept in memory, only the best one is written back to the output.
+	var best *bytes.Buffer
+	var bestName string
 	bestSize := uncompressedSize
-	for i, c := range fullfileCompressors {
-		var candidateSize int64
-		candidate := fmt.Sprintf("%s.%d.%s", output, i, c.Name)
-
-		_, err := uncompressed.Seek(0, io.SeekStart)
+	for _, c := range compressors {
+		_, err = uncompressed.Seek(0, io.SeekStart)
 		if err != nil {
 			return fmt.Errorf("couldn't seek in fullfile %s: %s", input, err)
 		}
-		out, err := os.Create(candidate)
-		if err != nil {
-			log.Printf("WARNING: couldn't create output file for %q compressor: %s", c.Name, err)
-			continue
-		}
-		err = c.Func(out, uncompressed)
+		candidate := &bytes.Buffer{}
+		err = c.Compress(candidate, uncompressed)
 		if err != nil {
 			log.Printf("WARNING: couldn't compress %s using compressor %q: %s", input, c.Name, err)
-			_ = out.Close()
-			_ = os.RemoveAll(candidate)
 			continue
 		}
-		candidateSize, err = out.Seek(0, io.SeekEnd)
-		if err != nil {
-			log.Printf("WARNING: couldn't get size of %s: %s", candidate, err)
-			_ = out.Close()
-			_ = os.RemoveAll(candidate)
-			continue
-		}
-		_ = out.Close()
 
-		if candidateSize < bestSize {
-			if best != "" {
-				_ = os.RemoveAll(best)
-			}
-			best = candidate
-			bestSize = candidateSize
-		} else {
-			_ = os.RemoveAll(candidate)
+		if debugFullfiles {
+			log.Printf("DEBUG: %s.%s (%d bytes)", filepath.Base(output), c.Name, candidate.Len())
 		}
 
-		if debugFullfiles {
-			log.Printf("DEBUG: %s (%d bytes)", filepath.Base(candidate), candidateSize)
+		if int64(candidate.Len()) < bestSize {
+			best = candidate
+			bestName = c.Name
+			bestSize = int64(candidate.Len())
 		}
 	}
 
-	var bestName string
-	if best != "" {
-		bestName = filepath.Ext(best)[1:]
+	if best != nil {
 		info.CompressedCounts[bestName]++
 	} else {
 		bestName = "<uncompressed>"
@@ -295,17 +270,28 @@ func createRegularFullfile(input, name, output string, info *FullfilesInfo) (err
 		log.Printf("DEBUG: best algorithm was %s", bestName)
 	}
 
-	if best != "" {
-		// Failure during rename might indicate some further problems, so return error
-		// instead of ignoring it (since there is an uncompressed version).
-		return os.Rename(best, output)
+	if best == nil {
+		return nil
+	}
+
+	// Failure while replacing the contents might indicate some further problems, so return
+	// error instead of ignoring it.
+	if err = uncompressed.Truncate(0); err != nil {
+		return fmt.Errorf("couldn't truncate fullfile %s: %s", output, err)
+	}
+	if _, err = uncompressed.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("couldn't seek in fullfile %s: %s", output, err)
+	}
+	if _, err = best.WriteTo(uncompressed); err != nil {
+		_ = os.Remove(output)
+		return fmt.Errorf("couldn't write compressed fullfile %s: %s", output, err)
 	}
 	return nil
 }
 
-func tarRegularFullfile(w io.Writer, input, name string, fi os.FileInfo) error {
+func tarRegularFullfile(w io.Writer, input, name string, fi os.FileInfo, xattrs bool) error {
 	tw := tar.NewWriter(w)
-	hdr, err := getHeaderFromFileInfo(fi)
+	hdr, err := getHeaderFromFileInfo(fi, input, xattrs)
 	if err != nil {
 		return err
 	}
@@ -361,22 +347,21 @@ func createTarGzipHeaderOnly(output string, hdr *tar.Header) error {
 	return nil
 }
 
-func getHeaderFromFileInfo(fi os.FileInfo) (*tar.Header, error) {
+// getHeaderFromFileInfo creates the tar header for a file. If xattrs is true,
+// the extended attributes are read from path and stored in the header.
+func getHeaderFromFileInfo(fi os.FileInfo, path string, xattrs bool) (*tar.Header, error) {
 	// TODO: FileInfoHeader gets as much as it can. Change to explicitly pick only the metadata
 	// we care about.
-	return tar.FileInfoHeader(fi, "")
-}
-
-func externalCompressFunc(program string, args ...string) compressFunc {
-	return func(dst io.Writer, src io.Reader) error {
-		w, err := NewExternalWriter(dst, program, args...)
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(w, src)
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return nil, err
+	}
+	if xattrs {
+		xattrs, err := ReadXattrs(path)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return w.Close()
+		setTarHeaderXattrs(hdr, xattrs)
 	}
+	return hdr, nil
 }
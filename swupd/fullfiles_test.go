@@ -1,12 +1,10 @@
 package swupd
 
 import (
-	"archive/tar"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"syscall"
 	"testing"
 )
 
@@ -107,7 +105,7 @@ func TestCreateFullfiles(t *testing.T) {
 		m.Files = append(m.Files, f)
 	}
 
-	_, err = CreateFullfiles(m, chrootDir, outputDir, 0)
+	_, err = CreateFullfiles(m, chrootDir, outputDir, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -174,22 +172,3 @@ func mustHaveMatchingHash(t *testing.T, path string) {
 		t.Fatalf("unexpected hash %s for contents of %s", hash, path)
 	}
 }
-
-func newHashFromTarHeader(hdr *tar.Header) (*Hash, error) {
-	info := &HashFileInfo{
-		Mode:     uint32(hdr.Mode),
-		UID:      uint32(hdr.Uid),
-		GID:      uint32(hdr.Gid),
-		Size:     hdr.Size,
-		Linkname: hdr.Linkname,
-	}
-	switch hdr.Typeflag {
-	case tar.TypeReg, tar.TypeRegA:
-		info.Mode |= syscall.S_IFREG
-	case tar.TypeDir:
-		info.Mode |= syscall.S_IFDIR
-	case tar.TypeSymlink:
-		info.Mode |= syscall.S_IFLNK
-	}
-	return NewHash(info)
-}
@@ -0,0 +1,399 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Categories of the content found in the output directory.
+const (
+	GCManifests = "manifests"
+	GCFullfiles = "fullfiles"
+	GCDeltas    = "deltas"
+	GCPacks     = "packs"
+	GCOther     = "other"
+)
+
+var gcCategories = []string{GCManifests, GCFullfiles, GCDeltas, GCPacks, GCOther}
+
+// KeepPolicy selects the versions retained by garbage collection. A version
+// is retained if it matches any of the rules.
+type KeepPolicy struct {
+	// Last retains the N most recent versions.
+	Last int
+	// Since retains the versions greater or equal than it, if not zero.
+	Since uint32
+	// Versions are retained explicitly.
+	Versions []uint32
+}
+
+// ParseKeepPolicy parses a comma separated list of rules: "last:N" keeps
+// the N most recent versions, "since:V" keeps all versions from V onwards
+// and a plain number keeps that version.
+func ParseKeepPolicy(s string) (*KeepPolicy, error) {
+	p := &KeepPolicy{}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(term, "last:"):
+			p.Last, err = strconv.Atoi(strings.TrimPrefix(term, "last:"))
+			if err == nil && p.Last < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case strings.HasPrefix(term, "since:"):
+			var v uint64
+			v, err = strconv.ParseUint(strings.TrimPrefix(term, "since:"), 10, 32)
+			p.Since = uint32(v)
+		default:
+			var v uint64
+			v, err = strconv.ParseUint(term, 10, 32)
+			p.Versions = append(p.Versions, uint32(v))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid keep policy rule %q: %s", term, err)
+		}
+	}
+	if p.Last == 0 && p.Since == 0 && len(p.Versions) == 0 {
+		return nil, fmt.Errorf("keep policy %q doesn't retain any version", s)
+	}
+	return p, nil
+}
+
+// Select returns the versions in available retained by the policy, sorted.
+func (p *KeepPolicy) Select(available []uint32) []uint32 {
+	sorted := append([]uint32(nil), available...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	explicit := make(map[uint32]bool)
+	for _, v := range p.Versions {
+		explicit[v] = true
+	}
+	var result []uint32
+	for i, v := range sorted {
+		if explicit[v] || (p.Since > 0 && v >= p.Since) || len(sorted)-i <= p.Last {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// ListVersions returns the versions in outputDir that have a Manifest.MoM,
+// sorted.
+func ListVersions(outputDir string) ([]uint32, error) {
+	entries, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	var versions []uint32
+	for _, e := range entries {
+		v, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(outputDir, e.Name(), "Manifest.MoM")); err != nil {
+			continue
+		}
+		versions = append(versions, uint32(v))
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// LatestVersions returns the version pointed by the latest file of each
+// format in outputDir.
+func LatestVersions(outputDir string) ([]uint32, error) {
+	paths, err := filepath.Glob(filepath.Join(outputDir, "version", "format*", "latest"))
+	if err != nil {
+		return nil, err
+	}
+	var versions []uint32
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version in %s: %s", path, err)
+		}
+		versions = append(versions, uint32(v))
+	}
+	return versions, nil
+}
+
+// GCEntry is a file in the output directory, Path is relative to it.
+type GCEntry struct {
+	Path     string
+	Category string
+	Size     int64
+}
+
+// GCPlan describes which content of an output directory is reachable from the
+// retained versions. Everything else is listed in Remove.
+type GCPlan struct {
+	OutputDir string
+	Retained  []uint32
+	Remove    []GCEntry
+
+	KeptCount uint64
+	KeptSize  int64
+}
+
+type gcFileKey struct {
+	version uint32
+	hash    Hashval
+}
+
+// PlanGC marks the content reachable from the retained versions in outputDir:
+// their own directories, the bundle manifests referenced by their MoMs, the
+// manifest deltas from those manifests, the fullfiles of every file in their
+// full manifests, the deltas between those files and the packs from retained
+// versions (or zero packs). The latest version of each format is always
+// retained. Version directories without a Manifest.MoM are not touched.
+func PlanGC(outputDir string, retain []uint32) (*GCPlan, error) {
+	latest, err := LatestVersions(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	retained := make(map[uint32]bool)
+	for _, v := range append(latest, retain...) {
+		retained[v] = true
+	}
+	if len(retained) == 0 {
+		return nil, fmt.Errorf("no version to retain in %s", outputDir)
+	}
+
+	plan := &GCPlan{OutputDir: outputDir}
+	marked := make(map[string]bool)
+	reachable := make(map[gcFileKey]bool)
+	for v := range retained {
+		plan.Retained = append(plan.Retained, v)
+	}
+	sort.Slice(plan.Retained, func(i, j int) bool { return plan.Retained[i] < plan.Retained[j] })
+
+	// Marking must be complete, otherwise content in use would be removed, so
+	// any failure to read the manifests of retained versions is an error.
+	for _, v := range plan.Retained {
+		verDir := filepath.Join(outputDir, fmt.Sprint(v))
+		mom, err := ParseManifestFile(filepath.Join(verDir, "Manifest.MoM"))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read manifests of retained version %d: %s", v, err)
+		}
+		for _, b := range mom.Files {
+			name := filepath.Join(fmt.Sprint(b.Version), "Manifest."+b.Name)
+			marked[name] = true
+			marked[name+".tar"] = true
+		}
+		full, err := ParseManifestFile(filepath.Join(verDir, "Manifest.full"))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read manifests of retained version %d: %s", v, err)
+		}
+		for _, f := range full.Files {
+			if !f.Present() {
+				continue
+			}
+			reachable[gcFileKey{f.Version, f.Hash}] = true
+			marked[filepath.Join(fmt.Sprint(f.Version), "files", f.Hash.String()+".tar")] = true
+		}
+	}
+
+	versions, err := ListVersions(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		verDir := filepath.Join(outputDir, fmt.Sprint(v))
+		err = filepath.Walk(verDir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(outputDir, path)
+			if err != nil {
+				return err
+			}
+			category, keep := classifyGCEntry(rel, retained, marked, reachable)
+			if keep {
+				plan.KeptCount++
+				plan.KeptSize += fi.Size()
+				return nil
+			}
+			plan.Remove = append(plan.Remove, GCEntry{Path: rel, Category: category, Size: fi.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// classifyGCEntry returns the category of the file in path, relative to the
+// output directory, and whether it is reachable.
+func classifyGCEntry(path string, retained map[uint32]bool, marked map[string]bool, reachable map[gcFileKey]bool) (string, bool) {
+	parts := strings.Split(path, string(filepath.Separator))
+	version, _ := strconv.ParseUint(parts[0], 10, 32)
+	inRetained := retained[uint32(version)]
+	name := parts[len(parts)-1]
+
+	switch {
+	case len(parts) == 3 && parts[1] == "files":
+		return GCFullfiles, marked[path]
+
+	case len(parts) == 3 && parts[1] == "delta":
+		// Deltas are named FROMVERSION-TOVERSION-FROMHASH-TOHASH.
+		fields := strings.Split(name, "-")
+		if len(fields) != 4 || checkHashString(fields[2]) != nil || checkHashString(fields[3]) != nil {
+			return GCDeltas, inRetained
+		}
+		from, err1 := strconv.ParseUint(fields[0], 10, 32)
+		to, err2 := strconv.ParseUint(fields[1], 10, 32)
+		if err1 != nil || err2 != nil {
+			return GCDeltas, inRetained
+		}
+		return GCDeltas, inRetained &&
+			reachable[gcFileKey{uint32(from), internHash(fields[2])}] &&
+			reachable[gcFileKey{uint32(to), internHash(fields[3])}]
+
+	case len(parts) == 2 && packNameRegexp.MatchString(name):
+		match := packNameRegexp.FindStringSubmatch(name)
+		from, _ := strconv.ParseUint(match[2], 10, 32)
+		return GCPacks, inRetained && (from == 0 || retained[uint32(from)])
+
+	case len(parts) == 2 && manifestDeltaNameRegexp.MatchString(name):
+		// Only useful if a retained version still uses the old manifest.
+		bundle, from, _ := parseManifestDeltaName(name)
+		return GCManifests, inRetained && marked[filepath.Join(fmt.Sprint(from), "Manifest."+bundle)]
+
+	case len(parts) == 2 && strings.HasPrefix(name, "Manifest."):
+		return GCManifests, inRetained || marked[path]
+	}
+
+	// Other content of retained versions is kept as is.
+	return GCOther, inRetained
+}
+
+// Size returns the total size of the files to be removed.
+func (plan *GCPlan) Size() int64 {
+	var total int64
+	for _, e := range plan.Remove {
+		total += e.Size
+	}
+	return total
+}
+
+// WriteText writes a summary of the plan, with the space that can be
+// reclaimed in each category. If verbose, every file to be removed is listed.
+func (plan *GCPlan) WriteText(w io.Writer, verbose bool) error {
+	var buf bytes.Buffer
+	retained := make([]string, len(plan.Retained))
+	for i, v := range plan.Retained {
+		retained[i] = fmt.Sprint(v)
+	}
+	fmt.Fprintf(&buf, "Retained versions: %s\n", strings.Join(retained, " "))
+	fmt.Fprintf(&buf, "Reachable: %d files, %s\n", plan.KeptCount, formatSize(plan.KeptSize))
+
+	counts := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, e := range plan.Remove {
+		counts[e.Category]++
+		sizes[e.Category] += e.Size
+	}
+	fmt.Fprintf(&buf, "Reclaimable: %d files, %s\n", len(plan.Remove), formatSize(plan.Size()))
+	for _, c := range gcCategories {
+		if counts[c] > 0 {
+			fmt.Fprintf(&buf, "  %-10s %6d files  %s\n", c, counts[c], formatSize(sizes[c]))
+		}
+	}
+	if verbose {
+		for _, e := range plan.Remove {
+			fmt.Fprintf(&buf, "%s\t%s\t%d\n", e.Category, e.Path, e.Size)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Execute removes the unreachable files of the plan, and the version
+// directories that become empty. Only regular files and symbolic links are
+// removed.
+func (plan *GCPlan) Execute() error {
+	dirs := make(map[string]bool)
+	for _, e := range plan.Remove {
+		path := filepath.Join(plan.OutputDir, e.Path)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && fi.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("refusing to remove %s: not a regular file", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		for dir := filepath.Dir(e.Path); dir != "."; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	// Remove the deepest directories first.
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, dir := range sorted {
+		path := filepath.Join(plan.OutputDir, dir)
+		entries, err := ioutil.ReadDir(path)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package swupd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeepPolicy(t *testing.T) {
+	available := []uint32{40, 10, 20, 30, 50}
+	tests := []struct {
+		policy   string
+		expected []uint32
+	}{
+		{"last:2", []uint32{40, 50}},
+		{"since:30", []uint32{30, 40, 50}},
+		{"10,last:1", []uint32{10, 50}},
+		{"last:10", []uint32{10, 20, 30, 40, 50}},
+		{"15", nil},
+	}
+	for _, tt := range tests {
+		p, err := ParseKeepPolicy(tt.policy)
+		if err != nil {
+			t.Errorf("couldn't parse policy %q: %s", tt.policy, err)
+			continue
+		}
+		if got := p.Select(available); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("policy %q selected %v but expected %v", tt.policy, got, tt.expected)
+		}
+	}
+
+	for _, policy := range []string{"", "last:0", "last:x", "since:", "latest"} {
+		if _, err := ParseKeepPolicy(policy); err == nil {
+			t.Errorf("ParseKeepPolicy did not raise error for %q", policy)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	ts := newTestSwupd(t, "gc-")
+	defer ts.cleanup()
+
+	ts.Bundles = []string{"contents"}
+	largeContents := strings.Repeat("large", 1000)
+
+	ts.addFile(10, "contents", "/large", largeContents)
+	ts.addFile(10, "contents", "/same", "same")
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+	ts.createPack("contents", 0, 10, "")
+
+	for _, v := range []uint32{20, 30} {
+		ts.copyChroots(v-10, v)
+		ts.addFile(v, "contents", "/large", fmt.Sprint(v)+largeContents[2:])
+		ts.addFile(v, "contents", "/same", "same")
+		ts.createManifests(v)
+		ts.createFullfiles(v)
+		ts.createPack("contents", 0, v, "")
+		ts.createPack("contents", v-10, v, "")
+	}
+	ts.createPack("contents", 10, 30, "")
+	ts.write("www/version/format1/latest", "30")
+
+	plan, err := PlanGC(ts.path("www"), []uint32{10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Retained, []uint32{10, 30}) {
+		t.Fatalf("retained %v but expected latest version to be added", plan.Retained)
+	}
+
+	removed := make(map[string]bool)
+	for _, e := range plan.Remove {
+		removed[e.Path] = true
+		if !strings.HasPrefix(e.Path, "20/") && !strings.HasPrefix(e.Path, "30/delta/20-") && e.Path != "30/pack-contents-from-20.tar" {
+			t.Errorf("unexpected removal of %s (%s)", e.Path, e.Category)
+		}
+	}
+	for _, path := range []string{"20/Manifest.MoM", "20/pack-contents-from-10.tar", "30/pack-contents-from-20.tar"} {
+		if !removed[path] {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+
+	if err = plan.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	ts.checkExists("www/10/files")
+	ts.checkExists("www/30/pack-contents-from-10.tar")
+	ts.checkNotExists("www/20")
+
+	// Both retained versions and the packs between them are still valid.
+	for _, v := range []uint32{10, 30} {
+		report := mustVerifyRepository(t, ts, v)
+		checkVerifyIssues(t, report)
+	}
+
+	// Once collected, nothing else is unreachable.
+	plan, err = PlanGC(ts.path("www"), []uint32{10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Remove) != 0 {
+		t.Errorf("unexpected removals after collection: %v", plan.Remove)
+	}
+}
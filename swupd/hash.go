@@ -15,6 +15,7 @@
 package swupd
 
 import (
+	"archive/tar"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -98,6 +99,7 @@ type HashFileInfo struct {
 	GID      uint32
 	Size     int64
 	Linkname string
+	Xattrs   map[string]string
 }
 
 // Hash is used to calculate the swupd Hash of a file. Create one with
@@ -115,10 +117,10 @@ type Hash struct {
 //     contents := file contents
 //     HMAC(key, data)
 //
-//     swupd hash = HMAC(HMAC(stat, nil), contents)
+//     swupd hash = HMAC(HMAC(stat, xattrs), contents)
 //
-// The data for the inner HMAC was used for file xattrs, but is not
-// used at the moment.
+// The xattrs for the inner HMAC are empty unless the file has extended
+// attributes in the info, see GetHashForFileWithXattrs.
 func NewHash(info *HashFileInfo) (*Hash, error) {
 	var data []byte
 	switch info.Mode & syscall.S_IFMT {
@@ -154,7 +156,7 @@ func NewHash(info *HashFileInfo) (*Hash, error) {
 
 	var key [64]byte
 	mac := hmac.New(sha256.New, stat[:])
-	_, err := mac.Write(nil)
+	_, err := mac.Write(xattrsBlob(info.Xattrs))
 	if err != nil {
 		return nil, err
 	}
@@ -193,6 +195,12 @@ func (h *Hash) Sum() string {
 
 // GetHashForFile calculate the swupd hash for a file in the disk.
 func GetHashForFile(filename string) (string, error) {
+	return GetHashForFileWithXattrs(filename, false)
+}
+
+// GetHashForFileWithXattrs calculate the swupd hash for a file in the disk,
+// including its extended attributes if xattrs is true.
+func GetHashForFileWithXattrs(filename string, xattrs bool) (string, error) {
 	var info syscall.Stat_t
 	var err error
 	if err = syscall.Lstat(filename, &info); err != nil {
@@ -215,6 +223,13 @@ func GetHashForFile(filename string) (string, error) {
 		hashInfo.Linkname = link
 	}
 
+	if xattrs {
+		hashInfo.Xattrs, err = ReadXattrs(filename)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	h, err := NewHash(hashInfo)
 	if err != nil {
 		return "", fmt.Errorf("error creating hash for file %s: %s", filename, err)
@@ -250,3 +265,25 @@ func GetHashForBytes(info *HashFileInfo, data []byte) (string, error) {
 	}
 	return h.Sum(), nil
 }
+
+// newHashFromTarHeader creates a Hash using the metadata of a tar entry, as
+// stored in fullfiles and packs.
+func newHashFromTarHeader(hdr *tar.Header) (*Hash, error) {
+	info := &HashFileInfo{
+		Mode:     uint32(hdr.Mode),
+		UID:      uint32(hdr.Uid),
+		GID:      uint32(hdr.Gid),
+		Size:     hdr.Size,
+		Linkname: hdr.Linkname,
+		Xattrs:   TarHeaderXattrs(hdr),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		info.Mode |= syscall.S_IFREG
+	case tar.TypeDir:
+		info.Mode |= syscall.S_IFDIR
+	case tar.TypeSymlink:
+		info.Mode |= syscall.S_IFLNK
+	}
+	return NewHash(info)
+}
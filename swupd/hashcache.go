@@ -0,0 +1,218 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const hashCacheHeader = "swupd-hash-cache 1"
+
+// hashCacheKey identifies the state of a file in the disk. A file with the
+// same key is assumed to have the same swupd hash.
+type hashCacheKey struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime int64
+	ctime int64
+	mode  uint32
+	uid   uint32
+	gid   uint32
+}
+
+func hashCacheKeyFromStat(st *syscall.Stat_t) hashCacheKey {
+	return hashCacheKey{
+		dev:   uint64(st.Dev),
+		ino:   st.Ino,
+		size:  st.Size,
+		mtime: st.Mtim.Nano(),
+		ctime: st.Ctim.Nano(),
+		mode:  st.Mode,
+		uid:   st.Uid,
+		gid:   st.Gid,
+	}
+}
+
+// hashCache keeps the swupd hashes of the files hashed in previous builds, so
+// files that didn't change (e.g. hardlinked from the previous version
+// chroot) are not read again. A ratio of the cache hits given by verify is
+// hashed anyway and checked against the cache.
+//
+// Only entries used by a build are saved, so the cache doesn't grow with
+// content that is not in the chroots anymore.
+type hashCache struct {
+	path   string
+	verify float64
+
+	mu      sync.Mutex
+	entries map[hashCacheKey]string
+	used    map[hashCacheKey]string
+
+	hits     int
+	misses   int
+	verified int
+}
+
+// loadHashCache reads the hash cache at path. A missing file results in an
+// empty cache.
+func loadHashCache(path string, verify float64) (*hashCache, error) {
+	hc := &hashCache{
+		path:    path,
+		verify:  verify,
+		entries: make(map[hashCacheKey]string),
+		used:    make(map[hashCacheKey]string),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return hc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != hashCacheHeader {
+		return nil, fmt.Errorf("invalid hash cache %s: unknown header, remove it to start a new cache", path)
+	}
+	line := 1
+	for scanner.Scan() {
+		line++
+		var k hashCacheKey
+		var hash string
+		_, err = fmt.Sscanf(scanner.Text(), "%d %d %d %d %d %d %d %d %s",
+			&k.dev, &k.ino, &k.size, &k.mtime, &k.ctime, &k.mode, &k.uid, &k.gid, &hash)
+		if err == nil {
+			err = checkHashString(hash)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash cache %s at line %d: %s", path, line, err)
+		}
+		hc.entries[k] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// hash returns the swupd hash of the file at path, using the cache when
+// possible. A nil hashCache always calculates the hash. The extended
+// attributes are part of the hash if xattrs is true, a cache must only be used
+// with the setting it was loaded for, see hashCachePath.
+func (hc *hashCache) hash(path string, xattrs bool) (Hashval, error) {
+	if hc == nil {
+		hash, err := GetHashForFileWithXattrs(path, xattrs)
+		if err != nil {
+			return 0, err
+		}
+		return internHash(hash), nil
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return 0, fmt.Errorf("error statting file '%s' %v", path, err)
+	}
+	key := hashCacheKeyFromStat(&st)
+
+	hc.mu.Lock()
+	cached, ok := hc.entries[key]
+	check := ok && hc.verify > 0 && rand.Float64() < hc.verify
+	if ok && !check {
+		hc.hits++
+		hc.used[key] = cached
+		hc.mu.Unlock()
+		return internHash(cached), nil
+	}
+	hc.mu.Unlock()
+
+	hash, err := GetHashForFileWithXattrs(path, xattrs)
+	if err != nil {
+		return 0, err
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if check {
+		hc.verified++
+		if hash != cached {
+			return 0, fmt.Errorf("hash calculation error: hash cache has %s for %s but the file hash is %s, remove %s to start a new cache", cached, path, hash, hc.path)
+		}
+		hc.hits++
+	} else {
+		hc.misses++
+	}
+	hc.entries[key] = hash
+	hc.used[key] = hash
+	return internHash(hash), nil
+}
+
+// save writes the entries used since the cache was loaded.
+func (hc *hashCache) save() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	tmp := hc.path + ".new"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, hashCacheHeader)
+	for k, hash := range hc.used {
+		fmt.Fprintf(w, "%d %d %d %d %d %d %d %d %s\n", k.dev, k.ino, k.size, k.mtime, k.ctime, k.mode, k.uid, k.gid, hash)
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, hc.path)
+}
+
+// String returns a summary of the cache usage.
+func (hc *hashCache) String() string {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	s := fmt.Sprintf("%d hits, %d misses", hc.hits, hc.misses)
+	if hc.verify > 0 {
+		s += fmt.Sprintf(", %d hits verified", hc.verified)
+	}
+	return s
+}
+
+// hashCachePath returns the location of the hash cache in the state dir. The
+// hashes depend on whether extended attributes are hashed, so each setting
+// has its own cache.
+func hashCachePath(stateDir string, xattrs bool) string {
+	if xattrs {
+		return filepath.Join(stateDir, "hash-cache-xattrs")
+	}
+	return filepath.Join(stateDir, "hash-cache")
+}
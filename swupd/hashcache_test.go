@@ -0,0 +1,144 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustGetHashForFile(t *testing.T, path string) string {
+	t.Helper()
+	hash, err := GetHashForFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestHashCache(t *testing.T) {
+	fs := newTestFileSystem(t, "hash-cache-")
+	defer fs.cleanup()
+
+	fs.write("file", "content")
+	fs.symlink("link", "file")
+	cachePath := fs.path("hash-cache")
+
+	hc, err := loadHashCache(cachePath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file", "link"} {
+		got, err := hc.hash(fs.path(name), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := mustGetHashForFile(t, fs.path(name)); got.String() != expected {
+			t.Errorf("got hash %s for %s but expected %s", got, name, expected)
+		}
+	}
+	if err = hc.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new build reuses the hashes of unchanged files.
+	hc, err = loadHashCache(cachePath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hc.hash(fs.path("file"), false); err != nil {
+		t.Fatal(err)
+	}
+	if hc.hits != 1 || hc.misses != 0 {
+		t.Errorf("unexpected cache usage: %s", hc)
+	}
+
+	// Changing the file changes its key.
+	fs.write("file", "other content")
+	got, err := hc.hash(fs.path("file"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := mustGetHashForFile(t, fs.path("file")); got.String() != expected || hc.misses != 1 {
+		t.Errorf("got hash %s for changed file but expected %s (%s)", got, expected, hc)
+	}
+
+	// Only the entries used by the build are saved, so the one for the link
+	// is gone.
+	if err = hc.save(); err != nil {
+		t.Fatal(err)
+	}
+	hc, err = loadHashCache(cachePath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hc.entries) != 2 {
+		t.Errorf("saved cache has %d entries but expected 2", len(hc.entries))
+	}
+}
+
+func TestHashCacheVerify(t *testing.T) {
+	fs := newTestFileSystem(t, "hash-cache-")
+	defer fs.cleanup()
+
+	fs.write("file", "content")
+	cachePath := fs.path("hash-cache")
+	hc, err := loadHashCache(cachePath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hc.hash(fs.path("file"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hc.hash(fs.path("file"), false); err != nil {
+		t.Fatal(err)
+	}
+	if hc.verified != 1 {
+		t.Errorf("unexpected cache usage: %s", hc)
+	}
+
+	// Make the cached hash stale, the verification must catch it.
+	for k := range hc.entries {
+		hc.entries[k] = AllZeroHash
+	}
+	if _, err = hc.hash(fs.path("file"), false); err == nil {
+		t.Error("hash did not raise an error for a stale cache entry")
+	}
+
+	for _, content := range []string{"", "unknown\n", hashCacheHeader + "\n1 2 3\n"} {
+		if err = ioutil.WriteFile(cachePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadHashCache(cachePath, 0); err == nil {
+			t.Errorf("loadHashCache did not raise an error for %q", content)
+		}
+	}
+}
+
+func TestCreateManifestsHashCache(t *testing.T) {
+	ts := newTestSwupd(t, "hash-cache-")
+	defer ts.cleanup()
+
+	ts.appendServerINI("\n[Server]\nhash_cache=true\nhash_cache_verify=0.5\n")
+
+	ts.Bundles = []string{"test-bundle"}
+	ts.addFile(10, "test-bundle", "/foo", "foo")
+	ts.createManifests(10)
+	ts.copyChroots(10, 20)
+	ts.cp("image/10/full", "image/20")
+	ts.cp("image/10/test-bundle-info", "image/20")
+	ts.addFile(20, "test-bundle", "/bar", "bar")
+	ts.createManifests(20)
+
+	content, err := ioutil.ReadFile(hashCachePath(ts.Dir, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo", "bar"} {
+		hash := ts.mustHashFile(filepath.Join("image/20/full", name))
+		if !strings.Contains(string(content), hash) {
+			t.Errorf("hash cache doesn't contain hash of /%s", name)
+		}
+	}
+	fileInManifest(t, ts.parseManifest(20, "test-bundle"), 10, "/foo")
+}
@@ -181,7 +181,7 @@ func mustCreateManifestsStandard(t *testing.T, ver uint32, testDir string) *MoM
 
 func mustCreateManifests(t *testing.T, ver uint32, minVer uint32, format uint, testDir string) *MoM {
 	t.Helper()
-	mom, err := CreateManifests(ver, minVer, format, testDir)
+	mom, err := CreateManifests(ver, minVer, format, testDir, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -238,7 +238,7 @@ func checkManifestMatches(t *testing.T, testDir, ver, name string, res ...*regex
 
 func mustCreateAllDeltas(t *testing.T, manifest, statedir string, from, to uint32) {
 	t.Helper()
-	deltas, err := CreateDeltasForManifest(manifest, statedir, from, to, 0)
+	deltas, err := CreateDeltasForManifest(manifest, statedir, from, to, 0, nil)
 	if err != nil {
 		t.Fatalf("couldn't create deltas for %s: %s", manifest, err)
 	}
@@ -256,7 +256,7 @@ func mustCreateAllDeltas(t *testing.T, manifest, statedir string, from, to uint3
 
 func tryCreateAllDeltas(t *testing.T, manifest, statedir string, from, to uint32) {
 	t.Helper()
-	_, err := CreateDeltasForManifest(manifest, statedir, from, to, 0)
+	_, err := CreateDeltasForManifest(manifest, statedir, from, to, 0, nil)
 	if err != nil {
 		t.Fatalf("couldn't create deltas for %s: %s", manifest, err)
 	}
@@ -663,9 +663,11 @@ func (fs *testFileSystem) checkNotContains(subpath, sub string) {
 type testSwupd struct {
 	*testFileSystem
 
-	Bundles    []string
-	MinVersion uint32
-	Format     uint
+	Bundles         []string
+	MinVersion      uint32
+	Format          uint
+	ManifestWorkers int
+	Content         *ContentOptions
 }
 
 func newTestSwupd(t *testing.T, prefix string) *testSwupd {
@@ -691,6 +693,22 @@ func newTestSwupd(t *testing.T, prefix string) *testSwupd {
 	}
 }
 
+// appendServerINI adds content to the end of the server.ini of the test. Keys of
+// a repeated section are merged with the first one.
+func (ts *testSwupd) appendServerINI(content string) {
+	ts.t.Helper()
+	f, err := os.OpenFile(ts.path("server.ini"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if _, err = f.WriteString(content); err != nil {
+		ts.t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		ts.t.Fatal(err)
+	}
+}
+
 // Create Manifests and bump to next version.
 func (ts *testSwupd) createManifests(version uint32) *MoM {
 	ts.t.Helper()
@@ -703,7 +721,7 @@ func (ts *testSwupd) createManifests(version uint32) *MoM {
 	osRelease := fmt.Sprintf("VERSION_ID=%d\n", version)
 	ts.addFile(version, "os-core", "/usr/lib/os-release", osRelease)
 
-	mom, err := CreateManifests(version, ts.MinVersion, ts.Format, ts.Dir)
+	mom, err := CreateManifests(version, ts.MinVersion, ts.Format, ts.Dir, ts.ManifestWorkers, ts.Content)
 	if err != nil {
 		ts.t.Fatalf("error creating manifests for version %d: %s", version, err)
 	}
@@ -724,7 +742,7 @@ func (ts *testSwupd) createManifestsFromChroots(version uint32) *MoM {
 	osRelease := fmt.Sprintf("VERSION_ID=%d\n", version)
 	ts.write(filepath.Join("image", fmt.Sprint(version), "os-core", "usr/lib/os-release"), osRelease)
 
-	mom, err := CreateManifests(version, ts.MinVersion, ts.Format, ts.Dir)
+	mom, err := CreateManifests(version, ts.MinVersion, ts.Format, ts.Dir, ts.ManifestWorkers, ts.Content)
 	if err != nil {
 		ts.t.Fatalf("error creating manifests for version %d: %s", version, err)
 	}
@@ -749,7 +767,7 @@ func (ts *testSwupd) copyChroots(fromVersion, toVersion uint32) {
 
 func (ts *testSwupd) createPack(name string, from, to uint32, chrootDir string) *PackInfo {
 	ts.t.Helper()
-	return mustCreatePack(ts.t, name, from, to, ts.path("www"), chrootDir)
+	return mustCreatePack(ts.t, name, from, to, ts.path("www"), chrootDir, ts.Content)
 }
 
 func (ts *testSwupd) createFullfiles(version uint32) {
@@ -761,7 +779,7 @@ func (ts *testSwupd) createFullfiles(version uint32) {
 	}
 	chrootDir := ts.path(filepath.Join("image", fmt.Sprint(version), "full"))
 	outputDir := ts.path(filepath.Join("www", fmt.Sprint(version), "files"))
-	_, err = CreateFullfiles(m, chrootDir, outputDir, 0)
+	_, err = CreateFullfiles(m, chrootDir, outputDir, 0, ts.Content)
 	if err != nil {
 		ts.t.Fatalf("couldn't create fullfiles: %s", err)
 	}
@@ -14,92 +14,186 @@
 
 package swupd
 
-import "strings"
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
 
-func (f *File) setConfigFromPathname() {
-	// TODO: make this list configurable
-	configPaths := []string{
-		"/etc/",
-	}
+// heuristicRules are the pathname rules used to decide if a file gets a
+// modifier. A file matches if its name is one of paths, starts with one of
+// prefixes or matches one of globs (using path.Match, so "*" doesn't match
+// "/"). Names listed in exclude never match, even if other rules would.
+type heuristicRules struct {
+	prefixes []string
+	paths    []string
+	globs    []string
+	exclude  []string
+}
 
-	for _, path := range configPaths {
-		if strings.HasPrefix(f.Name, path) {
-			f.Modifier = ModifierConfig
-			return
-		}
-	}
+// heuristicsConfig holds the rules for each modifier set by the heuristics.
+type heuristicsConfig struct {
+	config heuristicRules
+	state  heuristicRules
+	boot   heuristicRules
 }
 
-func (f *File) setStateFromPathname() {
-	// TODO: make this list configurable
-	statePaths := []string{
-		"/usr/src/debug",
-		"/dev",
-		"/home",
-		"/proc",
-		"/root",
-		"/run",
-		"/sys",
-		"/tmp",
-		"/var",
-	}
+var defaultHeuristics = heuristicsConfig{
+	config: heuristicRules{
+		prefixes: []string{"/etc/"},
+	},
+	state: heuristicRules{
+		// the directories themselves are shipped, only their contents are
+		// state. /usr/src/debug is listed explicitly because the /usr/src/
+		// prefix would match it otherwise.
+		prefixes: []string{
+			"/usr/src/debug/",
+			"/dev/",
+			"/home/",
+			"/proc/",
+			"/root/",
+			"/run/",
+			"/sys/",
+			"/tmp/",
+			"/var/",
+			// these are paths that are not shipped directories
+			"/usr/src/",
+			"/lost+found",
+		},
+		exclude: []string{"/usr/src/debug"},
+	},
+	boot: heuristicRules{
+		prefixes: []string{
+			"/boot/",
+			"/usr/lib/modules/",
+			"/usr/lib/kernel/",
+		},
+	},
+}
 
-	for _, path := range statePaths {
-		// if no trailing / these are state directories that are actually shipped
-		// otherwise this is a non-shipped state file and the modifier should be
-		// set to state
-		if f.Name == path {
-			return
-		} else if strings.HasPrefix(f.Name, path+"/") {
-			f.Modifier = ModifierState
-			return
+// match returns a description of the rule matching name, or an empty string if
+// no rule matches.
+func (r *heuristicRules) match(name string) string {
+	for _, p := range r.exclude {
+		if name == p {
+			return ""
 		}
 	}
-
-	// TODO: make this list configurable
-	// these are paths that are not shipped directories
-	stateDirs := []string{
-		"/usr/src/",
-		"/lost+found",
+	for _, p := range r.paths {
+		if name == p {
+			return "path " + p
+		}
 	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(name, p) {
+			return "prefix " + p
+		}
+	}
+	for _, p := range r.globs {
+		// patterns are validated when the configuration is read
+		if ok, _ := path.Match(p, name); ok {
+			return "glob " + p
+		}
+	}
+	return ""
+}
 
-	for _, path := range stateDirs {
-		if strings.HasPrefix(f.Name, path) {
-			f.Modifier = ModifierState
-			return
+func (r *heuristicRules) validate() error {
+	for _, p := range r.globs {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid heuristics glob %q: %s", p, err)
 		}
 	}
+	return nil
 }
 
-func (f *File) setBootFromPathname() {
-	// TODO: make this list configurable
-	bootPaths := []string{
-		"/boot/",
-		"/usr/lib/modules/",
-		"/usr/lib/kernel/",
+func (f *File) setConfigFromPathname(h *heuristicsConfig) string {
+	rule := h.config.match(f.Name)
+	if rule != "" {
+		f.Modifier = ModifierConfig
 	}
+	return rule
+}
 
-	for _, path := range bootPaths {
-		if strings.HasPrefix(f.Name, path) {
-			f.Modifier = ModifierBoot
-			if f.Status == StatusDeleted {
-				f.Status = StatusGhosted
-			}
-			return
+func (f *File) setStateFromPathname(h *heuristicsConfig) string {
+	rule := h.state.match(f.Name)
+	if rule != "" {
+		f.Modifier = ModifierState
+	}
+	return rule
+}
+
+func (f *File) setBootFromPathname(h *heuristicsConfig) string {
+	rule := h.boot.match(f.Name)
+	if rule != "" {
+		f.Modifier = ModifierBoot
+		if f.Status == StatusDeleted {
+			f.Status = StatusGhosted
 		}
 	}
+	return rule
 }
 
-func (f *File) setModifierFromPathname() {
+// setModifierFromPathname sets the modifier of the file and returns the rule
+// responsible for it, or an empty string if the file was not tagged.
+func (f *File) setModifierFromPathname(h *heuristicsConfig) string {
 	// order here matters, first check for config, then state, finally boot
 	// more important modifiers must happen last to overwrite earlier ones
-	f.setConfigFromPathname()
-	f.setStateFromPathname()
-	f.setBootFromPathname()
+	var rule string
+	for _, set := range []func(*heuristicsConfig) string{
+		f.setConfigFromPathname,
+		f.setStateFromPathname,
+		f.setBootFromPathname,
+	} {
+		if r := set(h); r != "" {
+			rule = r
+		}
+	}
+	return rule
 }
 
-func (m *Manifest) applyHeuristics() {
+// heuristicMatch records which rule set the modifier of a file in a bundle.
+type heuristicMatch struct {
+	bundle   string
+	file     string
+	modifier ModifierFlag
+	rule     string
+}
+
+func (m *Manifest) applyHeuristics(h *heuristicsConfig) []heuristicMatch {
+	var matches []heuristicMatch
 	for _, f := range m.Files {
-		f.setModifierFromPathname()
+		if rule := f.setModifierFromPathname(h); rule != "" {
+			matches = append(matches, heuristicMatch{m.Name, f.Name, f.Modifier, rule})
+		}
+	}
+	return matches
+}
+
+// writeHeuristicsReport writes a tab separated report with the bundle, file,
+// modifier and the rule that tagged each file.
+func writeHeuristicsReport(path string, matches []heuristicMatch) error {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].bundle != matches[j].bundle {
+			return matches[i].bundle < matches[j].bundle
+		}
+		return matches[i].file < matches[j].file
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, m := range matches {
+		fmt.Fprintf(w, "%s\t%s\t%c\t%s\n", m.bundle, m.file, modifierBytes[m.modifier], m.rule)
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
 	}
+	return f.Close()
 }
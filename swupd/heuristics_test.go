@@ -18,7 +18,7 @@ func TestSetConfigFromPathname(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.file.Name, func(t *testing.T) {
-			tc.file.setConfigFromPathname()
+			tc.file.setConfigFromPathname(&defaultHeuristics)
 			if tc.file.Modifier != tc.expected {
 				t.Errorf("file %v modifier %v did not match expected %v",
 					tc.file.Name, tc.file.Modifier, tc.expected)
@@ -43,7 +43,7 @@ func TestSetStateFromPathname(t *testing.T) {
 	for _, tc := range pathTestCases {
 		t.Run(tc.Name, func(t *testing.T) {
 			// actual directories do not get their modifier set
-			tc.setStateFromPathname()
+			tc.setStateFromPathname(&defaultHeuristics)
 			if tc.Modifier != ModifierUnset {
 				t.Errorf("file %v modifier %v did not match expected %v",
 					tc.Name, tc.Modifier, ModifierUnset)
@@ -51,7 +51,7 @@ func TestSetStateFromPathname(t *testing.T) {
 
 			// now check children of the directory
 			tc.Name = tc.Name + "/a"
-			tc.setStateFromPathname()
+			tc.setStateFromPathname(&defaultHeuristics)
 			if tc.Modifier != ModifierState {
 				t.Errorf("file %v modifier %v did not match expected %v",
 					tc.Name, tc.Modifier, ModifierState)
@@ -71,7 +71,7 @@ func TestSetStateFromPathname(t *testing.T) {
 
 	for _, tc := range allTestCases {
 		t.Run(tc.file.Name, func(t *testing.T) {
-			tc.file.setStateFromPathname()
+			tc.file.setStateFromPathname(&defaultHeuristics)
 			if tc.file.Modifier != tc.expected {
 				t.Errorf("file %v modifier %v did not match expected %v",
 					tc.file.Name, tc.file.Modifier, tc.expected)
@@ -93,7 +93,7 @@ func TestSetBootFromPathname(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.file.Name, func(t *testing.T) {
-			tc.file.setBootFromPathname()
+			tc.file.setBootFromPathname(&defaultHeuristics)
 			if tc.file.Modifier != tc.expected {
 				t.Errorf("file %v modifier %v did not match expected %v",
 					tc.file.Name, tc.file.Modifier, tc.expected)
@@ -117,7 +117,7 @@ func TestSetModifierFromPathname(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.file.Name, func(t *testing.T) {
-			tc.file.setModifierFromPathname()
+			tc.file.setModifierFromPathname(&defaultHeuristics)
 			if tc.file.Modifier != tc.expected {
 				t.Errorf("file %v modifier %v did not match expected %v",
 					tc.file.Name, tc.file.Modifier, tc.expected)
@@ -141,7 +141,7 @@ func TestApplyHeuristics(t *testing.T) {
 		m.Files = append(m.Files, &File{Name: key})
 	}
 
-	m.applyHeuristics()
+	m.applyHeuristics(&defaultHeuristics)
 	for _, f := range m.Files {
 		if f.Modifier != testCases[f.Name] {
 			t.Errorf("file %v modifier %v did not match expected %v",
@@ -149,3 +149,59 @@ func TestApplyHeuristics(t *testing.T) {
 		}
 	}
 }
+
+func TestApplyHeuristicsConfigured(t *testing.T) {
+	c, err := readServerINI("/var/lib/update", "testdata/server.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		expected ModifierFlag
+		rule     string
+	}{
+		{"/etc/file", ModifierConfig, "prefix /etc/"},
+		{"/usr/lib/vendor-kernel/vmlinuz", ModifierBoot, "prefix /usr/lib/vendor-kernel/"},
+		{"/usr/lib/kernel/file", ModifierBoot, "prefix /usr/lib/kernel/"},
+		{"/opt/state", ModifierState, "path /opt/state"},
+		{"/opt/state/file", ModifierUnset, ""},
+		{"/opt/app/state/file", ModifierState, "glob /opt/*/state/*"},
+		{"/opt/app/state/dir/file", ModifierUnset, ""},
+		{"/var/file", ModifierState, "prefix /var/"},
+		{"/randomfile", ModifierUnset, ""},
+	}
+
+	m := Manifest{Name: "test-bundle"}
+	for _, tc := range testCases {
+		m.Files = append(m.Files, &File{Name: tc.name})
+	}
+
+	rules := make(map[string]string)
+	for _, match := range m.applyHeuristics(&c.heuristics) {
+		if match.bundle != m.Name {
+			t.Errorf("match for %s has bundle %q but expected %q", match.file, match.bundle, m.Name)
+		}
+		rules[match.file] = match.rule
+	}
+
+	for i, tc := range testCases {
+		f := m.Files[i]
+		if f.Modifier != tc.expected {
+			t.Errorf("file %v modifier %v did not match expected %v", f.Name, f.Modifier, tc.expected)
+		}
+		if rules[f.Name] != tc.rule {
+			t.Errorf("file %v tagged by rule %q but expected %q", f.Name, rules[f.Name], tc.rule)
+		}
+	}
+}
+
+func TestBootHeuristicsGhostDeleted(t *testing.T) {
+	f := File{Name: "/boot/EFI", Status: StatusDeleted}
+	if rule := f.setModifierFromPathname(&defaultHeuristics); rule != "prefix /boot/" {
+		t.Errorf("got rule %q but expected boot prefix", rule)
+	}
+	if f.Status != StatusGhosted {
+		t.Errorf("deleted boot file has status %v but expected ghosted", f.Status)
+	}
+}
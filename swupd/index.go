@@ -0,0 +1,349 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// Formats of the index file, set by the format key in the [Index] section of
+// server.ini.
+const (
+	// IndexFormatTSV writes a line with the file name and the bundle name,
+	// separated by a tab, for each file.
+	IndexFormatTSV = "tsv"
+	// IndexFormatBinary writes the file names sorted and front coded, with
+	// the bundle and the package of each file, compressed with gzip. See
+	// WriteBinaryIndex.
+	IndexFormatBinary = "binary"
+)
+
+// indexConfig controls the generation of the index bundle, that maps the files
+// of all bundles to the bundles that provide them.
+type indexConfig struct {
+	disabled bool
+	// bundle is the name of the index bundle and file is the path of the
+	// index file inside it.
+	bundle string
+	file   string
+	format string
+}
+
+var defaultIndex = indexConfig{
+	bundle: "os-core-update-index",
+	file:   "/usr/share/clear/os-core-update-index",
+	format: IndexFormatTSV,
+}
+
+func (idx *indexConfig) validate() error {
+	if idx.bundle == "" || idx.bundle == "full" || idx.bundle == "MoM" || filepath.Base(idx.bundle) != idx.bundle {
+		return fmt.Errorf("invalid index bundle name %q", idx.bundle)
+	}
+	if !filepath.IsAbs(idx.file) || filepath.Clean(idx.file) != idx.file {
+		return fmt.Errorf("invalid index file %q, must be an absolute path", idx.file)
+	}
+	switch idx.format {
+	case IndexFormatTSV, IndexFormatBinary:
+	default:
+		return fmt.Errorf("invalid index format %q, must be %s or %s", idx.format, IndexFormatTSV, IndexFormatBinary)
+	}
+	return nil
+}
+
+// readIndexSection overrides the index configuration in idx with the one set
+// in section: enabled, bundle, file and format.
+func readIndexSection(section *ini.Section, idx *indexConfig) error {
+	if key, err := section.GetKey("enabled"); err == nil {
+		enabled, err := key.Bool()
+		if err != nil {
+			return fmt.Errorf("invalid index enabled %q", key.Value())
+		}
+		idx.disabled = !enabled
+	}
+	if key, err := section.GetKey("bundle"); err == nil {
+		idx.bundle = key.Value()
+	}
+	if key, err := section.GetKey("file"); err == nil {
+		idx.file = key.Value()
+	}
+	if key, err := section.GetKey("format"); err == nil {
+		idx.format = key.Value()
+	}
+	return idx.validate()
+}
+
+// indexBundleName is the file in the image directory of a version with the
+// name of its index bundle, so the next version can drop it from the MoM when
+// it is renamed or disabled.
+const indexBundleName = "index-bundle"
+
+// readIndexBundle reads the name of the index bundle of a version from path. A
+// missing file results in the default name, used before it was configurable.
+func readIndexBundle(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return defaultIndex.bundle, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// filePackagesName is the file in the image directory of a version that maps
+// files to the packages that provide them. Each line has a file name and a
+// package name separated by a tab.
+const filePackagesName = "file-packages"
+
+// readFilePackages reads the packages of the files from path. A missing file
+// results in no packages.
+func readFilePackages(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	packages := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: %q", path, scanner.Text())
+		}
+		// keep the first package when a file is in many
+		if _, ok := packages[fields[0]]; !ok {
+			packages[fields[0]] = fields[1]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// IndexEntry is a file in the index and the bundle that provides it. Package is
+// empty when it is not known.
+type IndexEntry struct {
+	Name    string
+	Bundle  string
+	Package string
+}
+
+// binaryIndexMagic starts a binary index, followed by a byte with the version
+// of the format.
+var binaryIndexMagic = []byte("SWUPDIDX")
+
+const binaryIndexVersion = 1
+
+// WriteBinaryIndex writes entries, that must be sorted by name, in the binary
+// index format. After the magic and version the data is compressed with gzip
+// and contains, using unsigned varints for numbers and lengths:
+//
+//	number of bundles, followed by the length and name of each
+//	number of packages, followed by the length and name of each
+//	number of entries, followed for each one by:
+//	  length of the prefix shared with the previous name
+//	  length and bytes of the rest of the name
+//	  index of the bundle
+//	  index of the package plus one, zero when not known
+//
+// A name can appear more than once when many bundles provide the file.
+func WriteBinaryIndex(w io.Writer, entries []IndexEntry) error {
+	if _, err := w.Write(append(append([]byte(nil), binaryIndexMagic...), binaryIndexVersion)); err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(gw)
+
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf[:], v)
+		_, _ = bw.Write(buf[:n])
+	}
+	writeString := func(s string) {
+		writeUvarint(uint64(len(s)))
+		_, _ = bw.WriteString(s)
+	}
+
+	bundles, bundleIndex := indexStringTable(entries, func(e *IndexEntry) string { return e.Bundle })
+	packages, packageIndex := indexStringTable(entries, func(e *IndexEntry) string { return e.Package })
+	for _, table := range [][]string{bundles, packages} {
+		writeUvarint(uint64(len(table)))
+		for _, s := range table {
+			writeString(s)
+		}
+	}
+
+	writeUvarint(uint64(len(entries)))
+	var prev string
+	for i := range entries {
+		e := &entries[i]
+		if e.Name < prev {
+			_ = gw.Close()
+			return fmt.Errorf("index entries not sorted, %s after %s", e.Name, prev)
+		}
+		shared := 0
+		for shared < len(prev) && shared < len(e.Name) && prev[shared] == e.Name[shared] {
+			shared++
+		}
+		writeUvarint(uint64(shared))
+		writeString(e.Name[shared:])
+		writeUvarint(uint64(bundleIndex[e.Bundle]))
+		if e.Package == "" {
+			writeUvarint(0)
+		} else {
+			writeUvarint(uint64(packageIndex[e.Package] + 1))
+		}
+		prev = e.Name
+	}
+
+	if err := bw.Flush(); err != nil {
+		_ = gw.Close()
+		return err
+	}
+	return gw.Close()
+}
+
+// indexStringTable returns the distinct non-empty values of field in entries,
+// in order of appearance, and the position of each value.
+func indexStringTable(entries []IndexEntry, field func(e *IndexEntry) string) ([]string, map[string]int) {
+	var table []string
+	pos := make(map[string]int)
+	for i := range entries {
+		s := field(&entries[i])
+		if _, ok := pos[s]; ok || s == "" {
+			continue
+		}
+		pos[s] = len(table)
+		table = append(table, s)
+	}
+	return table, pos
+}
+
+// ReadBinaryIndex reads an index written by WriteBinaryIndex.
+func ReadBinaryIndex(r io.Reader) ([]IndexEntry, error) {
+	header := make([]byte, len(binaryIndexMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("couldn't read index header: %s", err)
+	}
+	if !bytes.Equal(header[:len(binaryIndexMagic)], binaryIndexMagic) {
+		return nil, fmt.Errorf("not a binary index")
+	}
+	if v := header[len(binaryIndexMagic)]; v != binaryIndexVersion {
+		return nil, fmt.Errorf("unsupported binary index version %d", v)
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = gr.Close()
+	}()
+	br := bufio.NewReader(gr)
+
+	readUvarint := func() (uint64, error) {
+		return binary.ReadUvarint(br)
+	}
+	readString := func() (string, error) {
+		n, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(br, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	readTable := func() ([]string, error) {
+		n, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		var table []string
+		for i := uint64(0); i < n; i++ {
+			s, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			table = append(table, s)
+		}
+		return table, nil
+	}
+
+	bundles, err := readTable()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read index bundles: %s", err)
+	}
+	packages, err := readTable()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read index packages: %s", err)
+	}
+	count, err := readUvarint()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read index entries: %s", err)
+	}
+
+	var entries []IndexEntry
+	var prev string
+	for i := uint64(0); i < count; i++ {
+		shared, err := readUvarint()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read index entry %d: %s", i, err)
+		}
+		rest, err := readString()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read index entry %d: %s", i, err)
+		}
+		bundle, err := readUvarint()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read index entry %d: %s", i, err)
+		}
+		pkg, err := readUvarint()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read index entry %d: %s", i, err)
+		}
+		if shared > uint64(len(prev)) || bundle >= uint64(len(bundles)) || pkg > uint64(len(packages)) {
+			return nil, fmt.Errorf("invalid index entry %d", i)
+		}
+		e := IndexEntry{
+			Name:   prev[:shared] + rest,
+			Bundle: bundles[bundle],
+		}
+		if pkg > 0 {
+			e.Package = packages[pkg-1]
+		}
+		entries = append(entries, e)
+		prev = e.Name
+	}
+	return entries, nil
+}
@@ -0,0 +1,146 @@
+package swupd
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryIndexRoundTrip(t *testing.T) {
+	entries := []IndexEntry{
+		{Name: "/usr/bin/bar", Bundle: "test-bundle1", Package: "bar"},
+		{Name: "/usr/bin/bar", Bundle: "test-bundle2", Package: "bar"},
+		{Name: "/usr/bin/baz", Bundle: "test-bundle2"},
+		{Name: "/usr/lib/libfoo.so", Bundle: "test-bundle1", Package: "foo-lib"},
+	}
+	var buf bytes.Buffer
+	if err := WriteBinaryIndex(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBinaryIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("got entries %v, but want %v", got, entries)
+	}
+
+	if err = WriteBinaryIndex(&buf, []IndexEntry{entries[2], entries[0]}); err == nil {
+		t.Errorf("expected error writing unsorted entries")
+	}
+	if _, err = ReadBinaryIndex(bytes.NewBufferString("/usr/bin/bar\ttest-bundle1\n")); err == nil {
+		t.Errorf("expected error reading a TSV index")
+	}
+}
+
+func TestCreateManifestsIndexBinary(t *testing.T) {
+	ts := newTestSwupd(t, "index-binary-")
+	defer ts.cleanup()
+	ts.appendServerINI("\n[Index]\nbundle=test-index\nfile=/usr/share/test/index\nformat=binary\n")
+
+	ts.Bundles = []string{"test-bundle1", "test-bundle2"}
+	ts.addFile(10, "test-bundle1", "/bar", "bar")
+	ts.addFile(10, "test-bundle2", "/foo", "foo")
+	ts.write("image/10/file-packages", "/foo\tfoo-package\n")
+	ts.createManifests(10)
+
+	fileInManifest(t, ts.parseManifest(10, "MoM"), 10, "test-index")
+	fileNotInManifest(t, ts.parseManifest(10, "MoM"), "os-core-update-index")
+	fileInManifest(t, ts.parseManifest(10, "test-index"), 10, "/usr/share/test/index")
+	fileInManifest(t, ts.parseManifest(10, "full"), 10, "/usr/share/clear/bundles/test-index")
+
+	f, err := os.Open(ts.path("image/10/full/usr/share/test/index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	entries, err := ReadBinaryIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var foundBar, foundFoo bool
+	for _, e := range entries {
+		switch e.Name {
+		case "/bar":
+			foundBar = e.Bundle == "test-bundle1" && e.Package == ""
+		case "/foo":
+			foundFoo = e.Bundle == "test-bundle2" && e.Package == "foo-package"
+		}
+	}
+	if !foundBar || !foundFoo {
+		t.Errorf("missing or wrong index entries: %v", entries)
+	}
+}
+
+func TestCreateManifestsIndexDisabled(t *testing.T) {
+	ts := newTestSwupd(t, "index-disabled-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"test-bundle"}
+	ts.addFile(10, "test-bundle", "/foo", "foo")
+	ts.createManifests(10)
+	fileInManifest(t, ts.parseManifest(10, "MoM"), 10, "os-core-update-index")
+
+	ts.appendServerINI("\n[Index]\nenabled=false\n")
+	ts.addFile(20, "test-bundle", "/foo", "foo")
+	ts.addFile(20, "test-bundle", "/bar", "bar")
+	ts.addIncludes(20, "test-bundle", []string{"os-core-update-index"})
+	ts.createManifests(20)
+
+	// The index bundle gets a last manifest with its files deleted.
+	fileInManifest(t, ts.parseManifest(20, "MoM"), 20, "os-core-update-index")
+	idx := ts.parseManifest(20, "os-core-update-index")
+	fileDeletedInManifest(t, idx, 20, "/usr/share/clear/os-core-update-index")
+	fileDeletedInManifest(t, idx, 20, "/usr/share/clear/bundles/os-core-update-index")
+	ts.checkNotContains("www/20/Manifest.test-bundle", "includes:\tos-core-update-index")
+
+	// And is dropped in the next version.
+	ts.addFile(30, "test-bundle", "/foo", "foo")
+	ts.createManifests(30)
+	fileNotInManifest(t, ts.parseManifest(30, "MoM"), "os-core-update-index")
+	ts.checkNotExists("www/30/Manifest.os-core-update-index")
+}
+
+func TestCreateManifestsIndexRenamed(t *testing.T) {
+	ts := newTestSwupd(t, "index-renamed-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"test-bundle"}
+	ts.addFile(10, "test-bundle", "/foo", "foo")
+	ts.createManifests(10)
+	fileInManifest(t, ts.parseManifest(10, "MoM"), 10, "os-core-update-index")
+
+	ts.appendServerINI("\n[Index]\nbundle=test-index\n")
+	ts.addFile(20, "test-bundle", "/foo", "foo")
+	ts.createManifests(20)
+
+	mom := ts.parseManifest(20, "MoM")
+	fileInManifest(t, mom, 20, "test-index")
+	fileInManifest(t, mom, 20, "os-core-update-index")
+	idx := ts.parseManifest(20, "os-core-update-index")
+	fileDeletedInManifest(t, idx, 20, "/usr/share/clear/bundles/os-core-update-index")
+	for _, f := range idx.Files {
+		if f.Present() {
+			t.Errorf("file %s is still present in the renamed index bundle", f.Name)
+		}
+	}
+
+	ts.addFile(30, "test-bundle", "/foo", "foo")
+	ts.createManifests(30)
+	mom = ts.parseManifest(30, "MoM")
+	fileInManifest(t, mom, 30, "test-index")
+	fileNotInManifest(t, mom, "os-core-update-index")
+}
+
+func TestReadServerINIBadIndex(t *testing.T) {
+	ts := newTestSwupd(t, "server-ini-index-")
+	defer ts.cleanup()
+	path := ts.path("server.ini")
+	for _, section := range []string{"enabled=maybe", "bundle=", "file=relative/path", "format=xml"} {
+		ts.write("server.ini", "[Index]\n"+section+"\n")
+		if _, err := readServerINI(ts.Dir, path); err == nil {
+			t.Errorf("readServerINI did not raise an error for %q", section)
+		}
+	}
+}
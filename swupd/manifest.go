@@ -15,7 +15,6 @@
 package swupd
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -33,13 +32,10 @@ import (
 
 const manifestFieldDelim = "\t"
 
-// TODO make this configurable (optional and configurable bundle/filepath)
-// this should be done when configuration is in a more stable state
-const (
-	indexBundle       = "os-core-update-index"
-	indexFileName     = "/usr/share/clear/os-core-update-index"
-	indexAllBundleDir = "/usr/share/clear/allbundles"
-)
+// indexAllBundleDir has the bundle definitions that are added to the index
+// bundle when present in the full chroot. The name of the index bundle and of
+// its index file are set in indexConfig.
+const indexAllBundleDir = "/usr/share/clear/allbundles"
 
 // ManifestHeader contains metadata for the manifest
 type ManifestHeader struct {
@@ -50,6 +46,12 @@ type ManifestHeader struct {
 	TimeStamp   time.Time
 	ContentSize uint64
 	Includes    []*Manifest
+	// Optional are the bundles marked also-add, that clients can offer
+	// to install with the bundle. They are not subtracted from it.
+	Optional []*Manifest
+	// Status is the status of the bundle, empty for active bundles. See
+	// BundleStatusExperimental and the other statuses.
+	Status string
 }
 
 // Manifest represents a bundle or list of bundles (MoM)
@@ -116,6 +118,10 @@ func readManifestFileHeaderLine(fields []string, m *Manifest) error {
 		m.Header.ContentSize = parsed
 	case "includes:":
 		m.Header.Includes = append(m.Header.Includes, &Manifest{Name: fields[1]})
+	case "also-add:":
+		m.Header.Optional = append(m.Header.Optional, &Manifest{Name: fields[1]})
+	case "status:":
+		m.Header.Status = fields[1]
 	}
 
 	return nil
@@ -124,6 +130,9 @@ func readManifestFileHeaderLine(fields []string, m *Manifest) error {
 // readManifestFileEntry
 // fields: "<fflags, 4 chars>", "<hash, 64 chars>", "<version>", "<filename>"
 func readManifestFileEntry(fields []string, m *Manifest) error {
+	if len(fields) != 4 {
+		return fmt.Errorf("invalid number of fields in file entry: %d", len(fields))
+	}
 	fflags := fields[0]
 	fhash := fields[1]
 	fver := fields[2]
@@ -186,7 +195,11 @@ func (m *Manifest) CheckHeaderIsValid() error {
 		return errors.New("manifest timestamp not set")
 	}
 
-	// Includes are not required.
+	if !validManifestStatus(m.Header.Status) {
+		return fmt.Errorf("manifest has invalid status %q", m.Header.Status)
+	}
+
+	// Includes and status are not required.
 	return nil
 }
 
@@ -229,56 +242,29 @@ func getNameForManifestFile(path string) string {
 
 // ParseManifest creates a Manifest from an io.Reader.
 func ParseManifest(r io.Reader) (*Manifest, error) {
-	m := &Manifest{}
-	input := bufio.NewScanner(r)
-
-	// Read the header.
-	parsedEntries := make(map[string]uint)
-	for input.Scan() {
-		text := input.Text()
-		if text == "" {
-			// Empty line means end of the header.
-			break
-		}
-
-		fields := strings.Split(text, manifestFieldDelim)
-		entry := fields[0]
-		if entry != "includes:" && parsedEntries[entry] > 0 {
-			return nil, fmt.Errorf("invalid manifest, duplicate entry %q in header", entry)
-		}
-		parsedEntries[entry]++
-
-		if err := readManifestFileHeaderLine(fields, m); err != nil {
-			return nil, err
-		}
-	}
-
-	// Validate the header.
-	for _, e := range requiredManifestHeaderEntries {
-		if parsedEntries[e] == 0 {
-			return nil, fmt.Errorf("invalid manifest, missing entry %q in header", e)
-		}
-	}
-	err := m.CheckHeaderIsValid()
+	mr, err := NewManifestReader(r)
 	if err != nil {
 		return nil, err
 	}
+	m := &Manifest{Header: mr.Header}
 
 	// Read the body.
-	for input.Scan() {
-		text := input.Text()
-		if text == "" {
-			return nil, errors.New("invalid manifest, extra blank line")
+	for {
+		f, err := mr.Next()
+		if err == io.EOF {
+			break
 		}
-
-		fields := strings.Split(text, manifestFieldDelim)
-		if err := readManifestFileEntry(fields, m); err != nil {
+		if err != nil {
 			return nil, err
 		}
-	}
 
-	if len(m.Files) == 0 {
-		return nil, errors.New("invalid manifest, does not have any file entries")
+		// add file to manifest
+		m.Files = append(m.Files, f)
+
+		// track deleted file
+		if f.Status == StatusDeleted {
+			m.DeletedFiles = append(m.DeletedFiles, f)
+		}
 	}
 
 	return m, nil
@@ -297,6 +283,12 @@ contentsize:	{{.ContentSize -}}
 {{range .Includes}}
 includes:	{{.Name}}
 {{- end}}
+{{- range .Optional}}
+also-add:	{{.Name}}
+{{- end}}
+{{- if .Status}}
+status:	{{.Status}}
+{{- end}}
 {{- end}}
 {{ range .Files}}
 {{.GetFlagString}}	{{.Hash}}	{{.Version}}	{{.Name}}
@@ -540,7 +532,7 @@ func linkDeltaPeersForPack(c *config, oldManifest, newManifest *Manifest) error
 			newPath := filepath.Join(c.imageBase, fmt.Sprint(nf.Version), "full", nf.Name)
 			fi, err := os.Stat(newPath)
 			if err != nil {
-				return errors.Wrapf(err, "error accessing %s to decide whether it can have a delta or not")
+				return errors.Wrapf(err, "error accessing %s to decide whether it can have a delta or not", newPath)
 			}
 			if fi.Size() < minimumSizeToMakeDeltaInBytes {
 				continue
@@ -552,18 +544,22 @@ func linkDeltaPeersForPack(c *config, oldManifest, newManifest *Manifest) error
 	}
 
 	// Run rename detection on old and new manifests
-	renameDetection(newManifest, added, removed, *c)
-
-	return nil
+	_, err := renameDetection(newManifest, oldManifest.Header.Version, added, removed, *c)
+	return err
 }
 
 func includesChanged(m1 *Manifest, m2 *Manifest) bool {
-	if len(m1.Header.Includes) != len(m2.Header.Includes) {
+	return manifestNamesChanged(m1.Header.Includes, m2.Header.Includes) ||
+		manifestNamesChanged(m1.Header.Optional, m2.Header.Optional)
+}
+
+func manifestNamesChanged(ms1, ms2 []*Manifest) bool {
+	if len(ms1) != len(ms2) {
 		return true
 	}
 
-	for i := 0; i < len(m1.Header.Includes); i++ {
-		if m1.Header.Includes[i].Name != m2.Header.Includes[i].Name {
+	for i := 0; i < len(ms1); i++ {
+		if ms1[i].Name != ms2[i].Name {
 			return true
 		}
 	}
@@ -571,13 +567,63 @@ func includesChanged(m1 *Manifest, m2 *Manifest) bool {
 	return false
 }
 
-func (m *Manifest) hasUnsupportedTypeChanges() bool {
+// typeChange describes an entry whose type is different from the one in the
+// previous version of the manifest.
+type typeChange struct {
+	Name string
+	From TypeFlag
+	To   TypeFlag
+}
+
+// resolveTypeChanges applies the type change policy to the entries of m linked
+// to the previous version by linkPeersAndChange, and returns the changes found.
+//
+// An entry that changes type is a new entry at the version of m: its peers are
+// unlinked so no delta or rename is ever made against content of a different
+// type, and clients get it from the fullfile or the staged file in a pack.
+//
+// When a directory is replaced by a file, the entries below it are kept as
+// deleted records, so clients remove the old subtree. When it is replaced by a
+// link, the deleted records below it are dropped instead: a client removing
+// them would follow the new link and delete the content it points to.
+func (m *Manifest) resolveTypeChanges() []typeChange {
+	var changes []typeChange
+	links := make(map[string]bool)
 	for _, f := range m.Files {
-		if f.isUnsupportedTypeChange() {
-			return true
+		if f.DeltaPeer == nil || !f.Present() || !f.DeltaPeer.Present() || f.Type == f.DeltaPeer.Type {
+			continue
+		}
+		changes = append(changes, typeChange{Name: f.Name, From: f.DeltaPeer.Type, To: f.Type})
+		if f.replacesDirectory() && f.Type == TypeLink {
+			links[f.Name] = true
+		}
+		f.Version = m.Header.Version
+		f.DeltaPeer.DeltaPeer = nil
+		f.DeltaPeer = nil
+	}
+
+	if len(links) == 0 {
+		return changes
+	}
+
+	files := m.Files[:0]
+	for _, f := range m.Files {
+		if f.Status == StatusDeleted && isBelowAny(f.Name, links) {
+			continue
 		}
+		files = append(files, f)
 	}
+	m.Files = files
+	return changes
+}
 
+// isBelowAny tells if one of the parent directories of name is in dirs.
+func isBelowAny(name string, dirs map[string]bool) bool {
+	for dir := filepath.Dir(name); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if dirs[dir] {
+			return true
+		}
+	}
 	return false
 }
 
@@ -633,22 +679,30 @@ func (m *Manifest) subtractManifests(m2 *Manifest) {
 	}
 }
 
-func (m *Manifest) removeDebuginfo(d dbgConfig) {
-	for i, f := range m.Files {
-		if strings.HasPrefix(f.Name, d.src) && len(f.Name) > len(d.src) {
-			copy(m.Files[i:], m.Files[i+1:])
-			m.Files[len(m.Files)-1] = &File{}
-			m.Files = m.Files[:len(m.Files)-1]
-			continue
-		}
+// isDebuginfo returns true if name is under one of the debuginfo directories
+// configured in d.
+func (d dbgConfig) isDebuginfo(name string) bool {
+	if strings.HasPrefix(name, d.src) && len(name) > len(d.src) {
+		return true
+	}
+	return strings.HasPrefix(name, d.lib) && len(name) > len(d.lib)
+}
 
-		if strings.HasPrefix(f.Name, d.lib) && len(f.Name) > len(d.lib) {
-			copy(m.Files[i:], m.Files[i+1:])
-			m.Files[len(m.Files)-1] = &File{}
-			m.Files = m.Files[:len(m.Files)-1]
-			continue
+// removeDebuginfo removes the debuginfo files from m and returns them.
+func (m *Manifest) removeDebuginfo(d dbgConfig) []*File {
+	var kept, removed []*File
+	for _, f := range m.Files {
+		if d.isDebuginfo(f.Name) {
+			removed = append(removed, f)
+			if f.Info != nil {
+				m.Header.ContentSize -= uint64(f.Info.Size())
+			}
+		} else {
+			kept = append(kept, f)
 		}
 	}
+	m.Files = kept
+	return removed
 }
 
 // getManifestVerFromMoM Find last version for b manifest from mom
@@ -704,19 +758,11 @@ func createAndWrite(path string, contents []byte) error {
 	return ioutil.WriteFile(path, contents, 0655)
 }
 
-func fileContains(path string, sub string) bool {
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
-		return false
-	}
-
-	return bytes.Contains(b, []byte(sub))
-}
-
 type bundleIndex struct {
 	fname string
 	bname string
 	bsize uint64
+	pkg   string
 }
 
 func constructIndex(c *config, ui *UpdateInfo, f2b []*bundleIndex) error {
@@ -730,25 +776,38 @@ func constructIndex(c *config, ui *UpdateInfo, f2b []*bundleIndex) error {
 
 	// construct content for the file
 	var output []byte
-	for _, line := range f2b {
-		strLine := fmt.Sprintf("%s\t%s\n", line.fname, line.bname)
-		output = append(output, []byte(strLine)...)
+	switch c.index.format {
+	case IndexFormatBinary:
+		entries := make([]IndexEntry, len(f2b))
+		for i, line := range f2b {
+			entries[i] = IndexEntry{Name: line.fname, Bundle: line.bname, Package: line.pkg}
+		}
+		var buf bytes.Buffer
+		if err := WriteBinaryIndex(&buf, entries); err != nil {
+			return err
+		}
+		output = buf.Bytes()
+	default:
+		for _, line := range f2b {
+			strLine := fmt.Sprintf("%s\t%s\n", line.fname, line.bname)
+			output = append(output, []byte(strLine)...)
+		}
 	}
 
 	imageVerPath := filepath.Join(c.imageBase, fmt.Sprint(ui.version))
 	// write to bundle chroot
-	outputFileName := filepath.Join(imageVerPath, indexBundle, indexFileName)
+	outputFileName := filepath.Join(imageVerPath, c.index.bundle, c.index.file)
 	if err := createAndWrite(outputFileName, output); err != nil {
 		return err
 	}
 
-	trackingFile := filepath.Join("/usr/share/clear/bundles", indexBundle)
-	if err := createAndWrite(filepath.Join(imageVerPath, indexBundle, trackingFile), []byte{}); err != nil {
+	trackingFile := filepath.Join("/usr/share/clear/bundles", c.index.bundle)
+	if err := createAndWrite(filepath.Join(imageVerPath, c.index.bundle, trackingFile), []byte{}); err != nil {
 		return err
 	}
 
 	// write to full chroot
-	fullFileName := filepath.Join(imageVerPath, "full", indexFileName)
+	fullFileName := filepath.Join(imageVerPath, "full", c.index.file)
 	if err := createAndWrite(fullFileName, output); err != nil {
 		return err
 	}
@@ -764,6 +823,15 @@ func constructIndex(c *config, ui *UpdateInfo, f2b []*bundleIndex) error {
 func writeIndexManifest(c *config, ui *UpdateInfo, bundles []*Manifest) (*Manifest, error) {
 	fileToBundles := []*bundleIndex{}
 	var newFull, newOsCore *Manifest
+	// only the binary format has the packages
+	var filePackages map[string]string
+	if c.index.format == IndexFormatBinary {
+		var err error
+		filePackages, err = readFilePackages(filepath.Join(c.imageBase, fmt.Sprint(ui.version), filePackagesName))
+		if err != nil {
+			return nil, err
+		}
+	}
 	for _, b := range bundles {
 		if b.Name == "full" {
 			// record for later and skip
@@ -783,6 +851,7 @@ func writeIndexManifest(c *config, ui *UpdateInfo, bundles []*Manifest) (*Manife
 					f.Name,
 					b.Name,
 					b.Header.ContentSize,
+					filePackages[f.Name],
 				}
 				fileToBundles = append(fileToBundles, ftb)
 			}
@@ -808,12 +877,12 @@ func writeIndexManifest(c *config, ui *UpdateInfo, bundles []*Manifest) (*Manife
 			TimeStamp: ui.timeStamp,
 			Includes:  []*Manifest{newOsCore},
 		},
-		Name: indexBundle,
+		Name: c.index.bundle,
 	}
 
 	bundleDir := filepath.Join(c.imageBase, fmt.Sprint(ui.version))
 	// add files from the chroot created in constructIndex
-	err := idxMan.addFilesFromChroot(filepath.Join(bundleDir, indexBundle), "")
+	err := idxMan.addFilesFromChroot(filepath.Join(bundleDir, c.index.bundle), "", nil, c.recordPool, c.content.xattrs())
 	if err != nil {
 		return nil, err
 	}
@@ -822,7 +891,7 @@ func writeIndexManifest(c *config, ui *UpdateInfo, bundles []*Manifest) (*Manife
 	// to the index as well
 	metaRoot := filepath.Join(bundleDir, "full", indexAllBundleDir)
 	if _, err = os.Stat(metaRoot); err == nil {
-		err = idxMan.addFilesFromChroot(metaRoot, filepath.Join(bundleDir, "full"))
+		err = idxMan.addFilesFromChroot(metaRoot, filepath.Join(bundleDir, "full"), nil, c.recordPool, c.content.xattrs())
 		if err != nil {
 			return nil, err
 		}
@@ -840,9 +909,16 @@ func writeIndexManifest(c *config, ui *UpdateInfo, bundles []*Manifest) (*Manife
 		}
 
 		includesPath := filepath.Join(c.imageBase, fmt.Sprint(ui.version), "noship", b.Name+"-includes")
-		if fileContains(includesPath, indexBundle) {
-			b.Header.Includes = append(b.Header.Includes, idxMan)
-			b.subtractManifests(idxMan)
+		includes, err := readIncludesFile(includesPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, inc := range includes {
+			if inc == c.index.bundle {
+				b.Header.Includes = append(b.Header.Includes, idxMan)
+				b.subtractManifests(idxMan)
+				break
+			}
 		}
 	}
 
@@ -886,7 +962,7 @@ func writeIndexManifest(c *config, ui *UpdateInfo, bundles []*Manifest) (*Manife
 
 	// done processing, sort by version before writing
 	idxMan.sortFilesVersionName()
-	manOutput := filepath.Join(c.outputDir, fmt.Sprint(ui.version), "Manifest."+indexBundle)
+	manOutput := filepath.Join(c.outputDir, fmt.Sprint(ui.version), "Manifest."+c.index.bundle)
 	if err := idxMan.WriteManifestFile(manOutput); err != nil {
 		return nil, err
 	}
@@ -922,6 +998,8 @@ func fileContentInManifest(f *File, m *Manifest) bool {
 // this is a hack to allow users to update using swupd-client v3.15.3 which performs a
 // check on contentsize with a maximum a couple of orders off the intended maximum.
 // Remove this code (and the caller) when a format bump has occurred in Clear.
+// Until then, formats not supported by that client can skip it, see
+// ContentOptions.UnclampedContentSize.
 var badMax uint64 = 2000000000
 
 func (m *Manifest) setMaxContentSizeHack() {
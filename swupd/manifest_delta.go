@@ -0,0 +1,168 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var manifestDeltaNameRegexp = regexp.MustCompile(`^Manifest-(.+)-delta-from-([0-9]+)$`)
+
+// ManifestDeltaName returns the name of the file, in the directory of the new
+// version, with the delta from the manifest of bundle at version from.
+func ManifestDeltaName(bundle string, from uint32) string {
+	return fmt.Sprintf("Manifest-%s-delta-from-%d", bundle, from)
+}
+
+// parseManifestDeltaName returns the bundle and the version the delta in name
+// applies to.
+func parseManifestDeltaName(name string) (string, uint32, error) {
+	match := manifestDeltaNameRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return "", 0, fmt.Errorf("invalid manifest delta name %s", name)
+	}
+	from, err := strconv.ParseUint(match[2], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid manifest delta name %s: %s", name, err)
+	}
+	return match[1], uint32(from), nil
+}
+
+// CreateManifestDeltas creates, in the directory of version to, the deltas for
+// the bundle manifests updated in that version from the manifests of the same
+// bundles listed in the MoMs of each version in fromVersions. Since an
+// unchanged bundle keeps its manifest, deltas are named after the version of
+// the old manifest, and a delta is created only once even if many versions
+// share it. Returns a list of deltas (which contains information about
+// individual delta errors), deltas that already exist are skipped. The
+// extended attributes of the manifests are checked if enabled in opts, which
+// can be nil.
+func CreateManifestDeltas(outputDir string, to uint32, fromVersions []uint32, opts *ContentOptions) ([]Delta, error) {
+	toMoM, err := ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(to), "Manifest.MoM"))
+	if err != nil {
+		return nil, err
+	}
+
+	var deltas []Delta
+	seen := make(map[string]bool)
+	for _, from := range fromVersions {
+		fromMoM, err := ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(from), "Manifest.MoM"))
+		if err != nil {
+			return nil, err
+		}
+		oldBundles := make(map[string]*File, len(fromMoM.Files))
+		for _, f := range fromMoM.Files {
+			oldBundles[f.Name] = f
+		}
+		for _, f := range toMoM.Files {
+			old := oldBundles[f.Name]
+			if f.Version != to || old == nil || old.Version >= to {
+				continue
+			}
+			name := ManifestDeltaName(f.Name, old.Version)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			deltas = append(deltas, Delta{
+				Path: filepath.Join(outputDir, fmt.Sprint(to), name),
+				from: old,
+				to:   f,
+			})
+		}
+	}
+
+	for i := range deltas {
+		deltas[i].Error = createManifestDelta(outputDir, &deltas[i], opts.xattrs())
+	}
+	return deltas, nil
+}
+
+func createManifestDelta(outputDir string, delta *Delta, xattrs bool) error {
+	if _, err := os.Stat(delta.Path); err == nil {
+		return nil
+	}
+
+	oldPath := filepath.Join(outputDir, fmt.Sprint(delta.from.Version), "Manifest."+delta.from.Name)
+	newPath := filepath.Join(outputDir, fmt.Sprint(delta.to.Version), "Manifest."+delta.to.Name)
+	deltaDesc := fmt.Sprintf("Manifest.%s (%d -> %d)", delta.to.Name, delta.from.Version, delta.to.Version)
+
+	oldContent, err := ioutil.ReadFile(oldPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create delta for %s", deltaDesc)
+	}
+	newContent, err := ioutil.ReadFile(newPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create delta for %s", deltaDesc)
+	}
+	var newXattrs map[string]string
+	if xattrs {
+		newXattrs, err = unchangedXattrs(oldPath, newPath)
+		if err == errXattrsChanged {
+			return fmt.Errorf("extended attributes changed, not using delta %s", deltaDesc)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to create delta for %s", deltaDesc)
+		}
+	}
+
+	deltaContent, err := diffContent(oldContent, newContent, newPath)
+	if err == errDeltaNotWorth {
+		return fmt.Errorf("bsdiff returned FULLDL, not using delta %s", deltaDesc)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create delta for %s", deltaDesc)
+	}
+
+	// Check that the delta produces the manifest listed in the MoM before
+	// writing it, like the client will do.
+	if _, err = ApplyManifestDelta(oldContent, deltaContent, newXattrs, delta.to.Hash.String()); err != nil {
+		return errors.Wrapf(err, "Failed to apply delta %s", delta.Path)
+	}
+
+	// A delta is only useful if it is smaller than the compressed manifest.
+	if tarInfo, err := os.Stat(newPath + ".tar"); err == nil && int64(len(deltaContent)) >= tarInfo.Size() {
+		return fmt.Errorf("Delta file larger than compressed manifest %s", newPath+".tar")
+	}
+
+	if err = ioutil.WriteFile(delta.Path, deltaContent, 0644); err != nil {
+		_ = os.Remove(delta.Path)
+		return errors.Wrapf(err, "Failed to write delta %s", delta.Path)
+	}
+	return nil
+}
+
+// ApplyManifestDelta applies a manifest delta to the content of the old
+// manifest and returns the content of the new one. Deltas don't carry extended
+// attributes, xattrs are the ones of the old manifest file, kept by the new
+// one, and can be nil. When expectedHash is not empty, the result is checked
+// against it, usually the hash listed in the MoM of the new version.
+func ApplyManifestDelta(oldContent, delta []byte, xattrs map[string]string, expectedHash string) ([]byte, error) {
+	content, hash, err := applyDelta(oldContent, delta, xattrs)
+	if err != nil {
+		return nil, err
+	}
+	if expectedHash != "" && hash != expectedHash {
+		return nil, fmt.Errorf("manifest produced by delta has hash %s, but expected %s", hash, expectedHash)
+	}
+	return content, nil
+}
@@ -0,0 +1,115 @@
+package swupd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+func TestManifestDeltas(t *testing.T) {
+	ts := newTestSwupd(t, "manifest-deltas-")
+	defer ts.cleanup()
+
+	ts.Bundles = []string{"contents"}
+	for _, v := range []uint32{10, 20, 30} {
+		if v > 10 {
+			ts.copyChroots(v-10, v)
+		}
+		for i := 0; i < 50; i++ {
+			ts.addFile(v, "contents", fmt.Sprintf("/file%02d", i), fmt.Sprint(i))
+		}
+		ts.addFile(v, "contents", "/changed", fmt.Sprint(v))
+		ts.createManifests(v)
+	}
+
+	deltas, err := CreateManifestDeltas(ts.path("www"), 30, []uint32{20, 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other bundles get deltas too, but their small manifests aren't
+	// always worth it.
+	for _, d := range deltas {
+		if d.to.Name == "contents" && d.Error != nil {
+			t.Fatalf("couldn't create delta %s: %s", d.Path, d.Error)
+		}
+	}
+	ts.checkExists("www/30/" + ManifestDeltaName("contents", 10))
+	ts.checkExists("www/30/" + ManifestDeltaName("contents", 20))
+
+	oldContent, err := ioutil.ReadFile(ts.path("www/10/Manifest.contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := ioutil.ReadFile(ts.path("www/30/" + ManifestDeltaName("contents", 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := GetHashForFile(ts.path("www/30/Manifest.contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ApplyManifestDelta(oldContent, delta, nil, hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ApplyManifestDelta(oldContent[1:], delta, nil, hash); err == nil {
+		t.Errorf("expected error applying delta to the wrong manifest")
+	}
+
+	// The extended attributes kept from the old manifest are in the hash.
+	newContent, err := ioutil.ReadFile(ts.path("www/30/Manifest.contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Lstat(ts.path("www/30/Manifest.contents"), &st); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := map[string]string{"security.ima": "signature"}
+	xattrsHash, err := GetHashForBytes(&HashFileInfo{Mode: st.Mode, UID: st.Uid, GID: st.Gid, Size: st.Size, Xattrs: xattrs}, newContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ApplyManifestDelta(oldContent, delta, xattrs, xattrsHash); err != nil {
+		t.Errorf("couldn't apply delta with extended attributes: %s", err)
+	}
+	if _, err = ApplyManifestDelta(oldContent, delta, nil, xattrsHash); err == nil {
+		t.Errorf("expected error applying delta without the extended attributes in the hash")
+	}
+
+	ts.write("www/version/format1/latest", "30")
+
+	// Only manifests were created, so skip the other content.
+	opts := &VerifyOptions{SkipFullfiles: true, SkipPacks: true}
+	report, err := VerifyRepository(ts.path("www"), 30, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVerifyIssues(t, report)
+	for _, c := range report.Checks {
+		if c.Name == VerifyManifestDeltas && c.Checked < 2 {
+			t.Errorf("checked %d manifest deltas but expected at least 2", c.Checked)
+		}
+	}
+
+	// A delta applied to another version of the manifest is broken.
+	mustCopyFile(t, ts.path("www/30/"+ManifestDeltaName("contents", 10)), ts.path("www/30/"+ManifestDeltaName("contents", 20)))
+	report, err = VerifyRepository(ts.path("www"), 30, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVerifyIssues(t, report, VerifyManifestDeltas+" 30/"+ManifestDeltaName("contents", 20))
+
+	// Without version 20, no client needs the delta from it.
+	plan, err := PlanGC(ts.path("www"), []uint32{10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := make(map[string]bool)
+	for _, e := range plan.Remove {
+		removed[e.Path] = true
+	}
+	if !removed["30/"+ManifestDeltaName("contents", 20)] || removed["30/"+ManifestDeltaName("contents", 10)] {
+		t.Errorf("unexpected manifest deltas removed: %v", plan.Remove)
+	}
+}
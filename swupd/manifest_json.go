@@ -0,0 +1,331 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ManifestJSONSchema identifies the version of the JSON representation of
+// manifests written by WriteManifestJSON.
+//
+// A manifest is represented as an object with the following fields:
+//
+//	schema    string, always ManifestJSONSchema
+//	name      string, name of the bundle, "MoM" or "full"
+//	header    object:
+//	  format       number
+//	  version      number
+//	  previous     number
+//	  filecount    number
+//	  timestamp    number, seconds since the Unix epoch
+//	  contentsize  number
+//	  includes     array of bundle names, may be omitted
+//	  alsoAdd      array of optional bundle names, may be omitted
+//	  status       string, status of the bundle, omitted when active
+//	files     array of objects:
+//	  name         string, the path of the file or the bundle name in a MoM
+//	  hash         string, 64 hex digits
+//	  version      number, version in which the file last changed
+//	  flags        string, the 4 characters used in the text format
+//	  type         "file", "directory", "link", "manifest" or "" if unset
+//	  status       "deleted", "ghosted" or "" if unset
+//	  modifier     "config", "state", "boot" or "" if unset
+//	  mix          true for bundles merged by client side mixer integration
+//	  renameScore  number, omitted when zero
+//	  renamePeer   peer object, omitted when not set
+//	  deltaPeer    peer object, omitted when not set
+//
+// Peer objects contain the name, hash and version of the related file, as
+// they refer to entries of other manifests.
+//
+// When parsing, the flags are taken from the type, status, modifier and mix
+// fields. If flags is also present it must agree with them.
+const ManifestJSONSchema = "swupd-manifest/1"
+
+type manifestJSON struct {
+	Schema string             `json:"schema"`
+	Name   string             `json:"name"`
+	Header manifestHeaderJSON `json:"header"`
+	Files  []*fileJSON        `json:"files"`
+}
+
+type manifestHeaderJSON struct {
+	Format      uint     `json:"format"`
+	Version     uint32   `json:"version"`
+	Previous    uint32   `json:"previous"`
+	FileCount   uint32   `json:"filecount"`
+	TimeStamp   int64    `json:"timestamp"`
+	ContentSize uint64   `json:"contentsize"`
+	Includes    []string `json:"includes,omitempty"`
+	AlsoAdd     []string `json:"alsoAdd,omitempty"`
+	Status      string   `json:"status,omitempty"`
+}
+
+type fileJSON struct {
+	Name        string    `json:"name"`
+	Hash        string    `json:"hash"`
+	Version     uint32    `json:"version"`
+	Flags       string    `json:"flags,omitempty"`
+	Type        string    `json:"type"`
+	Status      string    `json:"status"`
+	Modifier    string    `json:"modifier"`
+	Mix         bool      `json:"mix,omitempty"`
+	RenameScore uint16    `json:"renameScore,omitempty"`
+	RenamePeer  *peerJSON `json:"renamePeer,omitempty"`
+	DeltaPeer   *peerJSON `json:"deltaPeer,omitempty"`
+}
+
+type peerJSON struct {
+	Name    string `json:"name"`
+	Hash    string `json:"hash"`
+	Version uint32 `json:"version"`
+}
+
+var typeNames = map[TypeFlag]string{
+	TypeUnset:     "",
+	TypeFile:      "file",
+	TypeDirectory: "directory",
+	TypeLink:      "link",
+	TypeManifest:  "manifest",
+}
+
+var statusNames = map[StatusFlag]string{
+	StatusUnset:   "",
+	StatusDeleted: "deleted",
+	StatusGhosted: "ghosted",
+}
+
+var modifierNames = map[ModifierFlag]string{
+	ModifierUnset:  "",
+	ModifierConfig: "config",
+	ModifierState:  "state",
+	ModifierBoot:   "boot",
+}
+
+func newPeerJSON(f *File) *peerJSON {
+	if f == nil {
+		return nil
+	}
+	return &peerJSON{Name: f.Name, Hash: f.Hash.String(), Version: f.Version}
+}
+
+func (p *peerJSON) toFile() (*File, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if err := checkHashString(p.Hash); err != nil {
+		return nil, err
+	}
+	return &File{Name: p.Name, Hash: internHash(p.Hash), Version: p.Version}, nil
+}
+
+func checkHashString(hash string) error {
+	if len(hash) != 64 {
+		return fmt.Errorf("invalid hash: %v", hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return fmt.Errorf("invalid hash: %v", hash)
+	}
+	return nil
+}
+
+var (
+	typeFromName     = make(map[string]TypeFlag)
+	statusFromName   = make(map[string]StatusFlag)
+	modifierFromName = make(map[string]ModifierFlag)
+)
+
+func init() {
+	for flag, name := range typeNames {
+		typeFromName[name] = flag
+	}
+	for flag, name := range statusNames {
+		statusFromName[name] = flag
+	}
+	for flag, name := range modifierNames {
+		modifierFromName[name] = flag
+	}
+}
+
+func newFileJSON(f *File) (*fileJSON, error) {
+	flags, err := f.GetFlagString()
+	if err != nil {
+		return nil, err
+	}
+	return &fileJSON{
+		Name:        f.Name,
+		Hash:        f.Hash.String(),
+		Version:     f.Version,
+		Flags:       flags,
+		Type:        typeNames[f.Type],
+		Status:      statusNames[f.Status],
+		Modifier:    modifierNames[f.Modifier],
+		Mix:         f.Rename == MixManifest,
+		RenameScore: f.RenameScore,
+		RenamePeer:  newPeerJSON(f.RenamePeer),
+		DeltaPeer:   newPeerJSON(f.DeltaPeer),
+	}, nil
+}
+
+// WriteManifestJSON writes the manifest to w using the JSON representation
+// described in ManifestJSONSchema.
+func (m *Manifest) WriteManifestJSON(w io.Writer) error {
+	err := m.CheckHeaderIsValid()
+	if err != nil {
+		return err
+	}
+
+	mj := manifestJSON{
+		Schema: ManifestJSONSchema,
+		Name:   m.Name,
+		Header: manifestHeaderJSON{
+			Format:      m.Header.Format,
+			Version:     m.Header.Version,
+			Previous:    m.Header.Previous,
+			FileCount:   m.Header.FileCount,
+			TimeStamp:   m.Header.TimeStamp.Unix(),
+			ContentSize: m.Header.ContentSize,
+			Status:      m.Header.Status,
+		},
+		Files: make([]*fileJSON, 0, len(m.Files)),
+	}
+	for _, inc := range m.Header.Includes {
+		mj.Header.Includes = append(mj.Header.Includes, inc.Name)
+	}
+	for _, opt := range m.Header.Optional {
+		mj.Header.AlsoAdd = append(mj.Header.AlsoAdd, opt.Name)
+	}
+
+	for _, f := range m.Files {
+		fj, err := newFileJSON(f)
+		if err != nil {
+			return err
+		}
+		mj.Files = append(mj.Files, fj)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(&mj); err != nil {
+		return fmt.Errorf("couldn't write Manifest.%s: %s", m.Name, err)
+	}
+	return nil
+}
+
+// ParseManifestJSON creates a Manifest from its JSON representation, as
+// written by WriteManifestJSON. Rename and delta peers are created as
+// standalone files, since they refer to entries from other manifests.
+func ParseManifestJSON(r io.Reader) (*Manifest, error) {
+	var mj manifestJSON
+	if err := json.NewDecoder(r).Decode(&mj); err != nil {
+		return nil, fmt.Errorf("invalid manifest, %s", err)
+	}
+	if mj.Schema != ManifestJSONSchema {
+		return nil, fmt.Errorf("invalid manifest, unsupported schema %q", mj.Schema)
+	}
+
+	m := &Manifest{
+		Name: mj.Name,
+		Header: ManifestHeader{
+			Format:      mj.Header.Format,
+			Version:     mj.Header.Version,
+			Previous:    mj.Header.Previous,
+			FileCount:   mj.Header.FileCount,
+			ContentSize: mj.Header.ContentSize,
+			Status:      mj.Header.Status,
+		},
+	}
+	// leave a missing timestamp unset so the header validation catches it
+	if mj.Header.TimeStamp != 0 {
+		m.Header.TimeStamp = time.Unix(mj.Header.TimeStamp, 0)
+	}
+	for _, name := range mj.Header.Includes {
+		m.Header.Includes = append(m.Header.Includes, &Manifest{Name: name})
+	}
+	for _, name := range mj.Header.AlsoAdd {
+		m.Header.Optional = append(m.Header.Optional, &Manifest{Name: name})
+	}
+	if err := m.CheckHeaderIsValid(); err != nil {
+		return nil, err
+	}
+
+	for _, fj := range mj.Files {
+		f, err := fj.toFile()
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, f)
+		if f.Status == StatusDeleted {
+			m.DeletedFiles = append(m.DeletedFiles, f)
+		}
+	}
+
+	if len(m.Files) == 0 {
+		return nil, fmt.Errorf("invalid manifest, does not have any file entries")
+	}
+
+	return m, nil
+}
+
+func (fj *fileJSON) toFile() (*File, error) {
+	if fj == nil {
+		return nil, fmt.Errorf("invalid manifest, null file entry")
+	}
+	if err := checkHashString(fj.Hash); err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		Name:        fj.Name,
+		Hash:        internHash(fj.Hash),
+		Version:     fj.Version,
+		RenameScore: fj.RenameScore,
+	}
+
+	var ok bool
+	if f.Type, ok = typeFromName[fj.Type]; !ok {
+		return nil, fmt.Errorf("invalid file type %q for %s", fj.Type, fj.Name)
+	}
+	if f.Status, ok = statusFromName[fj.Status]; !ok {
+		return nil, fmt.Errorf("invalid file status %q for %s", fj.Status, fj.Name)
+	}
+	if f.Modifier, ok = modifierFromName[fj.Modifier]; !ok {
+		return nil, fmt.Errorf("invalid file modifier %q for %s", fj.Modifier, fj.Name)
+	}
+	if fj.Mix {
+		f.Rename = MixManifest
+	}
+
+	flags, err := f.GetFlagString()
+	if err != nil {
+		return nil, err
+	}
+	if fj.Flags != "" && fj.Flags != flags {
+		return nil, fmt.Errorf("flags %q for %s don't match type, status and modifier (%q)", fj.Flags, fj.Name, flags)
+	}
+
+	if f.RenamePeer, err = fj.RenamePeer.toFile(); err != nil {
+		return nil, err
+	}
+	if f.DeltaPeer, err = fj.DeltaPeer.toFile(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,144 @@
+package swupd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestJSONRoundTrip(t *testing.T) {
+	m, err := ParseManifestFile("testdata/manifest.good")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	if err = m.WriteManifest(&text); err != nil {
+		t.Fatal(err)
+	}
+
+	var js bytes.Buffer
+	if err = m.WriteManifestJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseManifestJSON(&js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != m.Name {
+		t.Errorf("got name %q but expected %q", got.Name, m.Name)
+	}
+
+	var gotText bytes.Buffer
+	if err = got.WriteManifest(&gotText); err != nil {
+		t.Fatal(err)
+	}
+	if gotText.String() != text.String() {
+		t.Errorf("manifest changed after round trip through JSON\ngot:\n%s\nexpected:\n%s", gotText.String(), text.String())
+	}
+}
+
+func TestManifestJSONFlagsAndPeers(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	peer := &File{Name: "/usr/bin/old", Hash: internHash(strings.Repeat("cd", 32)), Version: 10}
+	m := &Manifest{
+		Name: "MoM",
+		Header: ManifestHeader{
+			Format:    26,
+			Version:   20,
+			Previous:  10,
+			FileCount: 3,
+			TimeStamp: time.Unix(1000, 0),
+			Includes:  []*Manifest{{Name: "os-core"}},
+			Optional:  []*Manifest{{Name: "editors"}},
+			Status:    BundleStatusDeprecated,
+		},
+		Files: []*File{
+			{Name: "test-bundle", Hash: internHash(hash), Version: 20, Type: TypeManifest, Rename: MixManifest},
+			{Name: "/usr/bin/new", Hash: internHash(hash), Version: 20, Type: TypeFile, Modifier: ModifierBoot, RenameScore: 7, RenamePeer: peer, DeltaPeer: peer},
+			{Name: "/etc/removed", Hash: internHash(AllZeroHash), Version: 20, Status: StatusDeleted, Modifier: ModifierConfig},
+		},
+	}
+
+	var js bytes.Buffer
+	if err := m.WriteManifestJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"flags": "M..m"`, `"type": "manifest"`, `"mix": true`, `"modifier": "boot"`, `"status": "deleted"`} {
+		if !strings.Contains(js.String(), s) {
+			t.Errorf("JSON output doesn't contain %s:\n%s", s, js.String())
+		}
+	}
+
+	got, err := ParseManifestJSON(&js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Header.Includes) != 1 || got.Header.Includes[0].Name != "os-core" {
+		t.Errorf("includes were not preserved: %v", got.Header.Includes)
+	}
+	if len(got.Header.Optional) != 1 || got.Header.Optional[0].Name != "editors" {
+		t.Errorf("optional bundles were not preserved: %v", got.Header.Optional)
+	}
+	if got.Header.Status != BundleStatusDeprecated {
+		t.Errorf("status was not preserved: %q", got.Header.Status)
+	}
+	if len(got.DeletedFiles) != 1 || got.DeletedFiles[0].Name != "/etc/removed" {
+		t.Errorf("deleted files were not tracked: %v", got.DeletedFiles)
+	}
+	for i, f := range got.Files {
+		expected := m.Files[i]
+		if f.Name != expected.Name || f.Hash != expected.Hash || f.Version != expected.Version ||
+			f.Type != expected.Type || f.Status != expected.Status || f.Modifier != expected.Modifier ||
+			f.Rename != expected.Rename || f.RenameScore != expected.RenameScore {
+			t.Errorf("file %+v doesn't match expected %+v", f, expected)
+		}
+	}
+	f := got.Files[1]
+	if f.RenamePeer == nil || f.RenamePeer.Name != peer.Name || f.RenamePeer.Hash != peer.Hash || f.RenamePeer.Version != peer.Version {
+		t.Errorf("rename peer %+v doesn't match expected %+v", f.RenamePeer, peer)
+	}
+	if f.DeltaPeer == nil || f.DeltaPeer.Name != peer.Name {
+		t.Errorf("delta peer %+v doesn't match expected %+v", f.DeltaPeer, peer)
+	}
+}
+
+func TestParseManifestJSONInvalid(t *testing.T) {
+	header := `"header": {"format": 26, "version": 20, "previous": 10, "filecount": 1, "timestamp": 1000, "contentsize": 0}`
+	file := func(fields string) string {
+		return `{"schema": "swupd-manifest/1", "name": "b", ` + header + `, "files": [` + fields + `]}`
+	}
+	hash := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"not json", "MANIFEST\t26"},
+		{"bad schema", `{"schema": "swupd-manifest/99"}`},
+		{"bad header", `{"schema": "swupd-manifest/1", "header": {"format": 26}, "files": []}`},
+		{"no files", file("")},
+		{"null file", file("null")},
+		{"short hash", file(`{"name": "/f", "hash": "abc", "version": 20, "type": "file"}`)},
+		{"non hex hash", file(`{"name": "/f", "hash": "` + strings.Repeat("zz", 32) + `", "version": 20, "type": "file"}`)},
+		{"bad type", file(`{"name": "/f", "hash": "` + hash + `", "version": 20, "type": "socket"}`)},
+		{"bad modifier", file(`{"name": "/f", "hash": "` + hash + `", "version": 20, "type": "file", "modifier": "x"}`)},
+		{"no flags", file(`{"name": "/f", "hash": "` + hash + `", "version": 20}`)},
+		{"mismatched flags", file(`{"name": "/f", "hash": "` + hash + `", "version": 20, "type": "file", "flags": "D..."}`)},
+		{"bad peer", file(`{"name": "/f", "hash": "` + hash + `", "version": 20, "type": "file", "deltaPeer": {"name": "/g", "hash": "0"}}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseManifestJSON(strings.NewReader(tt.input)); err == nil {
+				t.Errorf("ParseManifestJSON did not raise error for invalid input")
+			}
+		})
+	}
+
+	valid := file(`{"name": "/f", "hash": "` + hash + `", "version": 20, "type": "file", "flags": "F..."}`)
+	if _, err := ParseManifestJSON(strings.NewReader(valid)); err != nil {
+		t.Errorf("unexpected error for valid input: %s", err)
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// FileIterator is a sequence of manifest files. Next returns io.EOF after the
+// last file.
+type FileIterator interface {
+	Next() (*File, error)
+}
+
+// ManifestReader reads a manifest incrementally, so the file entries don't
+// need to be kept in memory. The header is read and validated when the reader
+// is created, the file entries are returned by Next in the order they appear.
+type ManifestReader struct {
+	Header ManifestHeader
+
+	entries *manifestEntryReader
+}
+
+// manifestEntryReader parses file entries, one per line, keeping track of the
+// position in the input.
+type manifestEntryReader struct {
+	input *bufio.Scanner
+	count int
+
+	// offset is the position after the last line read, lineStart is the
+	// position where it started.
+	offset    int64
+	lineStart int64
+}
+
+func newManifestEntryReader(r io.Reader, offset int64) *manifestEntryReader {
+	er := &manifestEntryReader{
+		input:  bufio.NewScanner(r),
+		offset: offset,
+	}
+	er.input.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		er.offset += int64(advance)
+		return advance, token, err
+	})
+	return er
+}
+
+func (er *manifestEntryReader) scan() bool {
+	er.lineStart = er.offset
+	return er.input.Scan()
+}
+
+func (er *manifestEntryReader) next() (*File, error) {
+	if !er.scan() {
+		if err := er.input.Err(); err != nil {
+			return nil, err
+		}
+		if er.count == 0 {
+			return nil, errors.New("invalid manifest, does not have any file entries")
+		}
+		return nil, io.EOF
+	}
+	text := er.input.Text()
+	if text == "" {
+		return nil, errors.New("invalid manifest, extra blank line")
+	}
+
+	var m Manifest
+	if err := readManifestFileEntry(strings.Split(text, manifestFieldDelim), &m); err != nil {
+		return nil, err
+	}
+	er.count++
+	return m.Files[0], nil
+}
+
+// NewManifestReader reads the manifest header from r and returns a reader for
+// the file entries.
+func NewManifestReader(r io.Reader) (*ManifestReader, error) {
+	er := newManifestEntryReader(r, 0)
+	m := &Manifest{}
+
+	// Read the header.
+	parsedEntries := make(map[string]uint)
+	for er.scan() {
+		text := er.input.Text()
+		if text == "" {
+			// Empty line means end of the header.
+			break
+		}
+
+		fields := strings.Split(text, manifestFieldDelim)
+		entry := fields[0]
+		repeatable := entry == "includes:" || entry == "also-add:"
+		if !repeatable && parsedEntries[entry] > 0 {
+			return nil, fmt.Errorf("invalid manifest, duplicate entry %q in header", entry)
+		}
+		parsedEntries[entry]++
+
+		if err := readManifestFileHeaderLine(fields, m); err != nil {
+			return nil, err
+		}
+	}
+	if err := er.input.Err(); err != nil {
+		return nil, err
+	}
+
+	// Validate the header.
+	for _, e := range requiredManifestHeaderEntries {
+		if parsedEntries[e] == 0 {
+			return nil, fmt.Errorf("invalid manifest, missing entry %q in header", e)
+		}
+	}
+	err := m.CheckHeaderIsValid()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ManifestReader{Header: m.Header, entries: er}, nil
+}
+
+// Next returns the next file entry of the manifest, or io.EOF when all the
+// entries were read. A manifest without file entries is reported as an error.
+func (mr *ManifestReader) Next() (*File, error) {
+	return mr.entries.next()
+}
+
+// SortedManifestReader returns the file entries of a manifest sorted by name,
+// independently of the order they are stored. Manifests are written sorted by
+// version and then by name, so the entries form a few runs already sorted by
+// name, one per version. The runs are merged while reading, so the memory
+// used depends on the number of runs, not on the number of files.
+type SortedManifestReader struct {
+	Header ManifestHeader
+
+	runs   runHeap
+	closer io.Closer
+}
+
+// manifestRun is a sequence of file entries sorted by name.
+type manifestRun struct {
+	entries *manifestEntryReader
+	current *File
+}
+
+func (r *manifestRun) advance() error {
+	f, err := r.entries.next()
+	if err == io.EOF {
+		r.current = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.current = f
+	return nil
+}
+
+type runHeap []*manifestRun
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].current.Name < h[j].current.Name }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*manifestRun)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// NewSortedManifestReader reads the manifest from r, which has size bytes. The
+// whole manifest is validated once to find the sorted runs of entries, so
+// errors in the entries are reported here and not by Next.
+func NewSortedManifestReader(r io.ReaderAt, size int64) (*SortedManifestReader, error) {
+	mr, err := NewManifestReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	var starts []int64
+	var prev string
+	for {
+		f, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(starts) == 0 || f.Name < prev {
+			starts = append(starts, mr.entries.lineStart)
+		}
+		prev = f.Name
+	}
+
+	sr := &SortedManifestReader{Header: mr.Header}
+	for i, start := range starts {
+		end := size
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		run := &manifestRun{
+			entries: newManifestEntryReader(io.NewSectionReader(r, start, end-start), start),
+		}
+		if err = run.advance(); err != nil {
+			return nil, err
+		}
+		sr.runs = append(sr.runs, run)
+	}
+	heap.Init(&sr.runs)
+	return sr, nil
+}
+
+// OpenSortedManifest opens the manifest file in path for reading its entries
+// sorted by name. The returned reader must be closed after use.
+func OpenSortedManifest(path string) (*SortedManifestReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	sr, err := NewSortedManifestReader(f, fi.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("couldn't read manifest %s: %s", path, err)
+	}
+	sr.closer = f
+	return sr, nil
+}
+
+// Next returns the next file entry in name order, or io.EOF when all the
+// entries were read.
+func (sr *SortedManifestReader) Next() (*File, error) {
+	if len(sr.runs) == 0 {
+		return nil, io.EOF
+	}
+	run := sr.runs[0]
+	f := run.current
+	if err := run.advance(); err != nil {
+		return nil, err
+	}
+	if run.current == nil {
+		heap.Pop(&sr.runs)
+	} else {
+		heap.Fix(&sr.runs, 0)
+	}
+	return f, nil
+}
+
+// Close closes the underlying file when the reader was created by
+// OpenSortedManifest.
+func (sr *SortedManifestReader) Close() error {
+	if sr.closer == nil {
+		return nil
+	}
+	return sr.closer.Close()
+}
+
+type fileSliceIterator struct {
+	files []*File
+}
+
+func (it *fileSliceIterator) Next() (*File, error) {
+	if len(it.files) == 0 {
+		return nil, io.EOF
+	}
+	f := it.files[0]
+	it.files = it.files[1:]
+	return f, nil
+}
+
+// NewFileSliceIterator returns an iterator over files already in memory.
+func NewFileSliceIterator(files []*File) FileIterator {
+	return &fileSliceIterator{files: files}
+}
+
+// MergeJoinFiles walks two sequences of files sorted by name, calling fn with
+// the files of both sequences that have the same name. Files present in only
+// one sequence are paired with nil. An error is returned if any of the
+// sequences is not sorted, or if fn returns an error.
+func MergeJoinFiles(a, b FileIterator, fn func(a, b *File) error) error {
+	next := func(it FileIterator, prev *File) (*File, error) {
+		f, err := it.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil && f.Name <= prev.Name {
+			return nil, fmt.Errorf("files are not sorted by name: %s after %s", f.Name, prev.Name)
+		}
+		return f, nil
+	}
+
+	fileA, err := next(a, nil)
+	if err != nil {
+		return err
+	}
+	fileB, err := next(b, nil)
+	if err != nil {
+		return err
+	}
+	for fileA != nil || fileB != nil {
+		switch {
+		case fileB == nil || (fileA != nil && fileA.Name < fileB.Name):
+			if err = fn(fileA, nil); err != nil {
+				return err
+			}
+			fileA, err = next(a, fileA)
+		case fileA == nil || fileA.Name > fileB.Name:
+			if err = fn(nil, fileB); err != nil {
+				return err
+			}
+			fileB, err = next(b, fileB)
+		default:
+			if err = fn(fileA, fileB); err != nil {
+				return err
+			}
+			fileA, err = next(a, fileA)
+			if err == nil {
+				fileB, err = next(b, fileB)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package swupd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAllFiles(t *testing.T, it FileIterator) []*File {
+	t.Helper()
+	var files []*File
+	for {
+		f, err := it.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+}
+
+func TestManifestReader(t *testing.T) {
+	m, err := ParseManifestFile("testdata/manifest.good")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("testdata/manifest.good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	mr, err := NewManifestReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.Header.Version != m.Header.Version || mr.Header.FileCount != m.Header.FileCount ||
+		len(mr.Header.Includes) != len(m.Header.Includes) {
+		t.Errorf("header %+v doesn't match parsed header %+v", mr.Header, m.Header)
+	}
+
+	files := readAllFiles(t, mr)
+	if len(files) != len(m.Files) {
+		t.Fatalf("read %d files but expected %d", len(files), len(m.Files))
+	}
+	for i := range files {
+		if files[i].Name != m.Files[i].Name || files[i].Hash != m.Files[i].Hash {
+			t.Errorf("file %d is %s but expected %s", i, files[i].Name, m.Files[i].Name)
+		}
+	}
+}
+
+func TestManifestReaderInvalid(t *testing.T) {
+	header := "MANIFEST\t26\nversion:\t20\nprevious:\t10\nfilecount:\t1\ntimestamp:\t1000\ncontentsize:\t0\n\n"
+	entry := "F...\t" + strings.Repeat("a", 64) + "\t20\t/file\n"
+
+	if _, err := NewManifestReader(strings.NewReader("MANIFEST\t26\n\n" + entry)); err == nil {
+		t.Error("NewManifestReader did not raise error for incomplete header")
+	}
+
+	for _, body := range []string{"", entry + "\n" + entry, "x\n", "X...\t" + strings.Repeat("a", 64) + "\t20\t/file\n"} {
+		mr, err := NewManifestReader(strings.NewReader(header + body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for err == nil {
+			_, err = mr.Next()
+		}
+		if err == io.EOF {
+			t.Errorf("Next did not raise error for invalid body %q", body)
+		}
+	}
+}
+
+func TestSortedManifestReader(t *testing.T) {
+	m := &Manifest{
+		Name: "test",
+		Header: ManifestHeader{
+			Format:    26,
+			Version:   30,
+			Previous:  20,
+			TimeStamp: time.Unix(1000, 0),
+		},
+	}
+	for i := 0; i < 100; i++ {
+		m.Files = append(m.Files, &File{
+			Name:    fmt.Sprintf("/file%03d", (i*37)%100),
+			Hash:    internHash(strings.Repeat("a", 64)),
+			Version: uint32(10 * (1 + i%3)),
+			Type:    TypeFile,
+		})
+	}
+	m.Header.FileCount = uint32(len(m.Files))
+	m.sortFilesVersionName()
+
+	var buf bytes.Buffer
+	if err := m.WriteManifest(&buf); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := NewSortedManifestReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.runs) != 3 {
+		t.Errorf("found %d runs but expected one per version", len(sr.runs))
+	}
+
+	files := readAllFiles(t, sr)
+	m.sortFilesName()
+	if len(files) != len(m.Files) {
+		t.Fatalf("read %d files but expected %d", len(files), len(m.Files))
+	}
+	for i := range files {
+		if files[i].Name != m.Files[i].Name || files[i].Version != m.Files[i].Version {
+			t.Errorf("file %d is %s (%d) but expected %s (%d)", i, files[i].Name, files[i].Version, m.Files[i].Name, m.Files[i].Version)
+		}
+	}
+}
+
+func TestOpenSortedManifest(t *testing.T) {
+	sr, err := OpenSortedManifest("testdata/manifest.good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = sr.Close()
+	}()
+
+	files := readAllFiles(t, sr)
+	if !sort.SliceIsSorted(files, func(i, j int) bool { return files[i].Name < files[j].Name }) {
+		t.Error("files were not returned sorted by name")
+	}
+	m, err := ParseManifestFile("testdata/manifest.good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(m.Files) {
+		t.Errorf("read %d files but expected %d", len(files), len(m.Files))
+	}
+}
+
+func TestMergeJoinFiles(t *testing.T) {
+	files := func(names ...string) FileIterator {
+		var fs []*File
+		for _, name := range names {
+			fs = append(fs, &File{Name: name})
+		}
+		return NewFileSliceIterator(fs)
+	}
+	name := func(f *File) string {
+		if f == nil {
+			return "-"
+		}
+		return f.Name
+	}
+
+	var pairs []string
+	err := MergeJoinFiles(files("/a", "/b", "/d", "/f"), files("/b", "/c", "/d", "/e"), func(a, b *File) error {
+		pairs = append(pairs, name(a)+":"+name(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "/a:- /b:/b -:/c /d:/d -:/e /f:-"
+	if got := strings.Join(pairs, " "); got != expected {
+		t.Errorf("got pairs %q but expected %q", got, expected)
+	}
+
+	noop := func(a, b *File) error { return nil }
+	if err = MergeJoinFiles(files("/b", "/a"), files(), noop); err == nil {
+		t.Error("MergeJoinFiles did not raise error for unsorted files")
+	}
+	if err = MergeJoinFiles(files(), files("/a", "/a"), noop); err == nil {
+		t.Error("MergeJoinFiles did not raise error for duplicated files")
+	}
+
+	stop := fmt.Errorf("stop")
+	err = MergeJoinFiles(files("/a", "/b"), files("/a"), func(a, b *File) error { return stop })
+	if err != stop {
+		t.Errorf("got error %v but expected error returned by the function", err)
+	}
+}
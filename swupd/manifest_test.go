@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -210,10 +211,11 @@ func TestCheckInvalidManifestHeaders(t *testing.T) {
 		name   string
 		header ManifestHeader
 	}{
-		{"format not set", ManifestHeader{0, 100, 90, 553, time.Unix(1000, 0), 100000, nil}},
-		{"version zero", ManifestHeader{10, 0, 90, 553, time.Unix(1000, 0), 100000, nil}},
-		{"no files", ManifestHeader{10, 100, 90, 0, time.Unix(1000, 0), 100000, nil}},
-		{"no timestamp", ManifestHeader{10, 100, 90, 553, zeroTime, 100000, nil}},
+		{"format not set", ManifestHeader{Format: 0, Version: 100, Previous: 90, FileCount: 553, TimeStamp: time.Unix(1000, 0), ContentSize: 100000}},
+		{"version zero", ManifestHeader{Format: 10, Version: 0, Previous: 90, FileCount: 553, TimeStamp: time.Unix(1000, 0), ContentSize: 100000}},
+		{"no files", ManifestHeader{Format: 10, Version: 100, Previous: 90, FileCount: 0, TimeStamp: time.Unix(1000, 0), ContentSize: 100000}},
+		{"no timestamp", ManifestHeader{Format: 10, Version: 100, Previous: 90, FileCount: 553, TimeStamp: zeroTime, ContentSize: 100000}},
+		{"unknown status", ManifestHeader{Format: 10, Version: 100, Previous: 90, FileCount: 553, TimeStamp: time.Unix(1000, 0), ContentSize: 100000, Status: "Retired"}},
 	}
 
 	for _, tt := range tests {
@@ -309,6 +311,48 @@ func TestWriteManifestFile(t *testing.T) {
 	}
 }
 
+func TestWriteManifestRepeatedHeaderEntries(t *testing.T) {
+	m := Manifest{
+		Header: ManifestHeader{
+			Format:      10,
+			Version:     100,
+			Previous:    90,
+			FileCount:   1,
+			TimeStamp:   time.Unix(1000, 0),
+			ContentSize: 100,
+			Includes:    []*Manifest{{Name: "os-core"}, {Name: "editors"}},
+			Optional:    []*Manifest{{Name: "emacs"}, {Name: "vim"}, {Name: "nano"}},
+		},
+		Files: []*File{{Name: "/usr/bin/foo", Type: TypeFile, Version: 100}},
+	}
+
+	var output bytes.Buffer
+	if err := m.WriteManifest(&output); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(output.String(), "also-add:"); n != 3 {
+		t.Fatalf("expected 3 also-add entries in the manifest, got %d:\n%s", n, output.String())
+	}
+
+	got, err := ParseManifest(&output)
+	if err != nil {
+		t.Fatalf("couldn't read back manifest with repeated header entries: %s", err)
+	}
+	names := func(ms []*Manifest) []string {
+		var result []string
+		for _, m := range ms {
+			result = append(result, m.Name)
+		}
+		return result
+	}
+	if want := names(m.Header.Includes); !reflect.DeepEqual(names(got.Header.Includes), want) {
+		t.Errorf("got includes %v but want %v", names(got.Header.Includes), want)
+	}
+	if want := names(m.Header.Optional); !reflect.DeepEqual(names(got.Header.Optional), want) {
+		t.Errorf("got also-add %v but want %v", names(got.Header.Optional), want)
+	}
+}
+
 func TestWriteManifestWithBadHeader(t *testing.T) {
 	m := Manifest{Header: ManifestHeader{}}
 
@@ -428,126 +472,101 @@ func TestLinkPeersAndChange(t *testing.T) {
 	}
 }
 
-func TestHasTypeChanges(t *testing.T) {
-	mUnchanged := Manifest{
-		Files: []*File{
-			{ // no delta peer, no type change
-				Name:      "1",
-				Type:      TypeFile,
-				Status:    StatusUnset,
-				DeltaPeer: nil,
-			},
-			{ // same type, no type change
-				Name:   "2",
-				Type:   TypeFile,
-				Status: StatusUnset,
-				DeltaPeer: &File{
-					Name:   "2",
-					Type:   TypeFile,
-					Status: StatusUnset,
-				},
-			},
-			{ // File -> Link OK, no change reported
-				Name:   "3",
-				Type:   TypeLink,
-				Status: StatusUnset,
-				DeltaPeer: &File{
-					Name:   "3",
-					Type:   TypeFile,
-					Status: StatusUnset,
-				},
-			},
-			{ // File -> Directory OK, no change reported
-				Name:   "4",
-				Type:   TypeDirectory,
-				Status: StatusUnset,
-				DeltaPeer: &File{
-					Name:   "4",
-					Type:   TypeFile,
-					Status: StatusUnset,
-				},
-			},
-			{ // Link -> File OK, no change reported
-				Name:   "5",
-				Type:   TypeFile,
-				Status: StatusUnset,
-				DeltaPeer: &File{
-					Name:   "5",
-					Type:   TypeLink,
-					Status: StatusUnset,
-				},
-			},
-			{ // Link -> Directory OK, no change reported
-				Name:   "6",
-				Type:   TypeDirectory,
-				Status: StatusUnset,
-				DeltaPeer: &File{
-					Name:   "6",
-					Type:   TypeLink,
-					Status: StatusUnset,
-				},
-			},
-			{ // file deleted, no type change reported
-				Name:   "7",
-				Type:   TypeFile,
-				Status: StatusDeleted,
-				DeltaPeer: &File{
-					Name:   "7",
-					Type:   TypeLink,
-					Status: StatusUnset,
-				},
-			},
-			{ // delta peer deleted, no type change reported
-				Name:   "8",
-				Type:   TypeFile,
-				Status: StatusUnset,
-				DeltaPeer: &File{
-					Name:   "8",
-					Type:   TypeLink,
-					Status: StatusDeleted,
-				},
-			},
-		},
-	}
-	msChanged := []Manifest{
-		{
-			Files: []*File{ // Directory -> File TYPE CHANGE
-				{
-					Name:   "1",
-					Type:   TypeFile,
-					Status: StatusUnset,
-					DeltaPeer: &File{
-						Name:   "1",
-						Type:   TypeDirectory,
-						Status: StatusUnset,
-					},
-				},
-			},
-		},
-		{
-			Files: []*File{ // Directory -> Link TYPE CHANGE
-				{
-					Name:   "2",
-					Type:   TypeLink,
-					Status: StatusUnset,
-					DeltaPeer: &File{
-						Name:   "2",
-						Type:   TypeDirectory,
-						Status: StatusUnset,
-					},
-				},
-			},
-		},
+func TestResolveTypeChanges(t *testing.T) {
+	// entries returns /p with the given type and, for directories, a file
+	// inside it.
+	entries := func(typ TypeFlag, hash Hashval) []*File {
+		files := []*File{{Name: "/p", Type: typ, Hash: hash, Version: 10, Info: sizer(0)}}
+		if typ == TypeDirectory {
+			files = append(files, &File{Name: "/p/c", Type: TypeFile, Hash: hash, Version: 10, Info: sizer(0)})
+		}
+		return files
+	}
+
+	types := []TypeFlag{TypeFile, TypeDirectory, TypeLink}
+	for _, from := range types {
+		for _, to := range types {
+			t.Run(fmt.Sprintf("%s-to-%s", from, to), func(t *testing.T) {
+				mOld := Manifest{Header: ManifestHeader{Version: 10}, Files: entries(from, 1)}
+				mNew := Manifest{Header: ManifestHeader{Version: 20}, Files: entries(to, 2)}
+				mNew.linkPeersAndChange(&mOld, 0)
+				changes := mNew.resolveTypeChanges()
+
+				if from == to {
+					if len(changes) != 0 {
+						t.Fatalf("got type changes %v but expected none", changes)
+					}
+					if mNew.Files[0].DeltaPeer == nil {
+						t.Errorf("/p lost its delta peer")
+					}
+				} else {
+					expected := typeChange{Name: "/p", From: from, To: to}
+					if len(changes) != 1 || changes[0] != expected {
+						t.Fatalf("got type changes %v but expected %v", changes, expected)
+					}
+					f := mNew.Files[0]
+					if f.DeltaPeer != nil {
+						t.Errorf("/p is still linked to its previous version")
+					}
+					if f.Version != 20 {
+						t.Errorf("/p has version %d but expected 20", f.Version)
+					}
+				}
+
+				var child *File
+				for _, f := range mNew.Files {
+					if f.Name == "/p/c" {
+						child = f
+					}
+				}
+				switch {
+				case to == TypeDirectory:
+					if child == nil || child.Status == StatusDeleted {
+						t.Errorf("/p/c is not present in the new manifest")
+					}
+				case from == TypeDirectory && to == TypeLink:
+					if child != nil {
+						t.Errorf("/p/c is recorded below the new link")
+					}
+				case from == TypeDirectory:
+					if child == nil || child.Status != StatusDeleted || child.Version != 20 {
+						t.Errorf("/p/c is not recorded as deleted at version 20")
+					}
+				case child != nil:
+					t.Errorf("unexpected /p/c in the new manifest")
+				}
+			})
+		}
 	}
 
-	if mUnchanged.hasUnsupportedTypeChanges() {
-		t.Error("Manifest with no type changes detected to have type changes")
+	// Deleted entries are not type changes.
+	mOld := Manifest{Header: ManifestHeader{Version: 10}, Files: entries(TypeDirectory, 1)}
+	mNew := Manifest{Header: ManifestHeader{Version: 20}, Files: []*File{
+		{Name: "/p", Type: TypeLink, Hash: 2, Info: sizer(0)},
+	}}
+	mNew.linkPeersAndChange(&mOld, 0)
+	mNew.Files[0].DeltaPeer.Status = StatusDeleted
+	if changes := mNew.resolveTypeChanges(); len(changes) != 0 {
+		t.Errorf("got type changes %v for a deleted peer", changes)
 	}
+}
 
-	for _, m := range msChanged {
-		if !m.hasUnsupportedTypeChanges() {
-			t.Error("Manifest with type changes detected to have no type changes")
-		}
+func TestRemoveDebuginfo(t *testing.T) {
+	m := Manifest{
+		Header: ManifestHeader{ContentSize: 111},
+		Files: []*File{
+			{Name: "/usr/bin/foo", Info: sizer(1)},
+			{Name: "/usr/lib/debug/foo", Info: sizer(10)},
+			{Name: "/usr/src/debug/foo", Info: sizer(100)},
+		},
+	}
+	removed := m.removeDebuginfo(dbgConfig{lib: "/usr/lib/debug/", src: "/usr/src/debug/"})
+	if len(removed) != 2 || len(m.Files) != 1 || m.Files[0].Name != "/usr/bin/foo" {
+		t.Fatalf("got files %v and removed %v but expected only /usr/bin/foo kept", m.Files, removed)
+	}
+	// The size of the removed files is not part of the bundle anymore.
+	if m.Header.ContentSize != 1 {
+		t.Errorf("got contentsize %d after removing debuginfo but expected 1", m.Header.ContentSize)
 	}
 }
 
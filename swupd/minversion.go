@@ -0,0 +1,254 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MinVersionCandidate is the cost of building the next version with a given
+// minversion.
+type MinVersionCandidate struct {
+	MinVersion uint32 `json:"minVersion"`
+
+	// Files is the number of files of the last version older than
+	// MinVersion, that would get the new version. Fullfiles is the number
+	// of fullfiles re-issued for them, and FullfileSize their compressed
+	// size as found in the last version.
+	Files        int   `json:"files"`
+	Fullfiles    int   `json:"fullfiles"`
+	FullfileSize int64 `json:"fullfileSize"`
+
+	// Obsolete are the deltas, packs and manifest deltas from versions
+	// older than MinVersion, that clients can't use to reach the new
+	// version, relative to the output directory. ObsoleteSize is their
+	// total size.
+	Obsolete     []string `json:"obsolete"`
+	ObsoleteSize int64    `json:"obsoleteSize"`
+}
+
+// MinVersionPlan compares the candidate minversions for the version built
+// after LastVersion.
+type MinVersionPlan struct {
+	LastVersion uint32 `json:"lastVersion"`
+	// Fullfiles and FullfileSize count all the fullfiles of the last
+	// version.
+	Fullfiles    int   `json:"fullfiles"`
+	FullfileSize int64 `json:"fullfileSize"`
+	// Missing are the fullfiles of the last version not found, relative
+	// to the output directory. Their size is not counted, so the plan
+	// underestimates the cost of the candidates that re-issue them.
+	Missing []string `json:"missing"`
+
+	// Candidates are sorted by minversion, the first one is zero.
+	Candidates []*MinVersionCandidate `json:"candidates"`
+	// MaxReissue is the fraction of FullfileSize that can be re-issued by
+	// the Recommended minversion.
+	MaxReissue  float64 `json:"maxReissue"`
+	Recommended uint32  `json:"recommended"`
+}
+
+type obsoleteEntry struct {
+	path string
+	from uint32
+	size int64
+}
+
+// PlanMinVersion analyzes the content published in outputDir up to
+// lastVersion. Every published version of the same format is a candidate
+// minversion. The recommended one is the highest candidate whose re-issued
+// fullfiles are at most maxReissue (between 0 and 1) of the size of all the
+// fullfiles of the last version. Missing fullfiles are listed in the plan.
+func PlanMinVersion(outputDir string, lastVersion uint32, maxReissue float64) (*MinVersionPlan, error) {
+	if maxReissue < 0 || maxReissue > 1 {
+		return nil, fmt.Errorf("invalid maximum re-issued fraction %v, must be between 0 and 1", maxReissue)
+	}
+	lastMoM, err := ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(lastVersion), "Manifest.MoM"))
+	if err != nil {
+		return nil, err
+	}
+	full, err := ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(lastVersion), "Manifest.full"))
+	if err != nil {
+		return nil, err
+	}
+	versions, err := ListVersions(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &MinVersionPlan{
+		LastVersion: lastVersion,
+		MaxReissue:  maxReissue,
+		Candidates:  []*MinVersionCandidate{{}},
+	}
+	var obsolete []obsoleteEntry
+	for _, v := range versions {
+		if v > lastVersion {
+			continue
+		}
+		mom, err := ParseManifestFile(filepath.Join(outputDir, fmt.Sprint(v), "Manifest.MoM"))
+		if err != nil {
+			return nil, err
+		}
+		// Versions of older formats can't be minversions, the format
+		// bump already re-issued their content.
+		if mom.Header.Format != lastMoM.Header.Format {
+			continue
+		}
+		plan.Candidates = append(plan.Candidates, &MinVersionCandidate{MinVersion: v})
+		entries, err := listObsoleteCandidates(outputDir, v)
+		if err != nil {
+			return nil, err
+		}
+		obsolete = append(obsolete, entries...)
+	}
+
+	// Only the compressed size is needed, so the fullfiles are not read.
+	sizes := make(map[Hashval]int64)
+	for _, f := range full.Files {
+		if !f.Present() {
+			continue
+		}
+		if _, ok := sizes[f.Hash]; ok {
+			continue
+		}
+		path := filepath.Join(fmt.Sprint(f.Version), "files", f.Hash.String()+".tar")
+		fi, err := os.Stat(filepath.Join(outputDir, path))
+		if os.IsNotExist(err) {
+			plan.Missing = append(plan.Missing, path)
+		} else if err != nil {
+			return nil, err
+		} else {
+			sizes[f.Hash] = fi.Size()
+		}
+		plan.Fullfiles++
+		plan.FullfileSize += sizes[f.Hash]
+	}
+
+	for _, c := range plan.Candidates {
+		reissued := make(map[Hashval]bool)
+		for _, f := range full.Files {
+			if !f.Present() || f.Version >= c.MinVersion {
+				continue
+			}
+			c.Files++
+			if !reissued[f.Hash] {
+				reissued[f.Hash] = true
+				c.Fullfiles++
+				c.FullfileSize += sizes[f.Hash]
+			}
+		}
+		for _, e := range obsolete {
+			if e.from < c.MinVersion {
+				c.Obsolete = append(c.Obsolete, e.path)
+				c.ObsoleteSize += e.size
+			}
+		}
+		if float64(c.FullfileSize) <= maxReissue*float64(plan.FullfileSize) {
+			plan.Recommended = c.MinVersion
+		}
+	}
+	return plan, nil
+}
+
+// listObsoleteCandidates returns the deltas, packs and manifest deltas in the
+// directory of version, with the version they start from. Zero packs are
+// always useful so they are not listed.
+func listObsoleteCandidates(outputDir string, version uint32) ([]obsoleteEntry, error) {
+	var result []obsoleteEntry
+	dir := fmt.Sprint(version)
+	entries, err := ioutil.ReadDir(filepath.Join(outputDir, dir))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if match := packNameRegexp.FindStringSubmatch(name); match != nil {
+			from, _ := strconv.ParseUint(match[2], 10, 32)
+			if from == 0 {
+				continue
+			}
+			result = append(result, obsoleteEntry{filepath.Join(dir, name), uint32(from), e.Size()})
+		} else if _, from, err := parseManifestDeltaName(name); err == nil {
+			result = append(result, obsoleteEntry{filepath.Join(dir, name), from, e.Size()})
+		}
+	}
+
+	deltas, err := ioutil.ReadDir(filepath.Join(outputDir, dir, "delta"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range deltas {
+		// Deltas are named FROMVERSION-TOVERSION-FROMHASH-TOHASH.
+		fields := strings.Split(e.Name(), "-")
+		if len(fields) != 4 {
+			continue
+		}
+		from, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		result = append(result, obsoleteEntry{filepath.Join(dir, "delta", e.Name()), uint32(from), e.Size()})
+	}
+	return result, nil
+}
+
+// WriteText writes a table with the cost of each candidate and the
+// recommendation. If verbose, the obsolete paths of each candidate are listed.
+func (plan *MinVersionPlan) WriteText(w io.Writer, verbose bool) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Last version: %d, %d fullfiles, %s\n", plan.LastVersion, plan.Fullfiles, formatSize(plan.FullfileSize))
+	fmt.Fprintf(&buf, "%10s  %8s  %9s  %10s  %8s  %10s\n", "minversion", "files", "fullfiles", "re-issued", "obsolete", "size")
+	for _, c := range plan.Candidates {
+		fmt.Fprintf(&buf, "%10d  %8d  %9d  %10s  %8d  %10s\n", c.MinVersion, c.Files, c.Fullfiles, formatSize(c.FullfileSize), len(c.Obsolete), formatSize(c.ObsoleteSize))
+	}
+	if len(plan.Missing) > 0 {
+		fmt.Fprintf(&buf, "Warning: %d fullfiles of the last version are missing, their size is not counted\n", len(plan.Missing))
+	}
+	if verbose {
+		for _, path := range plan.Missing {
+			fmt.Fprintf(&buf, "missing\t%s\n", path)
+		}
+		// Each path is listed with the lowest minversion that obsoletes
+		// it.
+		listed := make(map[string]bool)
+		for _, c := range plan.Candidates {
+			for _, path := range c.Obsolete {
+				if !listed[path] {
+					listed[path] = true
+					fmt.Fprintf(&buf, "%d\t%s\n", c.MinVersion, path)
+				}
+			}
+		}
+	}
+	fmt.Fprintf(&buf, "Recommended minversion: %d (re-issuing at most %.0f%% of the fullfile size)\n", plan.Recommended, plan.MaxReissue*100)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteJSON writes the plan as JSON.
+func (plan *MinVersionPlan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
@@ -0,0 +1,86 @@
+package swupd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPlanMinVersion(t *testing.T) {
+	ts := newTestSwupd(t, "plan-minversion-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"contents"}
+	for _, v := range []uint32{10, 20, 30} {
+		ts.addFile(v, "contents", "/unchanged", "unchanged")
+		ts.addFile(v, "contents", "/changed", fmt.Sprint(v))
+		if v >= 20 {
+			ts.addFile(v, "contents", "/added", "added")
+		}
+		ts.createManifests(v)
+		ts.createFullfiles(v)
+	}
+	ts.createPack("contents", 10, 20, "")
+
+	plan, err := PlanMinVersion(ts.path("www"), 30, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Candidates) != 4 || plan.Recommended != 30 {
+		t.Fatalf("got %d candidates and recommended %d, but want 4 and 30", len(plan.Candidates), plan.Recommended)
+	}
+	byVersion := make(map[uint32]*MinVersionCandidate)
+	for _, c := range plan.Candidates {
+		byVersion[c.MinVersion] = c
+	}
+	if c := byVersion[10]; c.Files != 0 || len(c.Obsolete) != 0 {
+		t.Errorf("minversion 10 re-issues %d files and obsoletes %v, but want none", c.Files, c.Obsolete)
+	}
+	c := byVersion[20]
+	if c.Files == 0 || c.FullfileSize == 0 {
+		t.Errorf("minversion 20 re-issues no files")
+	}
+	if len(c.Obsolete) != 1 || c.Obsolete[0] != "20/"+GetPackFilename("contents", 10) {
+		t.Errorf("minversion 20 obsoletes %v, but want the pack from 10", c.Obsolete)
+	}
+	if byVersion[30].Files <= c.Files {
+		t.Errorf("minversion 30 re-issues %d files, but want more than minversion 20", byVersion[30].Files)
+	}
+
+	var buf bytes.Buffer
+	if err = plan.WriteText(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Recommended minversion: 30") {
+		t.Errorf("missing recommendation in report:\n%s", buf.String())
+	}
+
+	// Nothing is older than the first version.
+	if plan, err = PlanMinVersion(ts.path("www"), 30, 0); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Recommended != 10 {
+		t.Errorf("recommended %d without re-issuing fullfiles, but want 10", plan.Recommended)
+	}
+	if _, err = PlanMinVersion(ts.path("www"), 30, 2); err == nil {
+		t.Errorf("expected error for a fraction larger than 1")
+	}
+
+	// Missing fullfiles are reported.
+	f := fileInManifest(t, ts.parseManifest(30, "full"), 30, "/changed")
+	missing := "30/files/" + f.Hash.String() + ".tar"
+	ts.rm("www/" + missing)
+	if plan, err = PlanMinVersion(ts.path("www"), 30, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Missing) != 1 || plan.Missing[0] != missing {
+		t.Errorf("got missing fullfiles %v, but want %s", plan.Missing, missing)
+	}
+	buf.Reset()
+	if err = plan.WriteText(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "1 fullfiles of the last version are missing") {
+		t.Errorf("missing fullfiles not reported:\n%s", buf.String())
+	}
+}
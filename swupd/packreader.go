@@ -0,0 +1,387 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PackItemType tells how an entry of a pack provides its content.
+type PackItemType int
+
+// Pack entries are either a staged file or a delta against an older file.
+const (
+	PackItemStaged PackItemType = iota
+	PackItemDelta
+)
+
+func (t PackItemType) String() string {
+	switch t {
+	case PackItemStaged:
+		return "staged"
+	case PackItemDelta:
+		return "delta"
+	}
+	return "invalid"
+}
+
+// PackItem is an entry read from a pack. Hash is the content the entry
+// provides: the hash of a staged file or the result of applying a delta. The
+// From fields are only set for deltas.
+type PackItem struct {
+	Type   PackItemType
+	Header *tar.Header
+	Hash   Hashval
+
+	FromHash    Hashval
+	FromVersion uint32
+	ToVersion   uint32
+}
+
+// Name returns the name of the entry in the pack.
+func (item *PackItem) Name() string {
+	return item.Header.Name
+}
+
+// PackReader reads the entries of a pack, as written by WritePack.
+type PackReader struct {
+	tr *CompressedTarReader
+}
+
+// OpenPack returns a reader for the pack in r. The reader must be closed
+// after use, but doesn't close r.
+func OpenPack(r io.Reader) (*PackReader, error) {
+	tr, err := NewCompressedTarReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &PackReader{tr: tr}, nil
+}
+
+// Next advances to the next staged file or delta in the pack, skipping the
+// "delta/" and "staged/" directories. Returns io.EOF at the end of the pack.
+// The contents of the entry can be read from the PackReader.
+func (pr *PackReader) Next() (*PackItem, error) {
+	for {
+		hdr, err := pr.tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == "delta/" || hdr.Name == "staged/" {
+			continue
+		}
+		return parsePackItem(hdr)
+	}
+}
+
+// Read reads from the current entry of the pack.
+func (pr *PackReader) Read(p []byte) (int, error) {
+	return pr.tr.Read(p)
+}
+
+// Close releases the resources used by the reader.
+func (pr *PackReader) Close() error {
+	return pr.tr.Close()
+}
+
+func parsePackItem(hdr *tar.Header) (*PackItem, error) {
+	switch {
+	case strings.HasPrefix(hdr.Name, "staged/"):
+		// Directories are staged with a trailing slash.
+		staged := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "staged/"), "/")
+		if err := checkHashString(staged); err != nil {
+			return nil, fmt.Errorf("invalid entry %s: %s", hdr.Name, err)
+		}
+		return &PackItem{Type: PackItemStaged, Header: hdr, Hash: internHash(staged)}, nil
+
+	case strings.HasPrefix(hdr.Name, "delta/"):
+		// Deltas are named FROMVERSION-TOVERSION-FROMHASH-TOHASH.
+		fields := strings.Split(strings.TrimPrefix(hdr.Name, "delta/"), "-")
+		if len(fields) != 4 || checkHashString(fields[2]) != nil || checkHashString(fields[3]) != nil {
+			return nil, fmt.Errorf("invalid entry %s: invalid delta name", hdr.Name)
+		}
+		fromVersion, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %s: %s", hdr.Name, err)
+		}
+		toVersion, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %s: %s", hdr.Name, err)
+		}
+		return &PackItem{
+			Type:        PackItemDelta,
+			Header:      hdr,
+			Hash:        internHash(fields[3]),
+			FromHash:    internHash(fields[2]),
+			FromVersion: uint32(fromVersion),
+			ToVersion:   uint32(toVersion),
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected entry %s", hdr.Name)
+}
+
+// VerifyPackOptions tells VerifyPack where to find the original content the
+// deltas in a pack are applied to.
+type VerifyPackOptions struct {
+	// OutputDir is the directory with the update content, the fullfiles
+	// are read from OutputDir/VERSION/files/HASH.tar.
+	OutputDir string
+
+	// ChrootDir, if not empty, is tried first for the original content,
+	// in ChrootDir/FROMVERSION/full.
+	ChrootDir string
+
+	// GetFullfile, if set, is used instead of OutputDir to get the local
+	// path of a fullfile, e.g. after downloading it.
+	GetFullfile func(version uint32, hash Hashval) (string, error)
+
+	// Xattrs tells whether the hashes include the extended attributes of
+	// the files in ChrootDir, as in the ContentOptions used to create the
+	// content.
+	Xattrs bool
+}
+
+// PackIssue is a problem found in an entry of a pack.
+type PackIssue struct {
+	Item    *PackItem
+	Message string
+}
+
+// PackReport contains the results of VerifyPack.
+type PackReport struct {
+	// Items contains all the staged files and deltas in the pack.
+	Items []*PackItem
+
+	// Missing contains the files the client needs to update from the
+	// pack's from version that are not provided by the pack.
+	Missing []*File
+
+	// Extra contains the entries whose content is not in the to manifest.
+	Extra []*PackItem
+
+	// Invalid contains the entries that don't produce the content they
+	// are named after.
+	Invalid []PackIssue
+}
+
+// OK tells if no problems were found in the pack.
+func (r *PackReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Invalid) == 0
+}
+
+// Problems returns a description of each problem found in the pack.
+func (r *PackReport) Problems() []string {
+	var problems []string
+	for _, issue := range r.Invalid {
+		problems = append(problems, fmt.Sprintf("%s %s: %s", issue.Item.Type, issue.Item.Name(), issue.Message))
+	}
+	for _, item := range r.Extra {
+		problems = append(problems, fmt.Sprintf("%s %s: content is not in the manifest", item.Type, item.Name()))
+	}
+	for _, f := range r.Missing {
+		problems = append(problems, fmt.Sprintf("missing content for %s (%s)", f.Name, f.Hash))
+	}
+	return problems
+}
+
+// VerifyPack reads the pack in r and checks it against the manifests it was
+// created from, or a zero pack if fromManifest is nil. Staged files are
+// hashed and deltas are applied to the original content, and every file the
+// client needs to go from one version to the other must be provided by the
+// pack. Problems with the content are collected in the report, an error is
+// returned only if the pack can't be read.
+func VerifyPack(r io.Reader, fromManifest, toManifest *Manifest, opts *VerifyPackOptions) (*PackReport, error) {
+	if toManifest == nil {
+		return nil, fmt.Errorf("need a valid toManifest")
+	}
+	if opts == nil {
+		opts = &VerifyPackOptions{}
+	}
+
+	type contentKey struct {
+		name     string
+		hash     Hashval
+		typ      TypeFlag
+		status   StatusFlag
+		modifier ModifierFlag
+	}
+	var fromVersion uint32
+	fromHashes := make(map[Hashval]*File)
+	inFrom := make(map[contentKey]bool)
+	if fromManifest != nil {
+		fromVersion = fromManifest.Header.Version
+		for _, f := range fromManifest.Files {
+			inFrom[contentKey{f.Name, f.Hash, f.Type, f.Status, f.Modifier}] = true
+			if f.Present() {
+				fromHashes[f.Hash] = f
+			}
+		}
+	}
+	toHashes := make(map[Hashval]bool)
+	for _, f := range toManifest.Files {
+		if f.Present() {
+			toHashes[f.Hash] = true
+		}
+	}
+
+	pr, err := OpenPack(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = pr.Close()
+	}()
+
+	report := &PackReport{}
+	provided := make(map[Hashval]bool)
+	for {
+		item, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Items = append(report.Items, item)
+
+		if !toHashes[item.Hash] {
+			report.Extra = append(report.Extra, item)
+			continue
+		}
+
+		var got string
+		switch item.Type {
+		case PackItemStaged:
+			got, err = hashTarEntry(item.Header, pr)
+			if err != nil {
+				return nil, err
+			}
+		case PackItemDelta:
+			fromFile, ok := fromHashes[item.FromHash]
+			if !ok {
+				report.Invalid = append(report.Invalid, PackIssue{item, "original hash is not in the from manifest"})
+				continue
+			}
+			got, err = applyPackedDelta(pr, fromFile, fromVersion, opts)
+			if err != nil {
+				report.Invalid = append(report.Invalid, PackIssue{item, err.Error()})
+				continue
+			}
+		}
+		if got != item.Hash.String() {
+			report.Invalid = append(report.Invalid, PackIssue{item, fmt.Sprintf("content has hash %s", got)})
+			continue
+		}
+		provided[item.Hash] = true
+	}
+
+	for _, f := range toManifest.Files {
+		if f.Version <= fromVersion || !f.Present() || inFrom[contentKey{f.Name, f.Hash, f.Type, f.Status, f.Modifier}] {
+			continue
+		}
+		if !provided[f.Hash] {
+			report.Missing = append(report.Missing, f)
+		}
+	}
+	return report, nil
+}
+
+// applyPackedDelta applies the delta in r to the original content of
+// fromFile and returns the hash of the result.
+func applyPackedDelta(r io.Reader, fromFile *File, fromVersion uint32, opts *VerifyPackOptions) (string, error) {
+	delta, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	old, xattrs, err := readOriginalContent(fromFile, fromVersion, opts)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read original content: %s", err)
+	}
+	content, info, err := ApplyDelta(old, delta)
+	if err != nil {
+		return "", fmt.Errorf("couldn't apply: %s", err)
+	}
+	info.Xattrs = xattrs
+	return GetHashForBytes(info, content)
+}
+
+// readOriginalContent returns the contents and extended attributes of a file
+// the deltas apply to, preferring the chroot of the from version when it still
+// has the expected content.
+func readOriginalContent(f *File, fromVersion uint32, opts *VerifyPackOptions) ([]byte, map[string]string, error) {
+	if opts.ChrootDir != "" {
+		path := filepath.Join(opts.ChrootDir, fmt.Sprint(fromVersion), "full", f.Name)
+		if hash, err := GetHashForFileWithXattrs(path, opts.Xattrs); err == nil && hash == f.Hash.String() {
+			content, err := ioutil.ReadFile(path)
+			var xattrs map[string]string
+			if err == nil && opts.Xattrs {
+				xattrs, err = ReadXattrs(path)
+			}
+			if err == nil {
+				return content, xattrs, nil
+			}
+		}
+	}
+
+	var path string
+	if opts.GetFullfile != nil {
+		var err error
+		path, err = opts.GetFullfile(f.Version, f.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		path = filepath.Join(opts.OutputDir, fmt.Sprint(f.Version), "files", f.Hash.String()+".tar")
+	}
+	return readFullfile(path)
+}
+
+// readFullfile returns the contents and extended attributes of a regular file
+// stored in a fullfile.
+func readFullfile(path string) ([]byte, map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	tr, err := NewCompressedTarReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = tr.Close()
+	}()
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return nil, nil, fmt.Errorf("fullfile %s is not a regular file", path)
+	}
+	content, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, TarHeaderXattrs(hdr), nil
+}
@@ -0,0 +1,129 @@
+package swupd
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func mustVerifyPack(t *testing.T, path string, fromM, toM *Manifest, opts *VerifyPackOptions) *PackReport {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	report, err := VerifyPack(f, fromM, toM, opts)
+	if err != nil {
+		t.Fatalf("couldn't verify pack %s: %s", path, err)
+	}
+	return report
+}
+
+func TestOpenPack(t *testing.T) {
+	ts := newTestSwupd(t, "open-pack-")
+	defer ts.cleanup()
+
+	content := strings.Repeat("CONTENT", 1000)
+	ts.Bundles = []string{"os-core"}
+	ts.addFile(10, "os-core", "/file", content+"10")
+	ts.createManifests(10)
+	ts.addFile(20, "os-core", "/file", content+"20")
+	ts.addFile(20, "os-core", "/new", "new")
+	ts.createManifests(20)
+
+	info := ts.createPack("os-core", 10, 20, ts.path("image"))
+	mustHaveDeltaCount(t, info, 1)
+
+	hashIn10 := ts.mustHashFile("image/10/full/file")
+	hashIn20 := ts.mustHashFile("image/20/full/file")
+	hashNew := ts.mustHashFile("image/20/full/new")
+
+	f, err := os.Open(ts.path("www/20/pack-os-core-from-10.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	pr, err := OpenPack(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = pr.Close()
+	}()
+
+	var delta *PackItem
+	staged := make(map[string]*PackItem)
+	for {
+		item, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch item.Type {
+		case PackItemDelta:
+			delta = item
+		case PackItemStaged:
+			staged[item.Hash.String()] = item
+		}
+	}
+
+	if delta == nil || delta.Hash.String() != hashIn20 || delta.FromHash.String() != hashIn10 || delta.FromVersion != 10 || delta.ToVersion != 20 {
+		t.Errorf("unexpected delta entry %+v", delta)
+	}
+	if item := staged[hashNew]; item == nil || item.Name() != "staged/"+hashNew {
+		t.Errorf("missing staged entry for the new file, got %v", staged)
+	}
+}
+
+func TestVerifyPack(t *testing.T) {
+	ts := newTestSwupd(t, "verify-pack-")
+	defer ts.cleanup()
+
+	content := strings.Repeat("CONTENT", 1000)
+	ts.Bundles = []string{"os-core", "editors"}
+	ts.addFile(10, "os-core", "/file", content+"10")
+	ts.addFile(10, "editors", "/editor", "editor")
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+	ts.addFile(20, "os-core", "/file", content+"20")
+	ts.addFile(20, "os-core", "/new", "new")
+	ts.addFile(20, "editors", "/editor", "editor")
+	ts.createManifests(20)
+
+	ts.createPack("os-core", 10, 20, ts.path("image"))
+	ts.createPack("editors", 0, 10, ts.path("image"))
+	path := ts.path("www/20/pack-os-core-from-10.tar")
+	fromM := ts.parseManifest(10, "os-core")
+	toM := ts.parseManifest(20, "os-core")
+
+	// Deltas can be applied to the fullfiles or the chroot.
+	report := mustVerifyPack(t, path, fromM, toM, &VerifyPackOptions{OutputDir: ts.path("www")})
+	if !report.OK() {
+		t.Fatalf("unexpected problems verifying pack with fullfiles: %v", report.Problems())
+	}
+	report = mustVerifyPack(t, path, fromM, toM, &VerifyPackOptions{ChrootDir: ts.path("image")})
+	if !report.OK() {
+		t.Fatalf("unexpected problems verifying pack with chroot: %v", report.Problems())
+	}
+
+	// Without the original content the delta can't be checked.
+	report = mustVerifyPack(t, path, fromM, toM, &VerifyPackOptions{OutputDir: ts.path("nothing")})
+	if len(report.Invalid) != 1 || report.Invalid[0].Item.Type != PackItemDelta || len(report.Missing) != 1 {
+		t.Fatalf("expected an invalid delta and missing content, but got: %v", report.Problems())
+	}
+
+	// The pack of a different bundle has extra content and misses content:
+	// the changed file, the new file and os-release.
+	report = mustVerifyPack(t, ts.path("www/10/pack-editors-from-0.tar"), fromM, toM, nil)
+	if len(report.Extra) != 1 || len(report.Missing) != 3 || len(report.Invalid) != 0 {
+		t.Fatalf("expected extra and missing content, but got: %v", report.Problems())
+	}
+}
@@ -77,8 +77,9 @@ func (state PackState) String() string {
 
 // CreateAllDeltas builds all of the deltas using the full manifest from one
 // version to the next. This allows better concurrency and the pack creation
-// code can just worry about adding pre-existing files to packs.
-func CreateAllDeltas(outputDir string, fromVersion, toVersion, numWorkers int) error {
+// code can just worry about adding pre-existing files to packs. The extended
+// attributes are checked if enabled in opts, which can be nil.
+func CreateAllDeltas(outputDir string, fromVersion, toVersion, numWorkers int, opts *ContentOptions) error {
 	// Don't try to make deltas for zero packs
 	if fromVersion == 0 {
 		return nil
@@ -104,6 +105,7 @@ func CreateAllDeltas(outputDir string, fromVersion, toVersion, numWorkers int) e
 	if err != nil {
 		return err
 	}
+	c.content = opts
 
 	_, err = createDeltasFromManifests(&c, fromManifest, toManifest, numWorkers)
 	if err != nil {
@@ -117,8 +119,9 @@ func CreateAllDeltas(outputDir string, fromVersion, toVersion, numWorkers int) e
 // nil. The toManifest should always be non nil. The outputDir is used to pick deltas and
 // fullfiles. If not empty, chrootDir is tried first as a fast alternative to
 // decompressing the fullfiles. Multiple workers are used to parallelize delta creation.
-// If number of workers is zero or less, 1 worker is used.
-func WritePack(w io.Writer, fromManifest, toManifest *Manifest, outputDir, chrootDir string, numWorkers int) (info *PackInfo, err error) {
+// If number of workers is zero or less, 1 worker is used. The pack compressor and extended
+// attributes are selected by opts, which can be nil.
+func WritePack(w io.Writer, fromManifest, toManifest *Manifest, outputDir, chrootDir string, numWorkers int, opts *ContentOptions) (info *PackInfo, err error) {
 	if toManifest == nil {
 		return nil, fmt.Errorf("need a valid toManifest")
 	}
@@ -148,6 +151,7 @@ func WritePack(w io.Writer, fromManifest, toManifest *Manifest, outputDir, chroo
 		if err != nil {
 			return nil, err
 		}
+		c.content = opts
 
 		deltas, err = findDeltas(&c, fromManifest, toManifest)
 		if err != nil {
@@ -171,19 +175,23 @@ func WritePack(w io.Writer, fromManifest, toManifest *Manifest, outputDir, chroo
 		Entries: make([]PackEntry, len(toManifest.Files)),
 	}
 
-	xw, err := NewExternalWriter(w, "xz")
+	compressor, err := opts.packCompressor()
+	if err != nil {
+		return nil, err
+	}
+	cw, err := compressor.NewWriter(w)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
-		cerr := xw.Close()
+		cerr := cw.Close()
 		if err == nil && cerr != nil {
 			info = nil
 			err = cerr
 		}
 	}()
 
-	tw := tar.NewWriter(xw)
+	tw := tar.NewWriter(cw)
 	err = tw.WriteHeader(&tar.Header{
 		Name:     "delta/",
 		Mode:     0700,
@@ -267,7 +275,7 @@ func WritePack(w io.Writer, fromManifest, toManifest *Manifest, outputDir, chroo
 		info.FullfileCount++
 		if fullChrootDir != "" {
 			var fallback bool
-			fallback, err = copyFromFullChrootFile(tw, fullChrootDir, f)
+			fallback, err = copyFromFullChrootFile(tw, fullChrootDir, f, opts.xattrs())
 			if (err != nil) && fallback {
 				// If copy from chroot file fails before writing to the pack, we can
 				// fallback to try copying from the fullfile.
@@ -310,7 +318,7 @@ func copyFromDelta(tw *tar.Writer, delta *Delta) (fallback bool, err error) {
 	if !fi.Mode().IsRegular() {
 		return true, fmt.Errorf("delta %s is not a regular file", delta.Path)
 	}
-	hdr, err := getHeaderFromFileInfo(fi)
+	hdr, err := getHeaderFromFileInfo(fi, "", false)
 	if err != nil {
 		return true, err
 	}
@@ -331,13 +339,13 @@ func copyFromDelta(tw *tar.Writer, delta *Delta) (fallback bool, err error) {
 	return false, nil
 }
 
-func copyFromFullChrootFile(tw *tar.Writer, fullChrootDir string, f *File) (fallback bool, err error) {
+func copyFromFullChrootFile(tw *tar.Writer, fullChrootDir string, f *File, xattrs bool) (fallback bool, err error) {
 	realname := filepath.Join(fullChrootDir, f.Name)
 	fi, err := os.Lstat(realname)
 	if err != nil {
 		return true, err
 	}
-	hdr, err := getHeaderFromFileInfo(fi)
+	hdr, err := getHeaderFromFileInfo(fi, realname, xattrs)
 	if err != nil {
 		return true, err
 	}
@@ -509,8 +517,8 @@ func FindBundlesToPack(from *Manifest, to *Manifest) (map[string]*BundleToPack,
 // in the TO version subdirectory of outputDir (e.g. a pack from 10 to 20 is written to "www/20").
 // Empty packs will lead to not creating the pack.
 // Multiple workers are used to parallelize delta creation. If number of workers is zero or
-// less, 1 worker is used.
-func CreatePack(name string, fromVersion, toVersion uint32, outputDir, chrootDir string, numWorkers int) (*PackInfo, error) {
+// less, 1 worker is used. See WritePack for opts.
+func CreatePack(name string, fromVersion, toVersion uint32, outputDir, chrootDir string, numWorkers int, opts *ContentOptions) (*PackInfo, error) {
 	toDir := filepath.Join(outputDir, fmt.Sprint(toVersion))
 	toM, err := ParseManifestFile(filepath.Join(toDir, "Manifest."+name))
 	if err != nil {
@@ -530,7 +538,7 @@ func CreatePack(name string, fromVersion, toVersion uint32, outputDir, chrootDir
 	if err != nil {
 		return nil, err
 	}
-	info, err := WritePack(output, fromM, toM, outputDir, chrootDir, numWorkers)
+	info, err := WritePack(output, fromM, toM, outputDir, chrootDir, numWorkers, opts)
 	if err != nil {
 		_ = output.Close()
 		_ = os.RemoveAll(packPath)
@@ -2,8 +2,10 @@ package swupd
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"sort"
@@ -226,7 +228,7 @@ func TestCreatePackZeroPacks(t *testing.T) {
 	ts.createManifests(20)
 
 	// Expect failure when creating packs without the fullfiles.
-	_, err := CreatePack("editors", 0, 20, ts.path("www"), "", 0)
+	_, err := CreatePack("editors", 0, 20, ts.path("www"), "", 0, nil)
 	if err == nil {
 		t.Fatalf("unexpected success creating pack without chrootDir nor fullfiles available")
 	}
@@ -241,7 +243,7 @@ func TestCreatePackZeroPacks(t *testing.T) {
 
 	// Expect failure when creating packs for bundle shells, it won't find the new
 	// shell added in version 20.
-	_, err = CreatePack("shells", 0, 20, ts.path("www"), "", 0)
+	_, err = CreatePack("shells", 0, 20, ts.path("www"), "", 0, nil)
 	if err == nil {
 		t.Fatalf("unexpected success creating pack without all fullfiles available")
 	}
@@ -255,6 +257,29 @@ func TestCreatePackZeroPacks(t *testing.T) {
 	mustValidateZeroPack(t, ts.path("www/20/Manifest.shells"), ts.path("www/20/pack-shells-from-0.tar"))
 }
 
+func TestCreatePackZstd(t *testing.T) {
+	ts := newTestSwupd(t, "create-pack-zstd-")
+	defer ts.cleanup()
+	ts.Content = &ContentOptions{PackCompressor: "zstd"}
+	ts.Bundles = []string{"editors"}
+	ts.addFile(10, "editors", "/emacs", "emacs contents")
+	ts.addFile(10, "editors", "/vim", "vim contents")
+	ts.createManifests(10)
+
+	info := ts.createPack("editors", 0, 10, ts.path("image"))
+	mustHaveNoWarnings(t, info)
+
+	packPath := ts.path("www/10/pack-editors-from-0.tar")
+	pack, err := ioutil.ReadFile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pack, zstdMagic) {
+		t.Fatalf("pack %s is not compressed with zstd", packPath)
+	}
+	mustValidateZeroPack(t, ts.path("www/10/Manifest.editors"), packPath)
+}
+
 func TestCreatePackNonConsecutiveDeltas(t *testing.T) {
 	ts := newTestSwupd(t, "create-pack-ncd")
 	defer ts.cleanup()
@@ -350,7 +375,7 @@ func TestCreatePackWithDelta(t *testing.T) {
 	fs.write("image/20/contents/large2", largeContents[:1]+strings.ToUpper(largeContents[1:]))
 	mustCreateManifests(t, 20, minVer, format, fs.Dir)
 
-	info := mustCreatePack(t, "contents", 10, 20, fs.path("www"), fs.path("image"))
+	info := mustCreatePack(t, "contents", 10, 20, fs.path("www"), fs.path("image"), nil)
 	mustHaveDeltaCount(t, info, 2)
 
 	//
@@ -362,11 +387,11 @@ func TestCreatePackWithDelta(t *testing.T) {
 	mustCreateManifests(t, 30, minVer, format, fs.Dir)
 
 	// Pack between 20 and 30 has only a delta for large1.
-	info = mustCreatePack(t, "contents", 20, 30, fs.path("www"), fs.path("image"))
+	info = mustCreatePack(t, "contents", 20, 30, fs.path("www"), fs.path("image"), nil)
 	mustHaveDeltaCount(t, info, 1)
 
 	// Pack between 10 and 30 has both deltas.
-	info = mustCreatePack(t, "contents", 10, 30, fs.path("www"), fs.path("image"))
+	info = mustCreatePack(t, "contents", 10, 30, fs.path("www"), fs.path("image"), nil)
 	mustHaveDeltaCount(t, info, 2)
 }
 
@@ -386,7 +411,7 @@ func TestCreatePackWithIncompleteChrootDir(t *testing.T) {
 
 	// Creating a pack should fail, no way to get emacs contents from neither chroot
 	// or fullfile.
-	info, err := CreatePack("editors", 0, 10, fs.path("www"), fs.path("image"), 0)
+	info, err := CreatePack("editors", 0, 10, fs.path("www"), fs.path("image"), 0, nil)
 	if err == nil {
 		t.Fatalf("unexpected success when creating pack with incomplete chroot")
 	}
@@ -397,7 +422,7 @@ func TestCreatePackWithIncompleteChrootDir(t *testing.T) {
 	fs.rm("image/10/full/emacs")
 
 	// Now create pack.
-	info = mustCreatePack(t, "editors", 0, 10, fs.path("www"), fs.path("image"))
+	info = mustCreatePack(t, "editors", 0, 10, fs.path("www"), fs.path("image"), nil)
 	mustValidateZeroPack(t, fs.path("www/10/Manifest.editors"), fs.path("www/10/pack-editors-from-0.tar"))
 
 	// And note that we have a warning.
@@ -511,14 +536,14 @@ func mustValidateZeroPack(t *testing.T, manifestPath, packPath string) {
 	}
 }
 
-func mustCreatePack(t *testing.T, name string, fromVersion, toVersion uint32, outputDir, chrootDir string) *PackInfo {
+func mustCreatePack(t *testing.T, name string, fromVersion, toVersion uint32, outputDir, chrootDir string, opts *ContentOptions) *PackInfo {
 	t.Helper()
-	err := CreateAllDeltas(outputDir, int(fromVersion), int(toVersion), 0)
+	err := CreateAllDeltas(outputDir, int(fromVersion), int(toVersion), 0, opts)
 	if err != nil {
 		t.Fatalf("error creating pack for bundle %s: %s", name, err)
 	}
 	var info *PackInfo
-	info, err = CreatePack(name, fromVersion, toVersion, outputDir, chrootDir, 0)
+	info, err = CreatePack(name, fromVersion, toVersion, outputDir, chrootDir, 0, opts)
 	if err != nil {
 		t.Fatalf("error creating pack for bundle %s: %s", name, err)
 	}
@@ -551,7 +576,7 @@ func mustHaveNoWarnings(t *testing.T, info *PackInfo) {
 
 func mustCreateFullfiles(t *testing.T, m *Manifest, chrootDir, outputDir string) {
 	t.Helper()
-	_, err := CreateFullfiles(m, chrootDir, outputDir, 0)
+	_, err := CreateFullfiles(m, chrootDir, outputDir, 0, nil)
 	if err != nil {
 		t.Fatalf("couldn't create fullfiles: %s", err)
 	}
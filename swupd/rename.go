@@ -15,6 +15,7 @@
 package swupd
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -22,20 +23,153 @@ import (
 	"strings"
 )
 
-func renameDetection(manifest *Manifest, added []*File, removed []*File, c config) {
-	if len(added) == 0 || len(removed) == 0 {
-		return // nothing to rename
+// Strategies used by rename detection to pair removed and added files.
+const (
+	// RenameHash pairs files with the same content.
+	RenameHash = "hash"
+	// RenameName pairs files with the same name once digits and '.' are
+	// removed, so versioned paths match their previous versions.
+	RenameName = "name"
+	// RenamePath pairs files with the same base name and the same leading
+	// directory components.
+	RenamePath = "path"
+)
+
+// renameConfig holds the rules used by rename detection.
+type renameConfig struct {
+	// strategies are applied in order, each one pairing the files left
+	// unpaired by the previous ones.
+	strategies []string
+	// minSize is the minimum size of a file paired by name or path, smaller
+	// files are not worth a delta.
+	minSize int64
+	// similarity is the minimum ratio between the sizes of the smaller and
+	// the bigger file for a pair made by name or path, 0 disables the check.
+	similarity float64
+	// pathComponents is the number of leading directory components that
+	// must match for RenamePath.
+	pathComponents int
+	// bundles, if not empty, are the only bundles with rename detection.
+	// Bundles in excludeBundles never have rename detection.
+	bundles        []string
+	excludeBundles []string
+}
+
+var defaultRenames = renameConfig{
+	strategies:     []string{RenameHash, RenameName},
+	minSize:        minimumSizeToMakeDeltaInBytes,
+	pathComponents: 2,
+}
+
+func (r *renameConfig) validate() error {
+	for _, s := range r.strategies {
+		switch s {
+		case RenameHash, RenameName, RenamePath:
+		default:
+			return fmt.Errorf("invalid rename strategy %q", s)
+		}
+	}
+	if r.similarity < 0 || r.similarity > 1 {
+		return fmt.Errorf("invalid rename similarity %g, must be between 0 and 1", r.similarity)
+	}
+	if r.pathComponents < 1 {
+		return fmt.Errorf("invalid rename path components %d, must be at least 1", r.pathComponents)
+	}
+	return nil
+}
+
+// enabled tells if rename detection runs for the bundle.
+func (r *renameConfig) enabled(bundle string) bool {
+	for _, b := range r.excludeBundles {
+		if b == bundle {
+			return false
+		}
 	}
-	added = trimRenamed(added) // Make copies of input slices, tidy up whilst we are here
-	removed = trimRenamed(removed)
-	if err := fixupStatFields(removed, manifest, &c); err != nil {
-		panic(err)
+	if len(r.bundles) == 0 {
+		return true
 	}
-	if err := fixupStatFields(added, manifest, &c); err != nil {
-		panic(err)
+	for _, b := range r.bundles {
+		if b == bundle {
+			return true
+		}
+	}
+	return false
+}
+
+// similar tells if the sizes of two files are close enough to pair them.
+func (r *renameConfig) similar(a, b *File) bool {
+	if r.similarity == 0 {
+		return true
+	}
+	sa, sb := a.Info.Size(), b.Info.Size()
+	if sa > sb {
+		sa, sb = sb, sa
+	}
+	if sb == 0 {
+		return true
+	}
+	return float64(sa)/float64(sb) >= r.similarity
+}
+
+// renamePair is a rename found by rename detection.
+type renamePair struct {
+	from     *File
+	to       *File
+	strategy string
+}
+
+// renameDetection pairs files removed from manifest with the added ones using
+// the strategies in c, and links the pairs so they can be used for deltas. The
+// pairs found are also written to the rename report of manifest from
+// fromVersion, in the image directory of its version.
+func renameDetection(manifest *Manifest, fromVersion uint32, added []*File, removed []*File, c config) ([]renamePair, error) {
+	r := &c.renames
+	if !r.enabled(manifest.Name) {
+		return nil, nil
 	}
-	// Handle pure renames first, don't need to worry about size. Should we skip zero size?
-	// just add call to trimSmall if so
+
+	var pairs []renamePair
+	if len(added) > 0 && len(removed) > 0 {
+		added = trimRenamed(added) // Make copies of input slices, tidy up whilst we are here
+		removed = trimRenamed(removed)
+		if err := fixupStatFields(removed, manifest, &c); err != nil {
+			return nil, fmt.Errorf("rename detection for %s: %s", manifest.Name, err)
+		}
+		if err := fixupStatFields(added, manifest, &c); err != nil {
+			return nil, fmt.Errorf("rename detection for %s: %s", manifest.Name, err)
+		}
+
+		for _, strategy := range r.strategies {
+			added = trimRenamed(added)
+			removed = trimRenamed(removed)
+			switch strategy {
+			case RenameHash:
+				pairs = append(pairs, renameByHash(added, removed)...)
+			case RenameName:
+				pairs = append(pairs, renameByKey(added, removed, r, strategy, func(name string) string {
+					return strings.Map(stripVers, name)
+				})...)
+			case RenamePath:
+				pairs = append(pairs, renameByKey(added, removed, r, strategy, func(name string) string {
+					return pathKey(name, r.pathComponents)
+				})...)
+			default:
+				return nil, fmt.Errorf("invalid rename strategy %q", strategy)
+			}
+		}
+	}
+
+	reportPath := filepath.Join(c.imageBase, fmt.Sprint(manifest.Header.Version), "rename-reports", fmt.Sprintf("%s-from-%d", manifest.Name, fromVersion))
+	if err := writeRenameReport(reportPath, pairs); err != nil {
+		return nil, fmt.Errorf("couldn't write rename report for %s: %s", manifest.Name, err)
+	}
+	return pairs, nil
+}
+
+// renameByHash links the files with the same content. Size doesn't matter
+// here, a pure rename needs no delta.
+func renameByHash(added, removed []*File) []renamePair {
+	// Should we skip zero size? just add call to trimSmall if so
 	// Sort by Hash. No need to have tiebreaker on name as the Manifest links by hash
 	// so 2 identical files being renamed, e.g. python2.6/foo and python3.7/bar being
 	// renamed to python2.7/foo and python3.7/bar have no concept which is the source for the
@@ -47,6 +181,7 @@ func renameDetection(manifest *Manifest, added []*File, removed []*File, c confi
 	sort.Slice(removed, func(i, j int) bool {
 		return removed[i].Hash < removed[j].Hash
 	})
+	var pairs []renamePair
 	for ax, rx := 0, 0; ax < len(added) && rx < len(removed); {
 		af := added[ax]
 		rf := removed[rx]
@@ -57,33 +192,100 @@ func renameDetection(manifest *Manifest, added []*File, removed []*File, c confi
 			rx++
 		default: // Equal hash, so link
 			linkRenamePair(af, rf)
+			pairs = append(pairs, renamePair{rf, af, RenameHash})
 			ax++
 			rx++
 		}
 	}
-	// Link things with the same names skipping digits
-	// First remove small files (not worth sending diff) and files which have
-	// exact match
-	added = trimSmall(trimRenamed(added), minimumSizeToMakeDeltaInBytes)     // Make it explicit we are doing two steps
-	removed = trimSmall(trimRenamed(removed), minimumSizeToMakeDeltaInBytes) // TODO. make it one pass.
+	return pairs
+}
+
+// renameByKey links the files with the same key, skipping small files (not
+// worth sending diff) and files with sizes too different.
+func renameByKey(added, removed []*File, r *renameConfig, strategy string, key func(string) string) []renamePair {
 	//generate the pairs of *File and short name
-	pa := makePairedNames(added)
-	pr := makePairedNames(removed)
+	pa := makePairedNames(trimSmall(added, r.minSize), key)
+	pr := makePairedNames(trimSmall(removed, r.minSize), key)
+	var pairs []renamePair
 	// Merge where short names match
 	for ax, rx := 0, 0; ax < len(pa) && rx < len(pr); {
 		af := pa[ax]
 		rf := pr[rx]
 		switch {
+		case af.partialName == "":
+			ax++
+		case rf.partialName == "":
+			rx++
 		case af.partialName < rf.partialName:
 			ax++
 		case af.partialName > rf.partialName:
 			rx++
 		default: // Equal truncated name
-			linkRenamePair(af.f, rf.f)
-			ax++
-			rx++
+			// Sizes may not match in the order of the names, so try
+			// all the files sharing the key before moving on.
+			aEnd, rEnd := ax, rx
+			for aEnd < len(pa) && pa[aEnd].partialName == af.partialName {
+				aEnd++
+			}
+			for rEnd < len(pr) && pr[rEnd].partialName == rf.partialName {
+				rEnd++
+			}
+			used := make([]bool, rEnd-rx)
+			for _, a := range pa[ax:aEnd] {
+				for i, rp := range pr[rx:rEnd] {
+					if used[i] || !r.similar(a.f, rp.f) {
+						continue
+					}
+					used[i] = true
+					linkRenamePair(a.f, rp.f)
+					pairs = append(pairs, renamePair{rp.f, a.f, strategy})
+					break
+				}
+			}
+			ax, rx = aEnd, rEnd
 		}
 	}
+	return pairs
+}
+
+// pathKey returns the first n directory components of name followed by its
+// base name, or an empty string if name has less than n directories.
+func pathKey(name string, n int) string {
+	dirs := strings.Split(strings.Trim(filepath.Dir(name), "/"), "/")
+	if len(dirs) < n || dirs[0] == "" {
+		return ""
+	}
+	return "/" + strings.Join(dirs[:n], "/") + "/.../" + filepath.Base(name)
+}
+
+// writeRenameReport writes a tab separated report with the old and new names,
+// the strategy that paired them and whether the pair can have a delta, that
+// is, whether the content changed.
+func writeRenameReport(path string, pairs []renamePair) error {
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].to.Name < pairs[j].to.Name
+	})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, p := range pairs {
+		kind := "delta"
+		if p.from.Hash == p.to.Hash {
+			kind = "same-content"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.from.Name, p.to.Name, p.strategy, kind)
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 // linkRenamePair links two files together
@@ -139,7 +341,7 @@ func trimSmall(a []*File, minsize int64) []*File {
 // digits so a new release of a shared library is matched to previous ones
 type pairedNames struct {
 	f           *File
-	partialName string // Filename with digits removed
+	partialName string // Filename key used for matching, e.g. with digits removed
 }
 
 // stripVers is used with strings.Map to remove digits and '.' from filename
@@ -155,16 +357,17 @@ func stripVers(r rune) rune {
 	return r
 }
 
-// makePairedNames returns `a` sorted by name, disregarding digits.
+// makePairedNames returns `a` sorted by the key of their names, e.g. the name
+// disregarding digits.
 // The secondary sort key is the original name. This is mainly intended for
 // cases like with python we have the same filename under both python3.6 and python2.7
 // it would look weird to rename the old python2.7/file1 to python3.6/file2 and at
 // the same time rename the old python3.6/file1 to python2.7/file2.
-func makePairedNames(list []*File) []pairedNames {
+func makePairedNames(list []*File, key func(string) string) []pairedNames {
 	pairs := make([]pairedNames, len(list))
 	for i, f := range list {
 		pairs[i].f = f
-		pairs[i].partialName = strings.Map(stripVers, f.Name)
+		pairs[i].partialName = key(f.Name)
 	}
 	sort.Slice(pairs, func(a, b int) bool {
 		if pairs[a].partialName == pairs[b].partialName { // Same stripped name, sort on original name
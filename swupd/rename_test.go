@@ -1,7 +1,10 @@
 package swupd
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 )
@@ -23,6 +26,18 @@ func sizer(s int64) os.FileInfo {
 	return mockinfo{size: s}
 }
 
+// renameTestConfig returns the default config with the image base in a
+// temporary directory, where renameDetection writes its reports.
+func renameTestConfig(t *testing.T) (config, func()) {
+	dir, err := ioutil.TempDir("", "rename-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig
+	c.imageBase = dir
+	return c, func() { _ = os.RemoveAll(dir) }
+}
+
 // generateTestArray creates some File structures with shortnames and
 // returns a map of them.
 func generateTestArray(t *testing.T) map[string]File {
@@ -134,10 +149,14 @@ func TestRename(t *testing.T) {
 			remove: []string{"S1", "L3", "S2", "L1"}, add: []string{"L4", "L2"},
 			partner: []int{-1, 0, -1, 1}},
 	}
+	c, cleanup := renameTestConfig(t)
+	defer cleanup()
 	for _, tc := range tests {
 		add := filelist(t, sn, tc.add)
 		remove := markdelete(filelist(t, sn, tc.remove))
-		renameDetection(&Manifest{}, add, remove, config{})
+		if _, err := renameDetection(&Manifest{}, 0, add, remove, c); err != nil {
+			t.Fatalf("%s: %s", tc.description, err)
+		}
 		if len(tc.partner) != len(tc.remove) {
 			t.Fatalf("Invalid testcase %v, wrong partner length", tc)
 		}
@@ -151,3 +170,111 @@ func TestRename(t *testing.T) {
 		}
 	}
 }
+
+func TestRenameConfig(t *testing.T) {
+	sn := generateTestArray(t)
+	base, cleanup := renameTestConfig(t)
+	defer cleanup()
+
+	// Path strategy matches directories exactly, up to the configured
+	// number of components.
+	c := base
+	c.renames.strategies = []string{RenamePath}
+	add := filelist(t, sn, []string{"L2", "L4"})
+	remove := markdelete(filelist(t, sn, []string{"L1", "L3"}))
+	if _, err := renameDetection(&Manifest{}, 0, add, remove, c); err != nil {
+		t.Fatal(err)
+	}
+	checkLinked(t, remove[0], nil, "path strategy with 2 components")
+	checkLinked(t, remove[1], nil, "path strategy with 2 components")
+
+	c.renames.pathComponents = 1
+	add = filelist(t, sn, []string{"L2", "L4"})
+	remove = markdelete(filelist(t, sn, []string{"L1", "L3"}))
+	pairs, err := renameDetection(&Manifest{}, 0, add, remove, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinked(t, add[0], remove[0], "path strategy with 1 component")
+	checkLinked(t, add[1], remove[1], "path strategy with 1 component")
+	if len(pairs) != 2 || pairs[0].strategy != RenamePath {
+		t.Errorf("unexpected rename pairs %v", pairs)
+	}
+	report, err := ioutil.ReadFile(filepath.Join(c.imageBase, "0", "rename-reports", "-from-0"))
+	if err != nil {
+		t.Fatalf("rename report was not written: %s", err)
+	}
+	if strings.Count(string(report), "\tpath\t") != 2 {
+		t.Errorf("rename report doesn't have the path pairs:\n%s", report)
+	}
+
+	// Files with very different sizes are not paired by name.
+	c = base
+	c.renames.similarity = 0.5
+	add = filelist(t, sn, []string{"L2"})
+	add[0].Info = sizer(2000)
+	remove = markdelete(filelist(t, sn, []string{"L1"}))
+	if _, err = renameDetection(&Manifest{}, 0, add, remove, c); err != nil {
+		t.Fatal(err)
+	}
+	checkLinked(t, remove[0], nil, "similarity")
+
+	// Files sharing a name key are all tried, even if the first candidate
+	// has a very different size.
+	add = filelist(t, sn, []string{"L4", "L2"})
+	add[1].Info = sizer(2000)
+	remove = markdelete(filelist(t, sn, []string{"L3", "L1"}))
+	remove[0].Info = sizer(2000)
+	if _, err = renameDetection(&Manifest{}, 0, add, remove, c); err != nil {
+		t.Fatal(err)
+	}
+	checkLinked(t, add[0], remove[1], "similarity with shared key")
+	checkLinked(t, add[1], remove[0], "similarity with shared key")
+
+	// Excluded bundles don't get renames, not even for the same content.
+	c = base
+	c.renames.excludeBundles = []string{"excluded"}
+	add = filelist(t, sn, []string{"I2"})
+	remove = markdelete(filelist(t, sn, []string{"I1"}))
+	if _, err = renameDetection(&Manifest{Name: "excluded"}, 0, add, remove, c); err != nil {
+		t.Fatal(err)
+	}
+	checkLinked(t, remove[0], nil, "excluded bundle")
+}
+
+func TestRenameDetectionMissingChroot(t *testing.T) {
+	sn := generateTestArray(t)
+	add := filelist(t, sn, []string{"L2"})
+	remove := markdelete(filelist(t, sn, []string{"L1"}))
+	remove[0].Info = nil
+
+	c := defaultConfig
+	c.imageBase = "testdata/missing-image"
+	if _, err := renameDetection(&Manifest{}, 0, add, remove, c); err == nil {
+		t.Error("renameDetection did not raise an error for a missing chroot")
+	}
+}
+
+func TestRenameReport(t *testing.T) {
+	ts := newTestSwupd(t, "rename-report-")
+	defer ts.cleanup()
+	ts.Bundles = []string{"contents"}
+
+	contents := strings.Repeat("contents", 100)
+	ts.addFile(10, "contents", "/usr/lib/libfoo.so.1", contents)
+	ts.addFile(10, "contents", "/usr/lib/libbar.so.1", "bar")
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+
+	ts.addFile(20, "contents", "/usr/lib/libfoo.so.2", strings.ToUpper(contents[:1])+contents[1:])
+	ts.addFile(20, "contents", "/usr/lib/libbar-renamed.so.1", "bar")
+	ts.createManifests(20)
+	ts.createFullfiles(20)
+
+	info := ts.createPack("contents", 10, 20, "")
+	mustHaveDeltaCount(t, info, 1)
+
+	report := "image/20/rename-reports/contents-from-10"
+	ts.checkContains(report, "/usr/lib/libbar.so.1\t/usr/lib/libbar-renamed.so.1\thash\tsame-content\n")
+	ts.checkContains(report, "/usr/lib/libfoo.so.1\t/usr/lib/libfoo.so.2\tname\tdelta\n")
+}
@@ -0,0 +1,575 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"time"
+
+	// Register the hashes that may be used by signatures.
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// The signature of Manifest.MoM is a PKCS#7 (RFC 2315) SignedData in DER
+// format, with the content detached, as produced by
+//
+//     openssl smime -sign -binary -outform DER
+//
+// The types below cover the subset of the format used by swupd.
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+var digestAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{oidSHA1, crypto.SHA1},
+	{oidSHA256, crypto.SHA256},
+	{oidSHA384, crypto.SHA384},
+	{oidSHA512, crypto.SHA512},
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// Signer is a certificate and the key used to sign with it. The key may be
+// kept outside of the process, e.g. in a hardware token.
+type Signer struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// SignDetached creates a detached signature of content by each of the
+// signers. The digest is SHA-256 and the certificates are included in the
+// signature, so clients only need the trust roots to verify it. Signing with
+// more than one certificate allows rotating keys, since clients trusting any
+// of them accept the signature.
+func SignDetached(content []byte, signers []Signer) ([]byte, error) {
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no signers")
+	}
+
+	digest := crypto.SHA256.New()
+	_, _ = digest.Write(content)
+
+	attrs, err := marshalAttributes([]attributeValue{
+		{oidContentType, oidData},
+		{oidSigningTime, time.Now().UTC()},
+		{oidMessageDigest, digest.Sum(nil)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the attributes encoded as a SET, not with the
+	// implicit tag used when storing them.
+	attrsDigest := crypto.SHA256.New()
+	_, _ = attrsDigest.Write(attrs.setBytes())
+	signed := attrsDigest.Sum(nil)
+
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		ContentInfo:      contentInfo{ContentType: oidData},
+	}
+
+	var certs [][]byte
+	for _, signer := range signers {
+		var sigAlg asn1.ObjectIdentifier
+		var sigParams asn1.RawValue
+		switch signer.Cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			sigAlg = oidRSAEncryption
+			sigParams = asn1.NullRawValue
+		case *ecdsa.PublicKey:
+			sigAlg = oidECDSAWithSHA256
+		default:
+			return nil, fmt.Errorf("unsupported key type %T in certificate %s", signer.Cert.PublicKey, signer.Cert.Subject)
+		}
+
+		signature, err := signer.Key.Sign(rand.Reader, signed, crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't sign with certificate %s: %s", signer.Cert.Subject, err)
+		}
+		// The key may be external, so catch a key that doesn't match the
+		// certificate before publishing a signature nobody can verify.
+		if err = verifyDigestSignature(signer.Cert.PublicKey, crypto.SHA256, signed, signature); err != nil {
+			return nil, fmt.Errorf("signature made for certificate %s is invalid, check that the key matches it: %s", signer.Cert.Subject, err)
+		}
+
+		sd.SignerInfos = append(sd.SignerInfos, signerInfo{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: signer.Cert.RawIssuer},
+				SerialNumber: signer.Cert.SerialNumber,
+			},
+			DigestAlgorithm:           sha256Alg,
+			AuthenticatedAttributes:   attrs.RawValue,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg, Parameters: sigParams},
+			EncryptedDigest:           signature,
+		})
+		certs = append(certs, signer.Cert.Raw)
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		return bytes.Compare(certs[i], certs[j]) < 0
+	})
+	sd.Certificates = asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      bytes.Join(certs, nil),
+	}
+
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	// Raw values are encoded as is, so the explicit tag must be added here.
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      inner,
+		},
+	})
+}
+
+type attributeValue struct {
+	oid   asn1.ObjectIdentifier
+	value interface{}
+}
+
+type rawAttributes struct {
+	asn1.RawValue
+}
+
+// marshalAttributes encodes the attributes sorted as required by DER for the
+// elements of a SET OF.
+func marshalAttributes(values []attributeValue) (rawAttributes, error) {
+	var encoded [][]byte
+	for _, v := range values {
+		value, err := asn1.Marshal(v.value)
+		if err != nil {
+			return rawAttributes{}, err
+		}
+		attr, err := asn1.Marshal(attribute{
+			Type:   v.oid,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return rawAttributes{}, err
+		}
+		encoded = append(encoded, attr)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	raw := asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      bytes.Join(encoded, nil),
+	}
+	full, err := asn1.Marshal(raw)
+	if err != nil {
+		return rawAttributes{}, err
+	}
+	raw.FullBytes = full
+	return rawAttributes{raw}, nil
+}
+
+// setBytes returns the encoding of the attributes with the SET tag.
+func (a rawAttributes) setBytes() []byte {
+	b := append([]byte(nil), a.FullBytes...)
+	b[0] = 0x31
+	return b
+}
+
+// VerifySignatureOptions configures the verification of a signature.
+type VerifySignatureOptions struct {
+	// Roots are the trusted certificates. The certificate of the signer must
+	// be one of them or chain up to one of them.
+	Roots *x509.CertPool
+
+	// CurrentTime is used to check that the certificates in the chain are
+	// not expired. If zero, the current time is used.
+	CurrentTime time.Time
+}
+
+// VerifyDetached verifies that sig is a valid detached signature of content,
+// made by a certificate that chains up to one of the trusted roots and is
+// valid at the current time. Like the "-purpose crlsign" used by swupd clients
+// with openssl, a signer certificate with a key usage extension must allow CRL
+// signing. When there are several signers, all signatures must be valid and at
+// least one of the signers trusted. The certificate of the trusted signer is
+// returned.
+func VerifyDetached(content, sig []byte, opts *VerifySignatureOptions) (*x509.Certificate, error) {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(sig, &ci)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("invalid signature: trailing data")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("invalid signature: content type %s is not signed data", ci.ContentType)
+	}
+	var sd signedData
+	if _, err = asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		return nil, fmt.Errorf("invalid signature: expected a detached signature but content is included")
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, fmt.Errorf("invalid signature: no signers")
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificates in signature: %s", err)
+	}
+
+	if opts == nil {
+		opts = &VerifySignatureOptions{}
+	}
+
+	// All the signatures must be valid, but it is enough that one of the
+	// signers is trusted, so clients keep working while keys are rotated.
+	var trusted *x509.Certificate
+	var chainErr error
+	for i := range sd.SignerInfos {
+		si := &sd.SignerInfos[i]
+		signer := findSigner(certs, si)
+		if signer == nil {
+			return nil, fmt.Errorf("certificate of the signer not found in signature")
+		}
+		if err = checkSignerInfo(content, si, signer); err != nil {
+			return nil, err
+		}
+		if trusted != nil {
+			continue
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, c := range certs {
+			if c != signer {
+				intermediates.AddCert(c)
+			}
+		}
+		// The crlsign purpose doesn't restrict the extended key usage.
+		_, err = signer.Verify(x509.VerifyOptions{
+			Roots:         opts.Roots,
+			Intermediates: intermediates,
+			CurrentTime:   opts.CurrentTime,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil && signer.KeyUsage != 0 && signer.KeyUsage&x509.KeyUsageCRLSign == 0 {
+			err = fmt.Errorf("key usage doesn't allow CRL signing")
+		}
+		if err != nil {
+			if chainErr == nil {
+				chainErr = fmt.Errorf("couldn't verify certificate of the signer: %s", err)
+			}
+			continue
+		}
+		trusted = signer
+	}
+	if trusted == nil {
+		return nil, chainErr
+	}
+	return trusted, nil
+}
+
+func findSigner(certs []*x509.Certificate, si *signerInfo) *x509.Certificate {
+	for _, c := range certs {
+		if c.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) {
+			return c
+		}
+	}
+	return nil
+}
+
+func checkSignerInfo(content []byte, si *signerInfo, signer *x509.Certificate) error {
+	hash, err := digestHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	_, _ = h.Write(content)
+	contentDigest := h.Sum(nil)
+
+	// Without attributes the signature covers the content, otherwise it
+	// covers the attributes, which must include the digest of the content.
+	signed := contentDigest
+	if len(si.AuthenticatedAttributes.FullBytes) > 0 {
+		attrs := rawAttributes{si.AuthenticatedAttributes}
+		var messageDigest []byte
+		messageDigest, err = findMessageDigest(attrs.Bytes)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(messageDigest, contentDigest) {
+			return fmt.Errorf("signature doesn't match the content: message digest differs")
+		}
+		h = hash.New()
+		_, _ = h.Write(attrs.setBytes())
+		signed = h.Sum(nil)
+	}
+
+	if err = verifyDigestSignature(signer.PublicKey, hash, signed, si.EncryptedDigest); err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	return checkSignatureAlgorithm(si.DigestEncryptionAlgorithm.Algorithm, signer)
+}
+
+func verifyDigestSignature(pub crypto.PublicKey, hash crypto.Hash, digest, signature []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, signature) {
+			return fmt.Errorf("ecdsa verification failure")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	for _, d := range digestAlgorithms {
+		if d.oid.Equal(oid) {
+			return d.hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s in signature", oid)
+}
+
+// checkSignatureAlgorithm makes sure the algorithm declared in the signature
+// matches the key of the signer.
+func checkSignatureAlgorithm(oid asn1.ObjectIdentifier, signer *x509.Certificate) error {
+	var valid []asn1.ObjectIdentifier
+	switch signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		valid = []asn1.ObjectIdentifier{oidRSAEncryption, oidSHA1WithRSA, oidSHA256WithRSA, oidSHA384WithRSA, oidSHA512WithRSA}
+	case *ecdsa.PublicKey:
+		valid = []asn1.ObjectIdentifier{oidECDSAWithSHA1, oidECDSAWithSHA256, oidECDSAWithSHA384, oidECDSAWithSHA512}
+	}
+	for _, v := range valid {
+		if v.Equal(oid) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature algorithm %s doesn't match the key of the signer", oid)
+}
+
+func findMessageDigest(attrs []byte) ([]byte, error) {
+	for len(attrs) > 0 {
+		var attr attribute
+		var err error
+		attrs, err = asn1.Unmarshal(attrs, &attr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signed attributes: %s", err)
+		}
+		if !attr.Type.Equal(oidMessageDigest) {
+			continue
+		}
+		var digest []byte
+		if _, err = asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+			return nil, fmt.Errorf("invalid message digest attribute: %s", err)
+		}
+		return digest, nil
+	}
+	return nil, fmt.Errorf("signed attributes don't have a message digest")
+}
+
+// ReadCertificates reads all the PEM encoded certificates in a file.
+func ReadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse certificate in %s: %s", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return certs, nil
+}
+
+// ReadPrivateKey reads a PEM encoded private key in PKCS#1, PKCS#8 or SEC 1
+// format.
+func ReadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no private key found in %s", path)
+		}
+		var key interface{}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse private key in %s: %s", path, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T in %s", key, path)
+		}
+		return signer, nil
+	}
+}
+
+// SignFile writes to sigPath a detached signature of the file in path, made
+// with the first certificate in certPath and the private key in keyPath.
+func SignFile(path, sigPath, certPath, keyPath string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	certs, err := ReadCertificates(certPath)
+	if err != nil {
+		return err
+	}
+	key, err := ReadPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+	sig, err := SignDetached(content, []Signer{{Cert: certs[0], Key: key}})
+	if err != nil {
+		return fmt.Errorf("couldn't sign %s: %s", path, err)
+	}
+	return ioutil.WriteFile(sigPath, sig, 0644)
+}
+
+// VerifySignatureFile verifies that sigPath has a valid detached signature of
+// the file in path, trusting the certificates in certPath.
+func VerifySignatureFile(path, sigPath, certPath string) error {
+	roots, err := ReadCertificates(certPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert(c)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	_, err = VerifyDetached(content, sig, &VerifySignatureOptions{Roots: pool})
+	return err
+}
@@ -0,0 +1,249 @@
+package swupd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mustCreateCert creates a certificate for key signed by parent, or self-signed
+// if parent is nil.
+func mustCreateCert(t *testing.T, name string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer, isCA bool, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{Organization: []string{name}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func mustECDSAKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func certPool(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool
+}
+
+func TestSignDetached(t *testing.T) {
+	content := []byte("MANIFEST\t25\nversion:\t10\n")
+	nextYear := time.Now().AddDate(1, 0, 0)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := mustECDSAKey(t)
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		cert := mustCreateCert(t, "Mixer", key, nil, nil, false, nextYear)
+		sig, err := SignDetached(content, []Signer{{Cert: cert, Key: key}})
+		if err != nil {
+			t.Fatalf("couldn't sign with %T: %s", key, err)
+		}
+		opts := &VerifySignatureOptions{Roots: certPool(cert)}
+		signer, err := VerifyDetached(content, sig, opts)
+		if err != nil {
+			t.Fatalf("couldn't verify signature made with %T: %s", key, err)
+		}
+		if !signer.Equal(cert) {
+			t.Errorf("unexpected signer %s", signer.Subject)
+		}
+
+		if _, err = VerifyDetached([]byte("other content"), sig, opts); err == nil {
+			t.Errorf("signature made with %T verified for different content", key)
+		}
+		other := mustCreateCert(t, "Other", mustECDSAKey(t), nil, nil, false, nextYear)
+		if _, err = VerifyDetached(content, sig, &VerifySignatureOptions{Roots: certPool(other)}); err == nil {
+			t.Errorf("signature made with %T verified with untrusted certificate", key)
+		}
+	}
+}
+
+func TestVerifyDetachedChain(t *testing.T) {
+	content := []byte("MANIFEST\t25\nversion:\t20\n")
+	nextYear := time.Now().AddDate(1, 0, 0)
+
+	rootKey := mustECDSAKey(t)
+	root := mustCreateCert(t, "Root", rootKey, nil, nil, true, nextYear)
+	signerKey := mustECDSAKey(t)
+	signer := mustCreateCert(t, "Signer", signerKey, root, rootKey, false, time.Now().AddDate(0, 1, 0))
+
+	sig, err := SignDetached(content, []Signer{{Cert: signer, Key: signerKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &VerifySignatureOptions{Roots: certPool(root)}
+	if _, err = VerifyDetached(content, sig, opts); err != nil {
+		t.Fatalf("couldn't verify signature chaining up to root: %s", err)
+	}
+
+	// Expired signer certificate.
+	opts.CurrentTime = time.Now().AddDate(0, 2, 0)
+	if _, err = VerifyDetached(content, sig, opts); err == nil {
+		t.Fatalf("signature verified with an expired certificate")
+	}
+}
+
+func TestVerifyDetachedKeyUsage(t *testing.T) {
+	content := []byte("MANIFEST\t25\nversion:\t20\n")
+	nextYear := time.Now().AddDate(1, 0, 0)
+	rootKey := mustECDSAKey(t)
+	root := mustCreateCert(t, "Root", rootKey, nil, nil, true, nextYear)
+	opts := &VerifySignatureOptions{Roots: certPool(root)}
+
+	tests := []struct {
+		usage x509.KeyUsage
+		valid bool
+	}{
+		{0, true},
+		{x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign, true},
+		{x509.KeyUsageDigitalSignature, false},
+	}
+	for _, tt := range tests {
+		signerKey := mustECDSAKey(t)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{Organization: []string{"Signer"}},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     nextYear,
+			KeyUsage:     tt.usage,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, root, signerKey.Public(), rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := SignDetached(content, []Signer{{Cert: signer, Key: signerKey}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = VerifyDetached(content, sig, opts)
+		if tt.valid && err != nil {
+			t.Errorf("couldn't verify signature with key usage %d: %s", tt.usage, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("signature with key usage %d verified but CRL signing is not allowed", tt.usage)
+		}
+	}
+}
+
+func TestSignDetachedRotation(t *testing.T) {
+	content := []byte("MANIFEST\t25\nversion:\t30\n")
+	nextYear := time.Now().AddDate(1, 0, 0)
+
+	oldKey := mustECDSAKey(t)
+	oldCert := mustCreateCert(t, "Old", oldKey, nil, nil, false, nextYear)
+	newKey := mustECDSAKey(t)
+	newCert := mustCreateCert(t, "New", newKey, nil, nil, false, nextYear)
+
+	sig, err := SignDetached(content, []Signer{{Cert: oldCert, Key: oldKey}, {Cert: newCert, Key: newKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []*x509.Certificate{oldCert, newCert} {
+		signer, err := VerifyDetached(content, sig, &VerifySignatureOptions{Roots: certPool(root)})
+		if err != nil {
+			t.Fatalf("couldn't verify signature trusting only %s: %s", root.Subject, err)
+		}
+		if !signer.Equal(root) {
+			t.Errorf("expected %s as trusted signer, got %s", root.Subject, signer.Subject)
+		}
+	}
+	other := mustCreateCert(t, "Other", mustECDSAKey(t), nil, nil, false, nextYear)
+	if _, err = VerifyDetached(content, sig, &VerifySignatureOptions{Roots: certPool(other)}); err == nil {
+		t.Errorf("signature verified without trusting any of the signers")
+	}
+
+	// A key that doesn't match the certificate is caught when signing.
+	if _, err = SignDetached(content, []Signer{{Cert: oldCert, Key: newKey}}); err == nil {
+		t.Errorf("signed with a key that doesn't match the certificate")
+	}
+}
+
+func TestSignFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign-file-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := mustCreateCert(t, "Mixer", key, nil, nil, false, time.Now().AddDate(1, 0, 0))
+
+	certPath := filepath.Join(dir, "Swupd_Root.pem")
+	keyPath := filepath.Join(dir, "private.pem")
+	mustWritePEM(t, certPath, "CERTIFICATE", cert.Raw)
+	mustWritePEM(t, keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+
+	mom := filepath.Join(dir, "Manifest.MoM")
+	if err = ioutil.WriteFile(mom, []byte("MANIFEST\t25\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = SignFile(mom, mom+".sig", certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySignatureFile(mom, mom+".sig", certPath); err != nil {
+		t.Fatalf("couldn't verify signed file: %s", err)
+	}
+
+	mustAppendFile(t, mom, "changed\n")
+	if err = VerifySignatureFile(mom, mom+".sig", certPath); err == nil {
+		t.Fatalf("signature verified for changed file")
+	}
+}
+
+func mustWritePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,530 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the checks performed by VerifyRepository.
+const (
+	VerifySignature      = "signature"
+	VerifyManifests      = "manifests"
+	VerifyManifestDeltas = "manifest-deltas"
+	VerifyFullfiles      = "fullfiles"
+	VerifyPacks          = "packs"
+	VerifyPointers       = "pointers"
+)
+
+// VerifyOptions control which checks VerifyRepository performs.
+type VerifyOptions struct {
+	// Cert is the certificate used to verify Manifest.MoM.sig. The
+	// signature is not checked if Cert is empty.
+	Cert string
+
+	SkipFullfiles bool
+	SkipPacks     bool
+
+	// NumWorkers is the number of fullfiles checked in parallel. If zero or
+	// less, 1 worker is used.
+	NumWorkers int
+
+	// Xattrs tells whether the hashes include the extended attributes, as
+	// in the ContentOptions used to create the version.
+	Xattrs bool
+}
+
+// VerifyCheck summarizes one of the checks of a VerifyReport.
+type VerifyCheck struct {
+	Name    string `json:"name"`
+	Checked int    `json:"checked"`
+	Failed  int    `json:"failed"`
+	Skipped bool   `json:"skipped,omitempty"`
+}
+
+// VerifyIssue is a problem found by a check. Path is the file in the
+// repository where the problem was found.
+type VerifyIssue struct {
+	Check   string `json:"check"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// VerifyReport contains the results of VerifyRepository. Latest is the
+// version published for the format of the verified version, or zero if none
+// was published.
+type VerifyReport struct {
+	Version uint32         `json:"version"`
+	Format  uint           `json:"format"`
+	Latest  uint32         `json:"latest"`
+	Checks  []*VerifyCheck `json:"checks"`
+	Issues  []VerifyIssue  `json:"issues"`
+}
+
+// OK tells if no issues were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// WriteText writes a human readable version of the report.
+func (r *VerifyReport) WriteText(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Version %d (format %d)\n", r.Version, r.Format)
+	for _, c := range r.Checks {
+		switch {
+		case c.Skipped:
+			fmt.Fprintf(&buf, "  %-10s skipped\n", c.Name)
+		case c.Failed > 0:
+			fmt.Fprintf(&buf, "  %-10s FAILED (%d of %d)\n", c.Name, c.Failed, c.Checked)
+		default:
+			fmt.Fprintf(&buf, "  %-10s ok (%d)\n", c.Name, c.Checked)
+		}
+	}
+	if len(r.Issues) > 0 {
+		fmt.Fprintf(&buf, "\n%d issues found:\n", len(r.Issues))
+	}
+	for _, issue := range r.Issues {
+		if issue.Path != "" {
+			fmt.Fprintf(&buf, "  %s: %s: %s\n", issue.Check, issue.Path, issue.Message)
+		} else {
+			fmt.Fprintf(&buf, "  %s: %s\n", issue.Check, issue.Message)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *VerifyReport) WriteJSON(w io.Writer) error {
+	out := *r
+	if out.Issues == nil {
+		out.Issues = []VerifyIssue{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&out)
+}
+
+type verifier struct {
+	outputDir string
+	opts      *VerifyOptions
+	report    *VerifyReport
+
+	mu sync.Mutex
+}
+
+func (v *verifier) newCheck(name string) *VerifyCheck {
+	c := &VerifyCheck{Name: name}
+	v.report.Checks = append(v.report.Checks, c)
+	return c
+}
+
+func (v *verifier) fail(c *VerifyCheck, path, format string, a ...interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c.Failed++
+	if path != "" {
+		if rel, err := filepath.Rel(v.outputDir, path); err == nil {
+			path = rel
+		}
+	}
+	v.report.Issues = append(v.report.Issues, VerifyIssue{
+		Check:   c.Name,
+		Path:    path,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func (v *verifier) versionPath(version uint32, name string) string {
+	return filepath.Join(v.outputDir, fmt.Sprint(version), name)
+}
+
+// VerifyRepository checks that the content published for version in
+// outputDir (usually the "www" directory) is consistent: the MoM signature,
+// the hashes of the bundle manifests, the contents of fullfiles and packs, the
+// result of the manifest deltas and the latest version pointers. An error is
+// returned only when the MoM of the version can't be read, all the other
+// problems are collected in the report.
+func VerifyRepository(outputDir string, version uint32, opts *VerifyOptions) (*VerifyReport, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	v := &verifier{
+		outputDir: outputDir,
+		opts:      opts,
+		report:    &VerifyReport{Version: version},
+	}
+
+	momPath := v.versionPath(version, "Manifest.MoM")
+	mom, err := ParseManifestFile(momPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read Manifest.MoM for version %d: %s", version, err)
+	}
+	if mom.Header.Version != version {
+		return nil, fmt.Errorf("Manifest.MoM in %s has version %d", filepath.Dir(momPath), mom.Header.Version)
+	}
+	v.report.Format = mom.Header.Format
+
+	v.verifySignature(momPath)
+	v.verifyManifests(mom)
+	v.verifyFullfiles(version)
+	v.verifyPacks(version)
+	v.verifyManifestDeltas(mom)
+	v.verifyPointers(mom)
+
+	return v.report, nil
+}
+
+func (v *verifier) verifySignature(momPath string) {
+	c := v.newCheck(VerifySignature)
+	if v.opts.Cert == "" {
+		c.Skipped = true
+		return
+	}
+	c.Checked++
+
+	sig := momPath + ".sig"
+	if _, err := os.Stat(sig); err != nil {
+		v.fail(c, sig, "couldn't find signature: %s", err)
+		return
+	}
+	if err := VerifySignatureFile(momPath, sig, v.opts.Cert); err != nil {
+		v.fail(c, sig, "signature verification failed: %s", err)
+	}
+}
+
+func (v *verifier) verifyManifests(mom *Manifest) {
+	c := v.newCheck(VerifyManifests)
+	for _, f := range mom.Files {
+		c.Checked++
+		path := v.versionPath(f.Version, "Manifest."+f.Name)
+		hash, err := GetHashForFileWithXattrs(path, v.opts.Xattrs)
+		if err != nil {
+			v.fail(c, path, "%s", err)
+			continue
+		}
+		if hash != f.Hash.String() {
+			v.fail(c, path, "hash %s doesn't match %s in Manifest.MoM", hash, f.Hash)
+			continue
+		}
+		m, err := ParseManifestFile(path)
+		if err != nil {
+			v.fail(c, path, "%s", err)
+			continue
+		}
+		if m.Header.Version != f.Version || m.Header.Format != mom.Header.Format {
+			v.fail(c, path, "header has version %d and format %d, but Manifest.MoM expects version %d and format %d",
+				m.Header.Version, m.Header.Format, f.Version, mom.Header.Format)
+		}
+	}
+}
+
+// verifyManifestDeltas checks that each manifest delta in the version applies
+// to the old manifest it is named after and produces the manifest listed in
+// Manifest.MoM.
+func (v *verifier) verifyManifestDeltas(mom *Manifest) {
+	c := v.newCheck(VerifyManifestDeltas)
+	version := mom.Header.Version
+	paths, err := filepath.Glob(v.versionPath(version, "Manifest-*-delta-from-*"))
+	if err != nil {
+		v.fail(c, "", "%s", err)
+		return
+	}
+	for _, path := range paths {
+		c.Checked++
+		name, from, err := parseManifestDeltaName(filepath.Base(path))
+		if err != nil {
+			v.fail(c, path, "%s", err)
+			continue
+		}
+		var to *File
+		for _, f := range mom.Files {
+			if f.Name == name {
+				to = f
+				break
+			}
+		}
+		if to == nil || to.Version != version || from >= version {
+			v.fail(c, path, "delta doesn't match bundle %s in Manifest.MoM", name)
+			continue
+		}
+		oldPath := v.versionPath(from, "Manifest."+name)
+		oldContent, err := ioutil.ReadFile(oldPath)
+		if err != nil {
+			v.fail(c, path, "%s", err)
+			continue
+		}
+		var xattrs map[string]string
+		if v.opts.Xattrs {
+			if xattrs, err = ReadXattrs(oldPath); err != nil {
+				v.fail(c, path, "%s", err)
+				continue
+			}
+		}
+		delta, err := ioutil.ReadFile(path)
+		if err != nil {
+			v.fail(c, path, "%s", err)
+			continue
+		}
+		if _, err = ApplyManifestDelta(oldContent, delta, xattrs, to.Hash.String()); err != nil {
+			v.fail(c, path, "%s", err)
+		}
+	}
+}
+
+func (v *verifier) verifyFullfiles(version uint32) {
+	c := v.newCheck(VerifyFullfiles)
+	if v.opts.SkipFullfiles {
+		c.Skipped = true
+		return
+	}
+
+	fullPath := v.versionPath(version, "Manifest.full")
+	full, err := ParseManifestFile(fullPath)
+	if err != nil {
+		v.fail(c, fullPath, "%s", err)
+		return
+	}
+
+	type fullfileKey struct {
+		version uint32
+		hash    Hashval
+	}
+	done := make(map[fullfileKey]bool)
+	var files []*File
+	for _, f := range full.Files {
+		key := fullfileKey{f.Version, f.Hash}
+		if !f.Present() || done[key] {
+			continue
+		}
+		done[key] = true
+		files = append(files, f)
+	}
+	c.Checked = len(files)
+
+	numWorkers := v.opts.NumWorkers
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	start := len(v.report.Issues)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	taskCh := make(chan *File)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for f := range taskCh {
+				path := v.versionPath(f.Version, filepath.Join("files", f.Hash.String()+".tar"))
+				if err := checkFullfile(path, f.Hash); err != nil {
+					v.fail(c, path, "fullfile for %s: %s", f.Name, err)
+				}
+			}
+		}()
+	}
+	for _, f := range files {
+		taskCh <- f
+	}
+	close(taskCh)
+	wg.Wait()
+
+	// Workers report in any order, keep the report stable.
+	issues := v.report.Issues[start:]
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+}
+
+// checkFullfile verifies that the fullfile in path contains a single entry
+// named after hash and whose contents match that hash.
+func checkFullfile(path string, hash Hashval) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	tr, err := NewCompressedTarReader(f)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tr.Close()
+	}()
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("couldn't read entry: %s", err)
+	}
+	if strings.TrimSuffix(hdr.Name, "/") != hash.String() {
+		return fmt.Errorf("unexpected entry %s", hdr.Name)
+	}
+	got, err := hashTarEntry(hdr, tr)
+	if err != nil {
+		return err
+	}
+	if got != hash.String() {
+		return fmt.Errorf("contents have hash %s", got)
+	}
+	if _, err = tr.Next(); err != io.EOF {
+		return fmt.Errorf("expected a single entry")
+	}
+	return nil
+}
+
+// hashTarEntry returns the hash of a tar entry, including the extended
+// attributes stored in it.
+func hashTarEntry(hdr *tar.Header, r io.Reader) (string, error) {
+	h, err := newHashFromTarHeader(hdr)
+	if err != nil {
+		return "", fmt.Errorf("couldn't hash entry %s: %s", hdr.Name, err)
+	}
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		if _, err = io.Copy(h, r); err != nil {
+			return "", err
+		}
+	}
+	return h.Sum(), nil
+}
+
+var packNameRegexp = regexp.MustCompile(`^pack-(.+)-from-([0-9]+)\.tar$`)
+
+func (v *verifier) verifyPacks(version uint32) {
+	c := v.newCheck(VerifyPacks)
+	if v.opts.SkipPacks {
+		c.Skipped = true
+		return
+	}
+
+	paths, err := filepath.Glob(v.versionPath(version, "pack-*-from-*.tar"))
+	if err != nil {
+		v.fail(c, "", "%s", err)
+		return
+	}
+	for _, path := range paths {
+		c.Checked++
+		if err = v.verifyPack(version, path); err != nil {
+			v.fail(c, path, "%s", err)
+		}
+	}
+}
+
+// verifyPack checks that a pack provides every file the client needs to go
+// from the pack's version to version, and that both the staged files and the
+// deltas produce the content expected by the manifest.
+func (v *verifier) verifyPack(version uint32, path string) error {
+	match := packNameRegexp.FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return fmt.Errorf("invalid pack name")
+	}
+	name := match[1]
+	from, err := strconv.ParseUint(match[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid pack name: %s", err)
+	}
+	if uint32(from) >= version {
+		return fmt.Errorf("pack is from version %d, not older than %d", from, version)
+	}
+
+	toM, err := ParseManifestFile(v.versionPath(version, "Manifest."+name))
+	if err != nil {
+		return err
+	}
+	var fromM *Manifest
+	if from > 0 {
+		fromM, err = ParseManifestFile(v.versionPath(uint32(from), "Manifest."+name))
+		if err != nil {
+			return err
+		}
+	}
+
+	pack, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = pack.Close()
+	}()
+	report, err := VerifyPack(pack, fromM, toM, &VerifyPackOptions{OutputDir: v.outputDir, Xattrs: v.opts.Xattrs})
+	if err != nil {
+		return err
+	}
+	if problems := report.Problems(); len(problems) == 1 {
+		return fmt.Errorf("%s", problems[0])
+	} else if len(problems) > 1 {
+		return fmt.Errorf("%s (and %d more problems)", problems[0], len(problems)-1)
+	}
+	return nil
+}
+
+func (v *verifier) verifyPointers(mom *Manifest) {
+	c := v.newCheck(VerifyPointers)
+
+	dirs, err := filepath.Glob(filepath.Join(v.outputDir, "version", "format*"))
+	if err != nil {
+		v.fail(c, "", "%s", err)
+		return
+	}
+	var found bool
+	for _, dir := range dirs {
+		format, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(dir), "format"), 10, 32)
+		if err != nil {
+			continue
+		}
+		c.Checked++
+		if uint(format) == mom.Header.Format {
+			found = true
+		}
+
+		path := filepath.Join(dir, "latest")
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			v.fail(c, path, "%s", err)
+			continue
+		}
+		latest, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 32)
+		if err != nil {
+			v.fail(c, path, "invalid version %q", strings.TrimSpace(string(content)))
+			continue
+		}
+		latestMoM, err := ParseManifestFile(v.versionPath(uint32(latest), "Manifest.MoM"))
+		if err != nil {
+			v.fail(c, path, "points to version %d without a valid Manifest.MoM: %s", latest, err)
+			continue
+		}
+		if latestMoM.Header.Format != uint(format) {
+			v.fail(c, path, "points to version %d, which has format %d", latest, latestMoM.Header.Format)
+			continue
+		}
+		if uint(format) == mom.Header.Format {
+			v.report.Latest = uint32(latest)
+		}
+	}
+	if !found {
+		c.Checked++
+		v.fail(c, filepath.Join(v.outputDir, "version", fmt.Sprintf("format%d", mom.Header.Format), "latest"),
+			"no version published for format %d", mom.Header.Format)
+	}
+}
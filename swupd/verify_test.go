@@ -0,0 +1,163 @@
+package swupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustVerifyRepository(t *testing.T, ts *testSwupd, version uint32) *VerifyReport {
+	t.Helper()
+	report, err := VerifyRepository(ts.path("www"), version, &VerifyOptions{Xattrs: ts.Content.xattrs()})
+	if err != nil {
+		t.Fatalf("couldn't verify version %d: %s", version, err)
+	}
+	return report
+}
+
+func mustCopyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dst, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustAppendFile(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkVerifyIssues(t *testing.T, report *VerifyReport, expected ...string) {
+	t.Helper()
+	var got []string
+	for _, issue := range report.Issues {
+		got = append(got, issue.Check+" "+issue.Path)
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		var text bytes.Buffer
+		_ = report.WriteText(&text)
+		t.Fatalf("got issues:\n%s\nbut expected:\n%s\nreport:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"), text.String())
+	}
+}
+
+func TestVerifyRepository(t *testing.T) {
+	ts := newTestSwupd(t, "verify-")
+	defer ts.cleanup()
+
+	ts.Bundles = []string{"contents"}
+	largeContents := strings.Repeat("large", 1000)
+
+	ts.addFile(10, "contents", "/large", largeContents)
+	ts.addFile(10, "contents", "/small", "small")
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+	ts.createPack("contents", 0, 10, "")
+	ts.createPack("os-core", 0, 10, "")
+
+	ts.copyChroots(10, 20)
+	ts.addFile(20, "contents", "/large", strings.ToUpper(largeContents[:1])+largeContents[1:])
+	ts.addFile(20, "contents", "/small", "small")
+	ts.createManifests(20)
+	ts.createFullfiles(20)
+	info := ts.createPack("contents", 10, 20, "")
+	mustHaveDeltaCount(t, info, 1)
+	ts.write("www/version/format1/latest", "20")
+
+	report := mustVerifyRepository(t, ts, 20)
+	checkVerifyIssues(t, report)
+	if report.Latest != 20 {
+		t.Errorf("got latest version %d but expected 20", report.Latest)
+	}
+	checked := make(map[string]string)
+	for _, c := range report.Checks {
+		checked[c.Name] = fmt.Sprintf("%d %d %t", c.Checked, c.Failed, c.Skipped)
+	}
+	if checked[VerifySignature] != "0 0 true" || checked[VerifyPacks] != "1 0 false" || checked[VerifyManifests] != "3 0 false" {
+		t.Errorf("unexpected checks %v", checked)
+	}
+
+	report = mustVerifyRepository(t, ts, 10)
+	checkVerifyIssues(t, report)
+	if checked := report.Checks[3]; checked.Name != VerifyPacks || checked.Checked != 2 {
+		t.Errorf("unexpected pack check %+v", checked)
+	}
+
+	// Break a fullfile, a bundle manifest and the pointer to the latest
+	// version.
+	var small, large *File
+	for _, f := range ts.parseManifest(20, "full").Files {
+		switch f.Name {
+		case "/small":
+			small = f
+		case "/large":
+			large = f
+		}
+	}
+	fullfile := filepath.Join(fmt.Sprint(small.Version), "files", small.Hash.String()+".tar")
+	mustCopyFile(t, ts.path(filepath.Join("www", fmt.Sprint(large.Version), "files", large.Hash.String()+".tar")), ts.path(filepath.Join("www", fullfile)))
+	mustAppendFile(t, ts.path("www/20/Manifest.os-core"), "\n")
+	ts.write("www/version/format1/latest", "30")
+
+	report = mustVerifyRepository(t, ts, 20)
+	checkVerifyIssues(t, report,
+		VerifyManifests+" 20/Manifest.os-core",
+		VerifyFullfiles+" "+fullfile,
+		VerifyPointers+" version/format1/latest",
+	)
+	if report.OK() {
+		t.Error("report with issues is OK")
+	}
+
+	var js bytes.Buffer
+	if err := report.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	var decoded VerifyReport
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Version != 20 || len(decoded.Checks) != 6 || len(decoded.Issues) != 3 {
+		t.Errorf("unexpected JSON report:\n%s", js.String())
+	}
+}
+
+func TestVerifyRepositoryBrokenPack(t *testing.T) {
+	ts := newTestSwupd(t, "verify-")
+	defer ts.cleanup()
+
+	ts.Bundles = []string{"contents"}
+	ts.addFile(10, "contents", "/a", "a contents")
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+	ts.createPack("contents", 0, 10, "")
+	ts.write("www/version/format1/latest", "10")
+
+	// A pack of os-core used in place of the contents pack lacks files.
+	ts.createPack("os-core", 0, 10, "")
+	mustCopyFile(t, ts.path("www/10/pack-os-core-from-0.tar"), ts.path("www/10/pack-contents-from-0.tar"))
+
+	report := mustVerifyRepository(t, ts, 10)
+	checkVerifyIssues(t, report, VerifyPacks+" 10/pack-contents-from-0.tar")
+
+	if _, err := VerifyRepository(ts.path("www"), 30, nil); err == nil {
+		t.Error("VerifyRepository did not raise error for missing version")
+	}
+}
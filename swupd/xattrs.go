@@ -0,0 +1,211 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// hashedXattrs are the extended attributes carried by swupd content: file
+// capabilities and IMA signatures. Other attributes, e.g. the SELinux labels
+// set by the policy of the build host, are not part of the content.
+var hashedXattrs = map[string]bool{
+	"security.capability": true,
+	"security.ima":        true,
+}
+
+// paxXattrPrefix is the prefix of the PAX records used to store extended
+// attributes in tar files, as understood by libarchive and GNU tar.
+const paxXattrPrefix = "SCHILY.xattr."
+
+func isHashedXattr(name string) bool {
+	return hashedXattrs[name]
+}
+
+// ReadXattrs returns the extended attributes of path that are carried by swupd
+// content. Symbolic links are not followed.
+func ReadXattrs(path string) (map[string]string, error) {
+	names, err := llistxattr(path)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't list extended attributes of %s: %s", path, err)
+	}
+	var xattrs map[string]string
+	for _, name := range names {
+		if !isHashedXattr(name) {
+			continue
+		}
+		value, err := lgetxattr(path, name)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read extended attribute %s of %s: %s", name, path, err)
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// WriteXattrs sets the extended attributes of path. Symbolic links are not
+// followed.
+func WriteXattrs(path string, xattrs map[string]string) error {
+	for _, name := range sortedXattrNames(xattrs) {
+		if err := lsetxattr(path, name, xattrs[name]); err != nil {
+			return fmt.Errorf("couldn't set extended attribute %s of %s: %s", name, path, err)
+		}
+	}
+	return nil
+}
+
+// TarHeaderXattrs returns the extended attributes stored in the PAX records
+// of a tar entry.
+func TarHeaderXattrs(hdr *tar.Header) map[string]string {
+	var xattrs map[string]string
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, paxXattrPrefix)
+		if !isHashedXattr(name) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = v
+	}
+	return xattrs
+}
+
+func setTarHeaderXattrs(hdr *tar.Header, xattrs map[string]string) {
+	if len(xattrs) == 0 {
+		return
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+	for name, value := range xattrs {
+		hdr.PAXRecords[paxXattrPrefix+name] = value
+	}
+}
+
+func sortedXattrNames(xattrs map[string]string) []string {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// xattrsBlob serializes the extended attributes for the hash. Each attribute
+// is written as its name, a NUL byte and its value, sorted by name. No
+// attributes result in no data, so the hash is the same as before extended
+// attributes were supported.
+func xattrsBlob(xattrs map[string]string) []byte {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, name := range sortedXattrNames(xattrs) {
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		buf.WriteString(xattrs[name])
+	}
+	return buf.Bytes()
+}
+
+// The syscall package only has the variants that follow symbolic links, so
+// wrap the l* variants directly.
+
+func llistxattr(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	size, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if errno != 0 {
+		return nil, errno
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func lgetxattr(path, name string) (string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), 0, 0, 0, 0)
+	if errno != 0 {
+		return "", errno
+	}
+	if size == 0 {
+		return "", nil
+	}
+	buf := make([]byte, size)
+	size, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	if errno != 0 {
+		return "", errno
+	}
+	return string(buf[:size]), nil
+}
+
+func lsetxattr(path, name, value string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		b := []byte(value)
+		v = unsafe.Pointer(&b[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package swupd
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestXattrsBlob(t *testing.T) {
+	if blob := xattrsBlob(nil); blob != nil {
+		t.Errorf("expected no data for no extended attributes, got %q", blob)
+	}
+	blob := xattrsBlob(map[string]string{"security.b": "2", "security.a": "1"})
+	if string(blob) != "security.a\x001security.b\x002" {
+		t.Errorf("unexpected data for extended attributes: %q", blob)
+	}
+}
+
+func TestTarHeaderXattrs(t *testing.T) {
+	xattrs := map[string]string{"security.capability": "\x01\x00\x00\x02", "security.ima": "label"}
+	hdr := &tar.Header{PAXRecords: map[string]string{
+		paxXattrPrefix + "user.ignored":     "ignored",
+		paxXattrPrefix + "security.selinux": "ignored",
+		"path":                              "something",
+	}}
+	setTarHeaderXattrs(hdr, xattrs)
+	if got := TarHeaderXattrs(hdr); !reflect.DeepEqual(got, xattrs) {
+		t.Errorf("got extended attributes %v, but want %v", got, xattrs)
+	}
+	if got := TarHeaderXattrs(&tar.Header{}); got != nil {
+		t.Errorf("expected no extended attributes, got %v", got)
+	}
+}
+
+func TestHashXattrs(t *testing.T) {
+	ts := newTestSwupd(t, "hash-xattrs-")
+	defer ts.cleanup()
+
+	ts.Bundles = []string{"os-core"}
+	ts.addFile(10, "os-core", "/file", "content")
+	path := ts.path("image/10/full/file")
+	// Attributes not carried by swupd content don't change the hash.
+	if err := lsetxattr(path, "user.ignored", "value"); err == nil {
+		if hash, err := GetHashForFileWithXattrs(path, true); err != nil || hash != ts.mustHashFile("image/10/full/file") {
+			t.Fatalf("hash %s changed with an ignored extended attribute", hash)
+		}
+	}
+	if err := lsetxattr(path, "security.ima", "value"); err != nil {
+		t.Skipf("couldn't set extended attribute: %s", err)
+	}
+
+	without := ts.mustHashFile("image/10/full/file")
+	with, err := GetHashForFileWithXattrs(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if with == without {
+		t.Fatalf("hash %s didn't change with extended attributes", with)
+	}
+
+	// Records created without a worker pool include them too.
+	m := &Manifest{}
+	if err = m.addRecords(ts.path("image/10/full"), "", []string{"/file"}, nil, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 1 || m.Files[0].Hash.String() != with {
+		t.Fatalf("record without a worker pool doesn't have the hash with extended attributes")
+	}
+
+	ts.Content = &ContentOptions{Xattrs: true}
+	ts.createManifests(10)
+	ts.createFullfiles(10)
+	fullfile := ts.path(filepath.Join("www/10/files", with+".tar"))
+	mustHaveMatchingHash(t, fullfile)
+	ts.write("www/version/format1/latest", "10")
+	checkVerifyIssues(t, mustVerifyRepository(t, ts, 10))
+
+	f, err := os.Open(fullfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	tr, err := NewCompressedTarReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = tr.Close()
+	}()
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := TarHeaderXattrs(hdr); got["security.ima"] != "value" {
+		t.Errorf("fullfile doesn't have the extended attribute, got %v", got)
+	}
+}